@@ -9,6 +9,7 @@ require github.com/bgp59/victoriametrics-importer/vmi v0.1.0
 require (
 	github.com/bgp59/logrusx v0.2.1 // indirect
 	github.com/docker/go-units v0.5.0 // indirect
+	github.com/klauspost/compress v1.19.2 // indirect
 	github.com/mackerelio/go-osstat v0.2.6 // indirect
 	github.com/sirupsen/logrus v1.9.4 // indirect
 	github.com/tklauser/go-sysconf v0.3.16 // indirect
@@ -2,15 +2,29 @@
 
 package parser
 
+import (
+	"bytes"
+	"fmt"
+)
+
 // Return a random selection from a list of choices, each selection repeated
 // 1..N times:
 type RandomCategoricalParser struct {
 	// Current value, observing minimal parsing format:
 	Val []byte
+	// Optional numeric value associated with the current category, in minimal
+	// parsing format: the number of consecutive Parse() invocations for which
+	// the current category has been selected. It is nil unless enabled via
+	// config:
+	ValNum []byte
 	// The list of choices:
 	choices [][]byte
 	// Tne random gauge underlying the selection:
 	selector *RandomGaugeParser
+	// Whether to update ValNum and the underlying state for it:
+	withValue   bool
+	repeatCount int64
+	valNumBuf   *bytes.Buffer
 }
 
 type RandomCategoricalParserConfig struct {
@@ -21,6 +35,8 @@ type RandomCategoricalParserConfig struct {
 	MaxRepeat int32 `yaml:"max_repeat"`
 	// Seed:
 	Seed int64 `yaml:"seed"`
+	// Whether to carry a numeric value alongside the category:
+	WithValue bool `yaml:"with_value"`
 }
 
 func DefaultRandomCategoricalParserConfig() *RandomCategoricalParserConfig {
@@ -28,7 +44,10 @@ func DefaultRandomCategoricalParserConfig() *RandomCategoricalParserConfig {
 }
 
 func NewRandomCategoricalParser(cfg *RandomCategoricalParserConfig) *RandomCategoricalParser {
-	parser := &RandomCategoricalParser{}
+	parser := &RandomCategoricalParser{
+		withValue: cfg.WithValue,
+		valNumBuf: &bytes.Buffer{},
+	}
 	if len(cfg.Choices) > 0 {
 		parser.choices = make([][]byte, len(cfg.Choices))
 		for i, choice := range cfg.Choices {
@@ -50,7 +69,18 @@ func NewRandomCategoricalParser(cfg *RandomCategoricalParserConfig) *RandomCateg
 func (parser *RandomCategoricalParser) Parse() error {
 	if parser.selector != nil {
 		parser.selector.update(false)
-		parser.Val = parser.choices[parser.selector.ValInt]
+		val := parser.choices[parser.selector.ValInt]
+		if parser.withValue {
+			if bytes.Equal(val, parser.Val) {
+				parser.repeatCount += 1
+			} else {
+				parser.repeatCount = 1
+			}
+			parser.valNumBuf.Reset()
+			fmt.Fprintf(parser.valNumBuf, "%d", parser.repeatCount)
+			parser.ValNum = parser.valNumBuf.Bytes()
+		}
+		parser.Val = val
 	}
 	return nil
 }
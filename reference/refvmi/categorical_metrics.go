@@ -33,6 +33,10 @@ type CategoricalMetrics struct {
 	// The previous value:
 	val []byte
 
+	// The previous numeric value for the active category, if the parser
+	// carries one. N.B. a copy is kept since the parser reuses its buffer:
+	valNum []byte
+
 	// Cache for various metrics:
 	//  - the previous metric:
 	categoricalMetric []byte
@@ -103,6 +107,7 @@ func (m *CategoricalMetrics) TaskActivity() bool {
 
 	metricsCount, _ := m.GenBaseMetricsStart(buf, ts)
 	tsSuffix := m.TsSuffixBuf.Bytes()
+	byteCount := 0
 
 	// Update the value cache:
 	currVal := m.parser.Val
@@ -117,27 +122,54 @@ func (m *CategoricalMetrics) TaskActivity() bool {
 			buf.WriteByte('0')
 			buf.Write(tsSuffix)
 			metricsCount += 1
+			// Queue the buffer if it reached the target size or the max
+			// number of lines:
+			var n int
+			buf, n = m.GenBaseEmit(buf, 1)
+			byteCount += n
 		}
 		// Rebuild the metric:
 		m.categoricalMetric = []byte(fmt.Sprintf(
 			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. space before value is included
-			CATEGORICAL_METRIC,
-			vmi.INSTANCE_LABEL_NAME, m.Instance,
-			vmi.HOSTNAME_LABEL_NAME, m.Hostname,
+			vmi.RenameMetric(CATEGORICAL_METRIC),
+			m.InstanceLabelName, m.Instance,
+			m.HostnameLabelName, m.Hostname,
 			CATEGORY_LABEL, currVal,
 		))
 	}
-	if m.CycleNum == 0 || changed {
+	// The active category carries either the parser provided numeric value,
+	// if any, or 1:
+	currValNum := m.parser.ValNum
+	valNumChanged := false
+	if currValNum != nil {
+		valNumChanged = !bytes.Equal(currValNum, m.valNum)
+		if valNumChanged {
+			m.valNum = append(m.valNum[:0], currValNum...)
+		}
+	}
+	if m.CycleNum == 0 || changed || valNumChanged {
+		if buf == nil {
+			buf = metricsQueue.GetBuf()
+		}
 		buf.Write(m.categoricalMetric)
-		buf.WriteByte('1')
+		if currValNum != nil {
+			buf.Write(m.valNum)
+		} else {
+			buf.WriteByte('1')
+		}
 		buf.Write(tsSuffix)
 		metricsCount += 1
+		var n int
+		buf, n = m.GenBaseEmit(buf, 1)
+		byteCount += n
 	}
 
-	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, buf.Len())
-
-	// Queue the buffer for publish:
-	metricsQueue.QueueBuf(buf)
+	// Queue the (last) buffer for publish:
+	if buf != nil {
+		byteCount += buf.Len()
+		vmi.QueueBufFor(metricsQueue, m.Id, buf)
+	}
+	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, byteCount)
 
 	// Update cycle#:
 	if m.CycleNum += 1; m.CycleNum >= m.FullMetricsFactor {
@@ -165,10 +197,11 @@ func CategoricalMetricsTaskBuilder(cfg any) ([]vmi.MetricsGeneratorTask, error)
 			categoricalMetricsLog.Infof("interval=%s, metrics disabled", categoricalMetricsConfig.Interval)
 		} else {
 			categoricalMetricsLog.Infof(
-				"interval=%s, full_metrics_factor=%d, choice#: %d, repeat: 1 .. %d, seed: %d",
+				"interval=%s, full_metrics_factor=%d, choice#: %d, repeat: 1 .. %d, seed: %d, with_value: %v",
 				categoricalMetricsConfig.Interval, categoricalMetricsConfig.FullMetricsFactor,
 				len(categoricalMetricsConfig.ParserConfig.Choices),
 				categoricalMetricsConfig.ParserConfig.MaxRepeat, categoricalMetricsConfig.ParserConfig.Seed,
+				categoricalMetricsConfig.ParserConfig.WithValue,
 			)
 			tasks = append(tasks, NewCategoricalMetrics(categoricalMetricsConfig))
 		}
@@ -178,6 +211,23 @@ func CategoricalMetricsTaskBuilder(cfg any) ([]vmi.MetricsGeneratorTask, error)
 	}
 }
 
+// The intervals builder, used upon config reload instead of the task builder,
+// such that no generator is built just to learn its interval:
+func CategoricalMetricsIntervals(cfg any) (map[string]time.Duration, error) {
+	if refvmiConfig, ok := cfg.(*RefvmiConfig); ok {
+		if refvmiConfig == nil {
+			refvmiConfig = DefaultRefvmiConfig()
+		}
+		categoricalMetricsConfig := refvmiConfig.CategoricalMetricsConfig
+		if categoricalMetricsConfig == nil {
+			categoricalMetricsConfig = DefaultCategoricalMetricsConfig()
+		}
+		return map[string]time.Duration{CATEGORICAL_METRICS_ID: categoricalMetricsConfig.Interval}, nil
+	} else {
+		return nil, fmt.Errorf("cfg: CategoricalMetricsIntervals passed wrong config type %T", cfg)
+	}
+}
+
 func init() {
-	vmi.RegisterTaskBuilder(CategoricalMetricsTaskBuilder)
+	vmi.RegisterTaskBuilderWithIntervals(CategoricalMetricsTaskBuilder, CategoricalMetricsIntervals)
 }
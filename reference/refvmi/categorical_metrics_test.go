@@ -0,0 +1,136 @@
+// Tests for categorical metrics generator.
+
+package refvmi
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/vmi"
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestCategoricalMetricsWithValue(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	instance, hostname := "refvmi_test", "refvmi-test"
+
+	cfg := DefaultCategoricalMetricsConfig()
+	// Disable full metrics such that only changes are reported:
+	cfg.FullMetricsFactor = 1000
+	m := NewCategoricalMetrics(cfg)
+	m.Instance = instance
+	m.Hostname = hostname
+	m.TestMode = true
+	ts := time.UnixMilli(1746121347582)
+	m.TimeNowFunc = func() time.Time { return ts }
+
+	metricFmt := fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%%s"} %%s %%d`,
+		CATEGORICAL_METRIC,
+		vmi.INSTANCE_LABEL_NAME, instance,
+		vmi.HOSTNAME_LABEL_NAME, hostname,
+		CATEGORY_LABEL,
+	)
+
+	for i, tc := range []struct {
+		val, valNum string
+		// The expected metrics as (category, value) pairs:
+		wantMetrics [][2]string
+	}{
+		{"a", "3", [][2]string{{"a", "3"}}},
+		// Same category, same value, nothing to report:
+		{"a", "3", nil},
+		// Same category, new value:
+		{"a", "4", [][2]string{{"a", "4"}}},
+		// New category, the previous one should be zeroed:
+		{"b", "7", [][2]string{{"a", "0"}, {"b", "7"}}},
+		// New category, same value as before, the previous one should still be
+		// zeroed:
+		{"c", "7", [][2]string{{"b", "0"}, {"c", "7"}}},
+	} {
+		metricsQueue := vmi_testutils.NewTestMetricsQueue(0)
+		m.MetricsQueue = metricsQueue
+		m.parser.Val = []byte(tc.val)
+		m.parser.ValNum = []byte(tc.valNum)
+		if !m.TaskActivity() {
+			t.Fatalf("step# %d: TaskActivity() returned false, expected true", i)
+		}
+
+		gotMetrics := make(map[string]bool)
+		for _, metric := range metricsQueue.GetMetrics() {
+			gotMetrics[metric] = true
+		}
+		for _, want := range tc.wantMetrics {
+			metric := fmt.Sprintf(metricFmt, want[0], want[1], ts.UnixMilli())
+			if !gotMetrics[metric] {
+				t.Fatalf("step# %d: missing metric %q, got: %v", i, metric, metricsQueue.GetMetrics())
+			}
+			delete(gotMetrics, metric)
+		}
+		for metric := range gotMetrics {
+			if strings.HasPrefix(metric, CATEGORICAL_METRIC+"{") {
+				t.Fatalf("step# %d: unexpected metric %q", i, metric)
+			}
+		}
+		ts = ts.Add(m.Interval)
+	}
+}
+
+// A test metrics queue which also counts the queued buffers:
+type countingTestMetricsQueue struct {
+	*vmi_testutils.TestMetricsQueue
+	numBufs int
+}
+
+func (mq *countingTestMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	mq.numBufs++
+	mq.TestMetricsQueue.QueueBuf(buf)
+}
+
+func TestCategoricalMetricsMaxLinesPerBuffer(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	cfg := DefaultCategoricalMetricsConfig()
+	cfg.FullMetricsFactor = 1000
+	m := NewCategoricalMetrics(cfg)
+	m.Instance = "refvmi_test"
+	m.Hostname = "refvmi-test"
+	m.TestMode = true
+	m.MaxLinesPerBuffer = 1
+	ts := time.UnixMilli(1746121347582)
+	m.TimeNowFunc = func() time.Time { return ts }
+
+	for i, tc := range []struct {
+		val          string
+		wantNumLines int
+		wantNumBufs  int
+	}{
+		{"a", 1, 1},
+		// The interval, the previous category zeroed and the new one, w/ the
+		// buffer queued as soon as it reached the limit:
+		{"b", 3, 2},
+	} {
+		metricsQueue := &countingTestMetricsQueue{
+			TestMetricsQueue: vmi_testutils.NewTestMetricsQueue(0),
+		}
+		m.MetricsQueue = metricsQueue
+		m.parser.Val = []byte(tc.val)
+		m.parser.ValNum = nil
+		if !m.TaskActivity() {
+			t.Fatalf("step# %d: TaskActivity() returned false, expected true", i)
+		}
+		if got := len(metricsQueue.GetMetrics()); got != tc.wantNumLines {
+			t.Fatalf("step# %d: line count: want: %d, got: %d: %q", i, tc.wantNumLines, got, metricsQueue.GetMetrics())
+		}
+		if metricsQueue.numBufs != tc.wantNumBufs {
+			t.Fatalf("step# %d: buffer count: want: %d, got: %d", i, tc.wantNumBufs, metricsQueue.numBufs)
+		}
+		ts = ts.Add(m.Interval)
+	}
+}
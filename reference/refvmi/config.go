@@ -8,6 +8,7 @@ type RefvmiConfig struct {
 	GaugeMetricsConfig       *GaugeMetricsConfig       `yaml:"gauge_metrics"`
 	CounterMetricsConfig     *CounterMetricsConfig     `yaml:"counter_metrics"`
 	CategoricalMetricsConfig *CategoricalMetricsConfig `yaml:"categorical_metrics"`
+	GroupedMetricsConfig     *GroupedMetricsConfig     `yaml:"grouped_metrics"`
 }
 
 func DefaultRefvmiConfig() *RefvmiConfig {
@@ -15,5 +16,6 @@ func DefaultRefvmiConfig() *RefvmiConfig {
 		GaugeMetricsConfig:       DefaultGaugeMetricsConfig(),
 		CounterMetricsConfig:     DefaultCounterMetricsConfig(),
 		CategoricalMetricsConfig: DefaultCategoricalMetricsConfig(),
+		GroupedMetricsConfig:     DefaultGroupedMetricsConfig(),
 	}
 }
@@ -92,19 +92,20 @@ func (m *CounterMetrics) initialize() {
 	m.GenBaseInit()
 
 	instance, hostname := m.Instance, m.Hostname
+	instanceLabel, hostnameLabel := m.InstanceLabelName, m.HostnameLabelName
 
 	m.counterDeltaMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s"} `, // N.B. space before value is included
-		COUNTER_DELTA_METRIC,
-		vmi.INSTANCE_LABEL_NAME, instance,
-		vmi.HOSTNAME_LABEL_NAME, hostname,
+		vmi.RenameMetric(COUNTER_DELTA_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	))
 
 	m.counterRateMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s"} `, // N.B. space before value is included
-		COUNTER_RATE_METRIC,
-		vmi.INSTANCE_LABEL_NAME, instance,
-		vmi.HOSTNAME_LABEL_NAME, hostname,
+		vmi.RenameMetric(COUNTER_RATE_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	))
 
 	m.Initialized = true
@@ -139,6 +140,7 @@ func (m *CounterMetrics) TaskActivity() bool {
 	metricsQueue := m.MetricsQueue
 	buf := metricsQueue.GetBuf()
 	metricsCount, lastTs := m.GenBaseMetricsStart(buf, ts)
+	byteCount := 0
 
 	// All metrics depend upon having a previous value:
 	if hasPrev {
@@ -152,21 +154,30 @@ func (m *CounterMetrics) TaskActivity() bool {
 			buf.WriteString(strconv.FormatUint(uint64(delta), 10))
 			buf.Write(tsSuffix)
 			metricsCount += 1
-
-			if deltaSec > 0 {
-				buf.Write(m.counterRateMetric)
-				buf.WriteString(strconv.FormatFloat(float64(delta)/deltaSec, 'f', 3, 64))
-				buf.Write(tsSuffix)
+			// Queue the buffer if it reached the target size or the max
+			// number of lines:
+			var n int
+			buf, n = m.GenBaseEmit(buf, 1)
+			byteCount += n
+
+			if buf == nil {
+				buf = metricsQueue.GetBuf()
+			}
+			if deltaSec > 0 && m.GenBaseWriteFloatMetric(buf, m.counterRateMetric, float64(delta)/deltaSec, 3) {
 				metricsCount += 1
+				buf, n = m.GenBaseEmit(buf, 1)
+				byteCount += n
 			}
 		}
 		m.zeroDelta = zeroDelta
 	}
 
-	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, buf.Len())
-
-	// Queue the buffer for publish:
-	metricsQueue.QueueBuf(buf)
+	// Queue the (last) buffer for publish:
+	if buf != nil {
+		byteCount += buf.Len()
+		vmi.QueueBufFor(metricsQueue, m.Id, buf)
+	}
+	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, byteCount)
 
 	// Toggle dual cache index:
 	m.currentIndex = 1 - currIndex
@@ -210,6 +221,23 @@ func CounterMetricsTaskBuilder(cfg any) ([]vmi.MetricsGeneratorTask, error) {
 	}
 }
 
+// The intervals builder, used upon config reload instead of the task builder,
+// such that no generator is built just to learn its interval:
+func CounterMetricsIntervals(cfg any) (map[string]time.Duration, error) {
+	if refvmiConfig, ok := cfg.(*RefvmiConfig); ok {
+		if refvmiConfig == nil {
+			refvmiConfig = DefaultRefvmiConfig()
+		}
+		counterMetricsConfig := refvmiConfig.CounterMetricsConfig
+		if counterMetricsConfig == nil {
+			counterMetricsConfig = DefaultCounterMetricsConfig()
+		}
+		return map[string]time.Duration{COUNTER_METRICS_ID: counterMetricsConfig.Interval}, nil
+	} else {
+		return nil, fmt.Errorf("cfg: CounterMetricsIntervals passed wrong config type %T", cfg)
+	}
+}
+
 func init() {
-	vmi.RegisterTaskBuilder(CounterMetricsTaskBuilder)
+	vmi.RegisterTaskBuilderWithIntervals(CounterMetricsTaskBuilder, CounterMetricsIntervals)
 }
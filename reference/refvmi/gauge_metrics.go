@@ -88,12 +88,13 @@ func (m *GaugeMetrics) initialize() {
 	m.GenBaseInit()
 
 	instance, hostname := m.Instance, m.Hostname
+	instanceLabel, hostnameLabel := m.InstanceLabelName, m.HostnameLabelName
 
 	m.gaugeMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s"} `, // N.B. space before value is included
-		GAUGE_METRIC,
-		vmi.INSTANCE_LABEL_NAME, instance,
-		vmi.HOSTNAME_LABEL_NAME, hostname,
+		vmi.RenameMetric(GAUGE_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	))
 
 	m.Initialized = true
@@ -132,6 +133,7 @@ func (m *GaugeMetrics) TaskActivity() bool {
 	buf := metricsQueue.GetBuf()
 	metricsCount, _ := m.GenBaseMetricsStart(buf, ts)
 	tsSuffix := m.TsSuffixBuf.Bytes()
+	byteCount := 0
 
 	prevVal := m.valCache[1-currIndex]
 	if !hasPrev || m.CycleNum == 0 || !bytes.Equal(currVal, prevVal) {
@@ -139,12 +141,19 @@ func (m *GaugeMetrics) TaskActivity() bool {
 		buf.Write(currVal)
 		buf.Write(tsSuffix)
 		metricsCount += 1
+		// Queue the buffer if it reached the target size or the max number
+		// of lines:
+		var n int
+		buf, n = m.GenBaseEmit(buf, 1)
+		byteCount += n
 	}
 
-	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, buf.Len())
-
-	// Queue the buffer for publish:
-	metricsQueue.QueueBuf(buf)
+	// Queue the (last) buffer for publish:
+	if buf != nil {
+		byteCount += buf.Len()
+		vmi.QueueBufFor(metricsQueue, m.Id, buf)
+	}
+	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, byteCount)
 
 	// Toggle dual cache index:
 	m.currentIndex = 1 - currIndex
@@ -188,6 +197,23 @@ func GaugeMetricsTaskBuilder(cfg any) ([]vmi.MetricsGeneratorTask, error) {
 	}
 }
 
+// The intervals builder, used upon config reload instead of the task builder,
+// such that no generator is built just to learn its interval:
+func GaugeMetricsIntervals(cfg any) (map[string]time.Duration, error) {
+	if refvmiConfig, ok := cfg.(*RefvmiConfig); ok {
+		if refvmiConfig == nil {
+			refvmiConfig = DefaultRefvmiConfig()
+		}
+		gaugeMetricsConfig := refvmiConfig.GaugeMetricsConfig
+		if gaugeMetricsConfig == nil {
+			gaugeMetricsConfig = DefaultGaugeMetricsConfig()
+		}
+		return map[string]time.Duration{GAUGE_METRICS_ID: gaugeMetricsConfig.Interval}, nil
+	} else {
+		return nil, fmt.Errorf("cfg: GaugeMetricsIntervals passed wrong config type %T", cfg)
+	}
+}
+
 func init() {
-	vmi.RegisterTaskBuilder(GaugeMetricsTaskBuilder)
+	vmi.RegisterTaskBuilderWithIntervals(GaugeMetricsTaskBuilder, GaugeMetricsIntervals)
 }
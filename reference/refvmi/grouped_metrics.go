@@ -0,0 +1,294 @@
+// Grouped metrics generator example: fast and slow metric groups sharing the
+// same data source.
+
+package refvmi
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/refvmi/parser"
+
+	"github.com/bgp59/victoriametrics-importer/vmi"
+)
+
+const (
+	GROUPED_METRICS_CONFIG_FAST_INTERVAL_DEFAULT       = 2 * time.Second
+	GROUPED_METRICS_CONFIG_SLOW_INTERVAL_DEFAULT       = 60 * time.Second
+	GROUPED_METRICS_CONFIG_FULL_METRICS_FACTOR_DEFAULT = 10
+
+	// This Metrics Generator ID:
+	GROUPED_METRICS_ID = "grouped"
+	// The group member names:
+	GROUPED_METRICS_FAST_NAME = "fast"
+	GROUPED_METRICS_SLOW_NAME = "slow"
+)
+
+// The logger for this generator:
+var groupedMetricsLog = vmi.NewCompLogger(GROUPED_METRICS_ID)
+
+// The metrics generator context, shared by the fast and slow groups. The
+// fast group parses the data and it generates the gauge metric, whereas the
+// slow one generates the inventory (parse count and max value so far) based on
+// the data parsed by the fast group. The shared state is protected by the
+// group lock.
+type GroupedMetrics struct {
+	// The group:
+	group *vmi.GeneratorGroup
+
+	// The underlying parser:
+	parser *parser.RandomGaugeParser
+
+	// Dual buffer for current/previous value, needed for the delta approach;
+	// the index is -1 before the 1st parse:
+	valCache     [2][]byte
+	currentIndex int
+
+	// Inventory:
+	parseCount uint64
+	maxVal     int32
+
+	// Cache for various metrics:
+	gaugeMetric, parseCountMetric, maxMetric []byte
+}
+
+// The configuration for this generator:
+type GroupedMetricsConfig struct {
+	// How often to generate the fast and slow metrics groups in
+	// time.ParseDuration() format. Use 0 for the fast interval to disable the
+	// generator or for the slow one to disable the inventory:
+	FastInterval time.Duration `yaml:"fast_interval"`
+	SlowInterval time.Duration `yaml:"slow_interval"`
+
+	// Full metrics factor for the fast group; the slow group always generates
+	// the full set:
+	FullMetricsFactor int `yaml:"full_metrics_factor"`
+
+	// Parser configuration:
+	ParserConfig *parser.RandomGaugeParserConfig `yaml:"parser_config"`
+}
+
+func DefaultGroupedMetricsConfig() *GroupedMetricsConfig {
+	return &GroupedMetricsConfig{
+		FastInterval:      GROUPED_METRICS_CONFIG_FAST_INTERVAL_DEFAULT,
+		SlowInterval:      GROUPED_METRICS_CONFIG_SLOW_INTERVAL_DEFAULT,
+		FullMetricsFactor: GROUPED_METRICS_CONFIG_FULL_METRICS_FACTOR_DEFAULT,
+		ParserConfig:      parser.DefaultRandomGaugeParserConfig(),
+	}
+}
+
+func NewGroupedMetrics(cfg *GroupedMetricsConfig) *GroupedMetrics {
+	if cfg == nil {
+		cfg = DefaultGroupedMetricsConfig()
+	}
+	m := &GroupedMetrics{
+		group:        vmi.NewGeneratorGroup(GROUPED_METRICS_ID),
+		parser:       parser.NewRandomGaugeParser(cfg.ParserConfig),
+		currentIndex: -1,
+	}
+	if cfg.FastInterval > 0 {
+		m.group.AddMember(GROUPED_METRICS_FAST_NAME, cfg.FastInterval, cfg.FullMetricsFactor, m.fastActivity)
+		if cfg.SlowInterval > 0 {
+			m.group.AddMember(GROUPED_METRICS_SLOW_NAME, cfg.SlowInterval, 1, m.slowActivity)
+		}
+	}
+	return m
+}
+
+// Update metrics cache, normally this is needed only at the 1st time
+// generation. N.B. Both members are expected to have the same instance and
+// hostname, the latter being common to all generators.
+func (m *GroupedMetrics) initialize(member *vmi.GeneratorGroupMember) {
+	member.GenBaseInit()
+	member.Initialized = true
+
+	if m.gaugeMetric != nil {
+		return
+	}
+
+	instance, hostname := member.Instance, member.Hostname
+	instanceLabel, hostnameLabel := member.InstanceLabelName, member.HostnameLabelName
+
+	m.gaugeMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. space before value is included
+		vmi.RenameMetric(GROUPED_GAUGE_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	m.parseCountMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. space before value is included
+		vmi.RenameMetric(GROUPED_PARSE_COUNT_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	m.maxMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. space before value is included
+		vmi.RenameMetric(GROUPED_MAX_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+}
+
+// The fast group: parse new data and generate the gauge metric. N.B. Invoked
+// with the group lock held.
+func (m *GroupedMetrics) fastActivity(member *vmi.GeneratorGroupMember) bool {
+	if !member.Initialized {
+		m.initialize(member)
+	}
+
+	if !member.TestMode {
+		err := m.parser.Parse()
+		if err != nil {
+			groupedMetricsLog.Errorf("Parse(): %v", err)
+			return false // This will disable future invocations.
+		}
+	}
+	ts := member.TimeNowFunc()
+
+	// Update the inventory:
+	if m.parseCount == 0 || m.parser.ValInt > m.maxVal {
+		m.maxVal = m.parser.ValInt
+	}
+	m.parseCount++
+
+	// Update the value cache:
+	currIndex := m.currentIndex
+	hasPrev := currIndex >= 0
+	if !hasPrev {
+		currIndex = 0
+	}
+	currVal := m.parser.ValBytes
+	if len(m.valCache[currIndex]) < len(currVal) {
+		m.valCache[currIndex] = make([]byte, len(currVal))
+	}
+	m.valCache[currIndex] = m.valCache[currIndex][:len(currVal)]
+	copy(m.valCache[currIndex], currVal)
+
+	metricsQueue := member.MetricsQueue
+	buf := metricsQueue.GetBuf()
+	metricsCount, _ := member.GenBaseMetricsStart(buf, ts)
+	tsSuffix := member.TsSuffixBuf.Bytes()
+	byteCount := 0
+
+	prevVal := m.valCache[1-currIndex]
+	if !hasPrev || member.CycleNum == 0 || !bytes.Equal(currVal, prevVal) {
+		buf.Write(m.gaugeMetric)
+		buf.Write(currVal)
+		buf.Write(tsSuffix)
+		metricsCount += 1
+		var n int
+		buf, n = member.GenBaseEmit(buf, 1)
+		byteCount += n
+	}
+
+	if buf != nil {
+		byteCount += buf.Len()
+		vmi.QueueBufFor(metricsQueue, member.Id, buf)
+	}
+	vmi.UpdateMetricsGeneratorStats(member.Id, metricsCount, byteCount)
+
+	// Toggle dual cache index:
+	m.currentIndex = 1 - currIndex
+
+	// Update cycle#:
+	if member.CycleNum += 1; member.CycleNum >= member.FullMetricsFactor {
+		member.CycleNum = 0
+	}
+
+	return true
+}
+
+// The slow group: generate the inventory, based on the data parsed by the fast
+// group, w/o parsing. N.B. Invoked with the group lock held.
+func (m *GroupedMetrics) slowActivity(member *vmi.GeneratorGroupMember) bool {
+	if !member.Initialized {
+		m.initialize(member)
+	}
+
+	ts := member.TimeNowFunc()
+
+	metricsQueue := member.MetricsQueue
+	buf := metricsQueue.GetBuf()
+	metricsCount, _ := member.GenBaseMetricsStart(buf, ts)
+	tsSuffix := member.TsSuffixBuf.Bytes()
+	byteCount := 0
+
+	// Nothing to report before the 1st parse:
+	if m.parseCount > 0 {
+		buf.Write(m.parseCountMetric)
+		buf.WriteString(strconv.FormatUint(m.parseCount, 10))
+		buf.Write(tsSuffix)
+		buf.Write(m.maxMetric)
+		buf.WriteString(strconv.FormatInt(int64(m.maxVal), 10))
+		buf.Write(tsSuffix)
+		metricsCount += 2
+		var n int
+		buf, n = member.GenBaseEmit(buf, 2)
+		byteCount += n
+	}
+
+	if buf != nil {
+		byteCount += buf.Len()
+		vmi.QueueBufFor(metricsQueue, member.Id, buf)
+	}
+	vmi.UpdateMetricsGeneratorStats(member.Id, metricsCount, byteCount)
+
+	return true
+}
+
+func GroupedMetricsTaskBuilder(cfg any) ([]vmi.MetricsGeneratorTask, error) {
+	if refvmiConfig, ok := cfg.(*RefvmiConfig); ok {
+		if refvmiConfig == nil {
+			refvmiConfig = DefaultRefvmiConfig()
+		}
+		groupedMetricsConfig := refvmiConfig.GroupedMetricsConfig
+		if groupedMetricsConfig == nil {
+			groupedMetricsConfig = DefaultGroupedMetricsConfig()
+		}
+		if groupedMetricsConfig.FastInterval <= 0 {
+			groupedMetricsLog.Infof("fast_interval=%s, metrics disabled", groupedMetricsConfig.FastInterval)
+			return nil, nil
+		}
+		groupedMetricsLog.Infof(
+			"fast_interval=%s, slow_interval=%s, full_metrics_factor=%d, range: %d .. %d, repeat: 1 .. %d, seed: %d",
+			groupedMetricsConfig.FastInterval, groupedMetricsConfig.SlowInterval,
+			groupedMetricsConfig.FullMetricsFactor,
+			groupedMetricsConfig.ParserConfig.Min, groupedMetricsConfig.ParserConfig.Max,
+			groupedMetricsConfig.ParserConfig.MaxRepeat, groupedMetricsConfig.ParserConfig.Seed,
+		)
+		return NewGroupedMetrics(groupedMetricsConfig).group.Tasks(), nil
+	} else {
+		return nil, fmt.Errorf("cfg: GroupedMetricsTaskBuilder passed wrong config type %T", cfg)
+	}
+}
+
+// The intervals builder, used upon config reload instead of the task builder,
+// such that no generator is built just to learn its interval:
+func GroupedMetricsIntervals(cfg any) (map[string]time.Duration, error) {
+	if refvmiConfig, ok := cfg.(*RefvmiConfig); ok {
+		if refvmiConfig == nil {
+			refvmiConfig = DefaultRefvmiConfig()
+		}
+		groupedMetricsConfig := refvmiConfig.GroupedMetricsConfig
+		if groupedMetricsConfig == nil {
+			groupedMetricsConfig = DefaultGroupedMetricsConfig()
+		}
+		fastInterval, slowInterval := groupedMetricsConfig.FastInterval, groupedMetricsConfig.SlowInterval
+		if fastInterval <= 0 {
+			// The slow group is disabled along w/ the fast one:
+			slowInterval = 0
+		}
+		return map[string]time.Duration{
+			GROUPED_METRICS_ID + vmi.GENERATOR_GROUP_MEMBER_ID_SEP + GROUPED_METRICS_FAST_NAME: fastInterval,
+			GROUPED_METRICS_ID + vmi.GENERATOR_GROUP_MEMBER_ID_SEP + GROUPED_METRICS_SLOW_NAME: slowInterval,
+		}, nil
+	} else {
+		return nil, fmt.Errorf("cfg: GroupedMetricsIntervals passed wrong config type %T", cfg)
+	}
+}
+
+func init() {
+	vmi.RegisterTaskBuilderWithIntervals(GroupedMetricsTaskBuilder, GroupedMetricsIntervals)
+}
@@ -0,0 +1,120 @@
+// Tests for grouped metrics generator.
+
+package refvmi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/refvmi/parser"
+	"github.com/bgp59/victoriametrics-importer/vmi"
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestGroupedMetrics(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	instance, hostname := "refvmi_test", "refvmi-test"
+
+	cfg := DefaultGroupedMetricsConfig()
+	cfg.FastInterval = 100 * time.Millisecond
+	cfg.SlowInterval = 500 * time.Millisecond
+	cfg.ParserConfig = &parser.RandomGaugeParserConfig{Min: 1, Max: 1000, MaxRepeat: 1, Seed: 1}
+	m := NewGroupedMetrics(cfg)
+	members := m.group.Members
+	if len(members) != 2 {
+		t.Fatalf("len(members): want: 2, got: %d", len(members))
+	}
+	fast, slow := members[0], members[1]
+
+	metricsQueue := vmi_testutils.NewTestMetricsQueue(0)
+	ts := time.UnixMilli(1746121347582)
+	for _, member := range members {
+		member.Instance = instance
+		member.Hostname = hostname
+		member.MetricsQueue = metricsQueue
+		member.TestMode = true
+		member.TimeNowFunc = func() time.Time { return ts }
+	}
+
+	// Simulate the scheduling over a slow interval and check that the slow
+	// group reports the data parsed by the fast one:
+	numFast := int(cfg.SlowInterval / cfg.FastInterval)
+	maxVal := int32(0)
+	for i := 0; i < numFast; i++ {
+		if err := m.parser.Parse(); err != nil {
+			t.Fatal(err)
+		}
+		maxVal = max(maxVal, m.parser.ValInt)
+		if !fast.TaskActivity() {
+			t.Fatal("fast TaskActivity() returned false, expected true")
+		}
+		ts = ts.Add(fast.Interval)
+	}
+	if !slow.TaskActivity() {
+		t.Fatal("slow TaskActivity() returned false, expected true")
+	}
+
+	labels := fmt.Sprintf(
+		`{%s="%s",%s="%s"}`,
+		vmi.INSTANCE_LABEL_NAME, instance, vmi.HOSTNAME_LABEL_NAME, hostname,
+	)
+	wantMetrics := []string{
+		fmt.Sprintf("%s%s %d %d", GROUPED_PARSE_COUNT_METRIC, labels, numFast, ts.UnixMilli()),
+		fmt.Sprintf("%s%s %d %d", GROUPED_MAX_METRIC, labels, maxVal, ts.UnixMilli()),
+	}
+	gotMetrics := make(map[string]bool)
+	gaugeCount := 0
+	for _, metric := range metricsQueue.GetMetrics() {
+		gotMetrics[metric] = true
+		if strings.HasPrefix(metric, GROUPED_GAUGE_METRIC+"{") {
+			gaugeCount++
+		}
+	}
+	for _, metric := range wantMetrics {
+		if !gotMetrics[metric] {
+			t.Fatalf("missing metric %q, got: %v", metric, metricsQueue.GetMetrics())
+		}
+	}
+	// Seeded w/ no repeat, so the gauge should have been generated for every
+	// fast invocation, except for the rare case of consecutive identical
+	// values:
+	if gaugeCount == 0 || gaugeCount > numFast {
+		t.Fatalf("%s count: want: 1..%d, got: %d", GROUPED_GAUGE_METRIC, numFast, gaugeCount)
+	}
+}
+
+func TestGroupedMetricsTaskBuilder(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	for _, tc := range []struct {
+		fastInterval, slowInterval time.Duration
+		wantIds                    []string
+	}{
+		{2 * time.Second, time.Minute, []string{"grouped_fast", "grouped_slow"}},
+		{2 * time.Second, 0, []string{"grouped_fast"}},
+		{0, time.Minute, []string{}},
+	} {
+		t.Run(fmt.Sprintf("fast=%s,slow=%s", tc.fastInterval, tc.slowInterval), func(t *testing.T) {
+			refvmiConfig := DefaultRefvmiConfig()
+			refvmiConfig.GroupedMetricsConfig.FastInterval = tc.fastInterval
+			refvmiConfig.GroupedMetricsConfig.SlowInterval = tc.slowInterval
+			tasks, err := GroupedMetricsTaskBuilder(refvmiConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tasks) != len(tc.wantIds) {
+				t.Fatalf("len(tasks): want: %d, got: %d", len(tc.wantIds), len(tasks))
+			}
+			for i, task := range tasks {
+				if task.GetId() != tc.wantIds[i] {
+					t.Fatalf("task# %d id: want: %q, got: %q", i, tc.wantIds[i], task.GetId())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Tests for the intervals builders.
+
+package refvmi
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/vmi"
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// The intervals builders should agree w/ the task builders, for the same
+// config:
+func TestRefvmiMetricsIntervals(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	builders := []struct {
+		name string
+		tb   func(any) ([]vmi.MetricsGeneratorTask, error)
+		ib   func(any) (map[string]time.Duration, error)
+	}{
+		{"gauge", GaugeMetricsTaskBuilder, GaugeMetricsIntervals},
+		{"counter", CounterMetricsTaskBuilder, CounterMetricsIntervals},
+		{"categorical", CategoricalMetricsTaskBuilder, CategoricalMetricsIntervals},
+		{"grouped", GroupedMetricsTaskBuilder, GroupedMetricsIntervals},
+	}
+
+	enabledCfg := DefaultRefvmiConfig()
+	disabledCfg := DefaultRefvmiConfig()
+	disabledCfg.GaugeMetricsConfig.Interval = 0
+	disabledCfg.CounterMetricsConfig.Interval = 0
+	disabledCfg.CategoricalMetricsConfig.Interval = 0
+	disabledCfg.GroupedMetricsConfig.FastInterval = 0
+	slowDisabledCfg := DefaultRefvmiConfig()
+	slowDisabledCfg.GroupedMetricsConfig.SlowInterval = 0
+
+	for _, cfgTc := range []struct {
+		name string
+		cfg  *RefvmiConfig
+	}{
+		{"enabled", enabledCfg},
+		{"disabled", disabledCfg},
+		{"slow_disabled", slowDisabledCfg},
+	} {
+		for _, b := range builders {
+			t.Run(fmt.Sprintf("%s/%s", cfgTc.name, b.name), func(t *testing.T) {
+				tasks, err := b.tb(cfgTc.cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantIntervals := make(map[string]time.Duration)
+				for _, task := range tasks {
+					wantIntervals[task.GetId()] = task.GetInterval()
+				}
+				gotIntervals, err := b.ib(cfgTc.cfg)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The disabled tasks are either missing or w/ interval <= 0:
+				for id, interval := range gotIntervals {
+					if interval <= 0 {
+						delete(gotIntervals, id)
+					}
+				}
+				if fmt.Sprint(wantIntervals) != fmt.Sprint(gotIntervals) {
+					t.Fatalf("intervals: want: %v, got: %v", wantIntervals, gotIntervals)
+				}
+			})
+		}
+	}
+
+	if _, err := GaugeMetricsIntervals("wrong type"); err == nil {
+		t.Fatal("no error for wrong config type")
+	}
+}
@@ -0,0 +1,69 @@
+// Tests for custom instance and hostname label names.
+
+package refvmi
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/vmi"
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestRefvmiCustomLabelNames(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	instance, hostname := "refvmi_test", "refvmi-test"
+	instanceLabel, hostnameLabel := "instance", "host"
+
+	gaugeMetrics := NewGaugeMetrics(nil)
+	counterMetrics := NewCounterMetrics(nil)
+	categoricalMetrics := NewCategoricalMetrics(nil)
+
+	for _, tc := range []struct {
+		genBase *vmi.GeneratorBase
+		parse   func() error
+		action  func() bool
+	}{
+		{&gaugeMetrics.GeneratorBase, gaugeMetrics.parser.Parse, gaugeMetrics.TaskActivity},
+		{&counterMetrics.GeneratorBase, counterMetrics.parser.Parse, counterMetrics.TaskActivity},
+		{&categoricalMetrics.GeneratorBase, categoricalMetrics.parser.Parse, categoricalMetrics.TaskActivity},
+	} {
+		t.Run(tc.genBase.Id, func(t *testing.T) {
+			metricsQueue := vmi_testutils.NewTestMetricsQueue(0)
+			tc.genBase.Instance = instance
+			tc.genBase.Hostname = hostname
+			tc.genBase.InstanceLabelName = instanceLabel
+			tc.genBase.HostnameLabelName = hostnameLabel
+			tc.genBase.MetricsQueue = metricsQueue
+			tc.genBase.TestMode = true
+			ts := time.UnixMilli(1746121347582)
+			tc.genBase.TimeNowFunc = func() time.Time { return ts }
+
+			// 2 passes, such that the dtime metric is also generated:
+			for i := 0; i < 2; i++ {
+				if err := tc.parse(); err != nil {
+					t.Fatal(err)
+				}
+				if !tc.action() {
+					t.Fatal("TaskActivity() returned false, expected true")
+				}
+				ts = ts.Add(tc.genBase.Interval)
+			}
+
+			wantLabels := fmt.Sprintf(`{%s="%s",%s="%s"`, instanceLabel, instance, hostnameLabel, hostname)
+			metrics := metricsQueue.GetMetrics()
+			if len(metrics) == 0 {
+				t.Fatal("no metrics generated")
+			}
+			for _, metric := range metrics {
+				if !strings.Contains(metric, wantLabels) {
+					t.Errorf("%s: missing %s", metric, wantLabels)
+				}
+			}
+		})
+	}
+}
@@ -15,4 +15,10 @@ const (
 
 	// Gauge metric name:
 	GAUGE_METRIC = "refvmi_gauge"
+
+	// Grouped metrics, fast group:
+	GROUPED_GAUGE_METRIC = "refvmi_grouped_gauge"
+	// Grouped metrics, slow group:
+	GROUPED_PARSE_COUNT_METRIC = "refvmi_grouped_parse_count"
+	GROUPED_MAX_METRIC         = "refvmi_grouped_max"
 )
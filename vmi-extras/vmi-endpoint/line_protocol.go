@@ -0,0 +1,256 @@
+// InfluxDB line protocol parser, for the display of the requests targeting
+// the Influx write end-points.
+
+package main
+
+// The format, as per
+// https://docs.influxdata.com/influxdb/v2/reference/syntax/line-protocol/:
+//
+//	measurement[,tag=val...] field=val[,field=val...] [timestamp]
+//
+// whereby commas, spaces and equal signs may be escaped w/ backslash and the
+// string field values are double quoted.
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The URIs (path part) handled as Influx writes:
+var influxWritePaths = map[string]bool{
+	"/write":        true,
+	"/api/v2/write": true,
+}
+
+// Field value types:
+const (
+	INFLUX_FIELD_FLOAT    = "float"
+	INFLUX_FIELD_INTEGER  = "integer"
+	INFLUX_FIELD_UNSIGNED = "unsigned"
+	INFLUX_FIELD_STRING   = "string"
+	INFLUX_FIELD_BOOLEAN  = "boolean"
+)
+
+type InfluxTag struct {
+	Key, Value string
+}
+
+type InfluxField struct {
+	Key, Value, Type string
+}
+
+type InfluxPoint struct {
+	Measurement string
+	Tags        []InfluxTag
+	Fields      []InfluxField
+	// The timestamp is kept as-is, its precision is set by the request:
+	Timestamp string
+}
+
+var influxBooleanValues = map[string]bool{
+	"t": true, "T": true, "true": true, "True": true, "TRUE": true,
+	"f": true, "F": true, "false": true, "False": true, "FALSE": true,
+}
+
+// Return the index of the first unescaped occurrence of any of the stop chars
+// in s, starting from i, or len(s) if none. If quoteAware, the stop chars
+// between double quotes are ignored:
+func influxScan(s string, i int, stops string, quoteAware bool) int {
+	inQuotes := false
+	for ; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+		case quoteAware && c == '"':
+			inQuotes = !inQuotes
+		case !inQuotes && strings.IndexByte(stops, c) >= 0:
+			return i
+		}
+	}
+	return i
+}
+
+// Split s by the unescaped sep:
+func influxSplit(s string, sep byte, quoteAware bool) []string {
+	parts := make([]string, 0, 4)
+	for start := 0; ; {
+		i := influxScan(s, start, string(sep), quoteAware)
+		parts = append(parts, s[start:i])
+		if i >= len(s) {
+			return parts
+		}
+		start = i + 1
+	}
+}
+
+// Remove the backslash before any of the escapable chars:
+func influxUnescape(s string, escapable string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	buf := &strings.Builder{}
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && strings.IndexByte(escapable, s[i+1]) >= 0 {
+			i++
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// Split a key=value pair by the first unescaped `=':
+func influxSplitKeyValue(s string, what string) (string, string, error) {
+	i := influxScan(s, 0, "=", false)
+	if i >= len(s) {
+		return "", "", fmt.Errorf("%s %q: missing `='", what, s)
+	}
+	if i == 0 {
+		return "", "", fmt.Errorf("%s %q: empty key", what, s)
+	}
+	return s[:i], s[i+1:], nil
+}
+
+func parseInfluxFieldValue(val string) (string, string, error) {
+	n := len(val)
+	switch {
+	case n == 0:
+		return "", "", fmt.Errorf("empty value")
+	case val[0] == '"':
+		if n < 2 || influxScan(val, 1, `"`, false) != n-1 {
+			return "", "", fmt.Errorf("%s: unterminated string", val)
+		}
+		return influxUnescape(val[1:n-1], `"\`), INFLUX_FIELD_STRING, nil
+	case val[n-1] == 'i':
+		if _, err := strconv.ParseInt(val[:n-1], 10, 64); err != nil {
+			return "", "", fmt.Errorf("%s: invalid integer", val)
+		}
+		return val[:n-1], INFLUX_FIELD_INTEGER, nil
+	case val[n-1] == 'u':
+		if _, err := strconv.ParseUint(val[:n-1], 10, 64); err != nil {
+			return "", "", fmt.Errorf("%s: invalid unsigned", val)
+		}
+		return val[:n-1], INFLUX_FIELD_UNSIGNED, nil
+	case influxBooleanValues[val]:
+		return val, INFLUX_FIELD_BOOLEAN, nil
+	}
+	f, err := strconv.ParseFloat(val, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", "", fmt.Errorf("%s: invalid float", val)
+	}
+	return val, INFLUX_FIELD_FLOAT, nil
+}
+
+func ParseInfluxLine(line string) (*InfluxPoint, error) {
+	point := &InfluxPoint{}
+
+	// Measurement and tags:
+	i := influxScan(line, 0, " ", false)
+	keyParts := influxSplit(line[:i], ',', false)
+	if point.Measurement = influxUnescape(keyParts[0], `, \`); point.Measurement == "" {
+		return nil, fmt.Errorf("missing measurement")
+	}
+	for _, tag := range keyParts[1:] {
+		key, val, err := influxSplitKeyValue(tag, "tag")
+		if err != nil {
+			return nil, err
+		}
+		if val == "" {
+			return nil, fmt.Errorf("tag %q: empty value", tag)
+		}
+		point.Tags = append(point.Tags, InfluxTag{
+			Key:   influxUnescape(key, `,= \`),
+			Value: influxUnescape(val, `,= \`),
+		})
+	}
+
+	// Fields:
+	for i < len(line) && line[i] == ' ' {
+		i++
+	}
+	j := influxScan(line, i, " ", true)
+	if i == j {
+		return nil, fmt.Errorf("missing fields")
+	}
+	for _, field := range influxSplit(line[i:j], ',', true) {
+		key, val, err := influxSplitKeyValue(field, "field")
+		if err != nil {
+			return nil, err
+		}
+		val, typ, err := parseInfluxFieldValue(val)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %v", key, err)
+		}
+		point.Fields = append(point.Fields, InfluxField{
+			Key:   influxUnescape(key, `,= \`),
+			Value: val,
+			Type:  typ,
+		})
+	}
+
+	// Optional timestamp:
+	rest := strings.Fields(line[j:])
+	switch len(rest) {
+	case 0:
+	case 1:
+		if _, err := strconv.ParseInt(rest[0], 10, 64); err != nil {
+			return nil, fmt.Errorf("%s: invalid timestamp", rest[0])
+		}
+		point.Timestamp = rest[0]
+	default:
+		return nil, fmt.Errorf("%q: unexpected trailing content", strings.Join(rest[1:], " "))
+	}
+	return point, nil
+}
+
+// Parse the body of an Influx write request. The empty and comment lines are
+// ignored:
+func ParseInfluxLineProtocol(body []byte) ([]*InfluxPoint, error) {
+	points := make([]*InfluxPoint, 0)
+	for lineNum, line := range strings.Split(string(body), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		point, err := ParseInfluxLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line protocol: line# %d: %v", lineNum+1, err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// Display the points, one per line:
+func FormatInfluxPoints(buf *bytes.Buffer, points []*InfluxPoint) {
+	for _, point := range points {
+		fmt.Fprintf(buf, "measurement: %q, tags: {", point.Measurement)
+		for k, tag := range point.Tags {
+			if k > 0 {
+				buf.WriteString(", ")
+			}
+			fmt.Fprintf(buf, "%q: %q", tag.Key, tag.Value)
+		}
+		buf.WriteString("}, fields: {")
+		for k, field := range point.Fields {
+			if k > 0 {
+				buf.WriteString(", ")
+			}
+			if field.Type == INFLUX_FIELD_STRING {
+				fmt.Fprintf(buf, "%q: %q (%s)", field.Key, field.Value, field.Type)
+			} else {
+				fmt.Fprintf(buf, "%q: %s (%s)", field.Key, field.Value, field.Type)
+			}
+		}
+		buf.WriteString("}, timestamp: ")
+		if point.Timestamp != "" {
+			buf.WriteString(point.Timestamp)
+		} else {
+			buf.WriteString("-")
+		}
+		buf.WriteByte('\n')
+	}
+}
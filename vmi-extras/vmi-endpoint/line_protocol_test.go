@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseInfluxLine(t *testing.T) {
+	for _, tc := range []struct {
+		line      string
+		wantPoint string
+		wantErr   bool
+	}{
+		{
+			line:      `cpu usage=0.5`,
+			wantPoint: `measurement: "cpu", tags: {}, fields: {"usage": 0.5 (float)}, timestamp: -`,
+		},
+		{
+			line: `cpu,host=h1,region=us usage=0.5,n=3i,u=4u,ok=t,s="a b" 1746121347582000000`,
+			wantPoint: `measurement: "cpu", tags: {"host": "h1", "region": "us"}, ` +
+				`fields: {"usage": 0.5 (float), "n": 3 (integer), "u": 4 (unsigned), "ok": t (boolean), "s": "a b" (string)}, ` +
+				`timestamp: 1746121347582000000`,
+		},
+		{
+			line: `my\ cpu,tag\,key=tag\ value\=x field\ key="say \"hi\", \\o/" 1`,
+			wantPoint: `measurement: "my cpu", tags: {"tag,key": "tag value=x"}, ` +
+				`fields: {"field key": "say \"hi\", \\o/" (string)}, timestamp: 1`,
+		},
+		{line: `cpu`, wantErr: true},
+		{line: `,host=h1 usage=1`, wantErr: true},
+		{line: `cpu,host usage=1`, wantErr: true},
+		{line: `cpu,host= usage=1`, wantErr: true},
+		{line: `cpu usage`, wantErr: true},
+		{line: `cpu =1`, wantErr: true},
+		{line: `cpu usage=`, wantErr: true},
+		{line: `cpu usage=x`, wantErr: true},
+		{line: `cpu usage=NaN`, wantErr: true},
+		{line: `cpu usage=1.5i`, wantErr: true},
+		{line: `cpu usage=-1u`, wantErr: true},
+		{line: `cpu s="unterminated`, wantErr: true},
+		{line: `cpu s="a"b"`, wantErr: true},
+		{line: `cpu usage=1 ts`, wantErr: true},
+		{line: `cpu usage=1 1 2`, wantErr: true},
+	} {
+		t.Run(tc.line, func(t *testing.T) {
+			point, err := ParseInfluxLine(tc.line)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				t.Log(err)
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := &bytes.Buffer{}
+			FormatInfluxPoints(buf, []*InfluxPoint{point})
+			if got := strings.TrimSuffix(buf.String(), "\n"); tc.wantPoint != got {
+				t.Fatalf("point:\n\twant: %s\n\t got: %s", tc.wantPoint, got)
+			}
+		})
+	}
+}
+
+func TestHandleFuncInflux(t *testing.T) {
+	savedDisplayLevel, savedDisplayBodyLimit := displayLevel, displayBodyLimit
+	defer func() { displayLevel, displayBodyLimit = savedDisplayLevel, savedDisplayBodyLimit }()
+	displayLevel, displayBodyLimit = DISPLAY_BODY, 0
+
+	logBuf := &bytes.Buffer{}
+	savedLoggerWriter := logger.Writer()
+	defer logger.SetOutput(savedLoggerWriter)
+	logger.SetOutput(logBuf)
+
+	for _, tc := range []struct {
+		uri      string
+		body     string
+		wantLogs []string
+	}{
+		{
+			uri:  "/write?db=test",
+			body: "# comment\ncpu,host=h1 usage=0.5 1\n\nmem used=3i 2\n",
+			wantLogs: []string{
+				"2 line protocol points",
+				`measurement: "cpu", tags: {"host": "h1"}, fields: {"usage": 0.5 (float)}, timestamp: 1`,
+				`measurement: "mem", tags: {}, fields: {"used": 3 (integer)}, timestamp: 2`,
+			},
+		},
+		{
+			uri:  "/api/v2/write?bucket=test",
+			body: "cpu usage=0.5\ncpu usage=x\n",
+			wantLogs: []string{
+				"Error decoding request: line protocol: line# 2:",
+			},
+		},
+		{
+			uri:  "/api/v1/import/prometheus",
+			body: "cpu usage=x\n",
+			wantLogs: []string{
+				"Body (12 bytes after decoding):",
+				"cpu usage=x",
+			},
+		},
+	} {
+		t.Run(tc.uri, func(t *testing.T) {
+			logBuf.Reset()
+			r := httptest.NewRequest("POST", tc.uri, strings.NewReader(tc.body))
+			r.Header.Set("Content-Type", "text/plain")
+			handleFunc(httptest.NewRecorder(), r)
+			gotLog := logBuf.String()
+			for _, want := range tc.wantLogs {
+				if !strings.Contains(gotLog, want) {
+					t.Errorf("log: want: %q, got:\n%s", want, gotLog)
+				}
+			}
+		})
+	}
+}
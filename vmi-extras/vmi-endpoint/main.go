@@ -10,8 +10,10 @@ import (
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -37,6 +39,11 @@ const (
 	AUDIT_FILE_HEADER = "Timestamp,RemoteAddr,Method,URI,Proto,Size"
 )
 
+const (
+	// The batch sequence number header added by the importer:
+	BATCH_SEQ_HEADER = "X-VMI-Batch-Seq"
+)
+
 var logger = log.New(os.Stderr, "\n", log.Ldate|log.Lmicroseconds)
 
 var (
@@ -56,8 +63,46 @@ var (
 	bodyByteCount    int
 	requestCount     int
 	trafficMu        = &sync.Mutex{}
+
+	checkBatchSeq bool
+	// The highest batch sequence number seen so far, by remote host:
+	lastBatchSeq   = make(map[string]uint64)
+	lastBatchSeqMu = &sync.Mutex{}
 )
 
+// Check the continuity of the batch sequence number, if present, and return a
+// description of the anomaly or the empty string if none:
+func checkBatchSeqContinuity(r *http.Request) string {
+	seqVal := r.Header.Get(BATCH_SEQ_HEADER)
+	if seqVal == "" {
+		return ""
+	}
+	seq, err := strconv.ParseUint(seqVal, 10, 64)
+	if err != nil {
+		return fmt.Sprintf("%s: %q: invalid value", BATCH_SEQ_HEADER, seqVal)
+	}
+	remoteHost, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remoteHost = r.RemoteAddr
+	}
+
+	lastBatchSeqMu.Lock()
+	defer lastBatchSeqMu.Unlock()
+	lastSeq, ok := lastBatchSeq[remoteHost]
+	switch {
+	case !ok || seq == lastSeq+1:
+		lastBatchSeq[remoteHost] = seq
+		return ""
+	case seq == lastSeq:
+		return fmt.Sprintf("%s: %s: batch# %d: retry", remoteHost, BATCH_SEQ_HEADER, seq)
+	case seq < lastSeq:
+		return fmt.Sprintf("%s: %s: batch# %d: out of order, last: %d", remoteHost, BATCH_SEQ_HEADER, seq, lastSeq)
+	default:
+		lastBatchSeq[remoteHost] = seq
+		return fmt.Sprintf("%s: %s: batch# %d: gap, last: %d", remoteHost, BATCH_SEQ_HEADER, seq, lastSeq)
+	}
+}
+
 func logTrafficRate(interval time.Duration) {
 
 	trafficMu.Lock()
@@ -102,11 +147,20 @@ func handleFunc(_ http.ResponseWriter, r *http.Request) {
 
 	rSize += len(r.Method) + len(r.RequestURI) + len(r.Proto) + EOL_LEN
 
+	// The body is retained in memory only if it is going to be displayed,
+	// otherwise it is merely counted and discarded:
 	var body []byte
-	if r.Method == "PUT" || r.Method == "POST" {
-		body, err = io.ReadAll(r.Body)
-		if err == nil {
+	hasBody := r.Method == "PUT" || r.Method == "POST"
+	if hasBody {
+		if displayLevel >= DISPLAY_BODY {
+			body, err = io.ReadAll(r.Body)
 			bSize = len(body)
+		} else {
+			var n int64
+			n, err = io.Copy(io.Discard, r.Body)
+			bSize = int(n)
+		}
+		if err == nil {
 			rSize += bSize
 		}
 	}
@@ -119,7 +173,7 @@ func handleFunc(_ http.ResponseWriter, r *http.Request) {
 		}
 		switch hdr {
 		case "Content-Encoding":
-			if body != nil {
+			if hasBody && err == nil {
 				for _, val := range hdrVals {
 					switch val {
 					case "gzip":
@@ -152,6 +206,12 @@ func handleFunc(_ http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// The Influx writes are displayed parsed:
+	var influxPoints []*InfluxPoint
+	if hasBody && err == nil && displayLevel >= DISPLAY_BODY && influxWritePaths[r.URL.Path] {
+		influxPoints, err = ParseInfluxLineProtocol(body)
+	}
+
 	buf := &bytes.Buffer{}
 	if err != nil || displayLevel >= DISPLAY_REQUEST {
 		fmt.Fprintf(
@@ -171,6 +231,21 @@ func handleFunc(_ http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		fmt.Fprintf(buf, "Error decoding request: %s\n", err)
 	} else {
+		if influxPoints != nil {
+			fmt.Fprintf(
+				buf, "\nBody (%d bytes after decoding, %d line protocol points):\n\n",
+				len(body), len(influxPoints),
+			)
+			body = nil
+			pointsBuf := &bytes.Buffer{}
+			FormatInfluxPoints(pointsBuf, influxPoints)
+			if displayBodyLimit > 0 && pointsBuf.Len() > displayBodyLimit {
+				truncatedSize := pointsBuf.Len() - displayBodyLimit
+				pointsBuf.Truncate(displayBodyLimit)
+				fmt.Fprintf(pointsBuf, " ... (%d bytes truncated)\n", truncatedSize)
+			}
+			buf.Write(pointsBuf.Bytes())
+		}
 		if body != nil && displayLevel >= DISPLAY_BODY {
 			fmt.Fprintf(buf, "\nBody (%d bytes after decoding):\n\n", len(body))
 			displayBody, truncatedSize := body, 0
@@ -217,6 +292,11 @@ func handleFunc(_ http.ResponseWriter, r *http.Request) {
 			auditFileMu.Unlock()
 		}
 	}
+	if checkBatchSeq {
+		if anomaly := checkBatchSeqContinuity(r); anomaly != "" {
+			fmt.Fprintf(buf, "%s\n", anomaly)
+		}
+	}
 	if buf.Len() > 0 {
 		logger.Print(buf)
 	}
@@ -266,6 +346,12 @@ func main() {
 		DEFAULT_TRAFFIC_STATS_INT,
 		"Traffic stats interval, use 0 to disable",
 	)
+	flag.BoolVar(
+		&checkBatchSeq,
+		"check-batch-seq",
+		false,
+		fmt.Sprintf("Check the continuity of the %s header and log the retries, reorders and gaps", BATCH_SEQ_HEADER),
+	)
 	flag.Parse()
 
 	if displayLevelName != "" {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+// Generate an endless stream of bytes w/o allocating the full content.
+type testZeroReader struct{}
+
+func (testZeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+func testHandleFuncBodySize(t *testing.T, level int, bodySize int64) {
+	savedDisplayLevel := displayLevel
+	defer func() { displayLevel = savedDisplayLevel }()
+	displayLevel = level
+
+	trafficMu.Lock()
+	bodyByteCount, requestCount = 0, 0
+	trafficMu.Unlock()
+
+	r := httptest.NewRequest("POST", "/", io.LimitReader(testZeroReader{}, bodySize))
+
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	totalAlloc := memStats.TotalAlloc
+	handleFunc(httptest.NewRecorder(), r)
+	runtime.ReadMemStats(memStats)
+	allocated := memStats.TotalAlloc - totalAlloc
+
+	trafficMu.Lock()
+	gotBodyByteCount, gotRequestCount := bodyByteCount, requestCount
+	trafficMu.Unlock()
+
+	if int64(gotBodyByteCount) != bodySize {
+		t.Fatalf("bodyByteCount: want: %d, got: %d", bodySize, gotBodyByteCount)
+	}
+	if gotRequestCount != 1 {
+		t.Fatalf("requestCount: want: %d, got: %d", 1, gotRequestCount)
+	}
+	// The body should have been discarded rather than retained, therefore the
+	// allocation should be well below the body size:
+	if maxAllocated := uint64(bodySize / 16); allocated > maxAllocated {
+		t.Fatalf("allocated: want: <= %d, got: %d", maxAllocated, allocated)
+	}
+}
+
+func TestHandleFuncBodySize(t *testing.T) {
+	for _, level := range []int{
+		-1,
+		DISPLAY_REQUEST,
+		DISPLAY_HEADERS,
+	} {
+		bodySize := int64(64 * 1024 * 1024)
+		t.Run(
+			fmt.Sprintf("level=%d,bodySize=%d", level, bodySize),
+			func(t *testing.T) { testHandleFuncBodySize(t, level, bodySize) },
+		)
+	}
+}
+
+func TestCheckBatchSeqContinuity(t *testing.T) {
+	clear(lastBatchSeq)
+
+	for i, tc := range []struct {
+		seq         string
+		wantAnomaly bool
+	}{
+		{"", false},
+		{"5", false},
+		{"6", false},
+		{"6", true},  // retry
+		{"8", true},  // gap
+		{"7", true},  // out of order
+		{"9", false}, // continuity w/ the highest
+		{"x", true},  // invalid
+	} {
+		r := httptest.NewRequest("PUT", "/", nil)
+		if tc.seq != "" {
+			r.Header.Set(BATCH_SEQ_HEADER, tc.seq)
+		}
+		anomaly := checkBatchSeqContinuity(r)
+		if tc.wantAnomaly != (anomaly != "") {
+			t.Fatalf("step# %d: seq=%q: want anomaly: %v, got: %q", i, tc.seq, tc.wantAnomaly, anomaly)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+// Scrape metrics generator: forward the metrics from a Prometheus format
+// endpoint.
+
+package generators
+
+// The generator GETs the configured URL, e.g. the /metrics endpoint of an
+// application, and it queues the scraped samples into the metrics queue,
+// turning the importer into a lightweight scrape-and-forward agent.
+//
+// The instance and hostname labels and the extra labels, if any, are injected
+// into every sample. The scraped labels conflicting w/ the injected ones are
+// renamed to exported_<name>, same as Prometheus does for honor_labels:
+// false. The metric names are subject to metric_renames. The samples are
+// timestamped w/ the scrape time, unless honor_timestamps is set and the
+// sample has its own timestamp.
+//
+// The scrape is bound by the timeout via the context passed by the scheduler
+// (see "Timeouts" in scheduler.go). The scrape failures (errors, timeouts, non
+// 200 responses) are logged and the generator keeps being scheduled. The
+// comment lines (# HELP, # TYPE) are ignored and the invalid lines are counted
+// and logged.
+//
+// Since the generators configuration is importer specific, the generator is
+// not registered w/ the framework by this package. Rather the importer should
+// include a list of ScrapeMetricsConfig into its configuration and it should
+// build the tasks via NewScrapeMetricsTasks from its own task builder, e.g.:
+//
+//	func ScrapeMetricsTaskBuilder(cfg any) ([]vmi.MetricsGeneratorTask, error) {
+//		return generators.NewScrapeMetricsTasks(cfg.(*MyConfig).ScrapeMetricsConfigs)
+//	}
+//
+// and it should use ScrapeMetricsIntervals for the intervals builder, see
+// vmi.RegisterTaskBuilderWithIntervals.
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/vmi"
+)
+
+const (
+	SCRAPE_METRICS_CONFIG_INTERVAL_DEFAULT         = 15 * time.Second
+	SCRAPE_METRICS_CONFIG_TIMEOUT_DEFAULT          = 0 // i.e. the interval
+	SCRAPE_METRICS_CONFIG_HONOR_TIMESTAMPS_DEFAULT = false
+
+	// The generator ID is prefixed by:
+	SCRAPE_METRICS_ID_PREFIX = "scrape:"
+
+	// The prefix for the scraped labels conflicting w/ the injected ones:
+	SCRAPE_METRICS_EXPORTED_LABEL_PREFIX = "exported_"
+
+	// The max size of a scraped line:
+	SCRAPE_METRICS_MAX_LINE_SIZE = 1024 * 1024
+)
+
+var scrapeMetricsLog = vmi.NewCompLogger("scrape_metrics")
+
+type ScrapeMetricsConfig struct {
+	// The name, used for the generator ID, scrape:NAME; default: the URL host:
+	Name string `yaml:"name"`
+
+	// The URL to scrape:
+	URL string `yaml:"url"`
+
+	// How often to scrape, in time.ParseDuration() format. Use 0 to disable:
+	Interval time.Duration `yaml:"interval"`
+
+	// The scrape timeout. Use 0 for the interval:
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Extra labels injected into every scraped sample:
+	ExtraLabels map[string]string `yaml:"extra_labels"`
+
+	// Whether to keep the timestamps of the scraped samples, if any, rather
+	// than using the scrape time:
+	HonorTimestamps bool `yaml:"honor_timestamps"`
+}
+
+func DefaultScrapeMetricsConfig() *ScrapeMetricsConfig {
+	return &ScrapeMetricsConfig{
+		Interval:        SCRAPE_METRICS_CONFIG_INTERVAL_DEFAULT,
+		Timeout:         SCRAPE_METRICS_CONFIG_TIMEOUT_DEFAULT,
+		HonorTimestamps: SCRAPE_METRICS_CONFIG_HONOR_TIMESTAMPS_DEFAULT,
+	}
+}
+
+// The metrics generator context:
+type ScrapeMetrics struct {
+	vmi.GeneratorBase
+
+	url             string
+	extraLabels     map[string]string
+	honorTimestamps bool
+
+	// The HTTP client, mockable for testing:
+	client *http.Client
+
+	// Cache for the injected labels, `name="val",...`, and their names, for
+	// conflict detection:
+	injectedLabels     []byte
+	injectedLabelNames map[string]bool
+
+	// Scratch buffer for the scraped body:
+	body *bytes.Buffer
+}
+
+func NewScrapeMetrics(cfg *ScrapeMetricsConfig) (*ScrapeMetrics, error) {
+	if cfg == nil {
+		cfg = DefaultScrapeMetricsConfig()
+	}
+	scrapeUrl, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("NewScrapeMetrics: %v", err)
+	}
+	if scrapeUrl.Scheme != "http" && scrapeUrl.Scheme != "https" {
+		return nil, fmt.Errorf("NewScrapeMetrics: %q: invalid scheme, want: http or https", cfg.URL)
+	}
+	for name := range cfg.ExtraLabels {
+		if !vmi.IsValidLabelName(name) {
+			return nil, fmt.Errorf("NewScrapeMetrics: %q: invalid extra label name %q", cfg.URL, name)
+		}
+	}
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = cfg.Interval
+	}
+	return &ScrapeMetrics{
+		GeneratorBase: vmi.GeneratorBase{
+			Id:       scrapeMetricsId(cfg, scrapeUrl),
+			Interval: cfg.Interval,
+			Timeout:  timeout,
+		},
+		url:             cfg.URL,
+		extraLabels:     cfg.ExtraLabels,
+		honorTimestamps: cfg.HonorTimestamps,
+		client:          &http.Client{},
+		body:            &bytes.Buffer{},
+	}, nil
+}
+
+// Update metrics cache, normally this is needed only at the 1st time generation:
+func (m *ScrapeMetrics) initialize() {
+	m.GenBaseInit()
+
+	labels := map[string]string{
+		m.InstanceLabelName: m.Instance,
+		m.HostnameLabelName: m.Hostname,
+	}
+	for name, val := range m.extraLabels {
+		labels[name] = val
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	buf := &bytes.Buffer{}
+	m.injectedLabelNames = make(map[string]bool)
+	for i, name := range names {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(name)
+		buf.WriteString(`="`)
+		writeEscapedLabelValue(buf, labels[name])
+		buf.WriteByte('"')
+		m.injectedLabelNames[name] = true
+	}
+	m.injectedLabels = buf.Bytes()
+
+	m.Initialized = true
+}
+
+// Write the label value escaped as per the exposition format, i.e. `\`, `\"`
+// and `\n`:
+func writeEscapedLabelValue(buf *bytes.Buffer, val string) {
+	for i := 0; i < len(val); i++ {
+		switch c := val[i]; c {
+		case '\\', '"':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+// Scrape the URL into the body buffer:
+func (m *ScrapeMetrics) scrape(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/plain;version=0.0.4")
+	res, err := m.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, res.Body)
+		return fmt.Errorf("%s %s: %s", req.Method, m.url, res.Status)
+	}
+	m.body.Reset()
+	_, err = m.body.ReadFrom(res.Body)
+	return err
+}
+
+// Parse the labels, `{name="val",...}`, starting at the opening brace. Return
+// the list of name, value pairs, the latter quoted, and the index past the
+// closing brace, or -1 if invalid:
+func parseScrapedLabels(line []byte) ([][2][]byte, int) {
+	labels := make([][2][]byte, 0)
+	i, n := 1, len(line)
+	for {
+		for i < n && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i < n && line[i] == '}' {
+			return labels, i + 1
+		}
+		start := i
+		for i < n && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+			i++
+		}
+		name := line[start:i]
+		for i < n && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if len(name) == 0 || i >= n || line[i] != '=' {
+			return nil, -1
+		}
+		i++
+		for i < n && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i >= n || line[i] != '"' {
+			return nil, -1
+		}
+		start = i
+		for i++; i < n && line[i] != '"'; i++ {
+			if line[i] == '\\' {
+				i++
+			}
+		}
+		if i >= n {
+			return nil, -1
+		}
+		i++
+		labels = append(labels, [2][]byte{name, line[start:i]})
+		for i < n && (line[i] == ' ' || line[i] == '\t') {
+			i++
+		}
+		if i < n && line[i] == ',' {
+			i++
+		} else if i >= n || line[i] != '}' {
+			return nil, -1
+		}
+	}
+}
+
+// Write a scraped sample, `name{labels} value [timestamp]`, w/ the injected
+// labels. Return false if the line is invalid, in which case nothing is
+// written:
+func (m *ScrapeMetrics) writeSample(buf *bytes.Buffer, line []byte) bool {
+	i := bytes.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return false
+	}
+	name := line[:i]
+	var labels [][2][]byte
+	if line[i] == '{' {
+		var end int
+		if labels, end = parseScrapedLabels(line[i:]); end < 0 {
+			return false
+		}
+		i += end
+	}
+	fields := bytes.Fields(line[i:])
+	if len(fields) < 1 || len(fields) > 2 {
+		return false
+	}
+
+	buf.WriteString(vmi.RenameMetric(string(name)))
+	buf.WriteByte('{')
+	buf.Write(m.injectedLabels)
+	for _, label := range labels {
+		buf.WriteByte(',')
+		if m.injectedLabelNames[string(label[0])] {
+			buf.WriteString(SCRAPE_METRICS_EXPORTED_LABEL_PREFIX)
+		}
+		buf.Write(label[0])
+		buf.WriteByte('=')
+		buf.Write(label[1])
+	}
+	buf.WriteString("} ")
+	buf.Write(fields[0])
+	if m.honorTimestamps && len(fields) == 2 {
+		buf.WriteByte(' ')
+		buf.Write(fields[1])
+		buf.WriteByte('\n')
+	} else {
+		buf.Write(m.TsSuffixBuf.Bytes())
+	}
+	return true
+}
+
+// The actual metrics generation, used when invoked outside of the scheduler;
+// the scrape is bound by the timeout:
+func (m *ScrapeMetrics) TaskActivity() bool {
+	ctx, cancelFn := context.WithTimeout(context.Background(), m.Timeout)
+	defer cancelFn()
+	return m.TaskActivityContext(ctx)
+}
+
+// The actual metrics generation, it will be registered as the wrapping task's
+// context aware activity:
+func (m *ScrapeMetrics) TaskActivityContext(ctx context.Context) bool {
+	if !m.Initialized {
+		m.initialize()
+	}
+
+	if err := m.scrape(ctx); err != nil {
+		scrapeMetricsLog.Warnf("%s: %v", m.Id, err)
+		// Keep scheduling, the failure may be transient:
+		return true
+	}
+	ts := m.TimeNowFunc()
+
+	metricsQueue := m.MetricsQueue
+	buf := metricsQueue.GetBuf()
+	metricsCount, _ := m.GenBaseMetricsStart(buf, ts)
+	byteCount, invalidCount := 0, 0
+
+	scanner := bufio.NewScanner(m.body)
+	scanner.Buffer(nil, SCRAPE_METRICS_MAX_LINE_SIZE)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		if buf == nil {
+			buf = metricsQueue.GetBuf()
+		}
+		if !m.writeSample(buf, line) {
+			invalidCount++
+			continue
+		}
+		metricsCount++
+		var n int
+		buf, n = m.GenBaseEmit(buf, 1)
+		byteCount += n
+	}
+	if err := scanner.Err(); err != nil {
+		scrapeMetricsLog.Warnf("%s: %v", m.Id, err)
+	}
+	if invalidCount > 0 {
+		scrapeMetricsLog.Warnf("%s: %d invalid line(s) ignored", m.Id, invalidCount)
+	}
+
+	if buf != nil {
+		byteCount += buf.Len()
+		vmi.QueueBufFor(metricsQueue, m.Id, buf)
+	}
+	vmi.UpdateMetricsGeneratorStats(m.Id, metricsCount, byteCount)
+
+	return true
+}
+
+// The ID is based on the name, defaulting to the host:
+func scrapeMetricsId(cfg *ScrapeMetricsConfig, scrapeUrl *url.URL) string {
+	name := cfg.Name
+	if name == "" {
+		name = scrapeUrl.Host
+	}
+	return SCRAPE_METRICS_ID_PREFIX + name
+}
+
+// Build the tasks for the list of scrape configs, to be invoked from the
+// importer's task builder. The configs w/ interval <= 0 are disabled.
+func NewScrapeMetricsTasks(cfgs []*ScrapeMetricsConfig) ([]vmi.MetricsGeneratorTask, error) {
+	tasks := make([]vmi.MetricsGeneratorTask, 0)
+	ids := make(map[string]bool)
+	for _, cfg := range cfgs {
+		if cfg == nil {
+			continue
+		}
+		if cfg.Interval <= 0 {
+			scrapeMetricsLog.Infof("url=%s, interval=%s, metrics disabled", cfg.URL, cfg.Interval)
+			continue
+		}
+		m, err := NewScrapeMetrics(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if ids[m.Id] {
+			return nil, fmt.Errorf("NewScrapeMetricsTasks: duplicate id %q, set distinct names", m.Id)
+		}
+		ids[m.Id] = true
+		scrapeMetricsLog.Infof(
+			"id=%s, url=%s, interval=%s, timeout=%s, extra_labels=%v, honor_timestamps=%v",
+			m.Id, m.url, m.Interval, m.Timeout, m.extraLabels, m.honorTimestamps,
+		)
+		tasks = append(tasks, m)
+	}
+	return tasks, nil
+}
+
+// Return the intervals of the tasks for the list of scrape configs, by ID, w/o
+// building them, to be invoked from the importer's intervals builder.
+func ScrapeMetricsIntervals(cfgs []*ScrapeMetricsConfig) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, cfg := range cfgs {
+		if cfg == nil || cfg.Interval <= 0 {
+			continue
+		}
+		scrapeUrl, err := url.Parse(cfg.URL)
+		if err != nil {
+			return nil, fmt.Errorf("ScrapeMetricsIntervals: %v", err)
+		}
+		intervals[scrapeMetricsId(cfg, scrapeUrl)] = cfg.Interval
+	}
+	return intervals, nil
+}
@@ -0,0 +1,264 @@
+// Tests for the scrape metrics generator.
+
+package generators
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bgp59/victoriametrics-importer/vmi"
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+const (
+	TEST_SCRAPE_METRICS_INSTANCE = "scrape_test"
+	TEST_SCRAPE_METRICS_HOSTNAME = "scrape-test"
+)
+
+type ScrapeMetricsTestCase struct {
+	Name            string
+	Body            string
+	ExtraLabels     map[string]string
+	HonorTimestamps bool
+	WantMetrics     []string
+}
+
+func newTestScrapeMetrics(t *testing.T, cfg *ScrapeMetricsConfig, ts time.Time) (*ScrapeMetrics, *vmi_testutils.TestMetricsQueue) {
+	m, err := NewScrapeMetrics(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsQueue := vmi_testutils.NewTestMetricsQueue(0)
+	m.MetricsQueue = metricsQueue
+	m.Instance = TEST_SCRAPE_METRICS_INSTANCE
+	m.Hostname = TEST_SCRAPE_METRICS_HOSTNAME
+	m.InstanceLabelName = vmi.INSTANCE_LABEL_NAME
+	m.HostnameLabelName = vmi.HOSTNAME_LABEL_NAME
+	m.TestMode = true
+	m.TimeNowFunc = func() time.Time { return ts }
+	return m, metricsQueue
+}
+
+func testScrapeMetrics(tc *ScrapeMetricsTestCase, t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, tc.Body)
+	}))
+	defer server.Close()
+
+	cfg := DefaultScrapeMetricsConfig()
+	cfg.URL = server.URL + "/metrics"
+	cfg.ExtraLabels = tc.ExtraLabels
+	cfg.HonorTimestamps = tc.HonorTimestamps
+	ts := time.UnixMilli(1746121347582)
+	m, metricsQueue := newTestScrapeMetrics(t, cfg, ts)
+
+	if !m.TaskActivity() {
+		t.Fatal("TaskActivity() returned false, expected true")
+	}
+
+	wantMetrics := make([]string, len(tc.WantMetrics))
+	for i, metric := range tc.WantMetrics {
+		// The scrape timestamp is the default:
+		if strings.Contains(metric, "%d") {
+			metric = fmt.Sprintf(metric, ts.UnixMilli())
+		}
+		wantMetrics[i] = metric
+	}
+	errBuf := metricsQueue.GenerateReport(wantMetrics, true, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestScrapeMetrics(t *testing.T) {
+	for _, tc := range []*ScrapeMetricsTestCase{
+		{
+			Name: "no_labels",
+			Body: "# HELP up Up\n# TYPE up gauge\nup 1\n\n",
+			WantMetrics: []string{
+				`up{hostname="scrape-test",vmi_inst="scrape_test"} 1 %d`,
+			},
+		},
+		{
+			Name: "extra_labels",
+			Body: `http_requests_total{method="get",code="200"} 1027` + "\n" +
+				`http_requests_total{method="post",code="400"} 3` + "\n",
+			ExtraLabels: map[string]string{"job": "app"},
+			WantMetrics: []string{
+				`http_requests_total{hostname="scrape-test",job="app",vmi_inst="scrape_test",method="get",code="200"} 1027 %d`,
+				`http_requests_total{hostname="scrape-test",job="app",vmi_inst="scrape_test",method="post",code="400"} 3 %d`,
+			},
+		},
+		{
+			Name:        "escaped_extra_labels",
+			Body:        "up 1\n",
+			ExtraLabels: map[string]string{"job": "a\"b\\c\nd"},
+			WantMetrics: []string{
+				`up{hostname="scrape-test",job="a\"b\\c\nd",vmi_inst="scrape_test"} 1 %d`,
+			},
+		},
+		{
+			Name:        "conflicting_labels",
+			Body:        `temp{job="other",hostname="h1",path="a,b}\"c"} 21.5` + "\n",
+			ExtraLabels: map[string]string{"job": "app"},
+			WantMetrics: []string{
+				`temp{hostname="scrape-test",job="app",vmi_inst="scrape_test",exported_job="other",exported_hostname="h1",path="a,b}\"c"} 21.5 %d`,
+			},
+		},
+		{
+			Name: "timestamps",
+			Body: "a 1 1746121300000\nb{x=\"y\"} 2\n",
+			WantMetrics: []string{
+				`a{hostname="scrape-test",vmi_inst="scrape_test"} 1 %d`,
+				`b{hostname="scrape-test",vmi_inst="scrape_test",x="y"} 2 %d`,
+			},
+		},
+		{
+			Name:            "honor_timestamps",
+			Body:            "a 1 1746121300000\nb{x=\"y\"} 2\n",
+			HonorTimestamps: true,
+			WantMetrics: []string{
+				`a{hostname="scrape-test",vmi_inst="scrape_test"} 1 1746121300000`,
+				`b{hostname="scrape-test",vmi_inst="scrape_test",x="y"} 2 %d`,
+			},
+		},
+		{
+			Name: "invalid_lines",
+			Body: "valid 1\n{x=\"y\"} 2\nbad{x=\"y\" 3\nnovalue\ntoo many fields 4\n",
+			WantMetrics: []string{
+				`valid{hostname="scrape-test",vmi_inst="scrape_test"} 1 %d`,
+			},
+		},
+	} {
+		t.Run(
+			tc.Name,
+			func(t *testing.T) { testScrapeMetrics(tc, t) },
+		)
+	}
+}
+
+func TestScrapeMetricsFailure(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	block := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/error":
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		case "/timeout":
+			select {
+			case <-block:
+			case <-r.Context().Done():
+			}
+		}
+	}))
+	defer server.Close()
+	defer close(block)
+
+	for _, path := range []string{"/error", "/timeout"} {
+		t.Run(
+			path[1:],
+			func(t *testing.T) {
+				cfg := DefaultScrapeMetricsConfig()
+				cfg.URL = server.URL + path
+				cfg.Timeout = 100 * time.Millisecond
+				m, metricsQueue := newTestScrapeMetrics(t, cfg, time.Now())
+				if !m.TaskActivity() {
+					t.Fatal("TaskActivity() returned false, expected true")
+				}
+				if metrics := metricsQueue.GetMetrics(); len(metrics) > 0 {
+					t.Fatalf("unexpected metrics: %v", metrics)
+				}
+			},
+		)
+	}
+}
+
+func TestNewScrapeMetricsTasks(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, vmi.GetRootLogger(), nil)
+	defer tlc.RestoreLog()
+
+	for _, tc := range []struct {
+		name      string
+		urls      []string
+		names     []string
+		intervals []time.Duration
+		wantIds   []string
+		wantErr   bool
+	}{
+		{
+			name:      "ok",
+			urls:      []string{"http://h1:9100/metrics", "http://h2:9100/metrics", "http://h3:9100/metrics"},
+			names:     []string{"", "node2", ""},
+			intervals: []time.Duration{time.Second, time.Second, 0},
+			wantIds:   []string{"scrape:h1:9100", "scrape:node2"},
+		},
+		{
+			name:      "duplicate",
+			urls:      []string{"http://h1:9100/metrics", "http://h1:9100/other"},
+			names:     []string{"", ""},
+			intervals: []time.Duration{time.Second, time.Second},
+			wantErr:   true,
+		},
+		{
+			name:      "invalid_scheme",
+			urls:      []string{"h1:9100/metrics"},
+			names:     []string{""},
+			intervals: []time.Duration{time.Second},
+			wantErr:   true,
+		},
+	} {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				cfgs := make([]*ScrapeMetricsConfig, len(tc.urls))
+				for i, url := range tc.urls {
+					cfgs[i] = DefaultScrapeMetricsConfig()
+					cfgs[i].URL = url
+					cfgs[i].Name = tc.names[i]
+					cfgs[i].Interval = tc.intervals[i]
+				}
+				tasks, err := NewScrapeMetricsTasks(cfgs)
+				if tc.wantErr {
+					if err == nil {
+						t.Fatal("missing expected error")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(tasks) != len(tc.wantIds) {
+					t.Fatalf("len(tasks): want: %d, got: %d", len(tc.wantIds), len(tasks))
+				}
+				for i, task := range tasks {
+					if id := task.GetId(); id != tc.wantIds[i] {
+						t.Fatalf("tasks[%d]: id: want: %q, got: %q", i, tc.wantIds[i], id)
+					}
+				}
+				// The intervals builder helper should agree w/ the tasks:
+				intervals, err := ScrapeMetricsIntervals(cfgs)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(intervals) != len(tasks) {
+					t.Fatalf("len(intervals): want: %d, got: %d", len(tasks), len(intervals))
+				}
+				for _, task := range tasks {
+					if got := intervals[task.GetId()]; got != task.GetInterval() {
+						t.Fatalf("%s: interval: want: %s, got: %s", task.GetId(), task.GetInterval(), got)
+					}
+				}
+			},
+		)
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/docker/go-units v0.5.0
 	github.com/google/go-cmp v0.7.0
 	github.com/huandu/go-clone v1.7.3
+	github.com/klauspost/compress v1.19.2
 	github.com/mackerelio/go-osstat v0.2.6
 	github.com/sirupsen/logrus v1.9.4
 	github.com/tklauser/go-sysconf v0.3.16
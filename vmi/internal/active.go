@@ -0,0 +1,50 @@
+// Active/standby support for HA deployments.
+
+package vmi_internal
+
+// In HA setups two (or more) importers run side by side, but only one should
+// send, to avoid duplicate samples. No leader election is built in, rather the
+// active flag is provided externally, by a coordinator, via SetActive. While
+// inactive, the generators still run and they update their stats, but the
+// compressors discard the batches instead of sending them. The flag is
+// reported as vmi_active, once it was set.
+
+import (
+	"sync"
+)
+
+var activeState = struct {
+	// Whether the importer is active, i.e. it sends the metrics:
+	active bool
+	// Whether the flag was ever set, since it is reported only if so:
+	set bool
+	mu  *sync.Mutex
+}{
+	active: true,
+	mu:     &sync.Mutex{},
+}
+
+var activeLog = NewCompLogger("active")
+
+func SetActive(active bool) {
+	activeState.mu.Lock()
+	prevActive := activeState.active
+	activeState.active, activeState.set = active, true
+	activeState.mu.Unlock()
+	if prevActive != active {
+		activeLog.Infof("active: %v -> %v", prevActive, active)
+	}
+}
+
+func IsActive() bool {
+	activeState.mu.Lock()
+	defer activeState.mu.Unlock()
+	return activeState.active
+}
+
+// Return the active flag and whether it was ever set:
+func getActiveState() (bool, bool) {
+	activeState.mu.Lock()
+	defer activeState.mu.Unlock()
+	return activeState.active, activeState.set
+}
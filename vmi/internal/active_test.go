@@ -0,0 +1,91 @@
+package vmi_internal
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestSetActive(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	defer func() {
+		activeState.mu.Lock()
+		activeState.active, activeState.set = true, false
+		activeState.mu.Unlock()
+	}()
+
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors: 1,
+		FlushInterval:  20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+	defer pool.Shutdown()
+
+	numLinesPerBuf, timeout := 4, 2*time.Second
+	readCount := uint64(0)
+	// Queue a buffer and wait for the compressor to flush it:
+	queueBuffer := func(prefix string) {
+		buf := pool.GetBuf()
+		for j := 0; j < numLinesPerBuf; j++ {
+			fmt.Fprintf(buf, "vmi_test_%s{line=\"%d\"} 0 0\n", prefix, j)
+		}
+		pool.QueueBuf(buf)
+		readCount += 1
+		for deadline := time.Now().Add(timeout); ; time.Sleep(5 * time.Millisecond) {
+			if pool.SnapStats(nil)["0"].Uint64Stats[COMPRESSOR_STATS_READ_COUNT] >= readCount {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s: buffer not read after %s", prefix, timeout)
+			}
+		}
+	}
+	countLines := func(prefix string) int {
+		n := 0
+		for line, count := range sender.MapLines() {
+			if strings.HasPrefix(line, "vmi_test_"+prefix) {
+				n += count
+			}
+		}
+		return n
+	}
+
+	// Standby: the buffer is read, but not sent:
+	SetActive(false)
+	if active, activeSet := getActiveState(); active || !activeSet {
+		t.Fatalf("getActiveState: want: false, true, got: %v, %v", active, activeSet)
+	}
+	queueBuffer("standby")
+	if got := countLines("standby"); got != 0 {
+		t.Fatalf("standby lines sent: want: 0, got: %d", got)
+	}
+	stats := pool.SnapStats(nil)["0"]
+	if got := stats.Uint64Stats[COMPRESSOR_STATS_SEND_COUNT]; got != 0 {
+		t.Fatalf("standby send count: want: 0, got: %d", got)
+	}
+	if got := stats.Uint64Stats[COMPRESSOR_STATS_READ_BYTE_COUNT]; got == 0 {
+		t.Fatalf("standby read byte count: want > 0, got: %d", got)
+	}
+
+	// Active again: the sends resume:
+	SetActive(true)
+	queueBuffer("active")
+	if got := countLines("active"); got != numLinesPerBuf {
+		t.Fatalf("active lines sent: want: %d, got: %d", numLinesPerBuf, got)
+	}
+	if got := countLines("standby"); got != 0 {
+		t.Fatalf("standby lines sent after resume: want: 0, got: %d", got)
+	}
+	if got := pool.SnapStats(nil)["0"].Uint64Stats[COMPRESSOR_STATS_SEND_COUNT]; got != 1 {
+		t.Fatalf("send count: want: 1, got: %d", got)
+	}
+}
@@ -0,0 +1,27 @@
+package vmi_internal
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	GoVersion     = runtime.Version()
+	BuildSettings = GetBuildSettings()
+)
+
+// Retrieve the build settings embedded in the binary, see
+// https://pkg.go.dev/runtime/debug#BuildSetting. GOOS and GOARCH default to
+// the runtime values, since they are not always recorded (e.g. go run):
+func GetBuildSettings() map[string]string {
+	buildSettings := map[string]string{
+		"GOOS":   runtime.GOOS,
+		"GOARCH": runtime.GOARCH,
+	}
+	if buildInfo, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range buildInfo.Settings {
+			buildSettings[setting.Key] = setting.Value
+		}
+	}
+	return buildSettings
+}
@@ -0,0 +1,208 @@
+// Capture and replay of metrics buffers.
+
+package vmi_internal
+
+// The metrics buffers queued by the generators may be captured into a file
+// (-capture-file) which can be replayed later (-replay-file) into the
+// compressor/endpoint pipeline, e.g. for load testing VictoriaMetrics with
+// realistic data. In replay mode no generators are run; the recorded buffers
+// are queued at a multiplier of their original timing (-replay-speed) and the
+// importer exits after the file was fully replayed and the metrics delivered.
+//
+// The capture file is a sequence of records, each consisting of a header line:
+//
+//	#vmi-capture UNIX_NANO_TS LEN
+//
+// followed by LEN bytes of metrics, in Prometheus exposition text format.
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	CAPTURE_RECORD_HEADER_PREFIX = "#vmi-capture"
+)
+
+// Mockable for testing:
+var captureTimeNowFn = time.Now
+
+type CaptureWriter struct {
+	f   *os.File
+	out *bufio.Writer
+	mu  *sync.Mutex
+}
+
+func NewCaptureWriter(path string) (*CaptureWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("NewCaptureWriter: %v", err)
+	}
+	return &CaptureWriter{
+		f:   f,
+		out: bufio.NewWriter(f),
+		mu:  &sync.Mutex{},
+	}, nil
+}
+
+func (cw *CaptureWriter) WriteRecord(ts time.Time, b []byte) error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.out == nil {
+		return fmt.Errorf("%s: capture file closed", cw.f.Name())
+	}
+	_, err := fmt.Fprintf(cw.out, "%s %d %d\n", CAPTURE_RECORD_HEADER_PREFIX, ts.UnixNano(), len(b))
+	if err == nil {
+		_, err = cw.out.Write(b)
+	}
+	return err
+}
+
+// It is safe to call it multiple times:
+func (cw *CaptureWriter) Close() error {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.out == nil {
+		return nil
+	}
+	err := cw.out.Flush()
+	cw.out = nil
+	if closeErr := cw.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// A metrics queue which records the buffers before passing them to the
+// underlying queue:
+type CaptureMetricsQueue struct {
+	BufferQueue
+	cw *CaptureWriter
+	// Log the 1st write error only; the queue is used concurrently by the
+	// generators:
+	errLogged atomic.Bool
+}
+
+func NewCaptureMetricsQueue(metricsQueue BufferQueue, path string) (*CaptureMetricsQueue, error) {
+	cw, err := NewCaptureWriter(path)
+	if err != nil {
+		return nil, fmt.Errorf("NewCaptureMetricsQueue: %v", err)
+	}
+	return &CaptureMetricsQueue{
+		BufferQueue: metricsQueue,
+		cw:          cw,
+	}, nil
+}
+
+func (cq *CaptureMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	cq.QueueBufFor(METRICS_GENERATOR_UNKNOWN_ID, buf)
+}
+
+func (cq *CaptureMetricsQueue) QueueBufFor(genId string, buf *bytes.Buffer) {
+	if buf.Len() > 0 {
+		if err := cq.cw.WriteRecord(captureTimeNowFn(), buf.Bytes()); err != nil && cq.errLogged.CompareAndSwap(false, true) {
+			runnerLog.Errorf("capture: %v", err)
+		}
+	}
+	QueueBufFor(cq.BufferQueue, genId, buf)
+}
+
+func (cq *CaptureMetricsQueue) Close() error {
+	return cq.cw.Close()
+}
+
+type CaptureReader struct {
+	path string
+	in   *bufio.Reader
+}
+
+func NewCaptureReader(in io.Reader, path string) *CaptureReader {
+	return &CaptureReader{
+		path: path,
+		in:   bufio.NewReader(in),
+	}
+}
+
+// Read the next record, return io.EOF at the end of the file:
+func (cr *CaptureReader) ReadRecord() (time.Time, []byte, error) {
+	header, err := cr.in.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && header != "" {
+			err = fmt.Errorf("%s: truncated header %q", cr.path, header)
+		}
+		return time.Time{}, nil, err
+	}
+	var (
+		prefix string
+		tsNano int64
+		n      int
+	)
+	_, err = fmt.Sscanf(header, "%s %d %d\n", &prefix, &tsNano, &n)
+	if err != nil || prefix != CAPTURE_RECORD_HEADER_PREFIX || n < 0 {
+		return time.Time{}, nil, fmt.Errorf("%s: invalid header %q", cr.path, header)
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(cr.in, b); err != nil {
+		return time.Time{}, nil, fmt.Errorf("%s: truncated record: %v", cr.path, err)
+	}
+	return time.Unix(0, tsNano), b, nil
+}
+
+// Replay the capture file into the metrics queue. The speed is the multiplier
+// of the original timing, e.g. 2 replays twice as fast; use 0 to replay w/o any
+// delay. Return the number of replayed records.
+func ReplayCaptureFile(path string, speed float64, metricsQueue BufferQueue) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	cr := NewCaptureReader(f, path)
+	numRecords := 0
+	var firstTs, startTs time.Time
+	for {
+		ts, b, err := cr.ReadRecord()
+		if err == io.EOF {
+			return numRecords, nil
+		}
+		if err != nil {
+			return numRecords, err
+		}
+		if numRecords == 0 {
+			firstTs, startTs = ts, time.Now()
+		} else if speed > 0 {
+			// Keep the pace relative to the start, rather than to the
+			// previous record, to avoid the accumulation of sleep errors:
+			offset := time.Duration(float64(ts.Sub(firstTs)) / speed)
+			if pause := time.Until(startTs.Add(offset)); pause > 0 {
+				time.Sleep(pause)
+			}
+		}
+		buf := metricsQueue.GetBuf()
+		buf.Write(b)
+		metricsQueue.QueueBuf(buf)
+		numRecords++
+	}
+}
+
+// Replay mode: the compressor pools, if any, are drained afterwards and the
+// return value indicates whether there were no errors.
+func RunReplay(path string, speed float64, compressorPools []*CompressorPool) bool {
+	runnerLog.Infof("replay: file=%q, speed=%v", path, speed)
+	start := time.Now()
+	numRecords, err := ReplayCaptureFile(path, speed, MetricsQueue)
+	runnerLog.Infof("replay: %d record(s) in %s", numRecords, time.Since(start))
+	success := true
+	if err != nil {
+		runnerLog.Errorf("replay: %v", err)
+		success = false
+	}
+	return drainCompressorPools(compressorPools, "replay") && success
+}
@@ -0,0 +1,133 @@
+// Tests for capture_replay.go
+
+package vmi_internal
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestCaptureReplay(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	numRecords, numLines := 3, 4
+	recordInterval, speed := 100*time.Millisecond, 2.
+	captureFile := path.Join(t.TempDir(), "capture.txt")
+
+	// Capture:
+	ts := time.UnixMilli(1746121347582)
+	savedCaptureTimeNowFn := captureTimeNowFn
+	captureTimeNowFn = func() time.Time { return ts }
+	defer func() { captureTimeNowFn = savedCaptureTimeNowFn }()
+
+	testMetricsQueue := vmi_testutils.NewTestMetricsQueue(0)
+	captureMetricsQueue, err := NewCaptureMetricsQueue(testMetricsQueue, captureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantLineMap := make(map[string]int)
+	for i := 0; i < numRecords; i++ {
+		buf := captureMetricsQueue.GetBuf()
+		for j := 0; j < numLines; j++ {
+			line := fmt.Sprintf(`vmi_test_metric{rec="%d",line="%d"} %d %d`, i, j, i*numLines+j, ts.UnixMilli())
+			buf.WriteString(line + "\n")
+			wantLineMap[line] += 1
+		}
+		captureMetricsQueue.QueueBuf(buf)
+		ts = ts.Add(recordInterval)
+	}
+	if err = captureMetricsQueue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The capture should be transparent:
+	if got := len(testMetricsQueue.GetMetrics()); got != numRecords*numLines {
+		t.Fatalf("captured queue: len(metrics): want: %d, got: %d", numRecords*numLines, got)
+	}
+
+	// Replay:
+	poolCfg := DefaultCompressorPoolConfig()
+	poolCfg.NumCompressors = 1
+	pool, err := NewCompressorPool(poolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+	start := time.Now()
+	gotNumRecords, err := ReplayCaptureFile(captureFile, speed, pool)
+	elapsed := time.Since(start)
+	pool.Shutdown()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotNumRecords != numRecords {
+		t.Fatalf("numRecords: want: %d, got: %d", numRecords, gotNumRecords)
+	}
+
+	// The timing should be scaled by speed:
+	wantElapsed := time.Duration(float64(time.Duration(numRecords-1)*recordInterval) / speed)
+	maxElapsed := time.Duration(numRecords-1) * recordInterval
+	if elapsed < wantElapsed || maxElapsed <= elapsed {
+		t.Fatalf("elapsed: want: %s..%s, got: %s", wantElapsed, maxElapsed, elapsed)
+	}
+
+	gotLineMap := sender.MapLines()
+	for line, wantCount := range wantLineMap {
+		if gotCount := gotLineMap[line]; gotCount != wantCount {
+			t.Errorf("%q: count: want: %d, got: %d", line, wantCount, gotCount)
+		}
+	}
+	if len(gotLineMap) != len(wantLineMap) {
+		t.Errorf("len(lines): want: %d, got: %d", len(wantLineMap), len(gotLineMap))
+	}
+}
+
+func TestCaptureMetricsQueueConcurrentErrors(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	numGoroutines, numBufs := 8, 16
+	poolCfg := DefaultCompressorPoolConfig()
+	poolCfg.NumCompressors = 1
+	pool, err := NewCompressorPool(poolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+	captureMetricsQueue, err := NewCaptureMetricsQueue(pool, path.Join(t.TempDir(), "capture.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// All the subsequent writes will fail, the errors should be handled
+	// concurrently (run w/ -race) and the buffers still passed through:
+	if err = captureMetricsQueue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg := &sync.WaitGroup{}
+	for i := 0; i < numGoroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < numBufs; j++ {
+				buf := captureMetricsQueue.GetBuf()
+				fmt.Fprintf(buf, "vmi_test_metric{g=\"%d\",b=\"%d\"} 1\n", i, j)
+				captureMetricsQueue.QueueBuf(buf)
+			}
+		}()
+	}
+	wg.Wait()
+	pool.Shutdown()
+	if !captureMetricsQueue.errLogged.Load() {
+		t.Error("errLogged: want: true, got: false")
+	}
+	if got := len(sender.MapLines()); got != numGoroutines*numBufs {
+		t.Fatalf("len(lines): want: %d, got: %d", numGoroutines*numBufs, got)
+	}
+}
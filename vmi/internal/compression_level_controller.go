@@ -0,0 +1,158 @@
+// Adaptive compression level based on CPU headroom.
+
+package vmi_internal
+
+// On CPU-constrained hosts a high compression level steals cycles from
+// generators, whereas on idle hosts a higher compression saves bandwidth. The
+// controller below periodically samples the process %CPU and it lowers the
+// compression level when the latter is above a high watermark or raises it
+// when below a low watermark, within configured min/max boundaries. The level
+// changes by 1 step at a time, to avoid oscillations.
+
+import (
+	"compress/gzip"
+	"fmt"
+	"time"
+)
+
+const (
+	COMPRESSION_LEVEL_ADAPTIVE_CONFIG_ENABLED_DEFAULT        = false
+	COMPRESSION_LEVEL_ADAPTIVE_CONFIG_MIN_LEVEL_DEFAULT      = gzip.BestSpeed
+	COMPRESSION_LEVEL_ADAPTIVE_CONFIG_MAX_LEVEL_DEFAULT      = gzip.BestCompression
+	COMPRESSION_LEVEL_ADAPTIVE_CONFIG_HIGH_PCPU_DEFAULT      = 50.
+	COMPRESSION_LEVEL_ADAPTIVE_CONFIG_LOW_PCPU_DEFAULT       = 10.
+	COMPRESSION_LEVEL_ADAPTIVE_CONFIG_CHECK_INTERVAL_DEFAULT = 10 * time.Second
+
+	// The level used as the starting point if the configured one is
+	// gzip.DefaultCompression:
+	COMPRESSION_LEVEL_ADAPTIVE_DEFAULT_COMPRESSION_EQUIV = 6
+)
+
+type CompressionLevelAdaptiveConfig struct {
+	// Whether the adaptive mode is enabled or not:
+	Enabled bool `yaml:"enabled"`
+	// The range for the compression level, min..max, each 1..9:
+	MinLevel int `yaml:"min_level"`
+	MaxLevel int `yaml:"max_level"`
+	// The process %CPU watermarks; the level is lowered when the %CPU >= high
+	// and it is raised when %CPU <= low:
+	HighPcpu float64 `yaml:"high_pcpu"`
+	LowPcpu  float64 `yaml:"low_pcpu"`
+	// How often to sample the %CPU and adjust the level:
+	CheckInterval time.Duration `yaml:"check_interval"`
+}
+
+func DefaultCompressionLevelAdaptiveConfig() *CompressionLevelAdaptiveConfig {
+	return &CompressionLevelAdaptiveConfig{
+		Enabled:       COMPRESSION_LEVEL_ADAPTIVE_CONFIG_ENABLED_DEFAULT,
+		MinLevel:      COMPRESSION_LEVEL_ADAPTIVE_CONFIG_MIN_LEVEL_DEFAULT,
+		MaxLevel:      COMPRESSION_LEVEL_ADAPTIVE_CONFIG_MAX_LEVEL_DEFAULT,
+		HighPcpu:      COMPRESSION_LEVEL_ADAPTIVE_CONFIG_HIGH_PCPU_DEFAULT,
+		LowPcpu:       COMPRESSION_LEVEL_ADAPTIVE_CONFIG_LOW_PCPU_DEFAULT,
+		CheckInterval: COMPRESSION_LEVEL_ADAPTIVE_CONFIG_CHECK_INTERVAL_DEFAULT,
+	}
+}
+
+type CompressionLevelController struct {
+	minLevel, maxLevel int
+	highPcpu, lowPcpu  float64
+	checkInterval      time.Duration
+	// The current level:
+	level int
+	// The previous CPU time sample, for %CPU calculation; a negative value
+	// indicates that there is no valid previous sample:
+	prevCpuTime float64
+	prevTs      time.Time
+	// Sampling functions, they may be overridden for testing:
+	cpuTimeFunc func() (float64, error)
+	timeNowFunc func() time.Time
+}
+
+func NewCompressionLevelController(
+	cfg *CompressionLevelAdaptiveConfig,
+	initialLevel int,
+) (*CompressionLevelController, error) {
+	if cfg == nil {
+		cfg = DefaultCompressionLevelAdaptiveConfig()
+	}
+
+	if cfg.MinLevel < gzip.BestSpeed || cfg.MinLevel > gzip.BestCompression ||
+		cfg.MaxLevel < gzip.BestSpeed || cfg.MaxLevel > gzip.BestCompression ||
+		cfg.MinLevel > cfg.MaxLevel {
+		return nil, fmt.Errorf(
+			"NewCompressionLevelController: invalid min_level..max_level %d..%d, want %d <= min_level <= max_level <= %d",
+			cfg.MinLevel, cfg.MaxLevel, gzip.BestSpeed, gzip.BestCompression,
+		)
+	}
+	if cfg.LowPcpu >= cfg.HighPcpu {
+		return nil, fmt.Errorf(
+			"NewCompressionLevelController: invalid low_pcpu/high_pcpu %.1f/%.1f, want low_pcpu < high_pcpu",
+			cfg.LowPcpu, cfg.HighPcpu,
+		)
+	}
+	if cfg.CheckInterval <= 0 {
+		return nil, fmt.Errorf(
+			"NewCompressionLevelController: invalid check_interval %s, want > 0",
+			cfg.CheckInterval,
+		)
+	}
+
+	if initialLevel == gzip.DefaultCompression {
+		initialLevel = COMPRESSION_LEVEL_ADAPTIVE_DEFAULT_COMPRESSION_EQUIV
+	}
+	if initialLevel < cfg.MinLevel {
+		initialLevel = cfg.MinLevel
+	}
+	if initialLevel > cfg.MaxLevel {
+		initialLevel = cfg.MaxLevel
+	}
+
+	return &CompressionLevelController{
+		minLevel:      cfg.MinLevel,
+		maxLevel:      cfg.MaxLevel,
+		highPcpu:      cfg.HighPcpu,
+		lowPcpu:       cfg.LowPcpu,
+		checkInterval: cfg.CheckInterval,
+		level:         initialLevel,
+		prevCpuTime:   -1,
+		cpuTimeFunc:   GetMyCpuTime,
+		timeNowFunc:   time.Now,
+	}, nil
+}
+
+// Update the level based on a %CPU reading and return the new value:
+func (ctl *CompressionLevelController) Update(pcpu float64) int {
+	if pcpu >= ctl.highPcpu && ctl.level > ctl.minLevel {
+		ctl.level--
+	} else if pcpu <= ctl.lowPcpu && ctl.level < ctl.maxLevel {
+		ctl.level++
+	}
+	return ctl.level
+}
+
+// Sample the process CPU time and update the level accordingly. Return the
+// new level and whether it was updated or not; the latter can be false if
+// this is the 1st sample or if the CPU time cannot be retrieved.
+func (ctl *CompressionLevelController) Sample() (int, bool) {
+	cpuTime, err := ctl.cpuTimeFunc()
+	ts := ctl.timeNowFunc()
+	if err != nil {
+		compressorLog.Warnf("adaptive_level: GetMyCpuTime(): %v", err)
+		ctl.prevCpuTime = -1
+		return ctl.level, false
+	}
+	prevCpuTime, prevTs := ctl.prevCpuTime, ctl.prevTs
+	ctl.prevCpuTime, ctl.prevTs = cpuTime, ts
+	if prevCpuTime < 0 {
+		return ctl.level, false
+	}
+	dTime := ts.Sub(prevTs).Seconds()
+	if dTime <= 0 {
+		return ctl.level, false
+	}
+	return ctl.Update((cpuTime - prevCpuTime) / dTime * 100), true
+}
+
+func (ctl *CompressionLevelController) GetLevel() int {
+	return ctl.level
+}
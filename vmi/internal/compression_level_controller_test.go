@@ -0,0 +1,123 @@
+// Tests for compression_level_controller.go
+
+package vmi_internal
+
+import (
+	"compress/gzip"
+	"fmt"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+type CompressionLevelControllerTestCase struct {
+	name         string
+	cfg          *CompressionLevelAdaptiveConfig
+	initialLevel int
+	// Synthetic %CPU readings and the expected level after each:
+	pcpuList      []float64
+	wantLevelList []int
+	wantErr       bool
+}
+
+func testCompressionLevelController(tc *CompressionLevelControllerTestCase, t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	ctl, err := NewCompressionLevelController(tc.cfg, tc.initialLevel)
+	if tc.wantErr {
+		if err == nil {
+			t.Fatal("want error, got nil")
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drive the controller via Sample(), w/ CPU time and timestamp matching
+	// the desired %CPU readings, 1 sec apart:
+	cpuTime, ts := 0., time.Now()
+	ctl.cpuTimeFunc = func() (float64, error) { return cpuTime, nil }
+	ctl.timeNowFunc = func() time.Time { return ts }
+	if _, updated := ctl.Sample(); updated {
+		t.Fatal("1st sample: want updated: false, got: true")
+	}
+
+	minLevel, maxLevel := ctl.minLevel, ctl.maxLevel
+	for i, pcpu := range tc.pcpuList {
+		cpuTime += pcpu / 100
+		ts = ts.Add(time.Second)
+		gotLevel, updated := ctl.Sample()
+		if !updated {
+			t.Fatalf("sample# %d: want updated: true, got: false", i)
+		}
+		if gotLevel < minLevel || gotLevel > maxLevel {
+			t.Fatalf("sample# %d: level %d out of bounds %d..%d", i, gotLevel, minLevel, maxLevel)
+		}
+		if gotLevel != tc.wantLevelList[i] {
+			t.Fatalf("sample# %d (pcpu=%.1f): level: want: %d, got: %d", i, pcpu, tc.wantLevelList[i], gotLevel)
+		}
+	}
+}
+
+func TestCompressionLevelController(t *testing.T) {
+	for _, tc := range []*CompressionLevelControllerTestCase{
+		{
+			name: "high_cpu",
+			cfg: &CompressionLevelAdaptiveConfig{
+				MinLevel: 2, MaxLevel: 7, HighPcpu: 50, LowPcpu: 10, CheckInterval: time.Second,
+			},
+			initialLevel:  5,
+			pcpuList:      []float64{60, 70, 80, 90, 95},
+			wantLevelList: []int{4, 3, 2, 2, 2},
+		},
+		{
+			name: "idle",
+			cfg: &CompressionLevelAdaptiveConfig{
+				MinLevel: 2, MaxLevel: 7, HighPcpu: 50, LowPcpu: 10, CheckInterval: time.Second,
+			},
+			initialLevel:  5,
+			pcpuList:      []float64{1, 2, 3, 4, 5},
+			wantLevelList: []int{6, 7, 7, 7, 7},
+		},
+		{
+			name: "mixed",
+			cfg: &CompressionLevelAdaptiveConfig{
+				MinLevel: 1, MaxLevel: 9, HighPcpu: 50, LowPcpu: 10, CheckInterval: time.Second,
+			},
+			initialLevel:  gzip.DefaultCompression,
+			pcpuList:      []float64{30, 60, 30, 5, 5, 55, 9},
+			wantLevelList: []int{6, 5, 5, 6, 7, 6, 7},
+		},
+		{
+			name: "initial_clamped",
+			cfg: &CompressionLevelAdaptiveConfig{
+				MinLevel: 3, MaxLevel: 4, HighPcpu: 50, LowPcpu: 10, CheckInterval: time.Second,
+			},
+			initialLevel:  9,
+			pcpuList:      []float64{30, 5, 75, 75},
+			wantLevelList: []int{4, 4, 3, 3},
+		},
+		{
+			name: "invalid_levels",
+			cfg: &CompressionLevelAdaptiveConfig{
+				MinLevel: 7, MaxLevel: 2, HighPcpu: 50, LowPcpu: 10, CheckInterval: time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid_pcpu",
+			cfg: &CompressionLevelAdaptiveConfig{
+				MinLevel: 1, MaxLevel: 9, HighPcpu: 10, LowPcpu: 10, CheckInterval: time.Second,
+			},
+			wantErr: true,
+		},
+	} {
+		t.Run(
+			fmt.Sprintf("%s/initialLevel=%d", tc.name, tc.initialLevel),
+			func(t *testing.T) { testCompressionLevelController(tc, t) },
+		)
+	}
+}
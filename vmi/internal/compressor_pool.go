@@ -5,18 +5,23 @@ import (
 	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/docker/go-units"
+	"github.com/klauspost/compress/snappy"
 )
 
 // The compressor pool consists of the following:
 //  - a metrics channel into which metrics generators write buffers
-//  - N compressors that read from the channel and gzip compress the buffers
-//    until they either reach a target size or a flush interval lapses. At that
-//    point the compressed buffer is sent out to import endpoints.
+//  - N compressors that read from the channel and compress the buffers, w/
+//    gzip or snappy (framed format), until they either reach a target size or
+//    a flush interval lapses. At that point the compressed buffer is sent out
+//    to import endpoints.
 //
 // The batch size cannot be assessed accurately because some of it is in the
 // compression buffer, which is not exposed. However it can be estimated based
@@ -25,6 +30,10 @@ import (
 // CF is updated at batch end, using exponential decay alpha:
 //   CF = (1 - alpha) * batchCF + alpha * CF, alpha = (0..1)
 // where batchCF = (number of read bytes)/size(batch)
+//
+// Alternatively the batch target size may be expressed in uncompressed bytes,
+// in which case the batch is sent out as soon as the number of bytes read
+// reaches the target, w/o any CF estimation.
 
 var compressorLog = NewCompLogger("compressor")
 
@@ -35,9 +44,102 @@ const (
 	COMPRESSOR_POOL_CONFIG_BUFFER_POOL_MAX_SIZE_DEFAULT = 64
 	COMPRESSOR_POOL_CONFIG_METRICS_QUEUE_SIZE_DEFAULT   = 64
 	COMPRESSOR_POOL_CONFIG_BATCH_TARGET_SIZE_DEFAULT    = "64k"
+	COMPRESSOR_POOL_CONFIG_BATCH_TARGET_MODE_DEFAULT    = COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED
 	COMPRESSOR_POOL_CONFIG_FLUSH_INTERVAL_DEFAULT       = 5 * time.Second
+	COMPRESSOR_POOL_CONFIG_CODEC_DEFAULT                = COMPRESSOR_POOL_CODEC_GZIP
+	COMPRESSOR_POOL_CONFIG_OUTPUT_FORMAT_DEFAULT        = COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION
+)
+
+// The compression codecs; they double as the content encoding of the batches
+// passed to the sender:
+const (
+	COMPRESSOR_POOL_CODEC_GZIP   = HTTP_CONTENT_ENCODING_GZIP
+	COMPRESSOR_POOL_CODEC_SNAPPY = HTTP_CONTENT_ENCODING_SNAPPY
+	// Implied by the remote write output format, see remote_write.go:
+	COMPRESSOR_POOL_CODEC_REMOTE_WRITE = HTTP_CONTENT_ENCODING_REMOTE_WRITE
+)
+
+// The output formats:
+const (
+	// Prometheus exposition text format, compressed w/ the codec:
+	COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION = "exposition"
+	// Prometheus remote write, see remote_write.go:
+	COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE = "remote_write"
+)
+
+// How batch_target_size is interpreted:
+const (
+	COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED   = "compressed"
+	COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED = "uncompressed"
+)
+
+// The generators fill the buffers up to the target size (see GetTargetSize),
+// overshooting by a few lines, before queuing them, so the buffers are
+// pre-sized accordingly, w/ some slack, to avoid their repeated growth. The
+// initial capacity is capped to limit the memory held by the buffer pool for
+// large targets:
+const (
+	COMPRESSOR_POOL_BUF_INITIAL_CAP_SLACK_FACTOR = 1.125
+	COMPRESSOR_POOL_BUF_INITIAL_CAP_MAX          = 1 << 20
 )
 
+func compressorPoolBufInitialCap(batchTargetSize int) int {
+	initialCap := int(float64(batchTargetSize) * COMPRESSOR_POOL_BUF_INITIAL_CAP_SLACK_FACTOR)
+	if initialCap > COMPRESSOR_POOL_BUF_INITIAL_CAP_MAX {
+		initialCap = COMPRESSOR_POOL_BUF_INITIAL_CAP_MAX
+	}
+	return initialCap
+}
+
+// A compressor exiting unexpectedly, i.e. not via Shutdown, is restarted
+// after a backoff, doubled for every consecutive restart. The backoff is reset
+// if the compressor ran for at least the max backoff:
+const (
+	COMPRESSOR_RESTART_BACKOFF_MIN = 100 * time.Millisecond
+	COMPRESSOR_RESTART_BACKOFF_MAX = 10 * time.Second
+)
+
+// The gzip writer factory; it may be replaced for testing:
+var compressorNewGzipWriter = gzip.NewWriterLevel
+
+// The batch writer, common to all codecs:
+type compressorWriter interface {
+	Write(p []byte) (int, error)
+	Close() error
+	Reset(w io.Writer)
+}
+
+// The gzip header written for every batch. It is fixed, i.e. no name, comment
+// or modification time and OS 0, such that identical input yields identical
+// compressed output, e.g. for golden file testing of the wire format:
+var compressorGzipHeader = gzip.Header{}
+
+// The gzip batch writer; N.B. gzip.Writer.Reset discards the header, so it has
+// to be restored:
+type compressorGzipWriter struct {
+	*gzip.Writer
+}
+
+func (gzWriter compressorGzipWriter) Reset(w io.Writer) {
+	gzWriter.Writer.Reset(w)
+	gzWriter.Header = compressorGzipHeader
+}
+
+func newCompressorWriter(codec string, w io.Writer, level int) (compressorWriter, error) {
+	switch codec {
+	case COMPRESSOR_POOL_CODEC_SNAPPY:
+		return snappy.NewBufferedWriter(w), nil
+	case COMPRESSOR_POOL_CODEC_REMOTE_WRITE:
+		return newRemoteWriteWriter(w), nil
+	}
+	gzWriter, err := compressorNewGzipWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	gzWriter.Header = compressorGzipHeader
+	return compressorGzipWriter{gzWriter}, nil
+}
+
 const (
 	INITIAL_COMPRESSION_FACTOR         = 2.
 	COMPRESSION_FACTOR_EXP_DECAY_ALPHA = 0.8
@@ -86,26 +188,80 @@ const (
 type CompressorStats struct {
 	Uint64Stats  []uint64
 	Float64Stats []float64
+	// Batch fill stats: the number of flushed batches and their cumulative
+	// size, in the units of the target, i.e. compressed or uncompressed bytes,
+	// based on batch_target_mode. They are used for the average fill ratio, so
+	// they are populated with the target size at snap time:
+	BatchCount      uint64
+	BatchByteCount  uint64
+	BatchTargetSize int
+	// The uncompressed byte count the current batch is read up to before
+	// being flushed, derived from the batch target size and the estimated
+	// compression factor; 0 until the first batch is flushed:
+	BatchReadByteLimit int
+	// The cumulative CPU time, in seconds, available only where the OS
+	// supports per thread CPU time, see THREAD_CPU_TIME_SUPPORTED:
+	CpuTime float64
+	// The cumulative wall time, in seconds, spent writing into and closing
+	// the compressor writer:
+	CompressTime float64
+	// The cumulative number of restarts following unexpected exits:
+	RestartCount uint64
 }
 
 type CompressorPoolStats map[string]*CompressorStats
 
+// The max age of the metrics, from the time they were queued to the time they
+// are picked up by a compressor, after which they are considered stale and
+// dropped rather than sent. Use 0 for no limit. This is set from
+// vmi_config.max_metric_age and it is applied to the pools created
+// afterwards.
+var MaxMetricAge time.Duration
+
+// The metrics queue entry; the buffer is tagged w/ its source and generation
+// time:
+type compressorQueueEntry struct {
+	buf   *bytes.Buffer
+	genId string
+	// Set only if there is a max metric age:
+	ts time.Time
+}
+
 type CompressorPool struct {
-	// The number of compressors:
+	// The number of compressors and how many of them are actually running, the
+	// latter maintained by the compressor loops themselves:
 	numCompressors int
+	activeCount    atomic.Int32
 	// The buffer pool for queued metrics:
 	bufPool *ReadFileBufPool
 	// The metrics channel (queue):
-	metricsQueue chan *bytes.Buffer
-	// The compression level:
+	metricsQueue chan compressorQueueEntry
+	// Guard the queue against closing while buffers are being queued: the
+	// queueing holds the read lock and the shutdown holds the write lock
+	// while closing. A buffer queued after the close, e.g. by a generator
+	// racing the shutdown, is dropped rather than causing a panic:
+	queueClosed bool
+	queueMu     *sync.RWMutex
+	// The max metric age, see MaxMetricAge:
+	maxMetricAge time.Duration
+	// The compression codec:
+	codec string
+	// The compression level, gzip only:
 	compressionLevel int
 	// Compressed batch target size; when the compressed data becomes greater
 	// than the latter, the batch is sent out:
 	batchTargetSize int
+	// Whether the batch target size is in uncompressed bytes, in which case
+	// the batch is sent out when the read bytes reach the target:
+	batchTargetUncompressed bool
 	// How long to wait before sending out a partially filled batch, to avoid
 	// staleness. A timer is set with the value below when the batch starts and
 	// if it fires before the target size is reached then the batch is sent out.
 	flushInterval time.Duration
+	// Adaptive compression level controller, nil if disabled:
+	levelCtl *CompressionLevelController
+	// Signal the adaptive compression level loop to stop:
+	stopLevelCtl chan struct{}
 	// State:
 	state CompressorPoolState
 	// Stats:
@@ -130,16 +286,32 @@ type CompressorPoolConfig struct {
 	// Metrics queue size, it should be deep enough to accommodate metrics up to
 	// send_buffer_timeout:
 	MetricsQueueSize int `yaml:"metrics_queue_size"`
-	// Compression level: 0..9:
+	// Compression codec: "gzip" (default) or "snappy" (framed format). The
+	// latter is much faster, at the expense of a lower compression factor:
+	Codec string `yaml:"codec"`
+	// Compression level: 0..9, gzip only:
 	CompressionLevel int `yaml:"compression_level"`
 	// Batch target size; metrics will be read from the queue until the
 	// compressed size is ~ to the value below. The value can have the usual `k`
 	// or `m` suffixes for KiB or MiB accordingly.
 	BatchTargetSize string `yaml:"batch_target_size"`
+	// How to interpret the batch target size: "compressed" (default), based on
+	// the estimated compression factor, or "uncompressed", based on the number
+	// of bytes read from the queue:
+	BatchTargetMode string `yaml:"batch_target_mode"`
 	// Flush interval. If batch_target_size is not reached before this interval
 	// expires, the metrics compressed thus far are being sent anyway. Use 0 to
 	// disable time flush.
 	FlushInterval time.Duration `yaml:"flush_interval"`
+	// Adaptive compression level, adjusted based on the process %CPU:
+	AdaptiveLevel *CompressionLevelAdaptiveConfig `yaml:"adaptive_level"`
+	// Output format: "exposition" (default) or "remote_write", for Prometheus
+	// remote write protobuf, snappy compressed. The latter implies the codec,
+	// therefore codec, compression_level and adaptive_level are ignored, and
+	// it requires remote write endpoints, e.g. http://HOST:8428/api/v1/write.
+	// The metrics should be encoded w/ the remote_write encoding, i.e. as
+	// protobuf WriteRequest messages; the runner takes care of that.
+	OutputFormat string `yaml:"output_format"`
 }
 
 func DefaultCompressorPoolConfig() *CompressorPoolConfig {
@@ -147,9 +319,13 @@ func DefaultCompressorPoolConfig() *CompressorPoolConfig {
 		NumCompressors:    COMPRESSOR_POOL_CONFIG_NUM_COMPRESSORS_DEFAULT,
 		BufferPoolMaxSize: COMPRESSOR_POOL_CONFIG_BUFFER_POOL_MAX_SIZE_DEFAULT,
 		MetricsQueueSize:  COMPRESSOR_POOL_CONFIG_METRICS_QUEUE_SIZE_DEFAULT,
+		Codec:             COMPRESSOR_POOL_CONFIG_CODEC_DEFAULT,
 		CompressionLevel:  COMPRESSOR_POOL_CONFIG_COMPRESSION_LEVEL_DEFAULT,
 		BatchTargetSize:   COMPRESSOR_POOL_CONFIG_BATCH_TARGET_SIZE_DEFAULT,
+		BatchTargetMode:   COMPRESSOR_POOL_CONFIG_BATCH_TARGET_MODE_DEFAULT,
 		FlushInterval:     COMPRESSOR_POOL_CONFIG_FLUSH_INTERVAL_DEFAULT,
+		AdaptiveLevel:     DefaultCompressionLevelAdaptiveConfig(),
+		OutputFormat:      COMPRESSOR_POOL_CONFIG_OUTPUT_FORMAT_DEFAULT,
 	}
 }
 
@@ -158,9 +334,39 @@ func NewCompressorPool(poolCfg *CompressorPoolConfig) (*CompressorPool, error) {
 		poolCfg = DefaultCompressorPoolConfig()
 	}
 
+	codec := poolCfg.Codec
+	switch codec {
+	case "":
+		codec = COMPRESSOR_POOL_CONFIG_CODEC_DEFAULT
+	case COMPRESSOR_POOL_CODEC_GZIP, COMPRESSOR_POOL_CODEC_SNAPPY:
+	default:
+		return nil, fmt.Errorf(
+			"NewCompressorPool: invalid codec %q, want: %q or %q",
+			poolCfg.Codec, COMPRESSOR_POOL_CODEC_GZIP, COMPRESSOR_POOL_CODEC_SNAPPY,
+		)
+	}
+
+	outputFormat := poolCfg.OutputFormat
+	switch outputFormat {
+	case "":
+		outputFormat = COMPRESSOR_POOL_CONFIG_OUTPUT_FORMAT_DEFAULT
+	case COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION:
+	case COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE:
+		if poolCfg.Codec != "" && poolCfg.Codec != COMPRESSOR_POOL_CONFIG_CODEC_DEFAULT {
+			compressorLog.Warnf("output_format=%s: codec=%s ignored", outputFormat, poolCfg.Codec)
+		}
+		codec = COMPRESSOR_POOL_CODEC_REMOTE_WRITE
+	default:
+		return nil, fmt.Errorf(
+			"NewCompressorPool: invalid output_format %q, want: %q or %q",
+			poolCfg.OutputFormat,
+			COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION, COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE,
+		)
+	}
+
 	// Create a dummy compressor to verify the compression level:
 	_, err := gzip.NewWriterLevel(nil, poolCfg.CompressionLevel)
-	if err != nil {
+	if codec == COMPRESSOR_POOL_CODEC_GZIP && err != nil {
 		return nil, fmt.Errorf("NewCompressorPool: %v", err)
 	}
 
@@ -172,6 +378,20 @@ func NewCompressorPool(poolCfg *CompressorPoolConfig) (*CompressorPool, error) {
 		)
 	}
 
+	var batchTargetUncompressed bool
+	switch poolCfg.BatchTargetMode {
+	case COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED, "":
+		batchTargetUncompressed = false
+	case COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED:
+		batchTargetUncompressed = true
+	default:
+		return nil, fmt.Errorf(
+			"NewCompressorPool: invalid batch_target_mode %q, want: %q or %q",
+			poolCfg.BatchTargetMode,
+			COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED, COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED,
+		)
+	}
+
 	numCompressors := poolCfg.NumCompressors
 	if numCompressors <= 0 {
 		numCompressors = AvailableCPUCount
@@ -181,24 +401,58 @@ func NewCompressorPool(poolCfg *CompressorPoolConfig) (*CompressorPool, error) {
 	}
 
 	pool := &CompressorPool{
-		numCompressors:   numCompressors,
-		bufPool:          NewBufPool(poolCfg.BufferPoolMaxSize),
-		metricsQueue:     make(chan *bytes.Buffer, poolCfg.MetricsQueueSize),
-		compressionLevel: poolCfg.CompressionLevel,
-		batchTargetSize:  int(batchTargetSize),
-		flushInterval:    poolCfg.FlushInterval,
-		state:            CompressorPoolStateCreated,
-		mu:               &sync.Mutex{},
-		poolStats:        NewCompressorPoolStats(numCompressors),
-		wg:               &sync.WaitGroup{},
+		numCompressors:          numCompressors,
+		bufPool:                 NewBufPoolWithCap(poolCfg.BufferPoolMaxSize, compressorPoolBufInitialCap(int(batchTargetSize))),
+		metricsQueue:            make(chan compressorQueueEntry, poolCfg.MetricsQueueSize),
+		queueMu:                 &sync.RWMutex{},
+		maxMetricAge:            MaxMetricAge,
+		codec:                   codec,
+		compressionLevel:        poolCfg.CompressionLevel,
+		batchTargetSize:         int(batchTargetSize),
+		batchTargetUncompressed: batchTargetUncompressed,
+		flushInterval:           poolCfg.FlushInterval,
+		state:                   CompressorPoolStateCreated,
+		mu:                      &sync.Mutex{},
+		poolStats:               NewCompressorPoolStats(numCompressors),
+		wg:                      &sync.WaitGroup{},
+	}
+
+	if poolCfg.AdaptiveLevel != nil && poolCfg.AdaptiveLevel.Enabled && codec != COMPRESSOR_POOL_CODEC_GZIP {
+		compressorLog.Warnf("codec=%s: adaptive_level applies to gzip only, it will be disabled", codec)
+	} else if poolCfg.AdaptiveLevel != nil && poolCfg.AdaptiveLevel.Enabled {
+		pool.levelCtl, err = NewCompressionLevelController(poolCfg.AdaptiveLevel, pool.compressionLevel)
+		if err != nil {
+			return nil, fmt.Errorf("NewCompressorPool: adaptive_level: %v", err)
+		}
+		pool.compressionLevel = pool.levelCtl.GetLevel()
+		pool.stopLevelCtl = make(chan struct{})
 	}
 
 	compressorLog.Infof("num_compressors=%d", pool.numCompressors)
 	compressorLog.Infof("buffer_pool_max_size=%d", poolCfg.BufferPoolMaxSize)
+	compressorLog.Infof("buffer initial capacity=%d", pool.bufPool.InitialCap())
 	compressorLog.Infof("metrics_queue_size=%d", poolCfg.MetricsQueueSize)
+	compressorLog.Infof("output_format=%s", outputFormat)
+	compressorLog.Infof("codec=%s", pool.codec)
 	compressorLog.Infof("compression_level=%d", pool.compressionLevel)
 	compressorLog.Infof("batch_target_size=%d", pool.batchTargetSize)
+	if pool.batchTargetUncompressed {
+		compressorLog.Infof("batch_target_mode=%s", COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED)
+	} else {
+		compressorLog.Infof("batch_target_mode=%s", COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED)
+	}
 	compressorLog.Infof("flush_interval=%s", pool.flushInterval)
+	compressorLog.Infof("max_metric_age=%s", pool.maxMetricAge)
+	if levelCtl := pool.levelCtl; levelCtl != nil {
+		compressorLog.Infof("adaptive_level.enabled=%v", true)
+		compressorLog.Infof("adaptive_level.min_level=%d", levelCtl.minLevel)
+		compressorLog.Infof("adaptive_level.max_level=%d", levelCtl.maxLevel)
+		compressorLog.Infof("adaptive_level.high_pcpu=%.1f", levelCtl.highPcpu)
+		compressorLog.Infof("adaptive_level.low_pcpu=%.1f", levelCtl.lowPcpu)
+		compressorLog.Infof("adaptive_level.check_interval=%s", levelCtl.checkInterval)
+	} else {
+		compressorLog.Infof("adaptive_level.enabled=%v", false)
+	}
 
 	return pool, nil
 }
@@ -222,7 +476,12 @@ func (pool *CompressorPool) Start(sender Sender) {
 
 	for compressorIndx := 0; compressorIndx < pool.numCompressors; compressorIndx++ {
 		pool.wg.Add(1)
-		go pool.loop(compressorIndx, sender)
+		go pool.supervise(compressorIndx, sender)
+	}
+
+	if pool.levelCtl != nil {
+		pool.wg.Add(1)
+		go pool.levelCtlLoop()
 	}
 }
 
@@ -242,7 +501,15 @@ func (pool *CompressorPool) Shutdown() {
 		compressorLog.Warn("closing compressor pool queue")
 	}
 
+	// N.B. The queueing in progress may be blocked waiting for room in the
+	// queue, which is fine since the compressors are still draining it:
+	pool.queueMu.Lock()
+	pool.queueClosed = true
 	close(pool.metricsQueue)
+	pool.queueMu.Unlock()
+	if pool.stopLevelCtl != nil {
+		close(pool.stopLevelCtl)
+	}
 	pool.wg.Wait()
 	compressorLog.Info("all compressors stopped")
 }
@@ -257,25 +524,133 @@ func (pool *CompressorPool) ReturnBuf(buf *bytes.Buffer) {
 }
 
 func (pool *CompressorPool) QueueBuf(b *bytes.Buffer) {
-	pool.metricsQueue <- b
+	pool.QueueBufFor(METRICS_GENERATOR_UNKNOWN_ID, b)
+}
+
+// Satisfy GenIdBufferQueue interface, such that the stale metrics can be
+// attributed to their generator:
+func (pool *CompressorPool) QueueBufFor(genId string, b *bytes.Buffer) {
+	pool.queueMu.RLock()
+	defer pool.queueMu.RUnlock()
+	if pool.queueClosed {
+		// Late buffer, the pool is stopped:
+		n := 0
+		if b != nil {
+			if n = bytes.Count(b.Bytes(), []byte{'\n'}); n > 0 {
+				MetricsGenStats.UpdateDropped(genId, uint64(n))
+			}
+			if pool.bufPool != nil {
+				pool.bufPool.ReturnBuf(b)
+			}
+		}
+		compressorLog.Warnf("%s: queue buffer: compressor pool stopped, %d metrics dropped", genId, n)
+		return
+	}
+	entry := compressorQueueEntry{buf: b, genId: genId}
+	if pool.maxMetricAge > 0 {
+		entry.ts = time.Now()
+	}
+	pool.metricsQueue <- entry
 }
 
 func (pool *CompressorPool) GetTargetSize() int {
 	return pool.batchTargetSize
 }
 
-func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
+// Return the number of buffers in the metrics queue and its capacity:
+func (pool *CompressorPool) GetQueueDepth() (int, int) {
+	return len(pool.metricsQueue), cap(pool.metricsQueue)
+}
+
+// Return the current compression level and whether it is adaptive or not:
+func (pool *CompressorPool) GetCompressionLevel() (int, bool) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return pool.compressionLevel, pool.levelCtl != nil
+}
+
+// Return the number of compressors currently running and the configured one:
+func (pool *CompressorPool) GetActiveCount() (int, int) {
+	return int(pool.activeCount.Load()), pool.numCompressors
+}
+
+// Periodically adjust the compression level based on the process %CPU:
+func (pool *CompressorPool) levelCtlLoop() {
+	defer func() {
+		compressorLog.Info("adaptive compression level loop stopped")
+		pool.wg.Done()
+	}()
+
+	levelCtl := pool.levelCtl
+	ticker := time.NewTicker(levelCtl.checkInterval)
+	defer ticker.Stop()
+
+	// Prime the CPU time:
+	levelCtl.Sample()
+	compressorLog.Info("start adaptive compression level loop")
+	for {
+		select {
+		case <-pool.stopLevelCtl:
+			return
+		case <-ticker.C:
+			if level, updated := levelCtl.Sample(); updated {
+				pool.mu.Lock()
+				prevLevel := pool.compressionLevel
+				pool.compressionLevel = level
+				pool.mu.Unlock()
+				if level != prevLevel {
+					compressorLog.Infof("compression_level: %d -> %d", prevLevel, level)
+				}
+			}
+		}
+	}
+}
+
+// Run the compressor loop, restarting it, w/ backoff, if it exits
+// unexpectedly, such that a transient failure doesn't permanently reduce the
+// throughput:
+func (pool *CompressorPool) supervise(compressorIndx int, sender Sender) {
+	defer pool.wg.Done()
+
+	var stats *CompressorStats
+	if pool.poolStats != nil {
+		stats = pool.poolStats[strconv.Itoa(compressorIndx)]
+	}
+	backoff := COMPRESSOR_RESTART_BACKOFF_MIN
+	for {
+		startTs := time.Now()
+		if pool.loop(compressorIndx, sender) {
+			return
+		}
+		if time.Since(startTs) >= COMPRESSOR_RESTART_BACKOFF_MAX {
+			backoff = COMPRESSOR_RESTART_BACKOFF_MIN
+		}
+		compressorLog.Warnf("compressor %d exited unexpectedly, restart in %s", compressorIndx, backoff)
+		time.Sleep(backoff)
+		backoff = min(2*backoff, COMPRESSOR_RESTART_BACKOFF_MAX)
+		if stats != nil {
+			pool.mu.Lock()
+			stats.RestartCount += 1
+			pool.mu.Unlock()
+		}
+	}
+}
+
+// The compressor loop proper. Return true if it exited normally, i.e. the
+// metrics queue was closed, or false otherwise.
+func (pool *CompressorPool) loop(compressorIndx int, sender Sender) bool {
 	var (
-		buf      *bytes.Buffer
-		err      error
-		stats    *CompressorStats
-		gzWriter *gzip.Writer
-		sendFn   func([]byte, time.Duration, bool) error
+		buf     *bytes.Buffer
+		err     error
+		stats   *CompressorStats
+		cWriter compressorWriter
+		sendFn  func([]byte, time.Duration, string) error
 	)
 
+	pool.activeCount.Add(1)
 	defer func() {
+		pool.activeCount.Add(-1)
 		compressorLog.Infof("compressor %d stopped", compressorIndx)
-		pool.wg.Done()
 	}()
 
 	if sender != nil {
@@ -283,8 +658,14 @@ func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
 	}
 	bufPool := pool.bufPool
 	MetricsQueue := pool.metricsQueue
+	maxMetricAge := pool.maxMetricAge
+	codec := pool.codec
+	pool.mu.Lock()
 	compressionLevel := pool.compressionLevel
+	pool.mu.Unlock()
+	adaptiveLevel := pool.levelCtl != nil
 	batchTargetSize := pool.batchTargetSize
+	batchTargetUncompressed := pool.batchTargetUncompressed
 	flushInterval := pool.flushInterval
 	mu := pool.mu
 	if pool.poolStats != nil {
@@ -292,38 +673,91 @@ func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
 	}
 	alpha := COMPRESSION_FACTOR_EXP_DECAY_ALPHA
 
+	// The CPU time is available per OS thread, therefore the compressor is
+	// locked to one, such that the thread CPU time is attributable to it:
+	trackCpuTime, cpuTime0, cpuTimeOffset := THREAD_CPU_TIME_SUPPORTED && stats != nil, 0., 0.
+	if trackCpuTime {
+		// Account for the previous runs, if restarted:
+		mu.Lock()
+		cpuTimeOffset = stats.CpuTime
+		mu.Unlock()
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		if cpuTime0, err = GetThreadCpuTime(); err != nil {
+			compressorLog.Warnf("compressor %d: GetThreadCpuTime(): %v, CPU time disabled", compressorIndx, err)
+			trackCpuTime = false
+		}
+	}
+
 	// Initialize a stopped timer:
 	flushTimer := time.NewTimer(time.Hour)
 	if !flushTimer.Stop() {
 		<-flushTimer.C
 	}
 
-	gzipped, estimatedCF := true, INITIAL_COMPRESSION_FACTOR
-	if compressionLevel == gzip.NoCompression {
+	estimatedCF := INITIAL_COMPRESSION_FACTOR
+	if codec == COMPRESSOR_POOL_CODEC_GZIP && compressionLevel == gzip.NoCompression {
 		estimatedCF = 1.
 	}
 
-	gzBuf := &bytes.Buffer{}
+	batchBuf := &bytes.Buffer{}
 
 	batchReadCount, batchReadByteCount, batchTimeoutCount, doSend, timerSet := 0, 0, 0, false, false
+	// The time spent compressing the current batch:
+	batchCompressTime := time.Duration(0)
 	batchReadByteLimit := int(float64(batchTargetSize) * estimatedCF)
+	if batchTargetUncompressed {
+		batchReadByteLimit = batchTargetSize
+	}
 	compressorLog.Infof("start compressor %d", compressorIndx)
+	var entry compressorQueueEntry
 	for isOpen := true; isOpen; {
 		select {
-		case buf, isOpen = <-MetricsQueue:
+		case entry, isOpen = <-MetricsQueue:
+			buf = entry.buf
+			if buf != nil && maxMetricAge > 0 && time.Since(entry.ts) > maxMetricAge {
+				// Better to drop than to send misleadingly old data:
+				if n := bytes.Count(buf.Bytes(), []byte{'\n'}); n > 0 {
+					MetricsGenStats.UpdateStaleDropped(entry.genId, uint64(n))
+				}
+				if bufPool != nil {
+					bufPool.ReturnBuf(buf)
+				}
+				buf = nil
+			}
 			if buf != nil && buf.Len() > 0 {
 				if batchReadCount == 0 {
 					// First read of the batch:
-					gzBuf.Reset()
-					// Create a gzWriter if none exists or repurpose the existent one:
-					if gzWriter == nil {
-						gzWriter, err = gzip.NewWriterLevel(gzBuf, compressionLevel)
+					batchBuf.Reset()
+					// Pick up the latest compression level, if adaptive; the
+					// compressor will have to be recreated if it changed:
+					if adaptiveLevel {
+						mu.Lock()
+						level := pool.compressionLevel
+						mu.Unlock()
+						if level != compressionLevel {
+							compressionLevel, cWriter = level, nil
+						}
+					}
+					// Create a writer if none exists or repurpose the existent one:
+					if cWriter == nil {
+						cWriter, err = newCompressorWriter(codec, batchBuf, compressionLevel)
 						if err != nil {
 							compressorLog.Warnf("compressor %d: %v", compressorIndx, err)
-							return
+							// The buffer cannot be compressed:
+							if n := bytes.Count(buf.Bytes(), []byte{'\n'}); n > 0 {
+								MetricsGenStats.UpdateDropped(entry.genId, uint64(n))
+							}
+							if bufPool != nil {
+								bufPool.ReturnBuf(buf)
+							}
+							if timerSet && !flushTimer.Stop() {
+								<-flushTimer.C
+							}
+							return false
 						}
 					} else {
-						gzWriter.Reset(gzBuf)
+						cWriter.Reset(batchBuf)
 					}
 					// Reset the flush timer:
 					if flushInterval > 0 {
@@ -333,7 +767,9 @@ func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
 				}
 				batchReadCount += 1
 				batchReadByteCount += buf.Len()
-				_, err := gzWriter.Write(buf.Bytes())
+				compressStart := time.Now()
+				_, err := cWriter.Write(buf.Bytes())
+				batchCompressTime += time.Since(compressStart)
 				if bufPool != nil {
 					bufPool.ReturnBuf(buf)
 				}
@@ -345,8 +781,9 @@ func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
 						<-flushTimer.C
 					}
 					batchReadCount, batchReadByteCount, batchTimeoutCount, doSend, timerSet = 0, 0, 0, false, false
+					batchCompressTime = 0
 					// Force the recreation of the compressor:
-					gzWriter = nil
+					cWriter = nil
 					if stats != nil {
 						mu.Lock()
 						stats.Uint64Stats[COMPRESSOR_STATS_WRITE_ERROR_COUNT] += 1
@@ -364,24 +801,37 @@ func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
 			if timerSet && !flushTimer.Stop() {
 				<-flushTimer.C
 			}
-			gzWriter.Close()
-			batchSentCount, batchSentByteCount, batchSentErrCount := 1, gzBuf.Len(), 0
+			compressStart := time.Now()
+			cWriter.Close()
+			batchCompressTime += time.Since(compressStart)
+			batchSentCount, batchSentByteCount, batchSentErrCount := 1, batchBuf.Len(), 0
 			if batchSentByteCount >= COMPRESSED_BATCH_MIN_SIZE_FOR_CF {
 				batchCF := float64(batchReadByteCount) / float64(batchSentByteCount)
 				estimatedCF = (1-alpha)*batchCF + alpha*estimatedCF
-				batchReadByteLimit = int(float64(batchTargetSize) * estimatedCF)
+				if !batchTargetUncompressed {
+					batchReadByteLimit = int(float64(batchTargetSize) * estimatedCF)
+				}
 			}
 
-			if sendFn != nil {
-				err = sendFn(gzBuf.Bytes(), -1, gzipped)
+			if sendFn != nil && IsActive() {
+				err = sendFn(batchBuf.Bytes(), -1, codec)
 				if err != nil {
 					compressorLog.Warnf("compressor %d: %v, batch discarded", compressorIndx, err)
 					batchSentByteCount, batchSentErrCount = 0, 1
 				}
 			} else {
+				// No sender or standby (see active.go), the batch is discarded:
 				batchSentCount, batchSentByteCount = 0, 0
 			}
 
+			cpuTime := -1.
+			if trackCpuTime {
+				if cpuTime, err = GetThreadCpuTime(); err != nil {
+					compressorLog.Warnf("compressor %d: GetThreadCpuTime(): %v, CPU time disabled", compressorIndx, err)
+					trackCpuTime, cpuTime = false, -1
+				}
+			}
+
 			if stats != nil {
 				mu.Lock()
 				stats.Uint64Stats[COMPRESSOR_STATS_READ_COUNT] += uint64(batchReadCount)
@@ -391,12 +841,25 @@ func (pool *CompressorPool) loop(compressorIndx int, sender Sender) {
 				stats.Uint64Stats[COMPRESSOR_STATS_TIMEOUT_FLUSH_COUNT] += uint64(batchTimeoutCount)
 				stats.Uint64Stats[COMPRESSOR_STATS_SEND_ERROR_COUNT] += uint64(batchSentErrCount)
 				stats.Float64Stats[COMPRESSOR_STATS_COMPRESSION_FACTOR] = estimatedCF
+				stats.BatchReadByteLimit = batchReadByteLimit
+				stats.BatchCount += 1
+				if batchTargetUncompressed {
+					stats.BatchByteCount += uint64(batchReadByteCount)
+				} else {
+					stats.BatchByteCount += uint64(batchBuf.Len())
+				}
+				if cpuTime >= 0 {
+					stats.CpuTime = cpuTimeOffset + cpuTime - cpuTime0
+				}
+				stats.CompressTime += batchCompressTime.Seconds()
 				mu.Unlock()
 			}
 
 			batchReadCount, batchReadByteCount, batchTimeoutCount, doSend, timerSet = 0, 0, 0, false, false
+			batchCompressTime = 0
 		}
 	}
+	return true
 }
 
 func NewCompressorStats() *CompressorStats {
@@ -425,10 +888,22 @@ func (pool *CompressorPool) SnapStats(to CompressorPoolStats) CompressorPoolStat
 	if to == nil {
 		to = NewCompressorPoolStats(pool.numCompressors)
 	}
+	for compressorId := range to {
+		if _, ok := poolStats[compressorId]; !ok {
+			delete(to, compressorId)
+		}
+	}
 	for compressorId, compressorStats := range poolStats {
 		toCompressorStats := to[compressorId]
 		copy(toCompressorStats.Uint64Stats, compressorStats.Uint64Stats)
 		copy(toCompressorStats.Float64Stats, compressorStats.Float64Stats)
+		toCompressorStats.BatchCount = compressorStats.BatchCount
+		toCompressorStats.BatchByteCount = compressorStats.BatchByteCount
+		toCompressorStats.BatchTargetSize = pool.batchTargetSize
+		toCompressorStats.BatchReadByteLimit = compressorStats.BatchReadByteLimit
+		toCompressorStats.CpuTime = compressorStats.CpuTime
+		toCompressorStats.CompressTime = compressorStats.CompressTime
+		toCompressorStats.RestartCount = compressorStats.RestartCount
 	}
 	return to
 }
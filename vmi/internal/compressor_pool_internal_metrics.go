@@ -36,26 +36,53 @@ type CompressorPoolInternalMetrics struct {
 	// and the stats index:
 	uint64DeltaMetricsCache map[string]compressorPoolStatsIndexMetricMap
 	float64MetricsCache     map[string]compressorPoolStatsIndexMetricMap
+	// Cache for the batch fill ratio metric, indexed by the compressorId:
+	batchFillRatioMetricsCache map[string][]byte
+	// Cache for the read byte limit metric, indexed by the compressorId:
+	readByteLimitMetricsCache map[string][]byte
+	// Cache for the CPU time metric, indexed by the compressorId:
+	cpuSecondsMetricsCache map[string][]byte
+	// Cache for the compress time metric, indexed by the compressorId:
+	compressSecondsMetricsCache map[string][]byte
+	// Cache for the restart metric, indexed by the compressorId:
+	restartTotalMetricsCache map[string][]byte
+	// Stale cache eviction:
+	cacheAging *metricsCacheAging
+	// The current compression level, published only if adaptive:
+	compressionLevel       int
+	adaptiveLevel          bool
+	compressionLevelMetric []byte
+	// The number of compressors currently running, published only if the
+	// configured number is known, i.e. it was snapped:
+	activeCount, numCompressors int
+	activeCountMetric           []byte
 }
 
 func NewCompressorPoolInternalMetrics(internalMetrics *InternalMetrics) *CompressorPoolInternalMetrics {
 	return &CompressorPoolInternalMetrics{
-		internalMetrics:         internalMetrics,
-		uint64DeltaMetricsCache: make(map[string]compressorPoolStatsIndexMetricMap),
-		float64MetricsCache:     make(map[string]compressorPoolStatsIndexMetricMap),
+		internalMetrics:             internalMetrics,
+		uint64DeltaMetricsCache:     make(map[string]compressorPoolStatsIndexMetricMap),
+		float64MetricsCache:         make(map[string]compressorPoolStatsIndexMetricMap),
+		batchFillRatioMetricsCache:  make(map[string][]byte),
+		readByteLimitMetricsCache:   make(map[string][]byte),
+		cpuSecondsMetricsCache:      make(map[string][]byte),
+		compressSecondsMetricsCache: make(map[string][]byte),
+		restartTotalMetricsCache:    make(map[string][]byte),
+		cacheAging:                  newMetricsCacheAging(internalMetrics.staleCacheEvictIntervals),
 	}
 }
 
 func (cpim *CompressorPoolInternalMetrics) updateMetricsCache(compressorId string) {
 	instance, hostname := cpim.internalMetrics.Instance, cpim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := cpim.internalMetrics.InstanceLabelName, cpim.internalMetrics.HostnameLabelName
 
 	indexMetricMap := make(compressorPoolStatsIndexMetricMap)
 	for index, name := range compressorStatsUint64DeltaMetricsNameMap {
 		metric := fmt.Sprintf(
 			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 			COMPRESSOR_ID_LABEL_NAME, compressorId,
 		)
 		indexMetricMap[index] = []byte(metric)
@@ -66,14 +93,62 @@ func (cpim *CompressorPoolInternalMetrics) updateMetricsCache(compressorId strin
 	for index, name := range compressorStatsFloat64MetricsNameMap {
 		metric := fmt.Sprintf(
 			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 			COMPRESSOR_ID_LABEL_NAME, compressorId,
 		)
 		indexMetricMap[index] = []byte(metric)
 	}
 	cpim.float64MetricsCache[compressorId] = indexMetricMap
+
+	cpim.batchFillRatioMetricsCache[compressorId] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(COMPRESSOR_STATS_BATCH_FILL_RATIO_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		COMPRESSOR_ID_LABEL_NAME, compressorId,
+	))
+
+	cpim.readByteLimitMetricsCache[compressorId] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(COMPRESSOR_STATS_READ_BYTE_LIMIT_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		COMPRESSOR_ID_LABEL_NAME, compressorId,
+	))
+
+	cpim.cpuSecondsMetricsCache[compressorId] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(COMPRESSOR_STATS_CPU_SECONDS_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		COMPRESSOR_ID_LABEL_NAME, compressorId,
+	))
+
+	cpim.compressSecondsMetricsCache[compressorId] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(COMPRESSOR_STATS_COMPRESS_SECONDS_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		COMPRESSOR_ID_LABEL_NAME, compressorId,
+	))
+
+	cpim.restartTotalMetricsCache[compressorId] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(COMPRESSOR_STATS_RESTART_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		COMPRESSOR_ID_LABEL_NAME, compressorId,
+	))
+}
+
+func (cpim *CompressorPoolInternalMetrics) SnapCompressionLevel() {
+	cpim.compressionLevel, cpim.adaptiveLevel = compressorPool.GetCompressionLevel()
+}
+
+func (cpim *CompressorPoolInternalMetrics) SnapActiveCount() {
+	cpim.activeCount, cpim.numCompressors = compressorPool.GetActiveCount()
 }
 
 func (cpim *CompressorPoolInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix []byte) (int, int, *bytes.Buffer) {
@@ -102,7 +177,7 @@ func (cpim *CompressorPoolInternalMetrics) generateMetrics(buf *bytes.Buffer, ts
 		for index, metric := range uint64IndexMetricMap {
 			val := currCompressorStats.Uint64Stats[index]
 			if prevCompressorStats != nil {
-				val -= prevCompressorStats.Uint64Stats[index]
+				val = uint64Delta(val, prevCompressorStats.Uint64Stats[index])
 			}
 			buf.Write(metric)
 			buf.WriteString(strconv.FormatUint(val, 10))
@@ -112,18 +187,111 @@ func (cpim *CompressorPoolInternalMetrics) generateMetrics(buf *bytes.Buffer, ts
 		for index, metric := range cpim.float64MetricsCache[compressorId] {
 			val := currCompressorStats.Float64Stats[index]
 			buf.Write(metric)
-			buf.WriteString(strconv.FormatFloat(val, 'f', 3, 64))
+			WriteFloatValue(buf, val, 3)
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+		// The average fill ratio, available only if there were batches
+		// flushed during the interval:
+		if batchTargetSize := currCompressorStats.BatchTargetSize; batchTargetSize > 0 {
+			batchCount, batchByteCount := currCompressorStats.BatchCount, currCompressorStats.BatchByteCount
+			if prevCompressorStats != nil {
+				batchCount = uint64Delta(batchCount, prevCompressorStats.BatchCount)
+				batchByteCount = uint64Delta(batchByteCount, prevCompressorStats.BatchByteCount)
+			}
+			if batchCount > 0 {
+				buf.Write(cpim.batchFillRatioMetricsCache[compressorId])
+				WriteFloatValue(
+					buf,
+					float64(batchByteCount)/float64(batchCount)/float64(batchTargetSize),
+					COMPRESSOR_STATS_BATCH_FILL_RATIO_METRIC_PRECISION,
+				)
+				buf.Write(tsSuffix)
+				metricsCount++
+			}
+		}
+		// The read byte limit, available only after the 1st batch was flushed:
+		if readByteLimit := currCompressorStats.BatchReadByteLimit; readByteLimit > 0 {
+			buf.Write(cpim.readByteLimitMetricsCache[compressorId])
+			buf.WriteString(strconv.Itoa(readByteLimit))
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+		// The CPU time, available only if supported by the OS:
+		if cpuTime := currCompressorStats.CpuTime; cpuTime > 0 {
+			buf.Write(cpim.cpuSecondsMetricsCache[compressorId])
+			WriteFloatValue(buf, cpuTime, COMPRESSOR_STATS_CPU_SECONDS_TOTAL_METRIC_PRECISION)
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+		// The compress time, available only after the 1st batch was flushed:
+		if compressTime := currCompressorStats.CompressTime; compressTime > 0 {
+			buf.Write(cpim.compressSecondsMetricsCache[compressorId])
+			WriteFloatValue(buf, compressTime, COMPRESSOR_STATS_COMPRESS_SECONDS_TOTAL_METRIC_PRECISION)
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+		// The restarts, published only if there were any:
+		if restartCount := currCompressorStats.RestartCount; restartCount > 0 {
+			buf.Write(cpim.restartTotalMetricsCache[compressorId])
+			buf.WriteString(strconv.FormatUint(restartCount, 10))
 			buf.Write(tsSuffix)
 			metricsCount++
 		}
 
 		if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 			partialByteCount += n
-			mq.QueueBuf(buf)
+			QueueBufFor(mq, cpim.internalMetrics.Id, buf)
 			buf = nil
 		}
 	}
 
+	// Evict the cache for compressors no longer present:
+	for _, compressorId := range evictStaleMetricsCache(cpim.cacheAging, cpim.uint64DeltaMetricsCache, currStats) {
+		delete(cpim.float64MetricsCache, compressorId)
+		delete(cpim.batchFillRatioMetricsCache, compressorId)
+		delete(cpim.readByteLimitMetricsCache, compressorId)
+		delete(cpim.cpuSecondsMetricsCache, compressorId)
+		delete(cpim.compressSecondsMetricsCache, compressorId)
+		delete(cpim.restartTotalMetricsCache, compressorId)
+	}
+
+	if cpim.adaptiveLevel {
+		if buf == nil {
+			buf = mq.GetBuf()
+		}
+		if cpim.compressionLevelMetric == nil {
+			cpim.compressionLevelMetric = []byte(fmt.Sprintf(
+				`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+				RenameMetric(COMPRESSOR_POOL_COMPRESSION_LEVEL_METRIC),
+				cpim.internalMetrics.InstanceLabelName, cpim.internalMetrics.Instance,
+				cpim.internalMetrics.HostnameLabelName, cpim.internalMetrics.Hostname,
+			))
+		}
+		buf.Write(cpim.compressionLevelMetric)
+		buf.WriteString(strconv.Itoa(cpim.compressionLevel))
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+
+	if cpim.numCompressors > 0 {
+		if buf == nil {
+			buf = mq.GetBuf()
+		}
+		if cpim.activeCountMetric == nil {
+			cpim.activeCountMetric = []byte(fmt.Sprintf(
+				`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+				RenameMetric(COMPRESSOR_POOL_ACTIVE_COUNT_METRIC),
+				cpim.internalMetrics.InstanceLabelName, cpim.internalMetrics.Instance,
+				cpim.internalMetrics.HostnameLabelName, cpim.internalMetrics.Hostname,
+			))
+		}
+		buf.Write(cpim.activeCountMetric)
+		buf.WriteString(strconv.Itoa(cpim.activeCount))
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+
 	// Flip the stats storage:
 	cpim.currIndex = 1 - cpim.currIndex
 
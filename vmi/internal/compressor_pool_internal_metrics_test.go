@@ -103,3 +103,84 @@ func TestCompressorPoolInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestCompressorPoolInternalMetricsBatchFillRatio(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	compressorId, batchTargetSize := "0", 65536
+	tc := &CompressorPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+		CurrStats: NewCompressorPoolStats(1),
+		PrevStats: NewCompressorPoolStats(1),
+	}
+	// 4 batches of 48k each during the interval, i.e. 0.75 of the target:
+	prevStats, currStats := tc.PrevStats[compressorId], tc.CurrStats[compressorId]
+	prevStats.BatchCount, prevStats.BatchByteCount, prevStats.BatchTargetSize = 2, 100000, batchTargetSize
+	currStats.BatchCount, currStats.BatchByteCount, currStats.BatchTargetSize = 6, 100000+4*49152, batchTargetSize
+	internalMetrics, err := newTestCompressorPoolInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.compressorPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} 0.750 %d`,
+		COMPRESSOR_STATS_BATCH_FILL_RATIO_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		COMPRESSOR_ID_LABEL_NAME, compressorId,
+		tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestCompressorPoolInternalMetricsActiveCount(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	tc := &CompressorPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+	}
+	internalMetrics, err := newTestCompressorPoolInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1 out of 4 compressors is waiting to be restarted:
+	compressorPoolInternalMetrics := internalMetrics.compressorPoolMetrics
+	compressorPoolInternalMetrics.activeCount, compressorPoolInternalMetrics.numCompressors = 3, 4
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := compressorPoolInternalMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} 3 %d`,
+		COMPRESSOR_POOL_ACTIVE_COUNT_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
@@ -0,0 +1,105 @@
+// Swappable compressor pool, for reconfiguring w/o losing in-flight data.
+
+package vmi_internal
+
+// The compressor pool settings (level, batch size, etc) are fixed at creation
+// time. Rather than tearing down and rebuilding the pool, which would drop the
+// in-flight data, a new pool is stood up w/ the new settings as a warm
+// standby, the generators are redirected to it and the old one is drained
+// and retired.
+//
+// The generators write into a SwappableCompressorPool, used as MetricsQueue,
+// which forwards to the current pool. The swap is guarded by a RW lock such
+// that the old pool is shutdown only after all QueueBuf calls in progress
+// have completed, therefore no buffer is sent into a closed queue.
+//
+// N.B. A buffer may be pulled from the old pool and queued into the new one;
+// that's fine since the buffers are not tied to a specific pool.
+
+import (
+	"bytes"
+	"sync"
+)
+
+type SwappableCompressorPool struct {
+	// The current pool:
+	pool *CompressorPool
+	// The sender used for starting the new pools:
+	sender Sender
+	// Serialize swaps:
+	swapMu *sync.Mutex
+	// Protect the current pool:
+	mu *sync.RWMutex
+}
+
+func NewSwappableCompressorPool(pool *CompressorPool, sender Sender) *SwappableCompressorPool {
+	return &SwappableCompressorPool{
+		pool:   pool,
+		sender: sender,
+		swapMu: &sync.Mutex{},
+		mu:     &sync.RWMutex{},
+	}
+}
+
+// Return the current pool:
+func (sp *SwappableCompressorPool) Pool() *CompressorPool {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	return sp.pool
+}
+
+// Create and start a new pool based on the config, redirect the metrics to it
+// and drain and retire the old one. If the new pool cannot be created then the
+// current one remains in effect. Return the new pool.
+func (sp *SwappableCompressorPool) Swap(poolCfg *CompressorPoolConfig) (*CompressorPool, error) {
+	sp.swapMu.Lock()
+	defer sp.swapMu.Unlock()
+
+	newPool, err := NewCompressorPool(poolCfg)
+	if err != nil {
+		return nil, err
+	}
+	newPool.Start(sp.sender)
+
+	sp.mu.Lock()
+	oldPool := sp.pool
+	sp.pool = newPool
+	sp.mu.Unlock()
+
+	compressorLog.Info("compressor pool swapped, drain and retire the old one")
+	// Shutdown closes the queue and waits for the compressors to process
+	// the remaining buffers and send the final batches:
+	oldPool.Shutdown()
+	return newPool, nil
+}
+
+func (sp *SwappableCompressorPool) Shutdown() {
+	sp.Pool().Shutdown()
+}
+
+// Satisfy BufferQueue interface:
+func (sp *SwappableCompressorPool) GetBuf() *bytes.Buffer {
+	return sp.Pool().GetBuf()
+}
+
+func (sp *SwappableCompressorPool) ReturnBuf(buf *bytes.Buffer) {
+	sp.Pool().ReturnBuf(buf)
+}
+
+func (sp *SwappableCompressorPool) QueueBuf(buf *bytes.Buffer) {
+	// Hold the read lock for the duration of the queueing, such that the swap
+	// cannot retire the pool in the meantime:
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	sp.pool.QueueBuf(buf)
+}
+
+func (sp *SwappableCompressorPool) QueueBufFor(genId string, buf *bytes.Buffer) {
+	sp.mu.RLock()
+	defer sp.mu.RUnlock()
+	sp.pool.QueueBufFor(genId, buf)
+}
+
+func (sp *SwappableCompressorPool) GetTargetSize() int {
+	return sp.Pool().GetTargetSize()
+}
@@ -0,0 +1,100 @@
+// Tests for compressor_pool_swap.go
+
+package vmi_internal
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestSwappableCompressorPool(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	poolCfg := DefaultCompressorPoolConfig()
+	poolCfg.NumCompressors = 2
+	poolCfg.BatchTargetSize = "1k"
+	poolCfg.FlushInterval = time.Second
+	pool, err := NewCompressorPool(poolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+	sp := NewSwappableCompressorPool(pool, sender)
+
+	// Generators writing concurrently w/ the swap:
+	numWriters, numBufsPerWriter, numLinesPerBuf := 4, 50, 10
+	wantLines := make(map[string]int)
+	for w := 0; w < numWriters; w++ {
+		for i := 0; i < numBufsPerWriter; i++ {
+			for k := 0; k < numLinesPerBuf; k++ {
+				wantLines[fmt.Sprintf(`vmi_test_metric{w="%d",i="%d",k="%d"} %d 1746121347582`, w, i, k, k)] = 1
+			}
+		}
+	}
+	start, wg := make(chan struct{}), &sync.WaitGroup{}
+	for w := 0; w < numWriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			<-start
+			for i := 0; i < numBufsPerWriter; i++ {
+				buf := sp.GetBuf()
+				for k := 0; k < numLinesPerBuf; k++ {
+					fmt.Fprintf(buf, `vmi_test_metric{w="%d",i="%d",k="%d"} %d 1746121347582`+"\n", w, i, k, k)
+				}
+				sp.QueueBuf(buf)
+				time.Sleep(time.Millisecond)
+			}
+		}(w)
+	}
+	close(start)
+
+	// Reconfigure the batch size while the writers are running:
+	time.Sleep(10 * time.Millisecond)
+	newPoolCfg := DefaultCompressorPoolConfig()
+	newPoolCfg.NumCompressors = 1
+	newPoolCfg.BatchTargetSize = "4k"
+	newPoolCfg.FlushInterval = time.Second
+	newPool, err := sp.Swap(newPoolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sp.Pool() != newPool {
+		t.Fatalf("Pool(): want: %p, got: %p", newPool, sp.Pool())
+	}
+	if got, want := sp.GetTargetSize(), 4096; got != want {
+		t.Errorf("GetTargetSize(): want: %d, got: %d", want, got)
+	}
+	if pool.state != CompressorPoolStateStopped {
+		t.Errorf("old pool state: want: %s, got: %s", CompressorPoolStateStopped, pool.state)
+	}
+
+	// An invalid config should leave the current pool in effect:
+	invalidPoolCfg := DefaultCompressorPoolConfig()
+	invalidPoolCfg.BatchTargetSize = "invalid"
+	if _, err := sp.Swap(invalidPoolCfg); err == nil {
+		t.Errorf("Swap(invalid): want error, got nil")
+	}
+	if sp.Pool() != newPool {
+		t.Errorf("Pool() after invalid swap: want: %p, got: %p", newPool, sp.Pool())
+	}
+
+	wg.Wait()
+	sp.Shutdown()
+
+	gotLines := sender.MapLines()
+	for line := range wantLines {
+		if gotLines[line] != 1 {
+			t.Errorf("%q: want: 1, got: %d", line, gotLines[line])
+		}
+	}
+	if len(gotLines) != len(wantLines) {
+		t.Errorf("line count: want: %d, got: %d", len(wantLines), len(gotLines))
+	}
+}
@@ -7,10 +7,13 @@ import (
 	"compress/gzip"
 	"fmt"
 	"io"
+	"math"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/snappy"
 	"github.com/sirupsen/logrus"
 
 	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
@@ -20,9 +23,12 @@ type CompressorPoolTestCase struct {
 	// CompressorPoolConfig overrides, they are applied if non nil; they should
 	// be supplied with the expected type for the fields:
 	NumCompressors   any
+	Codec            any
 	CompressLevel    any
 	BatchTargetSize  any
+	BatchTargetMode  any
 	FlushInterval    any
+	OutputFormat     any
 	numQueuedBuffers int
 	wantError        error
 }
@@ -54,9 +60,10 @@ func NewSenderMock() *SenderMock {
 
 }
 
-func (sender *SenderMock) SendBuffer(b []byte, timeout time.Duration, gzipped bool) error {
+func (sender *SenderMock) SendBuffer(b []byte, timeout time.Duration, bufEncoding string) error {
 	var buf []byte
-	if gzipped {
+	switch bufEncoding {
+	case HTTP_CONTENT_ENCODING_GZIP:
 		r, err := gzip.NewReader(bytes.NewBuffer(b))
 		if err != nil {
 			return fmt.Errorf("SenderMock: SendBuffer((%d bytes), ...)): gzip.NewReader: %v", len(b), err)
@@ -66,7 +73,13 @@ func (sender *SenderMock) SendBuffer(b []byte, timeout time.Duration, gzipped bo
 			return fmt.Errorf("SenderMock: SendBuffer((%d bytes), ...)): ReadAll: %v", len(b), err)
 		}
 		r.Close()
-	} else {
+	case HTTP_CONTENT_ENCODING_SNAPPY:
+		var err error
+		buf, err = io.ReadAll(snappy.NewReader(bytes.NewBuffer(b)))
+		if err != nil {
+			return fmt.Errorf("SenderMock: SendBuffer((%d bytes), ...)): snappy ReadAll: %v", len(b), err)
+		}
+	default:
 		buf = make([]byte, len(b))
 		copy(buf, b)
 	}
@@ -105,12 +118,21 @@ func makeTestCompressorPool(tc *CompressorPoolTestCase) (*CompressorPool, error)
 	if batchTargetSize, ok := tc.BatchTargetSize.(string); ok {
 		poolCfg.BatchTargetSize = batchTargetSize
 	}
+	if batchTargetMode, ok := tc.BatchTargetMode.(string); ok {
+		poolCfg.BatchTargetMode = batchTargetMode
+	}
+	if codec, ok := tc.Codec.(string); ok {
+		poolCfg.Codec = codec
+	}
 	if compressLevel, ok := tc.CompressLevel.(int); ok {
 		poolCfg.CompressionLevel = compressLevel
 	}
 	if flushInterval, ok := tc.FlushInterval.(time.Duration); ok {
 		poolCfg.FlushInterval = flushInterval
 	}
+	if outputFormat, ok := tc.OutputFormat.(string); ok {
+		poolCfg.OutputFormat = outputFormat
+	}
 	return NewCompressorPool(poolCfg)
 }
 
@@ -262,6 +284,35 @@ func TestCompressorPoolCreate(t *testing.T) {
 			BatchTargetSize: "13z",
 			wantError:       fmt.Errorf(`NewCompressorPool: invalid batch_target_size "13z": invalid suffix: 'z'`),
 		},
+		{
+			BatchTargetMode: COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED,
+		},
+		{
+			BatchTargetMode: "raw",
+			wantError:       fmt.Errorf(`NewCompressorPool: invalid batch_target_mode "raw", want: "compressed" or "uncompressed"`),
+		},
+		{
+			Codec: COMPRESSOR_POOL_CODEC_SNAPPY,
+		},
+		{
+			Codec:         COMPRESSOR_POOL_CODEC_SNAPPY,
+			CompressLevel: 42,
+		},
+		{
+			Codec:     "lz4",
+			wantError: fmt.Errorf(`NewCompressorPool: invalid codec "lz4", want: "gzip" or "snappy"`),
+		},
+		{
+			OutputFormat: COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE,
+		},
+		{
+			Codec:        COMPRESSOR_POOL_CODEC_SNAPPY,
+			OutputFormat: COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE,
+		},
+		{
+			OutputFormat: "influx",
+			wantError:    fmt.Errorf(`NewCompressorPool: invalid output_format "influx", want: "exposition" or "remote_write"`),
+		},
 	} {
 		t.Run(
 			"",
@@ -300,6 +351,19 @@ func TestCompressorPoolQueue(t *testing.T) {
 			BatchTargetSize:  "1k",
 			numQueuedBuffers: 15 * COMPRESSOR_POOL_MAX_NUM_COMPRESSORS,
 		},
+		{
+			NumCompressors:   1,
+			Codec:            COMPRESSOR_POOL_CODEC_SNAPPY,
+			FlushInterval:    0,
+			numQueuedBuffers: 15,
+		},
+		{
+			NumCompressors:   COMPRESSOR_POOL_MAX_NUM_COMPRESSORS,
+			Codec:            COMPRESSOR_POOL_CODEC_SNAPPY,
+			FlushInterval:    500 * time.Millisecond,
+			BatchTargetSize:  "1k",
+			numQueuedBuffers: 15 * COMPRESSOR_POOL_MAX_NUM_COMPRESSORS,
+		},
 	} {
 		t.Run(
 			"",
@@ -307,3 +371,475 @@ func TestCompressorPoolQueue(t *testing.T) {
 		)
 	}
 }
+
+func TestCompressorPoolUncompressedBatchTarget(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, logrus.DebugLevel)
+	defer tlc.RestoreLog()
+
+	batchTargetSize, bufSize, numQueuedBuffers := 4096, 1000, 20
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors:  1,
+		BatchTargetSize: fmt.Sprintf("%d", batchTargetSize),
+		BatchTargetMode: COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED,
+		FlushInterval:   time.Duration(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+
+	// Highly compressible content, such that a compressed target would have
+	// resulted in much larger batches. N.B. bufSize is a multiple of the line
+	// length.
+	line := "vmi_test_metric 0 0\n"
+	for i := 0; i < numQueuedBuffers; i++ {
+		buf := pool.GetBuf()
+		for buf.Len() < bufSize {
+			buf.WriteString(line)
+		}
+		pool.QueueBuf(buf)
+	}
+	pool.Shutdown()
+
+	// All batches but the last one should be flushed as soon as the raw size
+	// reaches the target:
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	if len(sender.bufs) < 2 {
+		t.Fatalf("len(bufs): want: >= 2, got: %d", len(sender.bufs))
+	}
+	for i, b := range sender.bufs[:len(sender.bufs)-1] {
+		if n := len(b); n < batchTargetSize || n >= batchTargetSize+bufSize {
+			t.Errorf("batch# %d: size: want: %d..%d, got: %d", i, batchTargetSize, batchTargetSize+bufSize, n)
+		}
+	}
+}
+
+func TestCompressorPoolMaxMetricAge(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, logrus.DebugLevel)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats, savedMaxMetricAge := MetricsGenStats, MaxMetricAge
+	defer func() { MetricsGenStats, MaxMetricAge = savedMetricsGenStats, savedMaxMetricAge }()
+	MetricsGenStats, MaxMetricAge = NewMetricsGeneratorStatsContainer(), 100*time.Millisecond
+
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors: 1,
+		FlushInterval:  time.Duration(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a stalled compressor by queueing buffers before the pool is
+	// started; the old ones should exceed the max age by the time the
+	// compressor resumes:
+	genId, numBuffers, numLinesPerBuf := "max_metric_age_test", 3, 4
+	queueBuffers := func(prefix string) {
+		for i := 0; i < numBuffers; i++ {
+			buf := pool.GetBuf()
+			for j := 0; j < numLinesPerBuf; j++ {
+				fmt.Fprintf(buf, "vmi_test_%s{buf=\"%d\",line=\"%d\"} 0 0\n", prefix, i, j)
+			}
+			pool.QueueBufFor(genId, buf)
+		}
+	}
+	queueBuffers("old")
+	time.Sleep(2 * MaxMetricAge)
+	queueBuffers("fresh")
+
+	sender := NewSenderMock()
+	pool.Start(sender)
+	pool.Shutdown()
+
+	gotLineMap := sender.MapLines()
+	for line := range gotLineMap {
+		if !strings.HasPrefix(line, "vmi_test_fresh") {
+			t.Errorf("unexpected line: %q", line)
+		}
+	}
+	if want, got := numBuffers*numLinesPerBuf, len(gotLineMap); want != got {
+		t.Errorf("line count: want: %d, got: %d", want, got)
+	}
+	want, got := uint64(numBuffers*numLinesPerBuf), MetricsGenStats.eventStats[genId][METRICS_GENERATOR_STALE_DROPPED_COUNT]
+	if want != got {
+		t.Errorf("stale dropped count: want: %d, got: %d", want, got)
+	}
+}
+
+// Run a single compressor pool w/ the given gzip level over a large input,
+// return the snapped stats:
+func runTestCompressorPoolLevel(t *testing.T, compressLevel int) CompressorPoolStats {
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors: 1,
+		CompressLevel:  compressLevel,
+		FlushInterval:  time.Duration(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Start(NewSenderMock())
+
+	// Poorly compressible content:
+	for i := 0; i < 2000; i++ {
+		buf := pool.GetBuf()
+		for j := 0; j < 100; j++ {
+			fmt.Fprintf(buf, "vmi_test_metric{i=\"%d\",j=\"%d\"} %d 0\n", i, j, (i*7919+j*104729)%1000003)
+		}
+		pool.QueueBuf(buf)
+	}
+	pool.Shutdown()
+
+	return pool.SnapStats(nil)
+}
+
+func TestCompressorPoolCompressTime(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	noCompressionTime := runTestCompressorPoolLevel(t, gzip.NoCompression)["0"].CompressTime
+	poolStats := runTestCompressorPoolLevel(t, gzip.BestCompression)
+	bestCompressionTime := poolStats["0"].CompressTime
+	if noCompressionTime <= 0 {
+		t.Fatalf("CompressTime(NoCompression): want: > 0, got: %f", noCompressionTime)
+	}
+	if bestCompressionTime <= noCompressionTime {
+		t.Fatalf(
+			"CompressTime(BestCompression): want: > %f (NoCompression), got: %f",
+			noCompressionTime, bestCompressionTime,
+		)
+	}
+
+	internalMetrics, err := newTestCompressorPoolInternalMetrics(&CompressorPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{Instance: "vmi", Hostname: "host"},
+		CurrStats:               poolStats,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.compressorPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf == nil {
+		t.Fatal("no metrics generated")
+	}
+	defer testMetricsQueue.ReturnBuf(buf)
+	wantMetric := fmt.Sprintf(
+		`%s{%s="vmi",%s="host",%s="0"} %.*f `,
+		COMPRESSOR_STATS_COMPRESS_SECONDS_TOTAL_METRIC, INSTANCE_LABEL_NAME, HOSTNAME_LABEL_NAME, COMPRESSOR_ID_LABEL_NAME,
+		COMPRESSOR_STATS_COMPRESS_SECONDS_TOTAL_METRIC_PRECISION, bestCompressionTime,
+	)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, wantMetric) {
+			return
+		}
+	}
+	t.Fatalf("missing %q metric in:\n%s", wantMetric, buf)
+}
+
+func TestCompressorPoolQueueWhileShutdown(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats := MetricsGenStats
+	defer func() { MetricsGenStats = savedMetricsGenStats }()
+	MetricsGenStats = NewMetricsGeneratorStatsContainer()
+
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors: 2,
+		FlushInterval:  time.Duration(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+
+	// The generators keep queueing while the pool is shutdown and a few more
+	// times after, such that there are late buffers for sure:
+	genId, numGenerators, numLinesPerBuf, numLateBuffers := "queue_while_shutdown_test", 4, 3, 5
+	queuedLineCount := make([]int, numGenerators)
+	shutdownDone := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for k := 0; k < numGenerators; k++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i, lateCount := 0, 0; lateCount < numLateBuffers; i++ {
+				select {
+				case <-shutdownDone:
+					lateCount++
+				default:
+				}
+				buf := pool.GetBuf()
+				for j := 0; j < numLinesPerBuf; j++ {
+					fmt.Fprintf(buf, "vmi_test_metric{gen=\"%d\",buf=\"%d\",line=\"%d\"} 0 0\n", k, i, j)
+				}
+				pool.QueueBufFor(genId, buf)
+				queuedLineCount[k] += numLinesPerBuf
+			}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	pool.Shutdown()
+	close(shutdownDone)
+	wg.Wait()
+
+	wantLineCount := 0
+	for _, n := range queuedLineCount {
+		wantLineCount += n
+	}
+	sentLineCount := 0
+	for _, n := range sender.MapLines() {
+		sentLineCount += n
+	}
+	droppedLineCount := int(MetricsGenStats.eventStats[genId][METRICS_GENERATOR_DROPPED_METRICS_COUNT])
+	if wantMinDropped := numGenerators * numLateBuffers * numLinesPerBuf; droppedLineCount < wantMinDropped {
+		t.Errorf("dropped count: want: >= %d, got: %d", wantMinDropped, droppedLineCount)
+	}
+	if gotLineCount := sentLineCount + droppedLineCount; gotLineCount != wantLineCount {
+		t.Errorf(
+			"line count: want: %d, got: %d (sent: %d, dropped: %d)",
+			wantLineCount, gotLineCount, sentLineCount, droppedLineCount,
+		)
+	}
+}
+
+func TestCompressorPoolCpuTime(t *testing.T) {
+	if !THREAD_CPU_TIME_SUPPORTED {
+		t.Skip("per thread CPU time not supported")
+	}
+
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// Heavy compression, using poorly compressible content:
+	poolStats := runTestCompressorPoolLevel(t, gzip.BestCompression)
+	if cpuTime := poolStats["0"].CpuTime; cpuTime <= 0 {
+		t.Fatalf("CpuTime: want: > 0, got: %f", cpuTime)
+	}
+
+	internalMetrics, err := newTestCompressorPoolInternalMetrics(&CompressorPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{Instance: "vmi", Hostname: "host"},
+		CurrStats:               poolStats,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.compressorPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf == nil {
+		t.Fatal("no metrics generated")
+	}
+	wantPrefix := fmt.Sprintf(
+		`%s{%s="vmi",%s="host",%s="0"} `,
+		COMPRESSOR_STATS_CPU_SECONDS_TOTAL_METRIC, INSTANCE_LABEL_NAME, HOSTNAME_LABEL_NAME, COMPRESSOR_ID_LABEL_NAME,
+	)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, wantPrefix) {
+			testMetricsQueue.ReturnBuf(buf)
+			return
+		}
+	}
+	t.Fatalf("missing %s metric in:\n%s", COMPRESSOR_STATS_CPU_SECONDS_TOTAL_METRIC, buf)
+}
+
+func TestCompressorPoolReadByteLimit(t *testing.T) {
+	for _, batchTargetMode := range []string{
+		COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED,
+		COMPRESSOR_POOL_BATCH_TARGET_MODE_UNCOMPRESSED,
+	} {
+		t.Run(batchTargetMode, func(t *testing.T) {
+			testCompressorPoolReadByteLimit(t, batchTargetMode)
+		})
+	}
+}
+
+func testCompressorPoolReadByteLimit(t *testing.T, batchTargetMode string) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	batchTargetSize := 4096
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors:  1,
+		BatchTargetSize: fmt.Sprintf("%d", batchTargetSize),
+		BatchTargetMode: batchTargetMode,
+		FlushInterval:   time.Duration(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Start(NewSenderMock())
+
+	for i := 0; i < 200; i++ {
+		buf := pool.GetBuf()
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(buf, "vmi_test_metric{i=\"%d\",j=\"%d\"} %d 0\n", i, j, i*j)
+		}
+		pool.QueueBuf(buf)
+	}
+	pool.Shutdown()
+
+	poolStats := pool.SnapStats(nil)
+	compressorStats := poolStats["0"]
+	cf := compressorStats.Float64Stats[COMPRESSOR_STATS_COMPRESSION_FACTOR]
+	wantReadByteLimit := float64(batchTargetSize)
+	if batchTargetMode == COMPRESSOR_POOL_BATCH_TARGET_MODE_COMPRESSED {
+		if cf <= 1 {
+			t.Fatalf("compression factor: want: > 1, got: %f", cf)
+		}
+		wantReadByteLimit *= cf
+	}
+	// N.B. The limit is truncated to an integer:
+	if got := compressorStats.BatchReadByteLimit; math.Abs(float64(got)-wantReadByteLimit) > 1 {
+		t.Fatalf(
+			"BatchReadByteLimit: want: %d * %f = %.3f, got: %d",
+			batchTargetSize, cf, wantReadByteLimit, got,
+		)
+	}
+
+	internalMetrics, err := newTestCompressorPoolInternalMetrics(&CompressorPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{Instance: "vmi", Hostname: "host"},
+		CurrStats:               poolStats,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.compressorPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf == nil {
+		t.Fatal("no metrics generated")
+	}
+	defer testMetricsQueue.ReturnBuf(buf)
+	wantMetric := fmt.Sprintf(
+		`%s{%s="vmi",%s="host",%s="0"} %d `,
+		COMPRESSOR_STATS_READ_BYTE_LIMIT_METRIC, INSTANCE_LABEL_NAME, HOSTNAME_LABEL_NAME, COMPRESSOR_ID_LABEL_NAME,
+		compressorStats.BatchReadByteLimit,
+	)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		if strings.HasPrefix(line, wantMetric) {
+			return
+		}
+	}
+	t.Fatalf("missing %q metric in:\n%s", wantMetric, buf)
+}
+
+func TestCompressorPoolRestart(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats, savedNewGzipWriter := MetricsGenStats, compressorNewGzipWriter
+	defer func() { MetricsGenStats, compressorNewGzipWriter = savedMetricsGenStats, savedNewGzipWriter }()
+	MetricsGenStats = NewMetricsGeneratorStatsContainer()
+
+	// Fail the 1st N writer creations, causing the compressor to exit:
+	numFailures := 2
+	compressorNewGzipWriter = func(w io.Writer, level int) (*gzip.Writer, error) {
+		if numFailures > 0 {
+			numFailures--
+			return nil, fmt.Errorf("injected error")
+		}
+		return gzip.NewWriterLevel(w, level)
+	}
+
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors: 1,
+		FlushInterval:  time.Duration(0),
+		// Force one batch per buffer:
+		BatchTargetSize: "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+
+	genId, numBuffers := "restart_test", 5
+	for i := 0; i < numBuffers; i++ {
+		buf := pool.GetBuf()
+		fmt.Fprintf(buf, "vmi_test_metric{buf=\"%d\"} 0 0\n", i)
+		pool.QueueBufFor(genId, buf)
+	}
+	pool.Shutdown()
+
+	// The buffers picked up by the failed compressors are lost, the others
+	// should have been sent by the restarted one:
+	wantLineMap := make(map[string]int)
+	for i := 2; i < numBuffers; i++ {
+		wantLineMap[fmt.Sprintf("vmi_test_metric{buf=\"%d\"} 0 0", i)] = 1
+	}
+	gotLineMap := sender.MapLines()
+	if len(wantLineMap) != len(gotLineMap) {
+		t.Errorf("lines: want: %v, got: %v", wantLineMap, gotLineMap)
+	}
+	for line := range wantLineMap {
+		if gotLineMap[line] != 1 {
+			t.Errorf("line %q: want count: 1, got: %d", line, gotLineMap[line])
+		}
+	}
+	if got := MetricsGenStats.eventStats[genId][METRICS_GENERATOR_DROPPED_METRICS_COUNT]; got != 2 {
+		t.Errorf("dropped count: want: 2, got: %d", got)
+	}
+
+	poolStats := pool.SnapStats(nil)
+	if got := poolStats["0"].RestartCount; got != 2 {
+		t.Errorf("RestartCount: want: 2, got: %d", got)
+	}
+	if got, _ := pool.GetActiveCount(); got != 0 {
+		t.Errorf("active count after shutdown: want: 0, got: %d", got)
+	}
+	internalMetrics, err := newTestCompressorPoolInternalMetrics(&CompressorPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{Instance: "vmi", Hostname: "host"},
+		CurrStats:               poolStats,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, buf := internalMetrics.compressorPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	wantMetric := fmt.Sprintf(
+		`%s{%s="vmi",%s="host",%s="0"} 2 `,
+		COMPRESSOR_STATS_RESTART_TOTAL_METRIC, INSTANCE_LABEL_NAME, HOSTNAME_LABEL_NAME, COMPRESSOR_ID_LABEL_NAME,
+	)
+	if buf == nil || !strings.Contains(buf.String(), wantMetric) {
+		t.Fatalf("missing %q in:\n%v", wantMetric, buf)
+	}
+}
+
+func TestCompressorWriterGzipDeterministic(t *testing.T) {
+	input := []byte("vmi_test_metric{label=\"value\"} 1 1746121347582\n")
+
+	compress := func(cWriter compressorWriter) {
+		if _, err := cWriter.Write(input); err != nil {
+			t.Fatal(err)
+		}
+		if err := cWriter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Compress the same input twice, w/ a new writer and w/ a reset one:
+	firstBuf, secondBuf := &bytes.Buffer{}, &bytes.Buffer{}
+	cWriter, err := newCompressorWriter(COMPRESSOR_POOL_CODEC_GZIP, firstBuf, gzip.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compress(cWriter)
+	cWriter.Reset(secondBuf)
+	compress(cWriter)
+
+	if !bytes.Equal(firstBuf.Bytes(), secondBuf.Bytes()) {
+		t.Fatalf("compressed bytes differ:\n%x\n%x", firstBuf.Bytes(), secondBuf.Bytes())
+	}
+
+	gzReader, err := gzip.NewReader(bytes.NewReader(secondBuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := gzReader.Header
+	if header.Name != "" || header.Comment != "" || !header.ModTime.IsZero() || header.OS != 0 {
+		t.Fatalf(
+			"header: want: Name=%q, Comment=%q, ModTime=%v, OS=0, got: Name=%q, Comment=%q, ModTime=%v, OS=%d",
+			"", "", time.Time{}, header.Name, header.Comment, header.ModTime, header.OS,
+		)
+	}
+}
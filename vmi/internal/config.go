@@ -4,6 +4,8 @@
 //
 //  vmi_config:
 //    instance: vmi
+//    instance_label: vmi_inst
+//    hostname_label: hostname
 //    use_short_hostname: false
 //    shutdown_max_wait: 5s
 //    log_config:
@@ -27,13 +29,23 @@
 // is not defined here. It is expected to be a map of generator names to
 // their specific configurations, which will be used by the importer to
 // instantiate the generators.
+//
+// The file may be in JSON format as well, w/ the same structure and keys,
+// detected based on the extension (.json) or, for other extensions, on the
+// content (a JSON object). Since JSON is a subset of YAML flow style, it is
+// decoded via the same path, which guarantees identical results.
 
 package vmi_internal
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -45,8 +57,39 @@ const (
 	VMI_CONFIG_SECTION_NAME = "vmi_config"
 	GENERATORS_SECTION_NAME = "generators"
 
+	// Config file formats:
+	CONFIG_FORMAT_YAML = "yaml"
+	CONFIG_FORMAT_JSON = "json"
+
 	VMI_CONFIG_USE_SHORT_HOSTNAME_DEFAULT = false
 	VMI_CONFIG_SHUTDOWN_MAX_WAIT_DEFAULT  = 5 * time.Second
+
+	VMI_CONFIG_DETECT_TS_REGRESSION_DEFAULT = false
+
+	VMI_CONFIG_GEN_MAX_LINES_PER_BUFFER_DEFAULT = 0
+
+	VMI_CONFIG_PIPELINE_SUMMARY_INTERVAL_DEFAULT = time.Duration(0) // i.e. disabled
+
+	VMI_CONFIG_TIMESTAMP_OFFSET_DEFAULT = time.Duration(0)
+
+	// Float formats, see strconv.FormatFloat:
+	VMI_CONFIG_FLOAT_FORMAT_FIXED   = "f"
+	VMI_CONFIG_FLOAT_FORMAT_AUTO    = "g"
+	VMI_CONFIG_FLOAT_FORMAT_DEFAULT = VMI_CONFIG_FLOAT_FORMAT_FIXED
+
+	VMI_CONFIG_DROP_NONFINITE_DEFAULT = false
+
+	VMI_CONFIG_STARTUP_SPLAY_DEFAULT = time.Duration(0) // i.e. disabled
+
+	VMI_CONFIG_MAX_METRIC_AGE_DEFAULT = time.Duration(0) // i.e. no limit
+
+	VMI_CONFIG_SELF_METRICS_ADDR_DEFAULT = "" // i.e. disabled
+
+	VMI_CONFIG_HEALTH_PROBE_ADDR_DEFAULT = "" // i.e. disabled
+
+	VMI_CONFIG_PPROF_ADDR_DEFAULT = "" // i.e. disabled
+
+	VMI_CONFIG_MAX_PROCESS_LIFETIME_DEFAULT = time.Duration(0) // i.e. no limit
 )
 
 type VmiConfig struct {
@@ -54,6 +97,11 @@ type VmiConfig struct {
 	// command line arg.
 	Instance string `yaml:"instance"`
 
+	// The names of the instance and hostname labels, common to all metrics,
+	// default "vmi_inst" and "hostname" respectively:
+	InstanceLabel string `yaml:"instance_label"`
+	HostnameLabel string `yaml:"hostname_label"`
+
 	// Whether to use short hostname or not as the value for hostname label.
 	// Typically the hostname is determined from the hostname system call and if
 	// the flag below is in effect, it is stripped of domain part. However if
@@ -65,21 +113,126 @@ type VmiConfig struct {
 	// indefinite wait and 0 stands for no wait at all (exit abruptly).
 	ShutdownMaxWait time.Duration `yaml:"shutdown_max_wait"`
 
+	// Whether to check that the timestamps used by each generator are
+	// increasing. A timestamp older than the previous one will cause the
+	// samples to be rejected by VictoriaMetrics as out-of-order, so
+	// regressions are logged and counted into the
+	// vmi_metrics_ts_regression_delta internal metric.
+	DetectTsRegression bool `yaml:"detect_ts_regression"`
+
+	// Soft limit for the number of metrics lines per buffer, enforced by the
+	// generators' emit helper (GeneratorBase.GenBaseEmit) which queues the
+	// buffer once it reaches the limit, regardless of its size. This keeps
+	// the batches from high cardinality generators bounded in line count. Use
+	// 0 for no limit.
+	GenMaxLinesPerBuffer int `yaml:"generator_max_lines_per_buffer"`
+
+	// How often to log a one-line summary of the pipeline health (send rate,
+	// healthy endpoints, queue depth, compression factor). Use 0 to disable.
+	SummaryLogInterval time.Duration `yaml:"pipeline_summary_interval"`
+
+	// Offset added to the timestamps of all metrics, to compensate for a known
+	// and otherwise uncorrectable clock skew. This is a blunt instrument, to be
+	// used only when the clock cannot be fixed.
+	TimestampOffset time.Duration `yaml:"timestamp_offset"`
+
+	// The format for the float values written via the emit helper
+	// (WriteFloatValue): "f" for fixed notation w/ the precision chosen by the
+	// generator, or "g" for the shortest representation, switching to the
+	// scientific notation for large or small exponents.
+	FloatFormat string `yaml:"float_format"`
+
+	// Whether to drop the NaN/Inf float values written via the emit helper
+	// (GeneratorBase.GenBaseWriteFloatMetric). Such values, which typically
+	// indicate a bug, are counted into the vmi_metrics_nonfinite_delta internal
+	// metric either way.
+	DropNonFinite bool `yaml:"drop_nonfinite"`
+
+	// Framework level suppression of unchanged samples, for the generators
+	// which don't implement the delta approach.
+	SuppressUnchanged *SuppressUnchangedConfig `yaml:"suppress_unchanged"`
+
+	// Delay the scheduler start by an offset in [0, startup_splay), derived
+	// from the instance and hostname, to de-sync a fleet of importers deployed
+	// simultaneously. Use 0 to disable.
+	StartupSplay time.Duration `yaml:"startup_splay"`
+
+	// The max age of the metrics, from generation to the time they are picked
+	// up by a compressor, after which they are considered stale and dropped,
+	// since it is better to drop than to send misleadingly old data. The drops
+	// are counted into vmi_metrics_stale_dropped_delta internal metric. Use 0
+	// for no limit.
+	MaxMetricAge time.Duration `yaml:"max_metric_age"`
+
+	// Rename the emitted metrics, old -> new, e.g. for adopting a different
+	// naming convention. Only the names are changed, the labels and the values
+	// are not affected.
+	MetricRenames map[string]string `yaml:"metric_renames"`
+
+	// The listen address, e.g. ":8429", for an HTTP server exposing the
+	// internal metrics at /metrics, in Prometheus exposition format. This is
+	// pull based and independent of the push endpoints. Leave empty to
+	// disable.
+	SelfMetricsAddr string `yaml:"self_metrics_addr"`
+
+	// The listen address, e.g. ":8430", for an HTTP server exposing the
+	// /livez and /readyz probes, e.g. for Kubernetes. Leave empty to disable.
+	HealthProbeAddr string `yaml:"health_probe_addr"`
+
+	// The listen address, e.g. "127.0.0.1:6060", for an HTTP server exposing
+	// the net/http/pprof handlers at /debug/pprof/. Since the profiling data
+	// may reveal sensitive details, the address should be restricted. Leave
+	// empty to disable.
+	PprofAddr string `yaml:"pprof_addr"`
+
+	// The max lifetime of the process, for environments that prefer periodic
+	// restarts to bound resource leaks. Once reached, the importer shuts down
+	// gracefully and it exits w/ PLANNED_RESTART_EXIT_CODE, such that the
+	// supervisor restarts it. Use 0 for no limit.
+	MaxProcessLifetime time.Duration `yaml:"max_process_lifetime"`
+
 	// Specific components configuration.
 	LoggerConfig           *logrusx.LoggerConfig   `yaml:"log_config"`
 	CompressorPoolConfig   *CompressorPoolConfig   `yaml:"compressor_pool_config"`
 	HttpEndpointPoolConfig *HttpEndpointPoolConfig `yaml:"http_endpoint_pool_config"`
 	SchedulerConfig        *SchedulerConfig        `yaml:"scheduler_config"`
 
+	// Additional sinks, each w/ its own compressor pool, HTTP endpoint pool
+	// and encoding. The metrics are sent to the primary sink, defined by the
+	// configuration above, and to all additional sinks simultaneously.
+	AdditionalSinks []*SinkConfig `yaml:"additional_sinks"`
+
 	// Internal metrics configuration.
 	InternalMetricsConfig *InternalMetricsConfig `yaml:"internal_metrics_config"`
 }
 
+// Valid label name, see https://prometheus.io/docs/concepts/data_model/:
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+func IsValidLabelName(name string) bool {
+	return labelNameRegexp.MatchString(name)
+}
+
 func DefaultVmiConfig() *VmiConfig {
 	return &VmiConfig{
 		Instance:               Instance,
+		InstanceLabel:          INSTANCE_LABEL_NAME,
+		HostnameLabel:          HOSTNAME_LABEL_NAME,
 		UseShortHostname:       VMI_CONFIG_USE_SHORT_HOSTNAME_DEFAULT,
 		ShutdownMaxWait:        VMI_CONFIG_SHUTDOWN_MAX_WAIT_DEFAULT,
+		DetectTsRegression:     VMI_CONFIG_DETECT_TS_REGRESSION_DEFAULT,
+		GenMaxLinesPerBuffer:   VMI_CONFIG_GEN_MAX_LINES_PER_BUFFER_DEFAULT,
+		SummaryLogInterval:     VMI_CONFIG_PIPELINE_SUMMARY_INTERVAL_DEFAULT,
+		TimestampOffset:        VMI_CONFIG_TIMESTAMP_OFFSET_DEFAULT,
+		FloatFormat:            VMI_CONFIG_FLOAT_FORMAT_DEFAULT,
+		DropNonFinite:          VMI_CONFIG_DROP_NONFINITE_DEFAULT,
+		SuppressUnchanged:      DefaultSuppressUnchangedConfig(),
+		StartupSplay:           VMI_CONFIG_STARTUP_SPLAY_DEFAULT,
+		MaxMetricAge:           VMI_CONFIG_MAX_METRIC_AGE_DEFAULT,
+		SelfMetricsAddr:        VMI_CONFIG_SELF_METRICS_ADDR_DEFAULT,
+		HealthProbeAddr:        VMI_CONFIG_HEALTH_PROBE_ADDR_DEFAULT,
+		PprofAddr:              VMI_CONFIG_PPROF_ADDR_DEFAULT,
+		MaxProcessLifetime:     VMI_CONFIG_MAX_PROCESS_LIFETIME_DEFAULT,
 		LoggerConfig:           logrusx.DefaultLoggerConfig(),
 		CompressorPoolConfig:   DefaultCompressorPoolConfig(),
 		HttpEndpointPoolConfig: DefaultHttpEndpointPoolConfig(),
@@ -88,8 +241,72 @@ func DefaultVmiConfig() *VmiConfig {
 	}
 }
 
-// LoadConfig loads the configuration from the specified YAML file (or buffer,
-// for testing) as follows:
+// The number of configuration warnings found at startup, published as
+// vmi_config_warnings; -1 stands for not validated, in which case the metric
+// is not published:
+var configWarningsCount = -1
+
+// Validate checks the configuration for issues which are not errors, i.e.
+// they don't prevent the importer from running, but they may indicate a
+// misconfiguration, e.g. values that will be adjusted (clamped) or ignored.
+// The returned warnings are intended for logging.
+func (vmiConfig *VmiConfig) Validate() []string {
+	warnings := make([]string, 0)
+
+	checkEpPoolCfg := func(name string, epPoolCfg *HttpEndpointPoolConfig) {
+		if epPoolCfg != nil && epPoolCfg.HealthCheckInterval < HTTP_ENDPOINT_POOL_HEALTHY_CHECK_MIN_INTERVAL {
+			warnings = append(warnings, fmt.Sprintf(
+				"%s.health_check_interval=%s too small, it will be adjusted to %s",
+				name, epPoolCfg.HealthCheckInterval, HTTP_ENDPOINT_POOL_HEALTHY_CHECK_MIN_INTERVAL,
+			))
+		}
+	}
+	checkEpPoolCfg("http_endpoint_pool_config", vmiConfig.HttpEndpointPoolConfig)
+	for i, sinkCfg := range vmiConfig.AdditionalSinks {
+		if sinkCfg != nil {
+			checkEpPoolCfg(fmt.Sprintf("additional_sinks[%d].http_endpoint_pool_config", i), sinkCfg.HttpEndpointPoolConfig)
+		}
+	}
+
+	if schedulerCfg := vmiConfig.SchedulerConfig; schedulerCfg != nil {
+		maxNumWorkers := schedulerCfg.MaxNumWorkers
+		if maxNumWorkers <= 0 {
+			maxNumWorkers = SCHEDULER_MAX_NUM_WORKERS
+		}
+		if schedulerCfg.NumWorkers > maxNumWorkers {
+			warnings = append(warnings, fmt.Sprintf(
+				"scheduler_config.num_workers=%d too large, it will be adjusted to %d",
+				schedulerCfg.NumWorkers, maxNumWorkers,
+			))
+		}
+		if schedulerCfg.AlignToWallClock && schedulerCfg.Jitter > 0 {
+			warnings = append(warnings, fmt.Sprintf(
+				"scheduler_config.jitter=%v ignored for align_to_wallclock", schedulerCfg.Jitter,
+			))
+		}
+	}
+
+	internalMetricsEnabled := true
+	if internalMetricsCfg := vmiConfig.InternalMetricsConfig; internalMetricsCfg != nil {
+		interval := internalMetricsCfg.Interval
+		if interval <= 0 {
+			internalMetricsEnabled = false
+		} else if compliantInterval := CompliantTaskInterval(interval); compliantInterval != interval {
+			warnings = append(warnings, fmt.Sprintf(
+				"internal_metrics_config.interval=%s will be adjusted to %s",
+				interval, compliantInterval,
+			))
+		}
+	}
+	if vmiConfig.SelfMetricsAddr != "" && !internalMetricsEnabled {
+		warnings = append(warnings, "self_metrics_addr set but internal metrics disabled, nothing will be served")
+	}
+
+	return warnings
+}
+
+// LoadConfig loads the configuration from the specified YAML or JSON file (or
+// buffer, for testing) as follows:
 //   - the vmi_config section is returned as a *VmiConfig structure
 //   - the generators section is loaded into the provided genConfig structure,
 //     which expected to have been primed with default values.
@@ -97,30 +314,63 @@ func DefaultVmiConfig() *VmiConfig {
 // Additionally an error is returned if the configuration could not be
 // loaded or parsed.
 func LoadConfig(cfgFile string, genConfig any, buf []byte) (*VmiConfig, error) {
+	vmiConfig, _, err := LoadConfigWithProvenance(cfgFile, genConfig, buf)
+	return vmiConfig, err
+}
+
+// Detect the config file format based on the extension, w/ a fallback over
+// content sniffing for unknown extensions:
+func DetectConfigFormat(cfgFile string, buf []byte) string {
+	switch strings.ToLower(filepath.Ext(cfgFile)) {
+	case ".json":
+		return CONFIG_FORMAT_JSON
+	case ".yaml", ".yml":
+		return CONFIG_FORMAT_YAML
+	}
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '{' {
+		return CONFIG_FORMAT_JSON
+	}
+	return CONFIG_FORMAT_YAML
+}
+
+// Same as LoadConfig, additionally recording the provenance of the vmi_config
+// settings present in the file.
+func LoadConfigWithProvenance(cfgFile string, genConfig any, buf []byte) (*VmiConfig, ConfigProvenance, error) {
 	if buf == nil {
 		// Normal case, buf is pre-populated only for testing.
 		f, err := os.Open(cfgFile)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		defer f.Close()
 		buf, err = io.ReadAll(f)
 		if err != nil {
-			return nil, fmt.Errorf("file: %q: %v", cfgFile, err)
+			return nil, nil, fmt.Errorf("file: %q: %v", cfgFile, err)
 		}
 	}
 
+	if DetectConfigFormat(cfgFile, buf) == CONFIG_FORMAT_JSON {
+		// Compact the JSON before decoding it as YAML, since the latter
+		// doesn't allow tabs for indentation; this also reports the syntax
+		// errors in JSON terms:
+		compactBuf := &bytes.Buffer{}
+		if err := json.Compact(compactBuf, buf); err != nil {
+			return nil, nil, fmt.Errorf("file: %q: invalid JSON: %v", cfgFile, err)
+		}
+		buf = compactBuf.Bytes()
+	}
+
 	docNode := yaml.Node{}
 	err := yaml.Unmarshal(buf, &docNode)
 	if err != nil {
-		return nil, fmt.Errorf("file: %q: %v", cfgFile, err)
+		return nil, nil, fmt.Errorf("file: %q: %v", cfgFile, err)
 	}
 
-	vmiConfig := DefaultVmiConfig()
+	vmiConfig, provenance := DefaultVmiConfig(), make(ConfigProvenance)
 	if docNode.Kind == yaml.DocumentNode && len(docNode.Content) > 0 {
 		rootNode := docNode.Content[0]
 		if rootNode.Kind != yaml.MappingNode {
-			return nil, fmt.Errorf("file: %q: invalid YAML root node %q", cfgFile, rootNode.Tag)
+			return nil, nil, fmt.Errorf("file: %q: invalid YAML root node %q", cfgFile, rootNode.Tag)
 		}
 		var toCfg any = nil
 		for _, n := range rootNode.Content {
@@ -135,12 +385,15 @@ func LoadConfig(cfgFile string, genConfig any, buf []byte) (*VmiConfig, error) {
 			}
 			if n.Kind == yaml.MappingNode && toCfg != nil {
 				if err = n.Decode(toCfg); err != nil {
-					return nil, fmt.Errorf("file: %q: %v", cfgFile, err)
+					return nil, nil, fmt.Errorf("file: %q: %v", cfgFile, err)
+				}
+				if toCfg == vmiConfig {
+					provenance.recordFileNode(VMI_CONFIG_SECTION_NAME, n)
 				}
 			}
 			toCfg = nil
 		}
 	}
 
-	return vmiConfig, nil
+	return vmiConfig, provenance, nil
 }
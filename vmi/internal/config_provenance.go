@@ -0,0 +1,123 @@
+// Configuration provenance, i.e. where the effective value of a setting came
+// from.
+
+package vmi_internal
+
+// The effective configuration is assembled from several sources: the built-in
+// defaults, the config file, the environment (e.g. the password via
+// "env:VAR") and the command line args. For complex setups it may be hard to
+// tell where a given value came from, so the provenance of the vmi_config
+// settings is recorded while loading the configuration and applying the
+// overrides. It is reported as comments in the -dump-config output, e.g.:
+//
+//	vmi_config:
+//	  instance: vmi_prod # cli
+//	  use_short_hostname: false # default
+//
+// The settings are identified by their YAML path, e.g.
+// "vmi_config.http_endpoint_pool_config.endpoints". Lists are recorded as a
+// whole, rather than item by item.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Configuration sources:
+const (
+	CONFIG_SOURCE_DEFAULT = "default"
+	CONFIG_SOURCE_FILE    = "file"
+	CONFIG_SOURCE_ENV     = "env"
+	CONFIG_SOURCE_CLI     = "cli"
+)
+
+// The value displayed by -dump-config in lieu of secrets:
+const CONFIG_DUMP_REDACTED_VALUE = "<redacted>"
+
+// The provenance of the settings which didn't come from the defaults, indexed
+// by YAML path:
+type ConfigProvenance map[string]string
+
+func (provenance ConfigProvenance) Set(path, source string) {
+	provenance[path] = source
+}
+
+// Return the source of the setting, defaulting to CONFIG_SOURCE_DEFAULT:
+func (provenance ConfigProvenance) Get(path string) string {
+	if source, ok := provenance[path]; ok {
+		return source
+	}
+	return CONFIG_SOURCE_DEFAULT
+}
+
+// Whether the setting, identified by its YAML path, holds a secret which
+// should not be displayed:
+func isConfigSecret(path string) bool {
+	return strings.HasSuffix(path, ".password")
+}
+
+// Record the settings present in the config file, from the parsed YAML:
+func (provenance ConfigProvenance) recordFileNode(path string, node *yaml.Node) {
+	if node.Kind != yaml.MappingNode {
+		source := CONFIG_SOURCE_FILE
+		if node.Kind == yaml.ScalarNode && isConfigSecret(path) &&
+			strings.HasPrefix(node.Value, HTTP_ENDPOINT_POOL_CONFIG_PASSWORD_ENV_PREFIX) {
+			source = CONFIG_SOURCE_ENV
+		}
+		provenance.Set(path, source)
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		provenance.recordFileNode(path+"."+node.Content[i].Value, node.Content[i+1])
+	}
+}
+
+// Annotate the YAML node of the effective configuration w/ the provenance:
+func (provenance ConfigProvenance) annotateNode(path string, node *yaml.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valNode := node.Content[i], node.Content[i+1]
+		keyPath := path + "." + keyNode.Value
+		if valNode.Kind == yaml.MappingNode {
+			provenance.annotateNode(keyPath, valNode)
+			continue
+		}
+		if isConfigSecret(keyPath) && valNode.Kind == yaml.ScalarNode && valNode.Value != "" &&
+			!strings.HasPrefix(valNode.Value, HTTP_ENDPOINT_POOL_CONFIG_PASSWORD_ENV_PREFIX) {
+			valNode.Value, valNode.Style = CONFIG_DUMP_REDACTED_VALUE, 0
+		}
+		keyNode.LineComment = provenance.Get(keyPath)
+		if len(valNode.Content) == 0 && valNode.Kind != yaml.ScalarNode {
+			// Empty collections are rendered in flow style, e.g. `[]`, on
+			// the key line and the comment should follow them:
+			valNode.LineComment, keyNode.LineComment = keyNode.LineComment, ""
+		}
+	}
+}
+
+// Write the effective vmi_config, annotated w/ the provenance of each setting:
+func DumpConfig(w io.Writer, vmiConfig *VmiConfig, provenance ConfigProvenance) error {
+	vmiConfigNode := &yaml.Node{}
+	if err := vmiConfigNode.Encode(vmiConfig); err != nil {
+		return fmt.Errorf("DumpConfig: %v", err)
+	}
+	if provenance == nil {
+		provenance = make(ConfigProvenance)
+	}
+	provenance.annotateNode(VMI_CONFIG_SECTION_NAME, vmiConfigNode)
+	docNode := &yaml.Node{
+		Kind: yaml.MappingNode,
+		Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Value: VMI_CONFIG_SECTION_NAME},
+			vmiConfigNode,
+		},
+	}
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(docNode); err != nil {
+		return fmt.Errorf("DumpConfig: %v", err)
+	}
+	return encoder.Close()
+}
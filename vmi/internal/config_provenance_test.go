@@ -0,0 +1,94 @@
+// Tests for config_provenance.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestConfigProvenance(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	data := strings.ReplaceAll(`
+vmi_config:
+	instance: vmi_file
+	detect_ts_regression: true
+	http_endpoint_pool_config:
+		endpoints:
+			- url: http://file:8428/api/v1/import/prometheus
+		username: vmi
+		password: env:VMI_TEST_PASSWORD
+generators:
+	gen1:
+		interval: 1s
+`, "\t", "  ")
+	vmiConfig, provenance, err := LoadConfigWithProvenance("", defaultGenConfig(), []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Override via CLI:
+	savedInstanceArg := *instanceArg
+	defer func() { *instanceArg = savedInstanceArg }()
+	*instanceArg = "vmi_cli"
+	applyConfigArgs(vmiConfig, provenance)
+	if vmiConfig.Instance != "vmi_cli" {
+		t.Fatalf("instance: want: %q, got: %q", "vmi_cli", vmiConfig.Instance)
+	}
+
+	for _, tc := range []struct {
+		path       string
+		wantSource string
+	}{
+		{"vmi_config.instance", CONFIG_SOURCE_CLI},
+		{"vmi_config.detect_ts_regression", CONFIG_SOURCE_FILE},
+		{"vmi_config.http_endpoint_pool_config.endpoints", CONFIG_SOURCE_FILE},
+		{"vmi_config.http_endpoint_pool_config.username", CONFIG_SOURCE_FILE},
+		{"vmi_config.http_endpoint_pool_config.password", CONFIG_SOURCE_ENV},
+		{"vmi_config.use_short_hostname", CONFIG_SOURCE_DEFAULT},
+		{"vmi_config.compressor_pool_config.num_compressors", CONFIG_SOURCE_DEFAULT},
+	} {
+		if gotSource := provenance.Get(tc.path); gotSource != tc.wantSource {
+			t.Errorf("%s: source: want: %q, got: %q", tc.path, tc.wantSource, gotSource)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := DumpConfig(buf, vmiConfig, provenance); err != nil {
+		t.Fatal(err)
+	}
+	dump := buf.String()
+	for _, wantRe := range []*regexp.Regexp{
+		regexp.MustCompile(`(?m)^  instance: vmi_cli # cli$`),
+		regexp.MustCompile(`(?m)^  detect_ts_regression: true # file$`),
+		regexp.MustCompile(`(?m)^  use_short_hostname: false # default$`),
+		regexp.MustCompile(`(?m)^    endpoints: # file$`),
+		regexp.MustCompile(`(?m)^    password: env:VMI_TEST_PASSWORD # env$`),
+		regexp.MustCompile(`(?m)^    num_compressors: -1 # default$`),
+	} {
+		if !wantRe.MatchString(dump) {
+			t.Errorf("%s: no match in:\n%s", wantRe, dump)
+		}
+	}
+}
+
+func TestDumpConfigRedacted(t *testing.T) {
+	vmiConfig := DefaultVmiConfig()
+	vmiConfig.HttpEndpointPoolConfig.Password = "secret"
+	buf := &bytes.Buffer{}
+	if err := DumpConfig(buf, vmiConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "secret") {
+		t.Fatalf("password not redacted:\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), "password: "+CONFIG_DUMP_REDACTED_VALUE) {
+		t.Fatalf("missing redacted password:\n%s", buf)
+	}
+}
@@ -1,6 +1,7 @@
 package vmi_internal
 
 import (
+	"errors"
 	"strings"
 	"testing"
 	"time"
@@ -10,8 +11,10 @@ import (
 )
 
 type LoadConfigTestCase struct {
-	Name          string
-	Description   string
+	Name        string
+	Description string
+	// Used for format detection only, the data is loaded from Data:
+	CfgFile       string
 	GenConfig     any
 	Data          string
 	WantVmiConfig *VmiConfig
@@ -49,7 +52,7 @@ func testLoadConfig(t *testing.T, tc *LoadConfigTestCase) {
 		t.Log(tc.Description)
 	}
 	genConfig := clone.Clone(tc.GenConfig)
-	gotVmiConfig, err := LoadConfig("", genConfig, []byte(strings.ReplaceAll(tc.Data, "\t", "  ")))
+	gotVmiConfig, err := LoadConfig(tc.CfgFile, genConfig, []byte(strings.ReplaceAll(tc.Data, "\t", "  ")))
 	if tc.WantErr == nil && err != nil {
 		t.Fatal(err)
 	}
@@ -257,3 +260,83 @@ func TestLoadGenConfig(t *testing.T) {
 		func(t *testing.T) { testLoadConfig(t, tc) },
 	)
 }
+
+func TestLoadConfigJson(t *testing.T) {
+	// JSON variant of TestLoadGenConfig, w/ some vmi_config settings added:
+	data := `
+		{
+			"vmi_config": {
+				"shutdown_max_wait": "7s",
+				"scheduler_config": {"num_workers": 5}
+			},
+			"generators": {
+				"gen1": {
+					"interval": "10s",
+					"exclude": ["foo", "bar"]
+				},
+				"gen2": {
+					"id": "gentwo",
+					"interval": "20s",
+					"timeout": "30s",
+					"include": ["baz", "qux"]
+				}
+			}
+		}
+	`
+	wantVmiConfig := DefaultVmiConfig()
+	wantVmiConfig.ShutdownMaxWait = 7 * time.Second
+	wantVmiConfig.SchedulerConfig.NumWorkers = 5
+	wantGenConfig := defaultGenConfig()
+	wantGenConfig.Gen1.Id = "gen1"
+	wantGenConfig.Gen1.Interval = 10 * time.Second
+	wantGenConfig.Gen1.Exclude = []string{"foo", "bar"}
+	wantGenConfig.Gen2.Id = "gentwo"
+	wantGenConfig.Gen2.Interval = 20 * time.Second
+	wantGenConfig.Gen2.Timeout = 30 * time.Second
+	wantGenConfig.Gen2.Include = []string{"baz", "qux"}
+
+	for _, tc := range []*LoadConfigTestCase{
+		{
+			Name:          "sniffed",
+			Description:   "Test loading JSON configuration detected by content",
+			GenConfig:     defaultGenConfig(),
+			Data:          data,
+			WantVmiConfig: wantVmiConfig,
+			WantGenConfig: wantGenConfig,
+		},
+		{
+			Name:          "extension",
+			Description:   "Test loading JSON configuration detected by extension",
+			CfgFile:       "vmi-config.json",
+			GenConfig:     defaultGenConfig(),
+			Data:          data,
+			WantVmiConfig: wantVmiConfig,
+			WantGenConfig: wantGenConfig,
+		},
+		{
+			Name:          "invalid",
+			Description:   "Test loading invalid JSON configuration",
+			CfgFile:       "vmi-config.json",
+			GenConfig:     defaultGenConfig(),
+			Data:          `{"vmi_config": {"instance": "inst1",}}`,
+			WantVmiConfig: nil,
+			WantGenConfig: defaultGenConfig(),
+			WantErr:       errors.New("invalid JSON"),
+		},
+	} {
+		t.Run(
+			tc.Name,
+			func(t *testing.T) { testLoadConfig(t, tc) },
+		)
+	}
+
+	// Tab indented JSON, e.g. as generated by tooling, is not valid YAML:
+	tabData := "{\n\t\"vmi_config\": {\n\t\t\"instance\": \"inst1\"\n\t}\n}\n"
+	gotVmiConfig, err := LoadConfig("vmi-config.json", nil, []byte(tabData))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotVmiConfig.Instance != "inst1" {
+		t.Fatalf("instance: want: %q, got: %q", "inst1", gotVmiConfig.Instance)
+	}
+}
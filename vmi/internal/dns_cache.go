@@ -0,0 +1,204 @@
+// DNS resolution cache w/ TTL for the HTTP endpoint pool dialer.
+
+package vmi_internal
+
+// By default the endpoints are dialed by name, the resolution being left to
+// net.Dialer, while http.Transport reuses the established connections for as
+// long as they are alive. For endpoints whose addresses change, e.g.
+// blue/green deployments via DNS, the importer may therefore remain pinned to
+// the old addresses indefinitely.
+//
+// Optionally (dns_cache_ttl) the dialer resolves the hosts via a cache w/ a
+// TTL. Once the TTL expires a host is re-resolved, either at the next dial or
+// by the pool's periodic refresh, whichever comes first, and the connections
+// to addresses no longer resolved are closed, such that new connections are
+// dialed to the current addresses. The addresses are tried in the resolved
+// order, restricted to the address family implied by the network, if any. If
+// the re-resolution fails, the previous addresses are used until the next
+// attempt.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+type DnsCache struct {
+	ttl     time.Duration
+	network string
+	entries map[string]*dnsCacheEntry
+	mu      *sync.Mutex
+	// Mockable for testing:
+	timeNowFn func() time.Time
+}
+
+type dnsCacheEntry struct {
+	addrs     []string
+	expiresAt time.Time
+	// The open connections dialed for this host:
+	conns map[*dnsCacheConn]bool
+}
+
+// The connections are tracked such that they can be closed when their address
+// is no longer resolved:
+type dnsCacheConn struct {
+	net.Conn
+	cache *DnsCache
+	host  string
+	addr  string
+}
+
+func (conn *dnsCacheConn) Close() error {
+	conn.cache.untrack(conn)
+	return conn.Conn.Close()
+}
+
+func NewDnsCache(ttl time.Duration, network string) *DnsCache {
+	return &DnsCache{
+		ttl:       ttl,
+		network:   network,
+		entries:   make(map[string]*dnsCacheEntry),
+		mu:        &sync.Mutex{},
+		timeNowFn: time.Now,
+	}
+}
+
+// Resolve the host, restricted to the address family implied by the network:
+func (cache *DnsCache) resolve(ctx context.Context, host string) ([]string, error) {
+	ctx, cancelFn := context.WithTimeout(ctx, HTTP_ENDPOINT_POOL_DNS_LOOKUP_TIMEOUT)
+	defer cancelFn()
+	resolved, err := httpEndpointPoolLookupHostFn(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]string, 0, len(resolved))
+	for _, addr := range resolved {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		isIPv4 := ip.To4() != nil
+		if cache.network == "tcp4" && !isIPv4 || cache.network == "tcp6" && isIPv4 {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("%s: no usable address for network %s", host, cache.network)
+	}
+	return addrs, nil
+}
+
+// Update the addresses of a host and close the connections to the addresses
+// no longer resolved:
+func (cache *DnsCache) update(host string, addrs []string) {
+	staleConns := make([]*dnsCacheConn, 0)
+	cache.mu.Lock()
+	entry := cache.entries[host]
+	if entry == nil {
+		entry = &dnsCacheEntry{conns: make(map[*dnsCacheConn]bool)}
+		cache.entries[host] = entry
+	} else if !slices.Equal(entry.addrs, addrs) {
+		epPoolLog.Infof("dns_cache: %s: %v -> %v", host, entry.addrs, addrs)
+	}
+	entry.addrs, entry.expiresAt = addrs, cache.timeNowFn().Add(cache.ttl)
+	for conn := range entry.conns {
+		if !slices.Contains(addrs, conn.addr) {
+			staleConns = append(staleConns, conn)
+		}
+	}
+	cache.mu.Unlock()
+	// N.B. Close updates the tracked connections, it must be called w/o the
+	// lock held:
+	for _, conn := range staleConns {
+		epPoolLog.Infof("dns_cache: %s: close connection to stale address %s", host, conn.addr)
+		conn.Close()
+	}
+}
+
+func (cache *DnsCache) untrack(conn *dnsCacheConn) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if entry := cache.entries[conn.host]; entry != nil {
+		delete(entry.conns, conn)
+	}
+}
+
+// Return the addresses of a host, re-resolving it if not cached or expired:
+func (cache *DnsCache) Lookup(ctx context.Context, host string) ([]string, error) {
+	cache.mu.Lock()
+	entry := cache.entries[host]
+	var addrs []string
+	if entry != nil {
+		addrs = entry.addrs
+		if cache.timeNowFn().Before(entry.expiresAt) {
+			cache.mu.Unlock()
+			return addrs, nil
+		}
+	}
+	cache.mu.Unlock()
+
+	newAddrs, err := cache.resolve(ctx, host)
+	if err != nil {
+		if len(addrs) == 0 {
+			return nil, err
+		}
+		epPoolLog.Warnf("dns_cache: %v, use previous addresses %v", err, addrs)
+		return addrs, nil
+	}
+	cache.update(host, newAddrs)
+	return newAddrs, nil
+}
+
+// Re-resolve all the cached hosts, regardless of expiration:
+func (cache *DnsCache) Refresh(ctx context.Context) {
+	cache.mu.Lock()
+	hosts := make([]string, 0, len(cache.entries))
+	for host := range cache.entries {
+		hosts = append(hosts, host)
+	}
+	cache.mu.Unlock()
+	for _, host := range hosts {
+		addrs, err := cache.resolve(ctx, host)
+		if err != nil {
+			epPoolLog.Warnf("dns_cache: refresh: %v", err)
+			continue
+		}
+		cache.update(host, addrs)
+	}
+}
+
+// Build the DialContext function for http.Transport, same as
+// NewHttpEndpointPoolDialContext, except that the host is resolved via the
+// cache:
+func (cache *DnsCache) DialContext(dialer *net.Dialer) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return httpEndpointPoolDialFn(dialer, ctx, cache.network, addr)
+		}
+		addrs, err := cache.Lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		for _, ipAddr := range addrs {
+			var conn net.Conn
+			conn, err = httpEndpointPoolDialFn(dialer, ctx, cache.network, net.JoinHostPort(ipAddr, port))
+			if err != nil {
+				continue
+			}
+			cacheConn := &dnsCacheConn{Conn: conn, cache: cache, host: host, addr: ipAddr}
+			cache.mu.Lock()
+			entry := cache.entries[host]
+			if entry != nil {
+				entry.conns[cacheConn] = true
+			}
+			cache.mu.Unlock()
+			return cacheConn, nil
+		}
+		return nil, err
+	}
+}
@@ -0,0 +1,185 @@
+// Tests for dns_cache.go
+
+package vmi_internal
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// Stub the resolver and the dialer; the dialed connections are pipes, whose
+// remote end is used for detecting the close:
+type dnsCacheTestStubs struct {
+	addrs       []string
+	lookupCount int
+	dialedAddrs []string
+	remoteConns []net.Conn
+	mu          *sync.Mutex
+}
+
+func newDnsCacheTestStubs(t *testing.T) *dnsCacheTestStubs {
+	stubs := &dnsCacheTestStubs{mu: &sync.Mutex{}}
+	savedLookupHostFn, savedDialFn := httpEndpointPoolLookupHostFn, httpEndpointPoolDialFn
+	t.Cleanup(func() {
+		httpEndpointPoolLookupHostFn, httpEndpointPoolDialFn = savedLookupHostFn, savedDialFn
+		for _, conn := range stubs.remoteConns {
+			conn.Close()
+		}
+	})
+	httpEndpointPoolLookupHostFn = func(ctx context.Context, host string) ([]string, error) {
+		stubs.mu.Lock()
+		defer stubs.mu.Unlock()
+		stubs.lookupCount++
+		return slices.Clone(stubs.addrs), nil
+	}
+	httpEndpointPoolDialFn = func(dialer *net.Dialer, ctx context.Context, network, addr string) (net.Conn, error) {
+		localConn, remoteConn := net.Pipe()
+		stubs.mu.Lock()
+		defer stubs.mu.Unlock()
+		stubs.dialedAddrs = append(stubs.dialedAddrs, addr)
+		stubs.remoteConns = append(stubs.remoteConns, remoteConn)
+		return localConn, nil
+	}
+	return stubs
+}
+
+func (stubs *dnsCacheTestStubs) setAddrs(addrs ...string) {
+	stubs.mu.Lock()
+	stubs.addrs = addrs
+	stubs.mu.Unlock()
+}
+
+// Whether the i'th dialed connection was closed locally:
+func (stubs *dnsCacheTestStubs) isClosed(i int) bool {
+	stubs.mu.Lock()
+	remoteConn := stubs.remoteConns[i]
+	stubs.mu.Unlock()
+	remoteConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err := remoteConn.Read(make([]byte, 1))
+	return err != nil && !isTimeoutErr(err)
+}
+
+func isTimeoutErr(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+func TestDnsCache(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	stubs := newDnsCacheTestStubs(t)
+	ttl := time.Minute
+	cache := NewDnsCache(ttl, "tcp4")
+	timeNow := time.Now()
+	cache.timeNowFn = func() time.Time { return timeNow }
+	dial := cache.DialContext(&net.Dialer{})
+
+	for i, tc := range []struct {
+		// The addresses returned by the resolver, nil for unchanged:
+		addrs []string
+		// Advance the time by:
+		advance time.Duration
+		// Refresh, rather than dial:
+		refresh         bool
+		wantLookupCount int
+		wantDialedAddr  string
+		// The indexes of the dialed connections expected to be closed:
+		wantClosed []int
+	}{
+		// The IPv6 address is ignored for tcp4:
+		{addrs: []string{"2001:db8::1", "10.0.0.1"}, wantLookupCount: 1, wantDialedAddr: "10.0.0.1:8428"},
+		// Cached:
+		{advance: ttl / 2, wantLookupCount: 1, wantDialedAddr: "10.0.0.1:8428"},
+		// Expired, re-resolved to the same address:
+		{advance: ttl, wantLookupCount: 2, wantDialedAddr: "10.0.0.1:8428"},
+		// Changed but still cached:
+		{addrs: []string{"10.0.0.2"}, wantLookupCount: 2, wantDialedAddr: "10.0.0.1:8428"},
+		// Expired, re-resolved to a new address, the old connections closed:
+		{advance: ttl, wantLookupCount: 3, wantDialedAddr: "10.0.0.2:8428", wantClosed: []int{0, 1, 2, 3}},
+		// Refreshed before expiration, the address kept:
+		{addrs: []string{"10.0.0.2", "10.0.0.3"}, refresh: true, wantLookupCount: 4},
+		// Refreshed, the address dropped:
+		{addrs: []string{"10.0.0.3"}, refresh: true, wantLookupCount: 5, wantClosed: []int{4}},
+	} {
+		if tc.addrs != nil {
+			stubs.setAddrs(tc.addrs...)
+		}
+		timeNow = timeNow.Add(tc.advance)
+		numDialed := len(stubs.dialedAddrs)
+		if tc.refresh {
+			cache.Refresh(context.Background())
+		} else {
+			if _, err := dial(context.Background(), "tcp", "host1:8428"); err != nil {
+				t.Fatalf("step# %d: dial: %v", i, err)
+			}
+			if gotDialedAddr := stubs.dialedAddrs[len(stubs.dialedAddrs)-1]; gotDialedAddr != tc.wantDialedAddr {
+				t.Fatalf("step# %d: dialed addr: want: %q, got: %q", i, tc.wantDialedAddr, gotDialedAddr)
+			}
+			numDialed++
+		}
+		if stubs.lookupCount != tc.wantLookupCount {
+			t.Fatalf("step# %d: lookup count: want: %d, got: %d", i, tc.wantLookupCount, stubs.lookupCount)
+		}
+		for j := 0; j < numDialed; j++ {
+			wantClosed := slices.Contains(tc.wantClosed, j)
+			if j < numDialed-1 && !wantClosed {
+				// Only the connections closed at this step are checked, the
+				// others were checked already:
+				continue
+			}
+			if gotClosed := stubs.isClosed(j); gotClosed != wantClosed {
+				t.Fatalf("step# %d: conn# %d closed: want: %v, got: %v", i, j, wantClosed, gotClosed)
+			}
+		}
+	}
+
+	// IP addresses should be dialed directly:
+	lookupCount := stubs.lookupCount
+	if _, err := dial(context.Background(), "tcp", "10.0.0.9:8428"); err != nil {
+		t.Fatal(err)
+	}
+	if stubs.lookupCount != lookupCount {
+		t.Fatalf("dial IP: lookup count: want: %d, got: %d", lookupCount, stubs.lookupCount)
+	}
+}
+
+func TestHttpEndpointPoolDnsCache(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	stubs := newDnsCacheTestStubs(t)
+	stubs.setAddrs("10.0.0.1")
+
+	epPoolCfg := DefaultHttpEndpointPoolConfig()
+	epPoolCfg.DnsCacheTTL = 100 * time.Millisecond
+	epPool, err := NewHttpEndpointPool(epPoolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epPool.Shutdown()
+
+	transport := epPool.client.(*http.Client).Transport.(*http.Transport)
+	if _, err := transport.DialContext(context.Background(), "tcp", "host1:8428"); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "10.0.0.1:8428", stubs.dialedAddrs[0]; want != got {
+		t.Fatalf("dialed addr: want: %q, got: %q", want, got)
+	}
+
+	// The periodic refresh should close the connection w/o further dials:
+	stubs.setAddrs("10.0.0.2")
+	if !stubs.isClosed(0) {
+		time.Sleep(3 * epPoolCfg.DnsCacheTTL)
+		if !stubs.isClosed(0) {
+			t.Fatal("stale connection not closed by the refresh")
+		}
+	}
+}
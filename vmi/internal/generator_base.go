@@ -5,6 +5,7 @@ package vmi_internal
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strconv"
 	"time"
 )
@@ -13,6 +14,23 @@ const (
 	GENERATOR_RUNTIME_UNAVAILABLE = -1.
 )
 
+// Whether to check for timestamp regressions, based on config:
+var DetectTsRegression = VMI_CONFIG_DETECT_TS_REGRESSION_DEFAULT
+
+// The soft limit for the number of lines per buffer, based on config:
+var GeneratorMaxLinesPerBuffer = VMI_CONFIG_GEN_MAX_LINES_PER_BUFFER_DEFAULT
+
+// The offset added to the timestamps of the metrics, based on config:
+var TimestampOffset = VMI_CONFIG_TIMESTAMP_OFFSET_DEFAULT
+
+// The format for float values, based on config:
+var FloatFormat = VMI_CONFIG_FLOAT_FORMAT_DEFAULT[0]
+
+// Whether to drop NaN/Inf float values, based on config:
+var DropNonFinite = VMI_CONFIG_DROP_NONFINITE_DEFAULT
+
+var generatorLog = NewCompLogger("generator")
+
 type GeneratorBase struct {
 	// Unique generator ID:
 	Id string
@@ -22,23 +40,55 @@ type GeneratorBase struct {
 	FullMetricsFactor int
 	// The current cycle# used in conjunction with the FullMetricsFactor:
 	CycleNum int
+	// The IDs of the generators which should run before this one in every
+	// cycle, if any (see "Dependencies" in scheduler.go):
+	Dependencies []string
+	// The concurrency class, e.g. the generator type, if any, and the max
+	// number of generators of the class which may run at the same time (see
+	// "Concurrency Classes" in scheduler.go). Use "" for no limit:
+	ConcurrencyClass    string
+	MaxClassConcurrency int
+	// The scheduling priority, higher value meaning higher priority, honored
+	// when more generators are ready to run than scheduler workers (see
+	// "Priorities" in scheduler.go). Default 0:
+	Priority int
+	// The timeout for a generation cycle, honored by the generators
+	// implementing TaskActivityContext (see "Timeouts" in scheduler.go). Use 0
+	// for the interval and < 0 for no timeout:
+	Timeout time.Duration
+	// Target size hint for the buffers queued by the emit helper (GenBaseEmit),
+	// used instead of the metrics queue's target size, if > 0. It applies to
+	// this generator's flush decisions only, independent of the compressor
+	// batching, e.g. a generator w/ a small metrics set may use a smaller
+	// hint to have its metrics queued promptly:
+	BufTargetSizeHint int
+	// The size of the generator's own bounded queue, if > 0, in buffers. The
+	// generator queues into it, rather than directly into the shared metrics
+	// queue, and the buffers are dropped if it is full, such that a slow sink
+	// doesn't stall the generator (see generator_metrics_queue.go):
+	QueueSize int
 	// The timestamp of the last metrics generation:
 	LastTs time.Time
 	// Cache for generator metrics:
 	DtimeMetric []byte
 	// Cache for timestamp suffix, common to all/a group of metrics:
 	TsSuffixBuf *bytes.Buffer
+	// The number of lines in the current buffer, maintained by GenBaseEmit:
+	BufLineCount int
 	// Whether the structure was initialized (caches, etc) or not:
 	Initialized bool
 	// The following fields, if left to their default values (type's nil) will
 	// be set during initialization with the usual values. They may be
 	// pre-populated during tests after the generator was created and before
 	// initialization.
-	Instance     string
-	Hostname     string
-	TimeNowFunc  func() time.Time
-	MetricsQueue BufferQueue
-	TestMode     bool
+	Instance          string
+	Hostname          string
+	InstanceLabelName string
+	HostnameLabelName string
+	TimeNowFunc       func() time.Time
+	MetricsQueue      BufferQueue
+	MaxLinesPerBuffer int
+	TestMode          bool
 }
 
 func (gb *GeneratorBase) GenBaseInit() {
@@ -54,6 +104,18 @@ func (gb *GeneratorBase) GenBaseInit() {
 		gb.Hostname = hostname
 	}
 
+	instanceLabel := gb.InstanceLabelName
+	if instanceLabel == "" {
+		instanceLabel = InstanceLabelName
+		gb.InstanceLabelName = instanceLabel
+	}
+
+	hostnameLabel := gb.HostnameLabelName
+	if hostnameLabel == "" {
+		hostnameLabel = HostnameLabelName
+		gb.HostnameLabelName = hostnameLabel
+	}
+
 	if gb.TimeNowFunc == nil {
 		gb.TimeNowFunc = time.Now
 	}
@@ -62,11 +124,21 @@ func (gb *GeneratorBase) GenBaseInit() {
 		gb.MetricsQueue = MetricsQueue
 	}
 
+	if gb.QueueSize > 0 {
+		if _, ok := gb.MetricsQueue.(*GeneratorMetricsQueue); !ok {
+			gb.MetricsQueue = NewGeneratorMetricsQueue(gb.MetricsQueue, gb.Id, gb.QueueSize)
+		}
+	}
+
+	if gb.MaxLinesPerBuffer == 0 {
+		gb.MaxLinesPerBuffer = GeneratorMaxLinesPerBuffer
+	}
+
 	gb.DtimeMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. space before value is included
-		METRICS_GENERATOR_DTIME_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+		RenameMetric(METRICS_GENERATOR_DTIME_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 		METRICS_GENERATOR_ID_LABEL_NAME, gb.Id,
 	))
 
@@ -87,20 +159,99 @@ func (gb *GeneratorBase) GenBaseMetricsStart(buf *bytes.Buffer, ts time.Time) (i
 	tsSuffixBuf := gb.TsSuffixBuf
 	validPrev := tsSuffixBuf.Len() > 0
 	tsSuffixBuf.Reset()
-	// N.B. The space after the value and the ending `\n' are included.
-	fmt.Fprintf(tsSuffixBuf, " %d\n", ts.UnixMilli())
+	// N.B. The space after the value and the ending `\n' are included. The
+	// offset applies to the published timestamp only, the intervals are based
+	// on the actual one.
+	fmt.Fprintf(tsSuffixBuf, " %d\n", ts.Add(TimestampOffset).UnixMilli())
 	if validPrev && buf != nil {
 		// Publish the actual interval since the prev run:
 		buf.Write(gb.DtimeMetric)
-		buf.WriteString(strconv.FormatFloat(ts.Sub(gb.LastTs).Seconds(), 'f', METRICS_GENERATOR_DTIME_METRIC_PRECISION, 64))
+		WriteFloatValue(buf, ts.Sub(gb.LastTs).Seconds(), METRICS_GENERATOR_DTIME_METRIC_PRECISION)
 		buf.Write(tsSuffixBuf.Bytes())
 		metricsCount++
 	}
 	lastTs := gb.LastTs
+	if DetectTsRegression && ts.Before(lastTs) {
+		MetricsGenStats.UpdateTsRegression(gb.Id)
+		generatorLog.Warnf(
+			"%s: timestamp regression: %s -> %s (%s)",
+			gb.Id, lastTs.Format(time.RFC3339Nano), ts.Format(time.RFC3339Nano), ts.Sub(lastTs),
+		)
+	}
 	gb.LastTs = ts
+	gb.BufLineCount = metricsCount
 	return metricsCount, lastTs
 }
 
+// Emit helper: account for the metrics lines just written into the buffer and
+// queue the latter if it reached either the target size (hint, if set) or the
+// max number of lines per buffer. Return the buffer to be used for subsequent
+// metrics, nil if it was queued (the caller should get a new one as needed),
+// and the number of queued bytes, for stats.
+func (gb *GeneratorBase) GenBaseEmit(buf *bytes.Buffer, numLines int) (*bytes.Buffer, int) {
+	gb.BufLineCount += numLines
+	maxLines, targetSize := gb.MaxLinesPerBuffer, gb.BufTargetSizeHint
+	if targetSize <= 0 {
+		targetSize = gb.MetricsQueue.GetTargetSize()
+	}
+	if (maxLines > 0 && gb.BufLineCount >= maxLines) || (targetSize > 0 && buf.Len() >= targetSize) {
+		byteCount := buf.Len()
+		QueueBufFor(gb.MetricsQueue, gb.Id, buf)
+		gb.BufLineCount = 0
+		return nil, byteCount
+	}
+	return buf, 0
+}
+
+// Emit helper for float values, using the configured format: 'f' w/ the
+// precision of the caller or 'g' w/ the smallest number of digits necessary to
+// represent the value exactly, switching to the scientific notation for large
+// or small exponents. Both are valid in the Prometheus exposition format.
+func WriteFloatValue(buf *bytes.Buffer, val float64, prec int) {
+	if FloatFormat == 'g' {
+		prec = -1
+	}
+	buf.Write(strconv.AppendFloat(buf.AvailableBuffer(), val, FloatFormat, prec, 64))
+}
+
+// Emit helper for float metrics: write the metric, i.e. `name{label="val",...} `,
+// the value and the timestamp suffix. NaN/Inf values are counted and they are
+// either dropped or written, based on config. Return true if the metric was
+// written.
+func (gb *GeneratorBase) GenBaseWriteFloatMetric(buf *bytes.Buffer, metric []byte, val float64, prec int) bool {
+	if math.IsNaN(val) || math.IsInf(val, 0) {
+		MetricsGenStats.UpdateNonFinite(gb.Id)
+		if DropNonFinite {
+			return false
+		}
+	}
+	buf.Write(metric)
+	WriteFloatValue(buf, val, prec)
+	buf.Write(gb.TsSuffixBuf.Bytes())
+	return true
+}
+
 // Satisfy GeneratorTask I/F:
 func (gb *GeneratorBase) GetId() string              { return gb.Id }
 func (gb *GeneratorBase) GetInterval() time.Duration { return gb.Interval }
+
+// Satisfy MetricsGeneratorTaskFullCycle I/F:
+func (gb *GeneratorBase) GetFullMetricsFactor() int { return gb.FullMetricsFactor }
+func (gb *GeneratorBase) GetCycleNum() int          { return gb.CycleNum }
+
+// Satisfy MetricsGeneratorTaskForceFull I/F:
+func (gb *GeneratorBase) ForceFullMetrics() { gb.CycleNum = 0 }
+
+// Satisfy MetricsGeneratorTaskDependencies I/F:
+func (gb *GeneratorBase) GetDependencies() []string { return gb.Dependencies }
+
+// Satisfy MetricsGeneratorTaskConcurrencyClass I/F:
+func (gb *GeneratorBase) GetConcurrencyClass() (string, int) {
+	return gb.ConcurrencyClass, gb.MaxClassConcurrency
+}
+
+// Satisfy MetricsGeneratorTaskPriority I/F:
+func (gb *GeneratorBase) GetPriority() int { return gb.Priority }
+
+// Satisfy MetricsGeneratorTaskTimeout I/F:
+func (gb *GeneratorBase) GetTimeout() time.Duration { return gb.Timeout }
@@ -0,0 +1,287 @@
+// Tests for generator_base.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// A metrics queue recording the line count of every queued buffer:
+type lineCountMetricsQueue struct {
+	*vmi_testutils.TestMetricsQueue
+	lineCounts []int
+}
+
+func (mq *lineCountMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	mq.lineCounts = append(mq.lineCounts, bytes.Count(buf.Bytes(), []byte{'\n'}))
+	mq.TestMetricsQueue.QueueBuf(buf)
+}
+
+func TestGenBaseEmitMaxLines(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	for _, tc := range []struct {
+		maxLines, numLines int
+		wantLineCounts     []int
+	}{
+		{0, 10, []int{10}},
+		{4, 10, []int{4, 4, 2}},
+		{5, 10, []int{5, 5}},
+		{20, 10, []int{10}},
+	} {
+		t.Run(fmt.Sprintf("maxLines=%d,numLines=%d", tc.maxLines, tc.numLines), func(t *testing.T) {
+			mq := &lineCountMetricsQueue{TestMetricsQueue: vmi_testutils.NewTestMetricsQueue(0)}
+			gb := &GeneratorBase{
+				Id:                "test_gen",
+				MetricsQueue:      mq,
+				MaxLinesPerBuffer: tc.maxLines,
+			}
+			gb.GenBaseInit()
+
+			ts := time.UnixMilli(1746121347582)
+			buf := mq.GetBuf()
+			gb.GenBaseMetricsStart(buf, ts)
+			tsSuffix := gb.TsSuffixBuf.Bytes()
+			wantByteCount, gotByteCount := 0, 0
+			for i := 0; i < tc.numLines; i++ {
+				if buf == nil {
+					buf = mq.GetBuf()
+				}
+				n := buf.Len()
+				fmt.Fprintf(buf, `vmi_test_metric{line="%d"} %d`, i, i)
+				buf.Write(tsSuffix)
+				wantByteCount += buf.Len() - n
+				var byteCount int
+				buf, byteCount = gb.GenBaseEmit(buf, 1)
+				gotByteCount += byteCount
+			}
+			if buf != nil {
+				gotByteCount += buf.Len()
+				mq.QueueBuf(buf)
+			}
+
+			if gotByteCount != wantByteCount {
+				t.Errorf("byteCount: want: %d, got: %d", wantByteCount, gotByteCount)
+			}
+			if len(mq.lineCounts) != len(tc.wantLineCounts) {
+				t.Fatalf("lineCounts: want: %v, got: %v", tc.wantLineCounts, mq.lineCounts)
+			}
+			for i, want := range tc.wantLineCounts {
+				if mq.lineCounts[i] != want {
+					t.Fatalf("lineCounts: want: %v, got: %v", tc.wantLineCounts, mq.lineCounts)
+				}
+			}
+		})
+	}
+}
+
+func TestGenBaseMetricsStartTimestampOffset(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedTimestampOffset := TimestampOffset
+	defer func() { TimestampOffset = savedTimestampOffset }()
+
+	ts := time.UnixMilli(1746121347582)
+	for _, offset := range []time.Duration{0, 1500 * time.Millisecond, -2 * time.Hour} {
+		t.Run(fmt.Sprintf("offset=%s", offset), func(t *testing.T) {
+			TimestampOffset = offset
+			mq := vmi_testutils.NewTestMetricsQueue(0)
+			gb := &GeneratorBase{Id: "test_gen", MetricsQueue: mq}
+			gb.GenBaseInit()
+
+			// The 2nd invocation publishes the interval, which should not be
+			// affected by the offset:
+			interval := time.Second
+			buf := mq.GetBuf()
+			gb.GenBaseMetricsStart(buf, ts)
+			gb.GenBaseMetricsStart(buf, ts.Add(interval))
+
+			wantTsSuffix := fmt.Sprintf(" %d\n", ts.Add(interval).Add(offset).UnixMilli())
+			if got := gb.TsSuffixBuf.String(); got != wantTsSuffix {
+				t.Fatalf("TsSuffixBuf: want: %q, got: %q", wantTsSuffix, got)
+			}
+			wantMetric := fmt.Sprintf(
+				`%s{%s="%s",%s="%s",%s="%s"} %.6f%s`,
+				METRICS_GENERATOR_DTIME_METRIC,
+				INSTANCE_LABEL_NAME, gb.Instance,
+				HOSTNAME_LABEL_NAME, gb.Hostname,
+				METRICS_GENERATOR_ID_LABEL_NAME, gb.Id,
+				interval.Seconds(), wantTsSuffix,
+			)
+			if got := buf.String(); got != wantMetric {
+				t.Fatalf("metric: want: %q, got: %q", wantMetric, got)
+			}
+			if !gb.LastTs.Equal(ts.Add(interval)) {
+				t.Fatalf("LastTs: want: %s, got: %s", ts.Add(interval), gb.LastTs)
+			}
+		})
+	}
+}
+
+func TestGenBaseEmitTargetSizeHint(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	ts := time.UnixMilli(1746121347582)
+	// All lines have the same length, single digit line#:
+	lineLen := len(fmt.Sprintf(`vmi_test_metric{line="0"} 0 %d`+"\n", ts.UnixMilli()))
+	numLines, queueTargetSize := 7, 1024*1024
+
+	for _, tc := range []struct {
+		hintLines      int
+		wantLineCounts []int
+	}{
+		{0, []int{7}},
+		{3, []int{3, 3, 1}},
+		{7, []int{7}},
+	} {
+		t.Run(fmt.Sprintf("hintLines=%d", tc.hintLines), func(t *testing.T) {
+			mq := &lineCountMetricsQueue{TestMetricsQueue: vmi_testutils.NewTestMetricsQueue(queueTargetSize)}
+			gb := &GeneratorBase{
+				Id:                "test_gen",
+				MetricsQueue:      mq,
+				BufTargetSizeHint: tc.hintLines * lineLen,
+			}
+			gb.GenBaseInit()
+
+			buf := mq.GetBuf()
+			gb.GenBaseMetricsStart(buf, ts)
+			tsSuffix := gb.TsSuffixBuf.Bytes()
+			for i := 0; i < numLines; i++ {
+				if buf == nil {
+					buf = mq.GetBuf()
+				}
+				fmt.Fprintf(buf, `vmi_test_metric{line="%d"} %d`, i, i)
+				buf.Write(tsSuffix)
+				buf, _ = gb.GenBaseEmit(buf, 1)
+			}
+			if buf != nil {
+				mq.QueueBuf(buf)
+			}
+
+			if len(mq.lineCounts) != len(tc.wantLineCounts) {
+				t.Fatalf("lineCounts: want: %v, got: %v", tc.wantLineCounts, mq.lineCounts)
+			}
+			for i, want := range tc.wantLineCounts {
+				if mq.lineCounts[i] != want {
+					t.Fatalf("lineCounts: want: %v, got: %v", tc.wantLineCounts, mq.lineCounts)
+				}
+			}
+		})
+	}
+}
+
+// Valid float values in the Prometheus exposition format (NaN and Inf are
+// not expected here):
+var promFloatValueRegexp = regexp.MustCompile(`^[-+]?(\d+(\.\d*)?|\.\d+)([eE][-+]?\d+)?$`)
+
+func TestWriteFloatValue(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedFloatFormat := FloatFormat
+	defer func() { FloatFormat = savedFloatFormat }()
+
+	for _, tc := range []struct {
+		format byte
+		val    float64
+		prec   int
+		want   string
+	}{
+		{'f', 1.5, 3, "1.500"},
+		{'f', 1e21, 3, "1000000000000000000000.000"},
+		{'f', 1.234e-9, 3, "0.000"},
+		{'f', -42.125, 2, "-42.12"},
+		{'g', 1.5, 3, "1.5"},
+		{'g', 1e21, 3, "1e+21"},
+		{'g', 1.234e-9, 3, "1.234e-09"},
+		{'g', -42.125, 2, "-42.125"},
+		{'g', 100, 3, "100"},
+	} {
+		t.Run(fmt.Sprintf("format=%c,val=%v,prec=%d", tc.format, tc.val, tc.prec), func(t *testing.T) {
+			FloatFormat = tc.format
+			buf := &bytes.Buffer{}
+			buf.WriteString(`vmi_test_metric{label="val"} `)
+			n := buf.Len()
+			WriteFloatValue(buf, tc.val, tc.prec)
+			got := buf.String()[n:]
+			if got != tc.want {
+				t.Fatalf("want: %q, got: %q", tc.want, got)
+			}
+			if !promFloatValueRegexp.MatchString(got) {
+				t.Fatalf("%q: invalid exposition value", got)
+			}
+			if _, err := strconv.ParseFloat(got, 64); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestGenBaseWriteFloatMetricNonFinite(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats, savedDropNonFinite := MetricsGenStats, DropNonFinite
+	defer func() { MetricsGenStats, DropNonFinite = savedMetricsGenStats, savedDropNonFinite }()
+
+	ts := time.UnixMilli(1746121347582)
+	metric := []byte(`vmi_test_rate{label="val"} `)
+	vals := []float64{1.5, math.NaN(), math.Inf(1), math.Inf(-1)}
+	for _, tc := range []struct {
+		dropNonFinite bool
+		wantLines     []string
+	}{
+		{
+			false,
+			[]string{
+				fmt.Sprintf("%s1.500 %d", metric, ts.UnixMilli()),
+				fmt.Sprintf("%sNaN %d", metric, ts.UnixMilli()),
+				fmt.Sprintf("%s+Inf %d", metric, ts.UnixMilli()),
+				fmt.Sprintf("%s-Inf %d", metric, ts.UnixMilli()),
+			},
+		},
+		{
+			true,
+			[]string{
+				fmt.Sprintf("%s1.500 %d", metric, ts.UnixMilli()),
+			},
+		},
+	} {
+		t.Run(fmt.Sprintf("dropNonFinite=%v", tc.dropNonFinite), func(t *testing.T) {
+			MetricsGenStats, DropNonFinite = NewMetricsGeneratorStatsContainer(), tc.dropNonFinite
+
+			mq := vmi_testutils.NewTestMetricsQueue(0)
+			gb := &GeneratorBase{Id: "test_gen", MetricsQueue: mq}
+			gb.GenBaseInit()
+			buf := mq.GetBuf()
+			gb.GenBaseMetricsStart(buf, ts)
+			writeCount := 0
+			for _, val := range vals {
+				if gb.GenBaseWriteFloatMetric(buf, metric, val, 3) {
+					writeCount++
+				}
+			}
+			if writeCount != len(tc.wantLines) {
+				t.Errorf("write count: want: %d, got: %d", len(tc.wantLines), writeCount)
+			}
+			if got, want := buf.String(), strings.Join(tc.wantLines, "\n")+"\n"; got != want {
+				t.Errorf("buf: want: %q, got: %q", want, got)
+			}
+			if got := MetricsGenStats.eventStats[gb.Id][METRICS_GENERATOR_NONFINITE_COUNT]; got != 3 {
+				t.Errorf("nonfinite count: want: 3, got: %d", got)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+// Metrics generator groups.
+
+package vmi_internal
+
+// A metrics generator normally maps to one task with one interval. Sometimes
+// it is desirable to generate different groups of metrics from the same data
+// source at different intervals, e.g. fast changing gauges every 2s and slow
+// changing inventory every 60s, without having to re-parse the data for each
+// group.
+//
+// A generator group consists of multiple members, each scheduled as its own
+// task with its own interval, full metrics factor and GeneratorBase, while
+// sharing the generator instance. The members may be executed concurrently by
+// the scheduler's workers, so the access to the shared state is serialized via
+// the group lock, which is held for the duration of the member's activity.
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// The member ID is <group_id><sep><name>:
+	GENERATOR_GROUP_MEMBER_ID_SEP = "_"
+)
+
+type GeneratorGroupMember struct {
+	GeneratorBase
+	// The group it belongs to:
+	Group *GeneratorGroup
+	// The actual metrics generation, invoked with the group lock held:
+	Activity func(member *GeneratorGroupMember) bool
+}
+
+// Satisfy MetricsGeneratorTask I/F:
+func (member *GeneratorGroupMember) TaskActivity() bool {
+	member.Group.mu.Lock()
+	defer member.Group.mu.Unlock()
+	return member.Activity(member)
+}
+
+type GeneratorGroup struct {
+	// The group ID, used as prefix for the member IDs:
+	Id string
+	// The members, in the order in which they were added:
+	Members []*GeneratorGroupMember
+	// Shared state lock:
+	mu *sync.Mutex
+}
+
+func NewGeneratorGroup(id string) *GeneratorGroup {
+	return &GeneratorGroup{
+		Id:      id,
+		Members: make([]*GeneratorGroupMember, 0),
+		mu:      &sync.Mutex{},
+	}
+}
+
+// Add a new member with its own interval and full metrics factor:
+func (group *GeneratorGroup) AddMember(
+	name string,
+	interval time.Duration,
+	fullMetricsFactor int,
+	activity func(member *GeneratorGroupMember) bool,
+) *GeneratorGroupMember {
+	member := &GeneratorGroupMember{
+		GeneratorBase: GeneratorBase{
+			Id:                group.Id + GENERATOR_GROUP_MEMBER_ID_SEP + name,
+			Interval:          interval,
+			FullMetricsFactor: fullMetricsFactor,
+			CycleNum:          GetInitialCycleNum(fullMetricsFactor),
+		},
+		Group:    group,
+		Activity: activity,
+	}
+	group.Members = append(group.Members, member)
+	return member
+}
+
+// The list of tasks, as expected from a task builder:
+func (group *GeneratorGroup) Tasks() []MetricsGeneratorTask {
+	tasks := make([]MetricsGeneratorTask, len(group.Members))
+	for i, member := range group.Members {
+		tasks[i] = member
+	}
+	return tasks
+}
+
+// Access to the shared state outside of the member activities:
+func (group *GeneratorGroup) Lock()   { group.mu.Lock() }
+func (group *GeneratorGroup) Unlock() { group.mu.Unlock() }
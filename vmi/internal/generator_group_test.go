@@ -0,0 +1,84 @@
+// Tests for generator_group.go
+
+package vmi_internal
+
+import (
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestGeneratorGroupCadence(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	fastInterval, slowInterval, runTime := 100*time.Millisecond, 500*time.Millisecond, 2*time.Second
+	// Allow for the 1st, irregular, invocation and scheduling jitter:
+	tolerance := 0.2
+
+	// Shared state: the fast member "parses", the slow one reports the count:
+	parseCount, slowParseCounts := 0, make([]int, 0)
+	group := NewGeneratorGroup("test")
+	fastMember := group.AddMember("fast", fastInterval, 1, func(member *GeneratorGroupMember) bool {
+		parseCount++
+		return true
+	})
+	slowMember := group.AddMember("slow", slowInterval, 1, func(member *GeneratorGroupMember) bool {
+		slowParseCounts = append(slowParseCounts, parseCount)
+		return true
+	})
+
+	for _, want := range []struct {
+		member *GeneratorGroupMember
+		id     string
+	}{
+		{fastMember, "test_fast"},
+		{slowMember, "test_slow"},
+	} {
+		if got := want.member.GetId(); got != want.id {
+			t.Fatalf("id: want: %q, got: %q", want.id, got)
+		}
+	}
+	tasks := group.Tasks()
+	if len(tasks) != 2 {
+		t.Fatalf("len(tasks): want: 2, got: %d", len(tasks))
+	}
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	for _, genTask := range tasks {
+		scheduler.AddNewTask(NewMetricsGeneratorTask(genTask))
+	}
+	time.Sleep(runTime)
+	scheduler.Shutdown()
+
+	group.Lock()
+	defer group.Unlock()
+
+	for _, check := range []struct {
+		name     string
+		count    int
+		interval time.Duration
+	}{
+		{"fast", parseCount, fastInterval},
+		{"slow", len(slowParseCounts), slowInterval},
+	} {
+		wantCount := float64(runTime) / float64(check.interval)
+		minCount, maxCount := int((1-tolerance)*wantCount), int((1+tolerance)*wantCount)+1
+		if check.count < minCount || maxCount < check.count {
+			t.Fatalf("%s: count: want: %d..%d, got: %d", check.name, minCount, maxCount, check.count)
+		}
+	}
+
+	// The slow member should have observed the progress of the fast one; skip
+	// the 1st, irregular, invocation, which may occur close to the 2nd one:
+	for i := 2; i < len(slowParseCounts); i++ {
+		if slowParseCounts[i] <= slowParseCounts[i-1] {
+			t.Fatalf("slow parse counts: want increasing, got: %v", slowParseCounts)
+		}
+	}
+}
@@ -16,11 +16,29 @@ const (
 	METRICS_GENERATOR_NUM_STATS
 )
 
+// Event stats, tracked only for the generators which had such events, e.g.
+// timestamp regressions, dropped metrics, NaN/Inf values or stale metrics, and
+// reported only for the latter:
+const (
+	METRICS_GENERATOR_TS_REGRESSION_COUNT = iota
+	METRICS_GENERATOR_DROPPED_METRICS_COUNT
+	METRICS_GENERATOR_NONFINITE_COUNT
+	METRICS_GENERATOR_STALE_DROPPED_COUNT
+	// Must be last:
+	METRICS_GENERATOR_NUM_EVENT_STATS
+)
+
+// The generator ID used for the events which cannot be attributed:
+const METRICS_GENERATOR_UNKNOWN_ID = "unknown"
+
 type MetricsGeneratorStats map[string][]uint64
 
 type MetricsGeneratorStatsContainer struct {
 	// Stats proper:
 	stats MetricsGeneratorStats
+	// Event stats, kept separately since they are reported only if there were
+	// events:
+	eventStats MetricsGeneratorStats
 	// Lock:
 	mu *sync.Mutex
 }
@@ -31,10 +49,18 @@ var MetricsGeneratorStatsMetricsNameMap = map[int]string{
 	METRICS_GENERATOR_BYTE_COUNT:       METRICS_GENERATOR_BYTE_DELTA_METRIC,
 }
 
+var MetricsGeneratorEventStatsMetricsNameMap = map[int]string{
+	METRICS_GENERATOR_TS_REGRESSION_COUNT:   METRICS_GENERATOR_TS_REGRESSION_DELTA_METRIC,
+	METRICS_GENERATOR_DROPPED_METRICS_COUNT: METRICS_GENERATOR_DROPPED_DELTA_METRIC,
+	METRICS_GENERATOR_NONFINITE_COUNT:       METRICS_GENERATOR_NONFINITE_DELTA_METRIC,
+	METRICS_GENERATOR_STALE_DROPPED_COUNT:   METRICS_GENERATOR_STALE_DROPPED_DELTA_METRIC,
+}
+
 func NewMetricsGeneratorStatsContainer() *MetricsGeneratorStatsContainer {
 	return &MetricsGeneratorStatsContainer{
-		stats: make(MetricsGeneratorStats),
-		mu:    &sync.Mutex{},
+		stats:      make(MetricsGeneratorStats),
+		eventStats: make(MetricsGeneratorStats),
+		mu:         &sync.Mutex{},
 	}
 }
 
@@ -52,10 +78,42 @@ func (mgsc *MetricsGeneratorStatsContainer) Update(genId string, metricCount, by
 	genStats[METRICS_GENERATOR_BYTE_COUNT] += byteCount
 }
 
+func (mgsc *MetricsGeneratorStatsContainer) updateEventStats(genId string, index int, count uint64) {
+	if genId == "" {
+		genId = METRICS_GENERATOR_UNKNOWN_ID
+	}
+	mgsc.mu.Lock()
+	defer mgsc.mu.Unlock()
+
+	genEventStats := mgsc.eventStats[genId]
+	if genEventStats == nil {
+		genEventStats = make([]uint64, METRICS_GENERATOR_NUM_EVENT_STATS)
+		mgsc.eventStats[genId] = genEventStats
+	}
+	genEventStats[index] += count
+}
+
+func (mgsc *MetricsGeneratorStatsContainer) UpdateTsRegression(genId string) {
+	mgsc.updateEventStats(genId, METRICS_GENERATOR_TS_REGRESSION_COUNT, 1)
+}
+
+func (mgsc *MetricsGeneratorStatsContainer) UpdateDropped(genId string, metricCount uint64) {
+	mgsc.updateEventStats(genId, METRICS_GENERATOR_DROPPED_METRICS_COUNT, metricCount)
+}
+
+func (mgsc *MetricsGeneratorStatsContainer) UpdateNonFinite(genId string) {
+	mgsc.updateEventStats(genId, METRICS_GENERATOR_NONFINITE_COUNT, 1)
+}
+
+func (mgsc *MetricsGeneratorStatsContainer) UpdateStaleDropped(genId string, metricCount uint64) {
+	mgsc.updateEventStats(genId, METRICS_GENERATOR_STALE_DROPPED_COUNT, metricCount)
+}
+
 func (mgsc *MetricsGeneratorStatsContainer) Clear() {
 	mgsc.mu.Lock()
 	defer mgsc.mu.Unlock()
 	clear(mgsc.stats)
+	clear(mgsc.eventStats)
 }
 
 type GeneratorInternalMetrics struct {
@@ -69,51 +127,91 @@ type GeneratorInternalMetrics struct {
 	// Cache for the metrics, `name{label="val",...}`, indexed by the generator
 	// Id and stats index:
 	metricsCache map[string][][]byte
+	// Stale cache eviction:
+	cacheAging *metricsCacheAging
+	// Same for the event stats:
+	eventStats        [2]MetricsGeneratorStats
+	eventMetricsCache map[string][][]byte
+	eventCacheAging   *metricsCacheAging
 }
 
 func NewGeneratorInternalMetrics(internalMetrics *InternalMetrics) *GeneratorInternalMetrics {
 	return &GeneratorInternalMetrics{
-		internalMetrics: internalMetrics,
-		metricsCache:    make(map[string][][]byte),
+		internalMetrics:   internalMetrics,
+		metricsCache:      make(map[string][][]byte),
+		cacheAging:        newMetricsCacheAging(internalMetrics.staleCacheEvictIntervals),
+		eventMetricsCache: make(map[string][][]byte),
+		eventCacheAging:   newMetricsCacheAging(internalMetrics.staleCacheEvictIntervals),
 	}
 }
 
-func (gim *GeneratorInternalMetrics) SnapStats() {
-	MetricsGenStats.mu.Lock()
-	defer MetricsGenStats.mu.Unlock()
-
-	toStats := gim.generatorStats[gim.currIndex]
+// Snap the stats from a container into the dual storage:
+func snapMetricsGeneratorStats(toStats, fromStats MetricsGeneratorStats, numStats int) MetricsGeneratorStats {
 	if toStats == nil {
 		toStats = make(MetricsGeneratorStats)
-		gim.generatorStats[gim.currIndex] = toStats
 	}
-
-	for genId, genStats := range MetricsGenStats.stats {
+	for genId := range toStats {
+		if _, ok := fromStats[genId]; !ok {
+			delete(toStats, genId)
+		}
+	}
+	for genId, genStats := range fromStats {
 		toGenStats := toStats[genId]
 		if toGenStats == nil {
-			toGenStats = make([]uint64, METRICS_GENERATOR_NUM_STATS)
+			toGenStats = make([]uint64, numStats)
 			toStats[genId] = toGenStats
 		}
 		copy(toGenStats, genStats)
 	}
+	return toStats
+}
+
+func (gim *GeneratorInternalMetrics) SnapStats() {
+	MetricsGenStats.mu.Lock()
+	defer MetricsGenStats.mu.Unlock()
+
+	gim.generatorStats[gim.currIndex] = snapMetricsGeneratorStats(
+		gim.generatorStats[gim.currIndex], MetricsGenStats.stats, METRICS_GENERATOR_NUM_STATS,
+	)
+	gim.eventStats[gim.currIndex] = snapMetricsGeneratorStats(
+		gim.eventStats[gim.currIndex], MetricsGenStats.eventStats, METRICS_GENERATOR_NUM_EVENT_STATS,
+	)
 }
 
 func (gim *GeneratorInternalMetrics) updateMetricsCache(genId string) {
 	instance, hostname := gim.internalMetrics.Instance, gim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := gim.internalMetrics.InstanceLabelName, gim.internalMetrics.HostnameLabelName
 
 	indexMetricMap := make([][]byte, METRICS_GENERATOR_NUM_STATS)
 	for index, name := range MetricsGeneratorStatsMetricsNameMap {
 		indexMetricMap[index] = []byte(fmt.Sprintf(
 			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 			METRICS_GENERATOR_ID_LABEL_NAME, genId,
 		))
 	}
 	gim.metricsCache[genId] = indexMetricMap
 }
 
+func (gim *GeneratorInternalMetrics) updateEventMetricsCache(genId string) {
+	instance, hostname := gim.internalMetrics.Instance, gim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := gim.internalMetrics.InstanceLabelName, gim.internalMetrics.HostnameLabelName
+
+	indexMetricMap := make([][]byte, METRICS_GENERATOR_NUM_EVENT_STATS)
+	for index, name := range MetricsGeneratorEventStatsMetricsNameMap {
+		indexMetricMap[index] = []byte(fmt.Sprintf(
+			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
+			METRICS_GENERATOR_ID_LABEL_NAME, genId,
+		))
+	}
+	gim.eventMetricsCache[genId] = indexMetricMap
+}
+
 func (gim *GeneratorInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix []byte) (int, int, *bytes.Buffer) {
 	crtStats, prevStats := gim.generatorStats[gim.currIndex], gim.generatorStats[1-gim.currIndex]
 
@@ -139,7 +237,7 @@ func (gim *GeneratorInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix
 		for index, metric := range metrics {
 			val := crtGenStats[index]
 			if prevGenStats != nil {
-				val -= prevGenStats[index]
+				val = uint64Delta(val, prevGenStats[index])
 			}
 			if buf == nil {
 				buf = mq.GetBuf()
@@ -152,12 +250,43 @@ func (gim *GeneratorInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix
 
 		if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 			partialByteCount += n
-			mq.QueueBuf(buf)
+			QueueBufFor(mq, gim.internalMetrics.Id, buf)
 			buf = nil
 		}
 
 	}
 
+	crtEventStats, prevEventStats := gim.eventStats[gim.currIndex], gim.eventStats[1-gim.currIndex]
+	for genId, crtGenEventStats := range crtEventStats {
+		metrics := gim.eventMetricsCache[genId]
+		if metrics == nil {
+			gim.updateEventMetricsCache(genId)
+			metrics = gim.eventMetricsCache[genId]
+		}
+		if prevEventStats != nil {
+			prevGenStats = prevEventStats[genId]
+		} else {
+			prevGenStats = nil
+		}
+		for index, metric := range metrics {
+			val := crtGenEventStats[index]
+			if prevGenStats != nil {
+				val = uint64Delta(val, prevGenStats[index])
+			}
+			if buf == nil {
+				buf = mq.GetBuf()
+			}
+			buf.Write(metric)
+			fmt.Fprintf(buf, "%d", val)
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+	}
+
+	// Evict the cache for generators no longer reporting:
+	evictStaleMetricsCache(gim.cacheAging, gim.metricsCache, crtStats)
+	evictStaleMetricsCache(gim.eventCacheAging, gim.eventMetricsCache, crtEventStats)
+
 	gim.currIndex = 1 - gim.currIndex
 
 	return metricsCount, partialByteCount, buf
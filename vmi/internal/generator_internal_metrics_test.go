@@ -6,6 +6,7 @@ import (
 	"maps"
 	"path"
 	"testing"
+	"time"
 
 	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
 )
@@ -102,3 +103,128 @@ func TestGeneratorInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestGeneratorInternalMetricsTsRegression(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats, savedDetectTsRegression := MetricsGenStats, DetectTsRegression
+	MetricsGenStats, DetectTsRegression = NewMetricsGeneratorStatsContainer(), true
+	defer func() { MetricsGenStats, DetectTsRegression = savedMetricsGenStats, savedDetectTsRegression }()
+
+	tc := &GeneratorInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+	}
+	internalMetrics, err := newGeneratorTestInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+
+	genId := "test_gen"
+	gb := &GeneratorBase{Id: genId, MetricsQueue: testMetricsQueue}
+	gb.GenBaseInit()
+	ts := time.UnixMilli(tc.PromTs)
+	for _, dt := range []time.Duration{0, time.Second, -500 * time.Millisecond, time.Second} {
+		ts = ts.Add(dt)
+		buf := testMetricsQueue.GetBuf()
+		gb.GenBaseMetricsStart(buf, ts)
+		testMetricsQueue.ReturnBuf(buf)
+	}
+	if got := MetricsGenStats.eventStats[genId][METRICS_GENERATOR_TS_REGRESSION_COUNT]; got != 1 {
+		t.Fatalf("tsRegression[%q]: want: 1, got: %d", genId, got)
+	}
+
+	gim := internalMetrics.generatorMetrics
+	gim.SnapStats()
+	_, _, buf := gim.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} 1 %d`,
+		METRICS_GENERATOR_TS_REGRESSION_DELTA_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		METRICS_GENERATOR_ID_LABEL_NAME, genId,
+		tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestGeneratorInternalMetricsDropped(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats := MetricsGenStats
+	MetricsGenStats = NewMetricsGeneratorStatsContainer()
+	defer func() { MetricsGenStats = savedMetricsGenStats }()
+
+	tc := &GeneratorInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+	}
+	internalMetrics, err := newGeneratorTestInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+
+	// Buffers queued after shutdown are discarded:
+	stdoutMetricsQueue, err := newStdoutMetricsQueue(nil, &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdoutMetricsQueue.Shutdown()
+
+	droppedGenId, keptGenId, numLines := "dropped_gen", "kept_gen", 3
+	for _, genId := range []string{droppedGenId, keptGenId} {
+		var mq BufferQueue = testMetricsQueue
+		if genId == droppedGenId {
+			mq = stdoutMetricsQueue
+		}
+		buf := mq.GetBuf()
+		for i := 0; i < numLines; i++ {
+			fmt.Fprintf(buf, "vmi_test_metric{gen=%q,line=\"%d\"} %d %d\n", genId, i, i, tc.PromTs)
+		}
+		QueueBufFor(mq, genId, buf)
+	}
+	if got := MetricsGenStats.eventStats[keptGenId]; got != nil {
+		t.Fatalf("eventStats[%q]: want: nil, got: %v", keptGenId, got)
+	}
+
+	gim := internalMetrics.generatorMetrics
+	gim.SnapStats()
+	_, _, buf := gim.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} %d %d`,
+		METRICS_GENERATOR_DROPPED_DELTA_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		METRICS_GENERATOR_ID_LABEL_NAME, droppedGenId,
+		numLines,
+		tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	for _, metric := range testMetricsQueue.GetMetrics() {
+		if bytes.HasPrefix([]byte(metric), []byte(METRICS_GENERATOR_DROPPED_DELTA_METRIC+"{")) && metric != wantMetric {
+			fmt.Fprintf(errBuf, "\nunexpected metric: %s", metric)
+		}
+	}
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
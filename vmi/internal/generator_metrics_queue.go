@@ -0,0 +1,109 @@
+// Per generator bounded metrics queue.
+
+package vmi_internal
+
+// All generators share the same metrics queue, so if the latter is full, e.g.
+// because of a slow sink, every generator blocks in QueueBuf. A generator may
+// opt for its own bounded queue (see GeneratorBase.QueueSize), drained by a
+// dedicated goroutine into the shared one. When the generator's queue is full,
+// the buffers are dropped, rather than blocking the generator, and the drops
+// are accounted as dropped metrics for the generator.
+//
+// This provides only partial isolation: the forwarding goroutine still blocks
+// while the shared queue is full, but the generators which own a queue are no
+// longer stalled and, by not piling up their buffers in the shared queue, they
+// leave room for the others.
+
+import (
+	"bytes"
+	"sync"
+)
+
+type GeneratorMetricsQueue struct {
+	BufferQueue
+	// The generator owning the queue:
+	genId string
+	// The bounded queue proper:
+	queue chan *bytes.Buffer
+	// Whether the queue was shutdown or not, queuing into a closed queue will
+	// drop the buffer:
+	closed bool
+	mu     *sync.Mutex
+	// Closed when the forwarding goroutine exits:
+	done chan bool
+}
+
+// All the generator queues, drained at shutdown:
+var generatorMetricsQueues = struct {
+	queues []*GeneratorMetricsQueue
+	mu     *sync.Mutex
+}{
+	mu: &sync.Mutex{},
+}
+
+func NewGeneratorMetricsQueue(metricsQueue BufferQueue, genId string, size int) *GeneratorMetricsQueue {
+	if size < 1 {
+		size = 1
+	}
+	gq := &GeneratorMetricsQueue{
+		BufferQueue: metricsQueue,
+		genId:       genId,
+		queue:       make(chan *bytes.Buffer, size),
+		mu:          &sync.Mutex{},
+		done:        make(chan bool),
+	}
+	go gq.forward()
+	generatorMetricsQueues.mu.Lock()
+	generatorMetricsQueues.queues = append(generatorMetricsQueues.queues, gq)
+	generatorMetricsQueues.mu.Unlock()
+	generatorLog.Infof("%s: queue_size=%d", genId, size)
+	return gq
+}
+
+func (gq *GeneratorMetricsQueue) forward() {
+	defer close(gq.done)
+	for buf := range gq.queue {
+		QueueBufFor(gq.BufferQueue, gq.genId, buf)
+	}
+}
+
+func (gq *GeneratorMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	gq.QueueBufFor(gq.genId, buf)
+}
+
+func (gq *GeneratorMetricsQueue) QueueBufFor(genId string, buf *bytes.Buffer) {
+	gq.mu.Lock()
+	defer gq.mu.Unlock()
+	if !gq.closed {
+		select {
+		case gq.queue <- buf:
+			return
+		default:
+		}
+	}
+	updateDroppedMetrics(genId, buf.Bytes())
+	gq.BufferQueue.ReturnBuf(buf)
+}
+
+// Close the queue and wait for the pending buffers to be forwarded:
+func (gq *GeneratorMetricsQueue) Shutdown() {
+	gq.mu.Lock()
+	if !gq.closed {
+		gq.closed = true
+		close(gq.queue)
+	}
+	gq.mu.Unlock()
+	<-gq.done
+}
+
+// Shutdown all the generator queues; this should be called after the
+// generators were stopped and before the shared queue is shutdown:
+func ShutdownGeneratorMetricsQueues() {
+	generatorMetricsQueues.mu.Lock()
+	queues := generatorMetricsQueues.queues
+	generatorMetricsQueues.queues = nil
+	generatorMetricsQueues.mu.Unlock()
+	for _, gq := range queues {
+		gq.Shutdown()
+	}
+}
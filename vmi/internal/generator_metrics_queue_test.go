@@ -0,0 +1,123 @@
+package vmi_internal
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// Shared metrics queue mock, blocking the buffers of selected generators,
+// i.e. a slow sink for their data, until released:
+type testGeneratorMetricsQueueSink struct {
+	blocked  map[string]chan bool
+	received map[string]int
+	mu       *sync.Mutex
+}
+
+func (sink *testGeneratorMetricsQueueSink) GetBuf() *bytes.Buffer     { return &bytes.Buffer{} }
+func (sink *testGeneratorMetricsQueueSink) ReturnBuf(b *bytes.Buffer) {}
+func (sink *testGeneratorMetricsQueueSink) GetTargetSize() int        { return 0 }
+
+func (sink *testGeneratorMetricsQueueSink) QueueBuf(b *bytes.Buffer) {
+	sink.QueueBufFor(METRICS_GENERATOR_UNKNOWN_ID, b)
+}
+
+func (sink *testGeneratorMetricsQueueSink) QueueBufFor(genId string, b *bytes.Buffer) {
+	if release := sink.blocked[genId]; release != nil {
+		<-release
+	}
+	sink.mu.Lock()
+	sink.received[genId] += 1
+	sink.mu.Unlock()
+}
+
+func (sink *testGeneratorMetricsQueueSink) getReceived(genId string) int {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	return sink.received[genId]
+}
+
+func testGeneratorMetricsQueueDropped(genId string) uint64 {
+	MetricsGenStats.mu.Lock()
+	defer MetricsGenStats.mu.Unlock()
+	if genEventStats := MetricsGenStats.eventStats[genId]; genEventStats != nil {
+		return genEventStats[METRICS_GENERATOR_DROPPED_METRICS_COUNT]
+	}
+	return 0
+}
+
+func TestGeneratorMetricsQueue(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricsGenStats := MetricsGenStats
+	defer func() { MetricsGenStats = savedMetricsGenStats }()
+	MetricsGenStats = NewMetricsGeneratorStatsContainer()
+
+	slowGenId, fastGenId := "slow", "fast"
+	queueSize, numBuffers, timeout := 2, 10, 2*time.Second
+
+	release := make(chan bool)
+	sink := &testGeneratorMetricsQueueSink{
+		blocked:  map[string]chan bool{slowGenId: release},
+		received: make(map[string]int),
+		mu:       &sync.Mutex{},
+	}
+	slowQueue := NewGeneratorMetricsQueue(sink, slowGenId, queueSize)
+	fastQueue := NewGeneratorMetricsQueue(sink, fastGenId, queueSize)
+
+	queueBuffers := func(gq *GeneratorMetricsQueue, waitForDelivery bool) {
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < numBuffers; i++ {
+				gq.QueueBuf(bytes.NewBufferString("metric 1 1000\n"))
+				if waitForDelivery {
+					for sink.getReceived(gq.genId) <= i {
+						time.Sleep(time.Millisecond)
+					}
+				}
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(timeout):
+			t.Fatalf("%s: QueueBuf blocked", gq.genId)
+		}
+	}
+
+	// The slow generator's queue fills up, with one buffer in transit, blocked
+	// in the sink, and the rest should be dropped w/o blocking the generator:
+	queueBuffers(slowQueue, false)
+	wantMinDropped := uint64(numBuffers - queueSize - 1)
+	if got := testGeneratorMetricsQueueDropped(slowGenId); got < wantMinDropped {
+		t.Fatalf("%s dropped: want >= %d, got: %d", slowGenId, wantMinDropped, got)
+	}
+
+	// The fast generator should deliver all its buffers, unaffected:
+	queueBuffers(fastQueue, true)
+	if got := sink.getReceived(fastGenId); got != numBuffers {
+		t.Fatalf("%s received: want: %d, got: %d", fastGenId, numBuffers, got)
+	}
+	if got := testGeneratorMetricsQueueDropped(fastGenId); got != 0 {
+		t.Fatalf("%s dropped: want: 0, got: %d", fastGenId, got)
+	}
+
+	// Release the slow sink, the pending buffers should be flushed at shutdown:
+	close(release)
+	slowQueue.Shutdown()
+	fastQueue.Shutdown()
+	dropped := int(testGeneratorMetricsQueueDropped(slowGenId))
+	if got := sink.getReceived(slowGenId); got+dropped != numBuffers {
+		t.Fatalf("%s received+dropped: want: %d, got: %d+%d", slowGenId, numBuffers, got, dropped)
+	}
+
+	// Queuing after shutdown should drop:
+	fastQueue.QueueBuf(bytes.NewBufferString("metric 1 1000\n"))
+	if got := testGeneratorMetricsQueueDropped(fastGenId); got != 1 {
+		t.Fatalf("%s dropped after shutdown: want: 1, got: %d", fastGenId, got)
+	}
+}
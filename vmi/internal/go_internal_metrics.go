@@ -19,6 +19,8 @@ const (
 	GO_MEM_FREE_DELTA_METRIC_INDEX
 	GO_MEM_IN_USE_OBJECT_COUNT_METRIC_INDEX
 	GO_MEM_NUM_GC_DELTA_METRIC_INDEX
+	GO_GC_PAUSE_SECONDS_TOTAL_METRIC_INDEX
+	GO_GC_PAUSE_SECONDS_LAST_METRIC_INDEX
 
 	// Must be last:
 	GO_INTERNAL_METRICS_NUM
@@ -33,6 +35,8 @@ var goInternalMetricsNameMap = map[int]string{
 	GO_MEM_FREE_DELTA_METRIC_INDEX:          GO_MEM_FREE_DELTA_METRIC,
 	GO_MEM_IN_USE_OBJECT_COUNT_METRIC_INDEX: GO_MEM_IN_USE_OBJECT_COUNT_METRIC,
 	GO_MEM_NUM_GC_DELTA_METRIC_INDEX:        GO_MEM_NUM_GC_DELTA_METRIC,
+	GO_GC_PAUSE_SECONDS_TOTAL_METRIC_INDEX:  GO_GC_PAUSE_SECONDS_TOTAL_METRIC,
+	GO_GC_PAUSE_SECONDS_LAST_METRIC_INDEX:   GO_GC_PAUSE_SECONDS_LAST_METRIC,
 }
 
 type GoInternalMetrics struct {
@@ -71,15 +75,16 @@ func (gim *GoInternalMetrics) SnapStats() {
 
 func (gim *GoInternalMetrics) updateMetricsCache() {
 	instance, hostname := gim.internalMetrics.Instance, gim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := gim.internalMetrics.InstanceLabelName, gim.internalMetrics.HostnameLabelName
 
 	gim.metricsCache = make(map[int][]byte)
 
 	for index, name := range goInternalMetricsNameMap {
 		gim.metricsCache[index] = []byte(fmt.Sprintf(
 			`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 		))
 	}
 }
@@ -128,23 +133,42 @@ func (gim *GoInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix []byte
 	// Note that deltas below work even at the 1st pass because prevMemStats has
 	// been primed w/ 0 when GoInternalMetrics was created:
 	buf.Write(metricsCache[GO_MEM_MALLOCS_DELTA_METRIC_INDEX])
-	buf.WriteString(strconv.FormatUint(currMemStats.Mallocs-prevMemStats.Mallocs, 10))
+	buf.WriteString(strconv.FormatUint(uint64Delta(currMemStats.Mallocs, prevMemStats.Mallocs), 10))
 	buf.Write(tsSuffix)
 	metricsCount++
 
 	buf.Write(metricsCache[GO_MEM_FREE_DELTA_METRIC_INDEX])
-	buf.WriteString(strconv.FormatUint(currMemStats.Frees-prevMemStats.Frees, 10))
+	buf.WriteString(strconv.FormatUint(uint64Delta(currMemStats.Frees, prevMemStats.Frees), 10))
 	buf.Write(tsSuffix)
 	metricsCount++
 
 	buf.Write(metricsCache[GO_MEM_NUM_GC_DELTA_METRIC_INDEX])
-	buf.WriteString(strconv.FormatUint(uint64(currMemStats.NumGC-prevMemStats.NumGC), 10))
+	buf.WriteString(strconv.FormatUint(uint64Delta(uint64(currMemStats.NumGC), uint64(prevMemStats.NumGC)), 10))
 	buf.Write(tsSuffix)
 	metricsCount++
 
+	// The GC pauses are published only after the 1st one:
+	if currMemStats.PauseTotalNs > 0 {
+		buf.Write(metricsCache[GO_GC_PAUSE_SECONDS_TOTAL_METRIC_INDEX])
+		WriteFloatValue(buf, float64(currMemStats.PauseTotalNs)/1e9, GO_GC_PAUSE_SECONDS_METRIC_PRECISION)
+		buf.Write(tsSuffix)
+		metricsCount++
+
+		// The most recent pause is at PauseNs[(NumGC+255)%256], see
+		// runtime.MemStats:
+		buf.Write(metricsCache[GO_GC_PAUSE_SECONDS_LAST_METRIC_INDEX])
+		WriteFloatValue(
+			buf,
+			float64(currMemStats.PauseNs[(currMemStats.NumGC+255)%256])/1e9,
+			GO_GC_PAUSE_SECONDS_METRIC_PRECISION,
+		)
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+
 	if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 		partialByteCount += n
-		mq.QueueBuf(buf)
+		QueueBufFor(mq, gim.internalMetrics.Id, buf)
 		buf = nil
 	}
 
@@ -7,6 +7,8 @@ import (
 	"fmt"
 	"path"
 	"runtime"
+	"strconv"
+	"strings"
 	"testing"
 
 	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
@@ -110,3 +112,93 @@ func TestGoInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestGoInternalMetricsGcPause(t *testing.T) {
+	tc := &GoInternalMetricsTestCase{
+		GoVersion: "go1.20.3",
+		CurrMemStats: &runtime.MemStats{
+			NumGC:        10,
+			PauseTotalNs: 12345678,
+		},
+		PrevMemStats: &runtime.MemStats{
+			NumGC: 8,
+		},
+		NumGoRoutine: 5,
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Name:        "gc_pause",
+			Description: "GC pauses, the previous one should be ignored",
+			Instance:    "vmi_test",
+			Hostname:    "vmi-test",
+			PromTs:      1234567890,
+		},
+	}
+	// The most recent pause is at PauseNs[(NumGC+255)%256]:
+	tc.CurrMemStats.PauseNs[9] = 1500000
+	tc.CurrMemStats.PauseNs[8] = 900000
+	for _, mv := range []struct {
+		name string
+		val  string
+	}{
+		{GO_NUM_GOROUTINE_METRIC, "5"},
+		{GO_MEM_SYS_BYTES_METRIC, "0"},
+		{GO_MEM_HEAP_BYTES_METRIC, "0"},
+		{GO_MEM_HEAP_SYS_BYTES_METRIC, "0"},
+		{GO_MEM_IN_USE_OBJECT_COUNT_METRIC, "0"},
+		{GO_MEM_MALLOCS_DELTA_METRIC, "0"},
+		{GO_MEM_FREE_DELTA_METRIC, "0"},
+		{GO_MEM_NUM_GC_DELTA_METRIC, "2"},
+		{GO_GC_PAUSE_SECONDS_TOTAL_METRIC, "0.012346"},
+		{GO_GC_PAUSE_SECONDS_LAST_METRIC, "0.001500"},
+	} {
+		tc.WantMetrics = append(tc.WantMetrics, fmt.Sprintf(
+			`%s{%s="%s",%s="%s"} %s %d`,
+			mv.name,
+			INSTANCE_LABEL_NAME, tc.Instance,
+			HOSTNAME_LABEL_NAME, tc.Hostname,
+			mv.val, tc.PromTs,
+		))
+	}
+	testGoInternalMetrics(tc, t)
+}
+
+func TestGoInternalMetricsGcPauseRuntime(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	internalMetrics, err := newTestInternalMetricsTsInit(&InternalMetricsTestCase{
+		Instance: "vmi_test",
+		Hostname: "vmi-test",
+		PromTs:   1234567890,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gim := NewGoInternalMetrics(internalMetrics)
+	runtime.GC()
+	gim.SnapStats()
+
+	_, _, buf := gim.generateMetrics(&bytes.Buffer{}, internalMetrics.TsSuffixBuf.Bytes())
+	gotVals := make(map[string]float64)
+	for _, line := range strings.Split(buf.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		name, _, _ := strings.Cut(fields[0], "{")
+		if val, err := strconv.ParseFloat(fields[1], 64); err == nil {
+			gotVals[name] = val
+		}
+	}
+	total, ok := gotVals[GO_GC_PAUSE_SECONDS_TOTAL_METRIC]
+	if !ok {
+		t.Fatalf("%s: missing", GO_GC_PAUSE_SECONDS_TOTAL_METRIC)
+	}
+	last, ok := gotVals[GO_GC_PAUSE_SECONDS_LAST_METRIC]
+	if !ok {
+		t.Fatalf("%s: missing", GO_GC_PAUSE_SECONDS_LAST_METRIC)
+	}
+	// Pauses are normally sub-millisecond, allow for slow test environments:
+	if total < last || last < 0 || last > 1 {
+		t.Fatalf("implausible GC pauses: total: %f, last: %f", total, last)
+	}
+}
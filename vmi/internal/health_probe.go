@@ -0,0 +1,79 @@
+// Liveness and readiness HTTP probes.
+
+package vmi_internal
+
+// When running under an orchestrator, e.g. Kubernetes, the importer may expose
+// (health_probe_addr) the following endpoints:
+//
+//	/livez:  200 once the scheduler is running, 503 otherwise
+//	/readyz: 200 if the HTTP endpoint pool has at least one healthy endpoint,
+//	         503 otherwise
+//
+// In stdout mode there is no HTTP endpoint pool and the importer is always
+// ready.
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+const (
+	HEALTH_PROBE_LIVEZ_PATH  = "/livez"
+	HEALTH_PROBE_READYZ_PATH = "/readyz"
+)
+
+var healthProbeLog = NewCompLogger("health_probe")
+
+type HealthProbeServer struct {
+	*BackgroundHttpServer
+	live atomic.Bool
+	// The pool used for readiness, nil if not applicable:
+	httpEndpointPool *HttpEndpointPool
+}
+
+func NewHealthProbeServer(addr string, httpEndpointPool *HttpEndpointPool) *HealthProbeServer {
+	hps := &HealthProbeServer{
+		httpEndpointPool: httpEndpointPool,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(HEALTH_PROBE_LIVEZ_PATH, hps.handleLivez)
+	mux.HandleFunc(HEALTH_PROBE_READYZ_PATH, hps.handleReadyz)
+	hps.BackgroundHttpServer = NewBackgroundHttpServer(addr, mux, healthProbeLog)
+	healthProbeLog.Infof(
+		"health_probe_addr=%q, livez=%q, readyz=%q",
+		addr, HEALTH_PROBE_LIVEZ_PATH, HEALTH_PROBE_READYZ_PATH,
+	)
+	return hps
+}
+
+// Set the liveness state, typically after the scheduler was started:
+func (hps *HealthProbeServer) SetLive(live bool) {
+	hps.live.Store(live)
+}
+
+func (hps *HealthProbeServer) IsLive() bool {
+	return hps.live.Load()
+}
+
+func (hps *HealthProbeServer) IsReady() bool {
+	return hps.httpEndpointPool == nil || hps.httpEndpointPool.HasHealthyEndpoint()
+}
+
+func writeProbeStatus(w http.ResponseWriter, ok bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if ok {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n"))
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ok\n"))
+	}
+}
+
+func (hps *HealthProbeServer) handleLivez(w http.ResponseWriter, r *http.Request) {
+	writeProbeStatus(w, hps.IsLive())
+}
+
+func (hps *HealthProbeServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	writeProbeStatus(w, hps.IsReady())
+}
@@ -0,0 +1,80 @@
+// Tests for health_probe.go
+
+package vmi_internal
+
+import (
+	"net/http"
+	"testing"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestHealthProbeServer(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	epPoolCfg := DefaultHttpEndpointPoolConfig()
+	epPoolCfg.Endpoints = []*HttpEndpointConfig{
+		{URL: "http://host1"},
+		{URL: "http://host2"},
+	}
+	epPool, err := NewHttpEndpointPool(epPoolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epPool.Shutdown()
+
+	hps := NewHealthProbeServer("127.0.0.1:0", epPool)
+	if err := hps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer hps.Shutdown()
+
+	probe := func(path string) int {
+		resp, err := http.Get("http://" + hps.Addr() + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Mark the head of the healthy list as unhealthy, w/o triggering the
+	// health check:
+	markUnhealthy := func() {
+		epPool.mu.Lock()
+		defer epPool.mu.Unlock()
+		ep := epPool.healthy.head
+		epPool.healthy.Remove(ep)
+		ep.healthy = false
+	}
+
+	for i, tc := range []struct {
+		live          bool
+		markUnhealthy bool
+		wantLivez     int
+		wantReadyz    int
+	}{
+		{false, false, http.StatusServiceUnavailable, http.StatusOK},
+		{true, false, http.StatusOK, http.StatusOK},
+		{true, true, http.StatusOK, http.StatusOK},
+		{true, true, http.StatusOK, http.StatusServiceUnavailable},
+		{false, false, http.StatusServiceUnavailable, http.StatusServiceUnavailable},
+	} {
+		hps.SetLive(tc.live)
+		if tc.markUnhealthy {
+			markUnhealthy()
+		}
+		if got := probe(HEALTH_PROBE_LIVEZ_PATH); got != tc.wantLivez {
+			t.Fatalf("step# %d: %s: want: %d, got: %d", i, HEALTH_PROBE_LIVEZ_PATH, tc.wantLivez, got)
+		}
+		if got := probe(HEALTH_PROBE_READYZ_PATH); got != tc.wantReadyz {
+			t.Fatalf("step# %d: %s: want: %d, got: %d", i, HEALTH_PROBE_READYZ_PATH, tc.wantReadyz, got)
+		}
+	}
+
+	// W/o HTTP endpoint pool, i.e. stdout mode, always ready:
+	if !NewHealthProbeServer("", nil).IsReady() {
+		t.Fatal("IsReady() w/o HTTP endpoint pool: want: true, got: false")
+	}
+}
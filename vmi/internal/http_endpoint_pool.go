@@ -4,21 +4,32 @@ package vmi_internal
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"math/rand"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
+
+	"github.com/docker/go-units"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"gopkg.in/yaml.v3"
 )
 
 // A VMI is configured with a list of URL endpoints for import.
@@ -35,6 +46,12 @@ import (
 // also gives a chance for closing idle connections to endpoints not currently
 // at the head. If the list has just one element then the idle connections are
 // closed explicitly.
+//
+// Optionally the content encoding may be negotiated with each endpoint upon
+// its admission into the healthy list: the endpoint is probed via an OPTIONS
+// request and the Accept-Encoding response header (RFC 7694) is used to select
+// the most preferred mutually supported encoding. The buffers, as produced by
+// the compressor (gzip), are re-encoded as needed before being sent.
 
 var epPoolLog = NewCompLogger("http_endpoint_pool")
 
@@ -42,6 +59,11 @@ const (
 	// Endpoint default values:
 	HTTP_ENDPOINT_URL_DEFAULT                      = "http://localhost:8428/api/v1/import/prometheus"
 	HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_DEFAULT = 1
+	HTTP_ENDPOINT_WEIGHT_DEFAULT                   = 1
+	// The threshold may be set to the number of addresses the endpoint host
+	// resolves to, via the following spec:
+	HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO_SPEC = "auto"
+	HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO      = -1
 
 	// Endpoint config pool default values:
 	HTTP_ENDPOINT_POOL_CONFIG_SHUFFLE_DEFAULT                        = false
@@ -51,20 +73,44 @@ const (
 	HTTP_ENDPOINT_POOL_CONFIG_HEALTH_CHECK_INTERVAL_DEFAULT          = 5 * time.Second
 	HTTP_ENDPOINT_POOL_CONFIG_HEALTHY_MAX_WAIT_DEFAULT               = 10 * time.Second
 	HTTP_ENDPOINT_POOL_CONFIG_SEND_BUFFER_TIMEOUT_DEFAULT            = 20 * time.Second
+	HTTP_ENDPOINT_POOL_CONFIG_FIRST_SEND_GATE_TIMEOUT_DEFAULT        = 0
+	HTTP_ENDPOINT_POOL_CONFIG_REQUIRE_ENDPOINT_AT_STARTUP_DEFAULT    = false
 	HTTP_ENDPOINT_POOL_CONFIG_RATE_LIMIT_MBPS_DEFAULT                = ""
+	HTTP_ENDPOINT_POOL_CONFIG_NEGOTIATE_ENCODING_DEFAULT             = false
+	HTTP_ENDPOINT_POOL_CONFIG_INFLIGHT_MAX_BYTES_DEFAULT             = ""
+	HTTP_ENDPOINT_POOL_CONFIG_HONOR_RETRY_AFTER_DEFAULT              = true
+	HTTP_ENDPOINT_POOL_CONFIG_RETRY_AFTER_MAX_DEFAULT                = 1 * time.Minute
+	HTTP_ENDPOINT_POOL_CONFIG_RETRY_ON_CONN_RESET_DEFAULT            = true
+	HTTP_ENDPOINT_POOL_CONFIG_RETRY_BACKOFF_BASE_DEFAULT             = 100 * time.Millisecond
+	HTTP_ENDPOINT_POOL_CONFIG_RETRY_BACKOFF_MAX_DEFAULT              = 5 * time.Second
+	HTTP_ENDPOINT_POOL_CONFIG_MAX_CONCURRENT_SENDS_DEFAULT           = 0 // No limit
+	HTTP_ENDPOINT_POOL_CONFIG_UNHEALTHY_THRESHOLD_REFRESH_DEFAULT    = 5 * time.Minute
+	HTTP_ENDPOINT_POOL_CONFIG_HEALTH_CHECK_MAX_RPS_DEFAULT           = 0 // No limit
+	HTTP_ENDPOINT_POOL_CONFIG_MAX_REQUESTS_PER_CONN_DEFAULT          = 0 // No limit
+	HTTP_ENDPOINT_POOL_CONFIG_BATCH_SEQ_HEADER_DEFAULT               = false
+	HTTP_ENDPOINT_POOL_CONFIG_MAX_SEND_ATTEMPTS_DEFAULT              = 0 // No limit
 	// Endpoint config definitions, later they may be configurable:
 	HTTP_ENDPOINT_POOL_HEALTHY_CHECK_MIN_INTERVAL    = 1 * time.Second
 	HTTP_ENDPOINT_POOL_HEALTHY_POLL_INTERVAL         = 500 * time.Millisecond
 	HTTP_ENDPOINT_POOL_HEALTH_CHECK_ERR_LOG_INTERVAL = 10 * time.Second
+	HTTP_ENDPOINT_POOL_DNS_LOOKUP_TIMEOUT            = 2 * time.Second
+	HTTP_ENDPOINT_POOL_CLASSIFIER_BODY_MAX_SIZE      = 64 * 1024
+	// The max jitter added to the retry backoff, as a fraction of the latter:
+	HTTP_ENDPOINT_POOL_RETRY_BACKOFF_JITTER_FACTOR = 0.2
 
 	// http.Transport config default values:
 	//   Dialer config default values:
 	HTTP_ENDPOINT_POOL_CONFIG_TCP_CONN_TIMEOUT_DEFAULT        = 2 * time.Second
 	HTTP_ENDPOINT_POOL_CONFIG_TCP_KEEP_ALIVE_DEFAULT          = 15 * time.Second
+	HTTP_ENDPOINT_POOL_CONFIG_NETWORK_DEFAULT                 = "tcp"
+	HTTP_ENDPOINT_POOL_CONFIG_FALLBACK_DELAY_DEFAULT          = 0 // i.e. net.Dialer default
+	HTTP_ENDPOINT_POOL_CONFIG_DNS_CACHE_TTL_DEFAULT           = 0 // i.e. disabled
+	HTTP_ENDPOINT_POOL_CONFIG_DNS_REFRESH_INTERVAL_DEFAULT    = 0 // i.e. disabled
 	HTTP_ENDPOINT_POOL_CONFIG_MAX_IDLE_CONNS_DEFAULT          = 0 // No limit
 	HTTP_ENDPOINT_POOL_CONFIG_MAX_IDLE_CONNS_PER_HOST_DEFAULT = 1
 	HTTP_ENDPOINT_POOL_CONFIG_MAX_CONNS_PER_HOST_DEFAULT      = 0 // No limit
 	HTTP_ENDPOINT_POOL_CONFIG_IDLE_CONN_TIMEOUT_DEFAULT       = 1 * time.Minute
+	HTTP_ENDPOINT_POOL_CONFIG_PROXY_DEFAULT                   = "" // i.e. from environment
 	// http.Client config default values:
 	HTTP_ENDPOINT_POOL_CONFIG_RESPONSE_TIMEOUT_DEFAULT = 5 * time.Second
 
@@ -72,11 +118,33 @@ const (
 	HTTP_ENDPOINT_POOL_CONFIG_PASSWORD_FILE_PREFIX = "file:"
 	HTTP_ENDPOINT_POOL_CONFIG_PASSWORD_ENV_PREFIX  = "env:"
 	HTTP_ENDPOINT_POOL_CONFIG_PASSWORD_PASS_PREFIX = "pass:"
+
+	// Content encodings:
+	HTTP_CONTENT_ENCODING_ZSTD     = "zstd"
+	HTTP_CONTENT_ENCODING_GZIP     = "gzip"
+	HTTP_CONTENT_ENCODING_IDENTITY = "identity"
+	HTTP_CONTENT_ENCODING_SNAPPY   = "snappy"
+	// The pseudo encoding of the Prometheus remote write buffers, i.e. snappy
+	// block compressed protobuf, see remote_write.go. The buffers are sent
+	// as-is, w/o encoding negotiation, w/ the remote write specific headers:
+	HTTP_CONTENT_ENCODING_REMOTE_WRITE = "remote_write"
+
+	// The per batch sequence number header, see BatchSeqHeader:
+	HTTP_ENDPOINT_POOL_BATCH_SEQ_HEADER = "X-VMI-Batch-Seq"
 )
 
-// The HTTP endpoint pool interface as seen by the compressor:
+// The content encodings supported by the pool, in order of preference:
+var HttpEndpointPoolContentEncodingPreference = []string{
+	HTTP_CONTENT_ENCODING_ZSTD,
+	HTTP_CONTENT_ENCODING_GZIP,
+	HTTP_CONTENT_ENCODING_IDENTITY,
+}
+
+// The HTTP endpoint pool interface as seen by the compressor; bufEncoding is
+// the content encoding of the buffer, as produced by the compressor, "" is the
+// same as identity:
 type Sender interface {
-	SendBuffer(b []byte, timeout time.Duration, gzipped bool) error
+	SendBuffer(b []byte, timeout time.Duration, bufEncoding string) error
 }
 
 // Endpoint stats:
@@ -86,6 +154,10 @@ const (
 	HTTP_ENDPOINT_STATS_SEND_BUFFER_ERROR_COUNT
 	HTTP_ENDPOINT_STATS_HEALTH_CHECK_COUNT
 	HTTP_ENDPOINT_STATS_HEALTH_CHECK_ERROR_COUNT
+	HTTP_ENDPOINT_STATS_RETRY_BACKOFF_COUNT
+	// The time of the last successful SendBuffer, as Unix microseconds, 0 if
+	// never:
+	HTTP_ENDPOINT_STATS_LAST_SUCCESS_TS
 	// Must be last:
 	HTTP_ENDPOINT_STATS_LEN
 )
@@ -94,24 +166,68 @@ const (
 const (
 	HTTP_ENDPOINT_POOL_STATS_HEALTHY_ROTATE_COUNT = iota
 	HTTP_ENDPOINT_POOL_STATS_NO_HEALTHY_EP_ERROR_COUNT
+	HTTP_ENDPOINT_POOL_STATS_DNS_REFRESH_COUNT
 	// Must be last:
 	HTTP_ENDPOINT_POOL_STATS_LEN
 )
 
 type HttpEndpointStats []uint64
 
+// Lifetime endpoint stats, cumulative across health check cycles:
+type HttpEndpointLifetimeStats struct {
+	// How many times the endpoint was marked unhealthy:
+	UnhealthyCount uint64
+	// The cumulative time, in microseconds, spent in the unhealthy state. For
+	// snapped stats this includes the ongoing unhealthy period, if any:
+	Downtime uint64
+	// When the current unhealthy period started, zero if healthy; not
+	// populated for snapped stats:
+	UnhealthySince time.Time
+}
+
 type HttpPoolStats []uint64
 
 type HttpEndpointPoolStats struct {
 	PoolStats HttpPoolStats
 	// Endpoint stats are indexed by URL:
 	EndpointStats map[string]HttpEndpointStats
+	// Endpoint lifetime stats, indexed by URL; populated only for the
+	// endpoints which were marked unhealthy at least once:
+	EndpointLifetimeStats map[string]*HttpEndpointLifetimeStats
+	// Endpoint state, indexed by URL, true if healthy, false if unhealthy,
+	// i.e. under health check:
+	EndpointHealthy map[string]bool
+	// The number of bytes currently in flight through credit readers and the
+	// ceiling for the latter, 0 if no ceiling:
+	InflightBytes    uint64
+	InflightMaxBytes uint64
+	// The cumulative time, in microseconds, spent waiting for a send slot and
+	// the max number of concurrent sends, 0 if no limit:
+	SendWaitTime       uint64
+	MaxConcurrentSends uint64
+	// The number of endpoints and how many of them are healthy:
+	NumEndpoints uint64
+	NumHealthy   uint64
+	// The number of connection recycles and the max number of requests per
+	// connection, 0 if no limit:
+	ConnRecycleCount   uint64
+	MaxRequestsPerConn uint64
+	// The retry backoff base, in microseconds, 0 if disabled:
+	RetryBackoffBase uint64
+	// The rate limit credit state, all 0 if there is no rate limit: the
+	// replenish value, the current balance and the cumulative time, in
+	// microseconds, spent by the sends waiting for credit (throttled):
+	RateLimitReplenishValue uint64
+	RateLimitCreditCurrent  uint64
+	RateLimitThrottleTime   uint64
 }
 
 func NewHttpEndpointPoolStats() *HttpEndpointPoolStats {
 	return &HttpEndpointPoolStats{
-		PoolStats:     make(HttpPoolStats, HTTP_ENDPOINT_POOL_STATS_LEN),
-		EndpointStats: make(map[string]HttpEndpointStats),
+		PoolStats:             make(HttpPoolStats, HTTP_ENDPOINT_POOL_STATS_LEN),
+		EndpointStats:         make(map[string]HttpEndpointStats),
+		EndpointLifetimeStats: make(map[string]*HttpEndpointLifetimeStats),
+		EndpointHealthy:       make(map[string]bool),
 	}
 }
 
@@ -128,6 +244,38 @@ func (pool *HttpEndpointPool) SnapStats(to *HttpEndpointPoolStats) *HttpEndpoint
 	}
 
 	copy(to.PoolStats, stats.PoolStats)
+	to.InflightBytes, to.InflightMaxBytes = stats.InflightBytes, stats.InflightMaxBytes
+	to.SendWaitTime, to.MaxConcurrentSends = stats.SendWaitTime, stats.MaxConcurrentSends
+	to.ConnRecycleCount, to.MaxRequestsPerConn = stats.ConnRecycleCount, stats.MaxRequestsPerConn
+	to.RetryBackoffBase = stats.RetryBackoffBase
+	to.RateLimitReplenishValue, to.RateLimitCreditCurrent, to.RateLimitThrottleTime = 0, 0, 0
+	if credit, ok := pool.credit.(*Credit); ok {
+		creditSnap := credit.Snapshot()
+		to.RateLimitReplenishValue = uint64(creditSnap.ReplenishValue)
+		// N.B. The credit becomes unlimited at shutdown:
+		to.RateLimitCreditCurrent = uint64(max(creditSnap.Current, 0))
+		to.RateLimitThrottleTime = uint64(creditSnap.WaitTime.Microseconds())
+	}
+	to.NumEndpoints, to.NumHealthy = uint64(len(stats.EndpointStats)), 0
+	for ep := pool.healthy.head; ep != nil; ep = ep.next {
+		if ep.healthy {
+			to.NumHealthy++
+		}
+	}
+
+	// Remove the endpoints no longer present:
+	for url := range to.EndpointStats {
+		if _, ok := stats.EndpointStats[url]; !ok {
+			delete(to.EndpointStats, url)
+		}
+	}
+	if to.EndpointHealthy == nil {
+		to.EndpointHealthy = make(map[string]bool)
+	}
+	clear(to.EndpointHealthy)
+	for url, ep := range pool.endpoints {
+		to.EndpointHealthy[url] = ep.healthy
+	}
 
 	for url, epStats := range stats.EndpointStats {
 		toEpStats := to.EndpointStats[url]
@@ -138,9 +286,57 @@ func (pool *HttpEndpointPool) SnapStats(to *HttpEndpointPoolStats) *HttpEndpoint
 		copy(toEpStats, epStats)
 	}
 
+	for url := range to.EndpointLifetimeStats {
+		if _, ok := stats.EndpointLifetimeStats[url]; !ok {
+			delete(to.EndpointLifetimeStats, url)
+		}
+	}
+	now := time.Now()
+	for url, epLifetimeStats := range stats.EndpointLifetimeStats {
+		toEpLifetimeStats := to.EndpointLifetimeStats[url]
+		if toEpLifetimeStats == nil {
+			toEpLifetimeStats = &HttpEndpointLifetimeStats{}
+			to.EndpointLifetimeStats[url] = toEpLifetimeStats
+		}
+		toEpLifetimeStats.UnhealthyCount = epLifetimeStats.UnhealthyCount
+		toEpLifetimeStats.Downtime = epLifetimeStats.Downtime
+		if !epLifetimeStats.UnhealthySince.IsZero() {
+			toEpLifetimeStats.Downtime += uint64(now.Sub(epLifetimeStats.UnhealthySince).Microseconds())
+		}
+	}
+
 	return to
 }
 
+// The networks supported by the dialer:
+var HttpEndpointPoolValidNetworks = map[string]bool{
+	"tcp":  true,
+	"tcp4": true,
+	"tcp6": true,
+}
+
+// The actual dial function, mockable for testing:
+var httpEndpointPoolDialFn = func(dialer *net.Dialer, ctx context.Context, network, addr string) (net.Conn, error) {
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// Build the DialContext function for http.Transport, forcing the configured
+// network. The transport always dials "tcp", which in dual-stack environments
+// tries both IPv6 and IPv4 w/ happy-eyeballs fallback (RFC 6555), governed by
+// dialer.FallbackDelay; "tcp4" or "tcp6" restrict the dial to the
+// corresponding address family.
+func NewHttpEndpointPoolDialContext(dialer *net.Dialer, network string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, _, addr string) (net.Conn, error) {
+		return httpEndpointPoolDialFn(dialer, ctx, network, addr)
+	}
+}
+
+// The host lookup function, used for the auto mark unhealthy threshold,
+// mockable for testing:
+var httpEndpointPoolLookupHostFn = func(ctx context.Context, host string) ([]string, error) {
+	return net.DefaultResolver.LookupHost(ctx, host)
+}
+
 // Define a mockable interface to substitute http.Client.Do() for testing purposes:
 type HttpClientDoer interface {
 	Do(req *http.Request) (*http.Response, error)
@@ -207,21 +403,99 @@ type HttpEndpoint struct {
 	// one member is unhealthy, it doesn't mean that others cannot be used. The
 	// net/http Transport connection cache will remove the failed connection and
 	// the name to address resolution mechanism should no longer resolve to this
-	// failed IP.
+	// failed IP. See UnhealthyThreshold for setting it automatically.
 	markUnhealthyThreshold int
+	// Whether the threshold above should be kept in sync w/ the number of
+	// addresses the host resolves to:
+	autoMarkUnhealthyThreshold bool
 	// State:
 	healthy bool
 	// The number of errors so far that is compared against the threshold above:
 	numErrors int
 	// The timestamp of the most recent error:
 	errorTs time.Time
+	// The interval after which older errors may be ignored, see the pool's
+	// errorResetInterval; use 0 to disable:
+	errorResetInterval time.Duration
+	// The content encoding, as negotiated w/ the endpoint upon admission into
+	// the healthy list; empty if not (yet) negotiated, in which case the buffer
+	// is sent as provided by the compressor:
+	contentEncoding string
+	// Whether the negotiation should occur before the next use:
+	negotiateEncoding bool
+	// Whether the endpoint was removed from the pool, see UpdateEndpoints:
+	removed bool
+	// The relative share of the selections, see HttpEndpointConfig.Weight:
+	weight int
+	// The endpoint is not eligible for selection until this time, as requested
+	// by the server via Retry-After:
+	pausedUntil time.Time
+	// The number of requests since the last connection recycle, used for
+	// max_requests_per_conn:
+	numRequests int
 	// Doubly linked list:
 	prev, next *HttpEndpoint
 }
 
+// The mark unhealthy threshold may be specified either as a number or as
+// "auto", in which case it is set to the number of addresses the endpoint host
+// resolves to. N.B. "auto" is accepted only as the spec, the negative numbers
+// stand for the default, same as before the spec was introduced:
+type UnhealthyThreshold int
+
+func (threshold *UnhealthyThreshold) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && node.Value == HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO_SPEC {
+		*threshold = HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO
+		return nil
+	}
+	var n int
+	if err := node.Decode(&n); err != nil {
+		return fmt.Errorf(
+			"mark_unhealthy_threshold: want int or %q, got %q",
+			HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO_SPEC, node.Value,
+		)
+	}
+	if n < 0 {
+		n = HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_DEFAULT
+	}
+	*threshold = UnhealthyThreshold(n)
+	return nil
+}
+
+func (threshold UnhealthyThreshold) MarshalYAML() (any, error) {
+	if threshold == HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO {
+		return HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO_SPEC, nil
+	}
+	return int(threshold), nil
+}
+
+func (threshold UnhealthyThreshold) String() string {
+	if threshold == HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO {
+		return HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO_SPEC
+	}
+	return strconv.Itoa(int(threshold))
+}
+
 type HttpEndpointConfig struct {
 	URL                    string
-	MarkUnhealthyThreshold int `yaml:"mark_unhealthy_threshold"`
+	MarkUnhealthyThreshold UnhealthyThreshold `yaml:"mark_unhealthy_threshold"`
+	// Override the pool's error_reset_interval, e.g. a longer interval for a
+	// known flaky endpoint, such that it is marked unhealthy more readily. Use 0
+	// for the pool's value or < 0 to disable:
+	ErrorResetInterval time.Duration `yaml:"error_reset_interval"`
+	// The relative capacity of the endpoint, for endpoints of uneven
+	// capacity. Upon rotation an endpoint stays at the head of the healthy list
+	// for a number of rotation turns proportional to its weight, such that over
+	// a full rotation cycle each healthy endpoint is selected proportionally to
+	// its weight. Use 0 for the default (1):
+	Weight int `yaml:"weight"`
+}
+
+// The headers set by the pool based on the buffer and the content encoding,
+// which may not be overridden via config:
+var HttpEndpointPoolReservedHeaders = map[string]bool{
+	"Content-Encoding": true,
+	"Content-Length":   true,
 }
 
 // The list of HTTP codes that denote success:
@@ -230,16 +504,40 @@ var HttpEndpointPoolSuccessCodes = map[int]bool{
 	http.StatusNoContent: true,
 }
 
-// The list of HTTP codes that should be retried:
-var HttpEndpointPoolRetryCodes = map[int]bool{}
+// The default list of HTTP codes that should be retried, typically returned
+// by load balancers during rolling restarts or by overloaded endpoints; it may
+// be overridden via retry_status_codes:
+var HTTP_ENDPOINT_POOL_CONFIG_RETRY_STATUS_CODES_DEFAULT = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// The list of HTTP codes for which Retry-After is honored:
+var HttpEndpointPoolRetryAfterCodes = map[int]bool{
+	http.StatusTooManyRequests:    true,
+	http.StatusServiceUnavailable: true,
+}
+
+// Custom success/failure classification of the responses, e.g. for gateways
+// signaling partial ingestion in the body. The body is read up to
+// HTTP_ENDPOINT_POOL_CLASSIFIER_BODY_MAX_SIZE. A non-nil error is used for
+// reporting only.
+type HttpResponseClassifier func(resp *http.Response, body []byte) (success bool, retryable bool, err error)
 
 // Error codes:
 var ErrHttpEndpointPoolNoHealthyEP = errors.New("no healthy HTTP endpoint available")
+var ErrHttpEndpointPoolNoSendSlot = errors.New("no send slot available")
+var ErrHttpEndpointPoolMaxSendAttempts = errors.New("max send attempts exceeded")
+var ErrHttpEndpointPoolSendDeadline = errors.New("send deadline exceeded")
 
 func DefaultHttpEndpointConfig() *HttpEndpointConfig {
 	return &HttpEndpointConfig{
 		URL:                    HTTP_ENDPOINT_URL_DEFAULT,
 		MarkUnhealthyThreshold: 0, // i.e. fallback over pool definition or default
+		ErrorResetInterval:     0, // i.e. fallback over pool definition
+		Weight:                 HTTP_ENDPOINT_WEIGHT_DEFAULT,
 	}
 }
 
@@ -250,7 +548,20 @@ func NewHttpEndpoint(cfg *HttpEndpointConfig) (*HttpEndpoint, error) {
 	}
 	ep := &HttpEndpoint{
 		url:                    cfg.URL,
-		markUnhealthyThreshold: cfg.MarkUnhealthyThreshold,
+		markUnhealthyThreshold: int(cfg.MarkUnhealthyThreshold),
+		errorResetInterval:     max(cfg.ErrorResetInterval, 0),
+		weight:                 cfg.Weight,
+	}
+	if ep.weight == 0 {
+		ep.weight = HTTP_ENDPOINT_WEIGHT_DEFAULT
+	}
+	if ep.weight < 0 {
+		return nil, fmt.Errorf("NewHttpEndpoint(%s): invalid weight %d, want: >= 0", ep.url, cfg.Weight)
+	}
+	if cfg.MarkUnhealthyThreshold == HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO {
+		// Start w/ the default, it will be updated upon resolution:
+		ep.markUnhealthyThreshold = HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_DEFAULT
+		ep.autoMarkUnhealthyThreshold = true
 	}
 	if ep.URL, err = url.Parse(ep.url); err != nil {
 		err = fmt.Errorf("NewHttpEndpoint(%s): %v", ep.url, err)
@@ -273,7 +584,9 @@ func (epDblLnkList *HttpEndpointDoublyLinkedList) Insert(ep, after *HttpEndpoint
 		ep.next = epDblLnkList.head
 		epDblLnkList.head = ep
 	}
-	if ep.next == nil {
+	if ep.next != nil {
+		ep.next.prev = ep
+	} else {
 		// Added to tail:
 		epDblLnkList.tail = ep
 	}
@@ -305,14 +618,25 @@ func (epDblLnkList *HttpEndpointDoublyLinkedList) AddToTail(ep *HttpEndpoint) {
 type HttpEndpointPool struct {
 	// The healthy list:
 	healthy *HttpEndpointDoublyLinkedList
+	// All the endpoints, healthy or not, indexed by URL:
+	endpoints map[string]*HttpEndpoint
+	// The pool level fallback for the endpoints' mark unhealthy threshold,
+	// needed for the endpoints added at runtime:
+	markUnhealthyThreshold UnhealthyThreshold
 	// Authorization header, if any:
 	authorization string
+	// Custom headers, added to all the requests, nil if none:
+	headers http.Header
 	// How often to rotate the healthy list. Set to 0 to rotate after every use
 	// or to -1 to disable the rotation:
 	healthyRotateInterval time.Duration
 	// The time stamp when the last change to the head of the healthy list
 	// occurred (most likely due to rotation):
 	healthyHeadChangeTs time.Time
+	// The endpoint at the head of the healthy list and the number of rotation
+	// turns it has held it for, used for weighted rotation:
+	healthyHeadTurnsEp *HttpEndpoint
+	healthyHeadTurns   int
 	// The rotation, which occurs *before* the endpoint is selected, should be
 	// disabled for its 1st use; for instance the endpoint has been just
 	// promoted to the head because the previous one had an error.
@@ -326,6 +650,11 @@ type HttpEndpointPool struct {
 	errorResetInterval time.Duration
 	// How often to check if an unhealthy endpoint has become healthy:
 	healthCheckInterval time.Duration
+	// Rate limiting credit for the health check requests across all
+	// endpoints, nil if no limit. With many endpoints recovering at the same
+	// time the aggregate probe rate may be high; when limited, a probe waits
+	// for a token rather than firing:
+	healthCheckCredit CreditController
 	// How long to wait for a healthy endpoint, in case healthy list is empty;
 	// normally this should be > HealthCheckInterval.
 	healthyMaxWait time.Duration
@@ -336,8 +665,78 @@ type HttpEndpointPool struct {
 	// How long to wait for a SendBuffer call to succeed; normally this should
 	// be longer than healthyMaxWait or other HTTP timeouts:
 	sendBufferTimeout time.Duration
+	// The max number of attempts for a SendBuffer call, regardless of the
+	// timeout, use 0 for no limit. With fast failing endpoints the retries
+	// may otherwise flood the log:
+	maxSendAttempts int
+	// First data health gate: the very first SendBuffer should succeed within
+	// this timeout, otherwise a prominent error is logged and, if
+	// requireEndpointAtStartup is set, the importer exits. Use 0 to disable:
+	firstSendGateTimeout     time.Duration
+	requireEndpointAtStartup bool
+	// Whether the first send was claimed by a SendBuffer call:
+	firstSendClaimed bool
 	// Rate limiting credit mechanism, if not nil:
 	credit CreditController
+	// Whether to negotiate the content encoding w/ the endpoints:
+	negotiateEncoding bool
+	// zstd encoder, used only if negotiateEncoding is in effect:
+	zstdEncoder *zstd.Encoder
+	// The ceiling for the number of bytes in flight through credit readers,
+	// use 0 for no limit. A rate limited request may keep its buffer alive for
+	// a long time and with many concurrent senders this may pin a lot of
+	// memory. When the ceiling is reached, new sends will wait for the ones in
+	// progress to complete.
+	inflightMaxBytes int
+	// Condition for the above, using the pool's access lock:
+	inflightCond *sync.Cond
+	// Semaphore limiting the number of concurrent sends across the pool, nil
+	// if no limit. Each compressor sends independently, so w/o a limit the
+	// concurrency is given by the number of compressors:
+	sendSem chan struct{}
+	// Whether to honor Retry-After for HttpEndpointPoolRetryAfterCodes, by
+	// pausing the endpoint for the indicated duration, capped to a max:
+	honorRetryAfter bool
+	retryAfterMax   time.Duration
+	// Recycle the connections after this many requests sent to an endpoint,
+	// use 0 for no limit. Go's transport doesn't support this directly, so the
+	// recycling is done by closing the idle connections, which will include
+	// the one just used:
+	maxRequestsPerConn int
+	// Whether to retry the same endpoint once, w/o reporting the error, if the
+	// send failed w/ connection reset or EOF on a reused connection. This is
+	// typically caused by the server closing an idle connection and it is not
+	// an indication of endpoint health:
+	retryOnConnReset bool
+	// The HTTP codes that should be retried w/ the next healthy endpoint, the
+	// error is still reported. Any other non success code is final:
+	retryCodes map[int]bool
+	// The backoff before retrying after a failed attempt: base * 2^(n-1), for
+	// the n-th consecutive failure, capped to max, plus a random jitter. Use 0
+	// for base to disable:
+	retryBackoffBase time.Duration
+	retryBackoffMax  time.Duration
+	// Whether to add the batch sequence number header and the last number
+	// assigned, using the pool's access lock. All the attempts of a batch
+	// share the same number:
+	batchSeqHeader bool
+	batchSeq       uint64
+	// Optional hook overriding the status code based classification of the
+	// responses. It should be set before the pool is used:
+	ResponseClassifier HttpResponseClassifier
+	// The endpoints w/ auto mark unhealthy threshold, the interval for
+	// refreshing the latter (0 to resolve at startup only) and the network,
+	// used for filtering the resolved addresses:
+	autoThresholdEndpoints    []*HttpEndpoint
+	unhealthyThresholdRefresh time.Duration
+	network                   string
+	// The DNS cache used by the dialer, nil if disabled, see dns_cache.go:
+	dnsCache *DnsCache
+	// How often to close the idle connections, such that the new ones
+	// re-resolve the endpoint hosts, use 0 to disable. W/o it the connection
+	// cache may keep an endpoint pinned to an address no longer in its DNS
+	// pool until the idle timeout:
+	dnsRefreshInterval time.Duration
 	// The http client as a mockable interface:
 	client HttpClientDoer
 	// Access lock:
@@ -356,22 +755,48 @@ type HttpEndpointPoolConfig struct {
 	Endpoints                   []*HttpEndpointConfig `yaml:"endpoints"`
 	Username                    string                `yaml:"username"`
 	Password                    string                `yaml:"password"`
-	MarkUnhealthyThreshold      int                   `yaml:"mark_unhealthy_threshold"`
+	BearerToken                 string                `yaml:"bearer_token"`
+	Headers                     map[string]string     `yaml:"headers"`
+	MarkUnhealthyThreshold      UnhealthyThreshold    `yaml:"mark_unhealthy_threshold"`
+	UnhealthyThresholdRefresh   time.Duration         `yaml:"mark_unhealthy_threshold_refresh"`
 	Shuffle                     bool                  `yaml:"shuffle"`
 	HealthyRotateInterval       time.Duration         `yaml:"healthy_rotate_interval"`
 	HealthyRotateIntervalOffset string                `yaml:"healthy_rotate_interval_offset"`
 	ErrorResetInterval          time.Duration         `yaml:"error_reset_interval"`
 	HealthCheckInterval         time.Duration         `yaml:"health_check_interval"`
+	HealthCheckMaxRps           float64               `yaml:"health_check_max_rps"`
 	HealthyMaxWait              time.Duration         `yaml:"healthy_max_wait"`
 	SendBufferTimeout           time.Duration         `yaml:"send_buffer_timeout"`
+	MaxSendAttempts             int                   `yaml:"max_send_attempts"`
+	FirstSendGateTimeout        time.Duration         `yaml:"first_send_gate_timeout"`
+	RequireEndpointAtStartup    bool                  `yaml:"require_endpoint_at_startup"`
 	RateLimitMbps               string                `yaml:"rate_limit_mbps"`
+	NegotiateEncoding           bool                  `yaml:"negotiate_encoding"`
+	InflightMaxBytes            string                `yaml:"inflight_max_bytes"`
+	MaxConcurrentSends          int                   `yaml:"max_concurrent_sends"`
+	HonorRetryAfter             bool                  `yaml:"honor_retry_after"`
+	RetryAfterMax               time.Duration         `yaml:"retry_after_max"`
+	RetryOnConnReset            bool                  `yaml:"retry_on_conn_reset"`
+	RetryStatusCodes            []int                 `yaml:"retry_status_codes"`
+	RetryBackoffBase            time.Duration         `yaml:"retry_backoff_base"`
+	RetryBackoffMax             time.Duration         `yaml:"retry_backoff_max"`
+	MaxRequestsPerConn          int                   `yaml:"max_requests_per_conn"`
+	BatchSeqHeader              bool                  `yaml:"batch_seq_header"`
 	IgnoreTLSVerify             bool                  `yaml:"ignore_tls_verify"`
+	CACertFile                  string                `yaml:"ca_cert_file"`
+	ClientCertFile              string                `yaml:"client_cert_file"`
+	ClientKeyFile               string                `yaml:"client_key_file"`
 	TcpConnTimeout              time.Duration         `yaml:"tcp_conn_timeout"`
 	TcpKeepAlive                time.Duration         `yaml:"tcp_keep_alive"`
+	Network                     string                `yaml:"network"`
+	FallbackDelay               time.Duration         `yaml:"fallback_delay"`
+	DnsCacheTTL                 time.Duration         `yaml:"dns_cache_ttl"`
+	DnsRefreshInterval          time.Duration         `yaml:"dns_refresh_interval"`
 	MaxIdleConns                int                   `yaml:"max_idle_conns"`
 	MaxIdleConnsPerHost         int                   `yaml:"max_idle_conns_per_host"`
 	MaxConnsPerHost             int                   `yaml:"max_conns_per_host"`
 	IdleConnTimeout             time.Duration         `yaml:"idle_conn_timeout"`
+	Proxy                       string                `yaml:"proxy"`
 	ResponseTimeout             time.Duration         `yaml:"response_timeout"`
 }
 
@@ -379,19 +804,40 @@ func DefaultHttpEndpointPoolConfig() *HttpEndpointPoolConfig {
 	return &HttpEndpointPoolConfig{
 		Shuffle:                     HTTP_ENDPOINT_POOL_CONFIG_SHUFFLE_DEFAULT,
 		MarkUnhealthyThreshold:      0, // i.e. fallback over default
+		UnhealthyThresholdRefresh:   HTTP_ENDPOINT_POOL_CONFIG_UNHEALTHY_THRESHOLD_REFRESH_DEFAULT,
 		HealthyRotateInterval:       HTTP_ENDPOINT_POOL_CONFIG_HEALTHY_ROTATE_INTERVAL_DEFAULT,
 		HealthyRotateIntervalOffset: HTTP_ENDPOINT_POOL_CONFIG_HEALTHY_ROTATE_INTERVAL_OFFSET_DEFAULT,
 		ErrorResetInterval:          HTTP_ENDPOINT_POOL_CONFIG_ERROR_RESET_INTERVAL_DEFAULT,
 		HealthCheckInterval:         HTTP_ENDPOINT_POOL_CONFIG_HEALTH_CHECK_INTERVAL_DEFAULT,
+		HealthCheckMaxRps:           HTTP_ENDPOINT_POOL_CONFIG_HEALTH_CHECK_MAX_RPS_DEFAULT,
 		HealthyMaxWait:              HTTP_ENDPOINT_POOL_CONFIG_HEALTHY_MAX_WAIT_DEFAULT,
 		SendBufferTimeout:           HTTP_ENDPOINT_POOL_CONFIG_SEND_BUFFER_TIMEOUT_DEFAULT,
+		MaxSendAttempts:             HTTP_ENDPOINT_POOL_CONFIG_MAX_SEND_ATTEMPTS_DEFAULT,
+		FirstSendGateTimeout:        HTTP_ENDPOINT_POOL_CONFIG_FIRST_SEND_GATE_TIMEOUT_DEFAULT,
+		RequireEndpointAtStartup:    HTTP_ENDPOINT_POOL_CONFIG_REQUIRE_ENDPOINT_AT_STARTUP_DEFAULT,
 		RateLimitMbps:               HTTP_ENDPOINT_POOL_CONFIG_RATE_LIMIT_MBPS_DEFAULT,
+		NegotiateEncoding:           HTTP_ENDPOINT_POOL_CONFIG_NEGOTIATE_ENCODING_DEFAULT,
+		InflightMaxBytes:            HTTP_ENDPOINT_POOL_CONFIG_INFLIGHT_MAX_BYTES_DEFAULT,
+		MaxConcurrentSends:          HTTP_ENDPOINT_POOL_CONFIG_MAX_CONCURRENT_SENDS_DEFAULT,
+		HonorRetryAfter:             HTTP_ENDPOINT_POOL_CONFIG_HONOR_RETRY_AFTER_DEFAULT,
+		RetryAfterMax:               HTTP_ENDPOINT_POOL_CONFIG_RETRY_AFTER_MAX_DEFAULT,
+		RetryOnConnReset:            HTTP_ENDPOINT_POOL_CONFIG_RETRY_ON_CONN_RESET_DEFAULT,
+		RetryStatusCodes:            slices.Clone(HTTP_ENDPOINT_POOL_CONFIG_RETRY_STATUS_CODES_DEFAULT),
+		RetryBackoffBase:            HTTP_ENDPOINT_POOL_CONFIG_RETRY_BACKOFF_BASE_DEFAULT,
+		RetryBackoffMax:             HTTP_ENDPOINT_POOL_CONFIG_RETRY_BACKOFF_MAX_DEFAULT,
+		MaxRequestsPerConn:          HTTP_ENDPOINT_POOL_CONFIG_MAX_REQUESTS_PER_CONN_DEFAULT,
+		BatchSeqHeader:              HTTP_ENDPOINT_POOL_CONFIG_BATCH_SEQ_HEADER_DEFAULT,
 		TcpConnTimeout:              HTTP_ENDPOINT_POOL_CONFIG_TCP_CONN_TIMEOUT_DEFAULT,
 		TcpKeepAlive:                HTTP_ENDPOINT_POOL_CONFIG_TCP_KEEP_ALIVE_DEFAULT,
+		Network:                     HTTP_ENDPOINT_POOL_CONFIG_NETWORK_DEFAULT,
+		FallbackDelay:               HTTP_ENDPOINT_POOL_CONFIG_FALLBACK_DELAY_DEFAULT,
+		DnsCacheTTL:                 HTTP_ENDPOINT_POOL_CONFIG_DNS_CACHE_TTL_DEFAULT,
+		DnsRefreshInterval:          HTTP_ENDPOINT_POOL_CONFIG_DNS_REFRESH_INTERVAL_DEFAULT,
 		MaxIdleConns:                HTTP_ENDPOINT_POOL_CONFIG_MAX_IDLE_CONNS_DEFAULT,
 		MaxIdleConnsPerHost:         HTTP_ENDPOINT_POOL_CONFIG_MAX_IDLE_CONNS_PER_HOST_DEFAULT,
 		MaxConnsPerHost:             HTTP_ENDPOINT_POOL_CONFIG_MAX_CONNS_PER_HOST_DEFAULT,
 		IdleConnTimeout:             HTTP_ENDPOINT_POOL_CONFIG_IDLE_CONN_TIMEOUT_DEFAULT,
+		Proxy:                       HTTP_ENDPOINT_POOL_CONFIG_PROXY_DEFAULT,
 		ResponseTimeout:             HTTP_ENDPOINT_POOL_CONFIG_RESPONSE_TIMEOUT_DEFAULT,
 	}
 }
@@ -438,6 +884,152 @@ func BuildHtmlBasicAuth(username, password string) (string, error) {
 	return authorization, nil
 }
 
+func BuildHtmlBearerAuth(token string) (string, error) {
+	authorization := ""
+	if token != "" {
+		if token, err := LoadPasswordSpec(token); err == nil {
+			authorization = "Bearer " + token
+		} else {
+			return "", err
+		}
+	}
+	return authorization, nil
+}
+
+// Build the custom headers from the config, the values support the same
+// file:/env:/pass: prefixes as the password. Return nil if there are no
+// headers.
+func BuildHttpHeaders(headers map[string]string) (http.Header, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	httpHeaders := make(http.Header)
+	for name, value := range headers {
+		if name == "" {
+			return nil, fmt.Errorf("BuildHttpHeaders: empty header name")
+		}
+		name = http.CanonicalHeaderKey(name)
+		if HttpEndpointPoolReservedHeaders[name] {
+			return nil, fmt.Errorf("BuildHttpHeaders: %s: reserved header", name)
+		}
+		value, err := LoadPasswordSpec(value)
+		if err != nil {
+			return nil, fmt.Errorf("BuildHttpHeaders: %s: %v", name, err)
+		}
+		httpHeaders.Set(name, value)
+	}
+	return httpHeaders, nil
+}
+
+// Add the custom headers, if any, to the request header, overriding the
+// existing values:
+func (epPool *HttpEndpointPool) setHeaders(header http.Header) {
+	for name, values := range epPool.headers {
+		header[name] = slices.Clone(values)
+	}
+}
+
+// Load a PEM encoded CA certificate bundle:
+func LoadCACertPool(caCertFile string) (*x509.CertPool, error) {
+	content, err := os.ReadFile(caCertFile)
+	if err != nil {
+		return nil, fmt.Errorf("LoadCACertPool: ca_cert_file: %v", err)
+	}
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("LoadCACertPool: ca_cert_file: %s: no valid PEM certificates", caCertFile)
+	}
+	return certPool, nil
+}
+
+// Load the client certificate and key, PEM encoded, for mutual TLS:
+func LoadClientCert(clientCertFile, clientKeyFile string) (*tls.Certificate, error) {
+	if (clientCertFile == "") != (clientKeyFile == "") {
+		return nil, fmt.Errorf(
+			"LoadClientCert: client_cert_file=%q, client_key_file=%q: both or neither should be set",
+			clientCertFile, clientKeyFile,
+		)
+	}
+	if clientCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("LoadClientCert: %v", err)
+	}
+	return &cert, nil
+}
+
+// Build the TLS config based on the pool config, return nil if the defaults
+// are to be used. When TLS verification is disabled, it takes precedence over
+// the CA certificates. The client certificate, if any, is presented
+// regardless.
+func NewHttpEndpointPoolTLSConfig(poolCfg *HttpEndpointPoolConfig) (*tls.Config, error) {
+	var tlsConfig *tls.Config
+	if poolCfg.CACertFile != "" {
+		certPool, err := LoadCACertPool(poolCfg.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{RootCAs: certPool}
+		epPoolLog.Infof("ca_cert_file=%s loaded", poolCfg.CACertFile)
+	}
+	if poolCfg.IgnoreTLSVerify {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		} else {
+			epPoolLog.Warnf("ignore_tls_verify=true, ca_cert_file=%s not used for verification", poolCfg.CACertFile)
+		}
+		tlsConfig.InsecureSkipVerify = true
+	}
+	cert, err := LoadClientCert(poolCfg.ClientCertFile, poolCfg.ClientKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	if cert != nil {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		tlsConfig.Certificates = []tls.Certificate{*cert}
+		subject := ""
+		if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+			subject = leaf.Subject.String()
+		}
+		epPoolLog.Infof(
+			"client_cert_file=%s, client_key_file=%s loaded, subject: %q",
+			poolCfg.ClientCertFile, poolCfg.ClientKeyFile, subject,
+		)
+	}
+	return tlsConfig, nil
+}
+
+// Build the transport proxy function based on the pool config proxy URL. If
+// the latter is empty, the proxy is determined from the environment, i.e.
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY. Also return a description of the
+// effective proxy, with the credentials redacted, suitable for logging.
+func NewHttpEndpointPoolProxy(proxy string) (func(*http.Request) (*url.URL, error), string, error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, "from environment", nil
+	}
+	proxyUrl, err := url.Parse(proxy)
+	if err == nil && (proxyUrl.Scheme == "" || proxyUrl.Host == "") {
+		err = fmt.Errorf("missing scheme or host")
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("NewHttpEndpointPoolProxy: invalid proxy URL: %v", redactProxyUrlErr(err))
+	}
+	return http.ProxyURL(proxyUrl), proxyUrl.Redacted(), nil
+}
+
+// Strip the URL from the parse error, since it may contain credentials:
+func redactProxyUrlErr(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
 func NewHttpEndpointPool(poolCfg *HttpEndpointPoolConfig) (*HttpEndpointPool, error) {
 	var err error
 
@@ -445,25 +1037,57 @@ func NewHttpEndpointPool(poolCfg *HttpEndpointPoolConfig) (*HttpEndpointPool, er
 		poolCfg = DefaultHttpEndpointPoolConfig()
 	}
 
+	if poolCfg.Username != "" && poolCfg.BearerToken != "" {
+		return nil, fmt.Errorf("NewHttpEndpointPool: username and bearer_token are mutually exclusive")
+	}
 	authorization, err := BuildHtmlBasicAuth(poolCfg.Username, poolCfg.Password)
+	if err == nil && poolCfg.BearerToken != "" {
+		authorization, err = BuildHtmlBearerAuth(poolCfg.BearerToken)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("NewHttpEndpointPool: %v", err)
+	}
+	headers, err := BuildHttpHeaders(poolCfg.Headers)
 	if err != nil {
 		return nil, fmt.Errorf("NewHttpEndpointPool: %v", err)
 	}
 
+	network := poolCfg.Network
+	if network == "" {
+		network = HTTP_ENDPOINT_POOL_CONFIG_NETWORK_DEFAULT
+	}
+	if !HttpEndpointPoolValidNetworks[network] {
+		return nil, fmt.Errorf("NewHttpEndpointPool: invalid network %q, want one of tcp, tcp4, tcp6", network)
+	}
 	dialer := &net.Dialer{
-		Timeout:   poolCfg.TcpConnTimeout,
-		KeepAlive: poolCfg.TcpKeepAlive,
+		Timeout:       poolCfg.TcpConnTimeout,
+		KeepAlive:     poolCfg.TcpKeepAlive,
+		FallbackDelay: poolCfg.FallbackDelay,
+	}
+	var dnsCache *DnsCache
+	dialContext := NewHttpEndpointPoolDialContext(dialer, network)
+	if poolCfg.DnsCacheTTL > 0 {
+		dnsCache = NewDnsCache(poolCfg.DnsCacheTTL, network)
+		dialContext = dnsCache.DialContext(dialer)
 	}
 	transport := &http.Transport{
-		DialContext:         dialer.DialContext,
+		DialContext:         dialContext,
 		DisableKeepAlives:   false,
 		IdleConnTimeout:     poolCfg.IdleConnTimeout,
 		MaxIdleConns:        poolCfg.MaxIdleConns,
 		MaxIdleConnsPerHost: poolCfg.MaxIdleConnsPerHost,
 		MaxConnsPerHost:     poolCfg.MaxConnsPerHost,
 	}
-	if poolCfg.IgnoreTLSVerify {
-		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	transport.TLSClientConfig, err = NewHttpEndpointPoolTLSConfig(poolCfg)
+	if err != nil {
+		return nil, fmt.Errorf("NewHttpEndpointPool: %v", err)
+	}
+	// The proxy applies to all the requests made via the transport, including
+	// the health checks:
+	proxyLog := ""
+	transport.Proxy, proxyLog, err = NewHttpEndpointPoolProxy(poolCfg.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("NewHttpEndpointPool: %v", err)
 	}
 
 	client := &http.Client{
@@ -481,20 +1105,39 @@ func NewHttpEndpointPool(poolCfg *HttpEndpointPoolConfig) (*HttpEndpointPool, er
 	}
 	epPool := &HttpEndpointPool{
 		healthy:                   &HttpEndpointDoublyLinkedList{},
+		endpoints:                 make(map[string]*HttpEndpoint),
+		dnsCache:                  dnsCache,
+		dnsRefreshInterval:        max(poolCfg.DnsRefreshInterval, 0),
+		markUnhealthyThreshold:    poolCfg.MarkUnhealthyThreshold,
 		authorization:             authorization,
+		headers:                   headers,
 		healthyPollInterval:       HTTP_ENDPOINT_POOL_HEALTHY_POLL_INTERVAL,
 		healthCheckErrLogInterval: HTTP_ENDPOINT_POOL_HEALTH_CHECK_ERR_LOG_INTERVAL,
 		healthyRotateInterval:     poolCfg.HealthyRotateInterval,
 		errorResetInterval:        poolCfg.ErrorResetInterval,
 		healthCheckInterval:       healthCheckInterval,
 		sendBufferTimeout:         poolCfg.SendBufferTimeout,
+		maxSendAttempts:           max(poolCfg.MaxSendAttempts, 0),
+		firstSendGateTimeout:      max(poolCfg.FirstSendGateTimeout, 0),
+		requireEndpointAtStartup:  poolCfg.RequireEndpointAtStartup,
 		healthyMaxWait:            poolCfg.HealthyMaxWait,
+		negotiateEncoding:         poolCfg.NegotiateEncoding,
+		honorRetryAfter:           poolCfg.HonorRetryAfter,
+		retryAfterMax:             poolCfg.RetryAfterMax,
+		retryOnConnReset:          poolCfg.RetryOnConnReset,
+		retryCodes:                make(map[int]bool),
+		retryBackoffBase:          max(poolCfg.RetryBackoffBase, 0),
+		retryBackoffMax:           max(poolCfg.RetryBackoffMax, 0),
+		batchSeqHeader:            poolCfg.BatchSeqHeader,
+		unhealthyThresholdRefresh: poolCfg.UnhealthyThresholdRefresh,
+		network:                   network,
 		firstUse:                  true,
 		client:                    client,
 		mu:                        &sync.Mutex{},
 		wg:                        &sync.WaitGroup{},
 		stats:                     NewHttpEndpointPoolStats(),
 	}
+	epPool.inflightCond = sync.NewCond(epPool.mu)
 
 	healthyRotateIntervalOffsetLog := ""
 	if offsetCfg := poolCfg.HealthyRotateIntervalOffset; epPool.healthyRotateInterval > 0 && offsetCfg != "" {
@@ -533,19 +1176,97 @@ func NewHttpEndpointPool(poolCfg *HttpEndpointPoolConfig) (*HttpEndpointPool, er
 		}
 	}
 
+	if poolCfg.HealthCheckMaxRps < 0 {
+		return nil, fmt.Errorf(
+			"NewHttpEndpointPool: invalid health_check_max_rps %v, want >= 0",
+			poolCfg.HealthCheckMaxRps,
+		)
+	}
+	if poolCfg.HealthCheckMaxRps > 0 {
+		// 1 token every 1/rps, w/o burst:
+		epPool.healthCheckCredit = NewCredit(1, 1, time.Duration(float64(time.Second)/poolCfg.HealthCheckMaxRps))
+	}
+
+	if poolCfg.InflightMaxBytes != "" {
+		inflightMaxBytes, err := units.RAMInBytes(poolCfg.InflightMaxBytes)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"NewHttpEndpointPool: invalid inflight_max_bytes %q: %v",
+				poolCfg.InflightMaxBytes, err,
+			)
+		}
+		if inflightMaxBytes > 0 {
+			epPool.inflightMaxBytes = int(inflightMaxBytes)
+			epPool.stats.InflightMaxBytes = uint64(inflightMaxBytes)
+		}
+	}
+
+	for _, code := range poolCfg.RetryStatusCodes {
+		if code < 100 || code > 599 || HttpEndpointPoolSuccessCodes[code] {
+			return nil, fmt.Errorf(
+				"NewHttpEndpointPool: invalid retry_status_codes code %d, want a non success 100..599 code",
+				code,
+			)
+		}
+		epPool.retryCodes[code] = true
+	}
+
+	if poolCfg.MaxRequestsPerConn > 0 {
+		epPool.maxRequestsPerConn = poolCfg.MaxRequestsPerConn
+		epPool.stats.MaxRequestsPerConn = uint64(poolCfg.MaxRequestsPerConn)
+	}
+
+	epPool.stats.RetryBackoffBase = uint64(epPool.retryBackoffBase.Microseconds())
+
+	if poolCfg.MaxConcurrentSends > 0 {
+		epPool.sendSem = make(chan struct{}, poolCfg.MaxConcurrentSends)
+		epPool.stats.MaxConcurrentSends = uint64(poolCfg.MaxConcurrentSends)
+	}
+
+	if epPool.negotiateEncoding {
+		if epPool.zstdEncoder, err = zstd.NewWriter(nil); err != nil {
+			return nil, fmt.Errorf("NewHttpEndpointPool: zstd.NewWriter: %v", err)
+		}
+	}
+
 	epPoolLog.Infof("healthy_rotate_interval=%s%s", epPool.healthyRotateInterval, healthyRotateIntervalOffsetLog)
 	epPoolLog.Infof("error_reset_interval=%s", epPool.errorResetInterval)
 	epPoolLog.Infof("health_check_interval=%s", epPool.healthCheckInterval)
+	epPoolLog.Infof("health_check_max_rps=%v", poolCfg.HealthCheckMaxRps)
 	epPoolLog.Infof("healthy_max_wait=%s", epPool.healthyMaxWait)
 	epPoolLog.Infof("healthy_poll_interval=%s", epPool.healthyPollInterval)
 	epPoolLog.Infof("max_idle_conns=%d", transport.MaxIdleConns)
 	epPoolLog.Infof("send_buffer_timeout=%s", epPool.sendBufferTimeout)
+	epPoolLog.Infof("max_send_attempts=%d", epPool.maxSendAttempts)
+	epPoolLog.Infof("first_send_gate_timeout=%s", epPool.firstSendGateTimeout)
+	epPoolLog.Infof("require_endpoint_at_startup=%v", epPool.requireEndpointAtStartup)
 	epPoolLog.Infof("rate_limit_mbps=%v", epPool.credit)
+	epPoolLog.Infof("negotiate_encoding=%v", epPool.negotiateEncoding)
+	epPoolLog.Infof("inflight_max_bytes=%d", epPool.inflightMaxBytes)
+	epPoolLog.Infof("max_concurrent_sends=%d", cap(epPool.sendSem))
+	epPoolLog.Infof("max_requests_per_conn=%d", epPool.maxRequestsPerConn)
+	epPoolLog.Infof("honor_retry_after=%v", epPool.honorRetryAfter)
+	epPoolLog.Infof("retry_after_max=%s", epPool.retryAfterMax)
+	epPoolLog.Infof("retry_on_conn_reset=%v", epPool.retryOnConnReset)
+	epPoolLog.Infof("retry_status_codes=%v", poolCfg.RetryStatusCodes)
+	epPoolLog.Infof("retry_backoff_base=%s", epPool.retryBackoffBase)
+	epPoolLog.Infof("retry_backoff_max=%s", epPool.retryBackoffMax)
+	epPoolLog.Infof("batch_seq_header=%v", epPool.batchSeqHeader)
+	// N.B. The header values may contain secrets, log only the names:
+	headerNames := slices.Sorted(maps.Keys(epPool.headers))
+	epPoolLog.Infof("headers=%v", headerNames)
+	epPoolLog.Infof("mark_unhealthy_threshold=%s", poolCfg.MarkUnhealthyThreshold)
+	epPoolLog.Infof("mark_unhealthy_threshold_refresh=%s", epPool.unhealthyThresholdRefresh)
 	epPoolLog.Infof("tcp_conn_timeout=%s", dialer.Timeout)
 	epPoolLog.Infof("tcp_keep_alive=%s", dialer.KeepAlive)
+	epPoolLog.Infof("network=%s", network)
+	epPoolLog.Infof("fallback_delay=%s", dialer.FallbackDelay)
+	epPoolLog.Infof("dns_cache_ttl=%s", poolCfg.DnsCacheTTL)
+	epPoolLog.Infof("dns_refresh_interval=%s", epPool.dnsRefreshInterval)
 	epPoolLog.Infof("max_idle_conns_per_host=%d", transport.MaxIdleConnsPerHost)
 	epPoolLog.Infof("max_conns_per_host=%d", transport.MaxConnsPerHost)
 	epPoolLog.Infof("idle_conn_timeout=%s", transport.IdleConnTimeout)
+	epPoolLog.Infof("proxy=%s", proxyLog)
 	epPoolLog.Infof("response_timeout=%s", client.Timeout)
 
 	endpoints := poolCfg.Endpoints
@@ -557,30 +1278,286 @@ func NewHttpEndpointPool(poolCfg *HttpEndpointPoolConfig) (*HttpEndpointPool, er
 		rand.Shuffle(len(endpoints), func(i, j int) { endpoints[i], endpoints[j] = endpoints[j], endpoints[i] })
 	}
 	for _, epCfg := range endpoints {
-		cfg := *epCfg
-		if cfg.URL == "" {
-			cfg.URL = HTTP_ENDPOINT_URL_DEFAULT
-		}
-		if cfg.MarkUnhealthyThreshold <= 0 {
-			cfg.MarkUnhealthyThreshold = poolCfg.MarkUnhealthyThreshold
-		}
-		if cfg.MarkUnhealthyThreshold <= 0 {
-			cfg.MarkUnhealthyThreshold = HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_DEFAULT
-		}
-		if ep, err := NewHttpEndpoint(&cfg); err != nil {
+		if err := epPool.addEndpoint(epCfg); err != nil {
 			return nil, err
-		} else {
-			epPool.stats.EndpointStats[ep.url] = make(HttpEndpointStats, HTTP_ENDPOINT_STATS_LEN)
-			epPool.MoveToHealthy(ep)
 		}
 	}
 	if epPool.healthy.head == nil {
 		epPoolLog.Warn(ErrHttpEndpointPoolNoHealthyEP)
 	}
+	if len(epPool.autoThresholdEndpoints) > 0 && epPool.unhealthyThresholdRefresh > 0 {
+		epPool.wg.Add(1)
+		go epPool.UnhealthyThresholdRefreshLoop()
+	}
+	if epPool.dnsCache != nil {
+		epPool.wg.Add(1)
+		go epPool.DnsCacheRefreshLoop()
+	}
+	if epPool.dnsRefreshInterval > 0 {
+		epPool.wg.Add(1)
+		go epPool.DnsRefreshLoop()
+	}
 
 	return epPool, nil
 }
 
+// Create an endpoint, w/ the pool fallbacks applied, and add it to the pool, as
+// healthy:
+func (epPool *HttpEndpointPool) addEndpoint(epCfg *HttpEndpointConfig) error {
+	cfg := *epCfg
+	if cfg.URL == "" {
+		cfg.URL = HTTP_ENDPOINT_URL_DEFAULT
+	}
+	if cfg.MarkUnhealthyThreshold == 0 {
+		cfg.MarkUnhealthyThreshold = epPool.markUnhealthyThreshold
+	}
+	if cfg.MarkUnhealthyThreshold <= 0 && cfg.MarkUnhealthyThreshold != HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_AUTO {
+		cfg.MarkUnhealthyThreshold = HTTP_ENDPOINT_MARK_UNHEALTHY_THRESHOLD_DEFAULT
+	}
+	if cfg.ErrorResetInterval == 0 {
+		cfg.ErrorResetInterval = epPool.errorResetInterval
+	} else {
+		epPoolLog.Infof("%s: error_reset_interval=%s", cfg.URL, cfg.ErrorResetInterval)
+	}
+	if cfg.Weight != 0 && cfg.Weight != HTTP_ENDPOINT_WEIGHT_DEFAULT {
+		epPoolLog.Infof("%s: weight=%d", cfg.URL, cfg.Weight)
+	}
+	ep, err := NewHttpEndpoint(&cfg)
+	if err != nil {
+		return err
+	}
+	epPool.mu.Lock()
+	epPool.endpoints[ep.url] = ep
+	epPool.stats.EndpointStats[ep.url] = make(HttpEndpointStats, HTTP_ENDPOINT_STATS_LEN)
+	if ep.autoMarkUnhealthyThreshold {
+		epPool.autoThresholdEndpoints = append(epPool.autoThresholdEndpoints, ep)
+	}
+	epPool.mu.Unlock()
+	if ep.autoMarkUnhealthyThreshold {
+		epPool.UpdateMarkUnhealthyThreshold(ep)
+	}
+	epPool.MoveToHealthy(ep)
+	return nil
+}
+
+// Update the endpoint list at runtime, e.g. upon config reload. The endpoints
+// are matched by URL: the new ones are added to the tail of the healthy list,
+// the ones no longer present are removed, whether healthy or not, and the
+// others are left unchanged, along w/ their state and settings. An empty list
+// stands for the default endpoint, same as for the pool creation.
+func (epPool *HttpEndpointPool) UpdateEndpoints(endpoints []*HttpEndpointConfig) error {
+	if len(endpoints) == 0 {
+		endpoints = []*HttpEndpointConfig{DefaultHttpEndpointConfig()}
+	}
+	// Validate the list upfront, such that it is applied all or nothing:
+	wantUrls := make(map[string]bool)
+	for _, epCfg := range endpoints {
+		url := epCfg.URL
+		if url == "" {
+			url = HTTP_ENDPOINT_URL_DEFAULT
+		}
+		if _, err := NewHttpEndpoint(&HttpEndpointConfig{URL: url}); err != nil {
+			return fmt.Errorf("UpdateEndpoints: %v", err)
+		}
+		wantUrls[url] = true
+	}
+
+	epPool.mu.Lock()
+	if epPool.shutdown {
+		epPool.mu.Unlock()
+		return fmt.Errorf("UpdateEndpoints: pool shutdown")
+	}
+	for url, ep := range epPool.endpoints {
+		if wantUrls[url] {
+			continue
+		}
+		if ep.healthy {
+			if ep == epPool.healthy.head {
+				epPool.firstUse = true
+			}
+			epPool.healthy.Remove(ep)
+		}
+		// N.B. The health check, if in progress, stops at its next probe and
+		// the sends in progress w/ this endpoint complete, but their outcome
+		// doesn't affect the pool anymore:
+		ep.healthy, ep.removed = false, true
+		delete(epPool.endpoints, url)
+		delete(epPool.stats.EndpointStats, url)
+		delete(epPool.stats.EndpointLifetimeStats, url)
+		epPool.autoThresholdEndpoints = slices.DeleteFunc(
+			epPool.autoThresholdEndpoints,
+			func(autoEp *HttpEndpoint) bool { return autoEp == ep },
+		)
+		epPoolLog.Infof("%s removed from the pool", url)
+	}
+	addEpCfgs := make([]*HttpEndpointConfig, 0)
+	for _, epCfg := range endpoints {
+		url := epCfg.URL
+		if url == "" {
+			url = HTTP_ENDPOINT_URL_DEFAULT
+		}
+		if epPool.endpoints[url] == nil {
+			addEpCfgs = append(addEpCfgs, epCfg)
+		}
+	}
+	epPool.mu.Unlock()
+
+	for _, epCfg := range addEpCfgs {
+		if err := epPool.addEndpoint(epCfg); err != nil {
+			// N.B. Not expected, the list was validated above:
+			return fmt.Errorf("UpdateEndpoints: %v", err)
+		}
+	}
+	return nil
+}
+
+// Change the rate limit at runtime, e.g. upon config reload, using the same
+// format as rate_limit_mbps; use "" to disable. The sends in progress complete
+// w/o further throttling.
+func (epPool *HttpEndpointPool) SetRateLimit(spec string) error {
+	var newCredit CreditController
+	if spec != "" {
+		credit, err := NewCreditFromSpec(spec)
+		if err != nil {
+			return fmt.Errorf("SetRateLimit: %v", err)
+		}
+		newCredit = credit
+	}
+	epPool.mu.Lock()
+	if epPool.shutdown {
+		epPool.mu.Unlock()
+		if credit, ok := newCredit.(*Credit); ok {
+			credit.StopReplenishWait()
+		}
+		return fmt.Errorf("SetRateLimit: pool shutdown")
+	}
+	oldCredit := epPool.credit
+	epPool.credit = newCredit
+	epPool.mu.Unlock()
+	// Stopping the old credit makes it unlimited, releasing its waiters:
+	if credit, ok := oldCredit.(*Credit); ok {
+		credit.StopReplenishWait()
+	}
+	epPoolLog.Infof("rate_limit_mbps=%v", newCredit)
+	return nil
+}
+
+// Resolve the host and return the number of addresses, restricted to the
+// address family implied by the network, if any:
+func (epPool *HttpEndpointPool) lookupNumAddrs(host string) (int, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return 1, nil
+	}
+	ctx, cancelFn := context.WithTimeout(epPool.ctx, HTTP_ENDPOINT_POOL_DNS_LOOKUP_TIMEOUT)
+	defer cancelFn()
+	addrs, err := httpEndpointPoolLookupHostFn(ctx, host)
+	if err != nil {
+		return 0, err
+	}
+	numAddrs := 0
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		isIPv4 := ip.To4() != nil
+		if epPool.network == "tcp4" && !isIPv4 || epPool.network == "tcp6" && isIPv4 {
+			continue
+		}
+		numAddrs++
+	}
+	if numAddrs == 0 {
+		return 0, fmt.Errorf("%s: no usable address for network %s", host, epPool.network)
+	}
+	return numAddrs, nil
+}
+
+// Set the mark unhealthy threshold to the number of addresses the endpoint
+// host resolves to; in case of error the current value is preserved:
+func (epPool *HttpEndpointPool) UpdateMarkUnhealthyThreshold(ep *HttpEndpoint) {
+	numAddrs, err := epPool.lookupNumAddrs(ep.URL.Hostname())
+	if err != nil {
+		epPoolLog.Warnf("%s: mark_unhealthy_threshold: %v", ep.url, err)
+		return
+	}
+	epPool.mu.Lock()
+	defer epPool.mu.Unlock()
+	if ep.markUnhealthyThreshold != numAddrs {
+		epPoolLog.Infof(
+			"%s: mark_unhealthy_threshold: %d -> %d (auto)",
+			ep.url, ep.markUnhealthyThreshold, numAddrs,
+		)
+		ep.markUnhealthyThreshold = numAddrs
+	}
+}
+
+func (epPool *HttpEndpointPool) UnhealthyThresholdRefreshLoop() {
+	defer epPool.wg.Done()
+
+	ticker := time.NewTicker(epPool.unhealthyThresholdRefresh)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-epPool.ctx.Done():
+			return
+		case <-ticker.C:
+			epPool.mu.Lock()
+			autoThresholdEndpoints := slices.Clone(epPool.autoThresholdEndpoints)
+			epPool.mu.Unlock()
+			for _, ep := range autoThresholdEndpoints {
+				epPool.UpdateMarkUnhealthyThreshold(ep)
+			}
+		}
+	}
+}
+
+// Periodically close the idle connections, such that the next requests dial
+// anew and therefore re-resolve the endpoint hosts. N.B. Only the connections
+// idle at the time of the tick are closed; those in use are returned to the
+// idle pool upon completion and they may be reused until a subsequent tick
+// finds them idle.
+func (epPool *HttpEndpointPool) DnsRefreshLoop() {
+	defer epPool.wg.Done()
+
+	ticker := time.NewTicker(epPool.dnsRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-epPool.ctx.Done():
+			return
+		case <-ticker.C:
+			epPool.client.CloseIdleConnections()
+			epPool.mu.Lock()
+			epPool.stats.PoolStats[HTTP_ENDPOINT_POOL_STATS_DNS_REFRESH_COUNT] += 1
+			epPool.mu.Unlock()
+			if RootLogger.IsEnabledForDebug {
+				epPoolLog.Debug("idle connections closed for DNS refresh")
+			}
+		}
+	}
+}
+
+// Re-resolve the cached hosts every TTL, such that the connections to stale
+// addresses are closed even w/o new dials, i.e. while the connections are
+// reused:
+func (epPool *HttpEndpointPool) DnsCacheRefreshLoop() {
+	defer epPool.wg.Done()
+
+	ticker := time.NewTicker(epPool.dnsCache.ttl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-epPool.ctx.Done():
+			return
+		case <-ticker.C:
+			epPool.dnsCache.Refresh(epPool.ctx)
+		}
+	}
+}
+
 func (epPool *HttpEndpointPool) HealthCheck(ep *HttpEndpoint) {
 	defer epPool.wg.Done()
 
@@ -617,6 +1594,7 @@ func (epPool *HttpEndpointPool) HealthCheck(ep *HttpEndpoint) {
 	if epPool.authorization != "" {
 		req.Header.Add("Authorization", epPool.authorization)
 	}
+	epPool.setHeaders(req.Header)
 
 	ticker := time.NewTicker(epPool.healthCheckInterval)
 	defer ticker.Stop()
@@ -627,6 +1605,20 @@ func (epPool *HttpEndpointPool) HealthCheck(ep *HttpEndpoint) {
 			epPoolLog.Warnf("cancel health check for %s", ep.url)
 			return
 		case <-ticker.C:
+			mu.Lock()
+			removed := ep.removed
+			mu.Unlock()
+			if removed {
+				epPoolLog.Infof("stop health check for removed %s", ep.url)
+				return
+			}
+			if epPool.healthCheckCredit != nil {
+				epPool.healthCheckCredit.GetCredit(1, 1)
+				if epPool.ctx.Err() != nil {
+					epPoolLog.Warnf("cancel health check for %s", ep.url)
+					return
+				}
+			}
 			res, err := epPool.client.Do(req)
 			if res != nil && res.Body != nil {
 				res.Body.Close()
@@ -662,9 +1654,12 @@ func (epPool *HttpEndpointPool) HealthCheck(ep *HttpEndpoint) {
 				}
 			}
 			mu.Lock()
-			stats.EndpointStats[url][HTTP_ENDPOINT_STATS_HEALTH_CHECK_COUNT] += 1
-			if !healthy {
-				stats.EndpointStats[url][HTTP_ENDPOINT_STATS_HEALTH_CHECK_ERROR_COUNT] += 1
+			// N.B. The stats are missing if the endpoint was removed meanwhile:
+			if epStats := stats.EndpointStats[url]; epStats != nil {
+				epStats[HTTP_ENDPOINT_STATS_HEALTH_CHECK_COUNT] += 1
+				if !healthy {
+					epStats[HTTP_ENDPOINT_STATS_HEALTH_CHECK_ERROR_COUNT] += 1
+				}
 			}
 			mu.Unlock()
 		}
@@ -701,6 +1696,15 @@ func (epPool *HttpEndpointPool) ReportError(ep *HttpEndpoint) {
 		// Initiate health check:
 		epPool.healthy.Remove(ep)
 		ep.healthy = false
+		if stats := epPool.stats; stats != nil {
+			epLifetimeStats := stats.EndpointLifetimeStats[ep.url]
+			if epLifetimeStats == nil {
+				epLifetimeStats = &HttpEndpointLifetimeStats{}
+				stats.EndpointLifetimeStats[ep.url] = epLifetimeStats
+			}
+			epLifetimeStats.UnhealthyCount += 1
+			epLifetimeStats.UnhealthySince = time.Now()
+		}
 		if !epPool.shutdown {
 			epPoolLog.Warnf("%s moved to health check", ep.url)
 			epPool.wg.Add(1)
@@ -725,12 +1729,20 @@ func (epPool *HttpEndpointPool) ReportError(ep *HttpEndpoint) {
 func (epPool *HttpEndpointPool) MoveToHealthy(ep *HttpEndpoint) {
 	epPool.mu.Lock()
 	defer epPool.mu.Unlock()
-	if ep.healthy {
-		// Already in the healthy state:
+	if ep.healthy || ep.removed {
+		// Already in the healthy state or no longer in the pool:
 		return
 	}
 	ep.healthy = true
 	ep.numErrors = 0
+	if stats := epPool.stats; stats != nil {
+		if epLifetimeStats := stats.EndpointLifetimeStats[ep.url]; epLifetimeStats != nil &&
+			!epLifetimeStats.UnhealthySince.IsZero() {
+			epLifetimeStats.Downtime += uint64(time.Since(epLifetimeStats.UnhealthySince).Microseconds())
+			epLifetimeStats.UnhealthySince = time.Time{}
+		}
+	}
+	ep.negotiateEncoding = epPool.negotiateEncoding
 	epPool.healthy.AddToTail(ep)
 	if epPool.healthy.head == ep {
 		epPoolLog.Infof("%s is at the head of the healthy list", ep.url)
@@ -739,6 +1751,106 @@ func (epPool *HttpEndpointPool) MoveToHealthy(ep *HttpEndpoint) {
 	}
 }
 
+// Ensure that the head of the healthy list is eligible for selection, i.e. it
+// is not paused. Paused endpoints at the head are moved to the tail. Return
+// false if there is no eligible endpoint. N.B. The caller should hold the lock.
+func (epPool *HttpEndpointPool) promoteEligible() bool {
+	head := epPool.healthy.head
+	if head == nil {
+		return false
+	}
+	now := time.Now()
+	for ep := head; ep != nil; ep = ep.next {
+		if ep.pausedUntil.IsZero() || !now.Before(ep.pausedUntil) {
+			ep.pausedUntil = time.Time{}
+			if ep != head {
+				for epPool.healthy.head != ep {
+					paused := epPool.healthy.head
+					epPool.healthy.Remove(paused)
+					epPool.healthy.AddToTail(paused)
+				}
+				epPool.firstUse = true
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// Pause an endpoint, i.e. make it ineligible for selection for a while, w/o
+// declaring it unhealthy:
+func (epPool *HttpEndpointPool) PauseEndpoint(ep *HttpEndpoint, pause time.Duration) {
+	epPool.mu.Lock()
+	defer epPool.mu.Unlock()
+	ep.pausedUntil = time.Now().Add(pause)
+	epPoolLog.Warnf("%s paused for %s", ep.url, pause)
+	if ep.healthy && epPool.healthy.head != epPool.healthy.tail {
+		epPool.healthy.Remove(ep)
+		epPool.healthy.AddToTail(ep)
+		epPool.firstUse = true
+	}
+}
+
+// Promote a healthy endpoint to the head of the healthy list, such that it is
+// used for the next send, w/o waiting for the rotation. This is intended for
+// admin actions, e.g. controlled failover, and integration tests. Unknown,
+// unhealthy or paused endpoints are left in place and an error is returned.
+func (epPool *HttpEndpointPool) Promote(url string) error {
+	epPool.mu.Lock()
+	defer epPool.mu.Unlock()
+	var ep *HttpEndpoint
+	for ep = epPool.healthy.head; ep != nil && ep.url != url; ep = ep.next {
+	}
+	if ep == nil {
+		return fmt.Errorf("Promote(%s): not a healthy endpoint", url)
+	}
+	if !ep.pausedUntil.IsZero() && time.Now().Before(ep.pausedUntil) {
+		return fmt.Errorf("Promote(%s): endpoint paused until %s", url, ep.pausedUntil.Format(time.RFC3339))
+	}
+	if ep != epPool.healthy.head {
+		epPool.healthy.Remove(ep)
+		epPool.healthy.AddToHead(ep)
+	}
+	// Restart the rotation interval, such that the endpoint is not rotated away
+	// upon the next use:
+	epPool.firstUse = true
+	epPoolLog.Infof("%s promoted to the head of the healthy list", ep.url)
+	return nil
+}
+
+// Whether there is at least one healthy endpoint, paused or not, e.g. for a
+// readiness probe:
+func (epPool *HttpEndpointPool) HasHealthyEndpoint() bool {
+	epPool.mu.Lock()
+	defer epPool.mu.Unlock()
+	for ep := epPool.healthy.head; ep != nil; ep = ep.next {
+		if ep.healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse Retry-After header value, either seconds or HTTP-date, see
+// https://www.rfc-editor.org/rfc/rfc9110#field.retry-after. Return the
+// duration and whether it was valid or not:
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if ts, err := http.ParseTime(value); err == nil {
+		return max(ts.Sub(now), 0), true
+	}
+	return 0, false
+}
+
 // Get the current healthy endpoint or nil if none available after max wait; if
 // maxWait < 0 then the pool healthyMaxWait is used:
 func (epPool *HttpEndpointPool) GetCurrentHealthy(maxWait time.Duration) *HttpEndpoint {
@@ -751,15 +1863,21 @@ func (epPool *HttpEndpointPool) GetCurrentHealthy(maxWait time.Duration) *HttpEn
 
 	// There is no sync.Condition Wait with timeout, so poll until deadline or
 	// shutdown, waiting for a healthy endpoint. It shouldn't impact the overall
-	// efficiency since this is not the normal operating condition.
+	// efficiency since this is not the normal operating condition. The wait is
+	// interrupted by shutdown, such that the callers return promptly.
 	deadline := time.Now().Add(maxWait)
-	for epPool.healthy.head == nil && !epPool.shutdown {
+	for !epPool.promoteEligible() && !epPool.shutdown {
 		timeLeft := time.Until(deadline)
 		if timeLeft <= 0 {
 			return nil
 		}
 		epPool.mu.Unlock()
-		time.Sleep(min(epPool.healthyPollInterval, timeLeft))
+		timer := time.NewTimer(min(epPool.healthyPollInterval, timeLeft))
+		select {
+		case <-timer.C:
+		case <-epPool.ctx.Done():
+		}
+		timer.Stop()
 		epPool.mu.Lock()
 	}
 	ep := epPool.healthy.head
@@ -772,29 +1890,42 @@ func (epPool *HttpEndpointPool) GetCurrentHealthy(maxWait time.Duration) *HttpEn
 			epPool.healthyRotateInterval > 0 &&
 				time.Since(epPool.healthyHeadChangeTs) >= epPool.healthyRotateInterval {
 			if epPool.healthy.head != epPool.healthy.tail {
-				epPool.healthy.Remove(ep)
-				epPool.healthy.AddToTail(ep)
-				if RootLogger.IsEnabledForDebug {
-					epPoolLog.Debugf(
-						"%s: error#: %d, threshold: %d rotated to healthy list tail",
-						ep.url, ep.numErrors, ep.markUnhealthyThreshold,
-					)
+				if ep != epPool.healthyHeadTurnsEp {
+					epPool.healthyHeadTurnsEp, epPool.healthyHeadTurns = ep, 0
 				}
-				ep = epPool.healthy.head
-				epPool.healthyHeadChangeTs = time.Now()
-				if RootLogger.IsEnabledForDebug {
-					epPoolLog.Debugf(
-						"%s: error#: %d, threshold: %d rotated to healthy list head",
-						ep.url, ep.numErrors, ep.markUnhealthyThreshold,
-					)
+				if epPool.healthyHeadTurns++; epPool.healthyHeadTurns < epPool.healthyHeadMaxTurns(ep) {
+					// Weighted rotation, the endpoint keeps the head for
+					// another turn:
+					epPool.healthyHeadChangeTs = time.Now()
+				} else {
+					epPool.healthyHeadTurnsEp = nil
+					epPool.healthy.Remove(ep)
+					epPool.healthy.AddToTail(ep)
+					if RootLogger.IsEnabledForDebug {
+						epPoolLog.Debugf(
+							"%s: error#: %d, threshold: %d rotated to healthy list tail",
+							ep.url, ep.numErrors, ep.markUnhealthyThreshold,
+						)
+					}
+					// The rotation may have brought a paused endpoint to the head:
+					epPool.promoteEligible()
+					ep = epPool.healthy.head
+					epPool.healthyHeadChangeTs = time.Now()
+					epPool.firstUse = false
+					if RootLogger.IsEnabledForDebug {
+						epPoolLog.Debugf(
+							"%s: error#: %d, threshold: %d rotated to healthy list head",
+							ep.url, ep.numErrors, ep.markUnhealthyThreshold,
+						)
+					}
+					epPool.stats.PoolStats[HTTP_ENDPOINT_POOL_STATS_HEALTHY_ROTATE_COUNT] += 1
 				}
-				epPool.stats.PoolStats[HTTP_ENDPOINT_POOL_STATS_HEALTHY_ROTATE_COUNT] += 1
 			}
 		}
 		// Apply error reset as needed:
 		if ep.numErrors > 0 &&
-			epPool.errorResetInterval > 0 &&
-			time.Since(ep.errorTs) >= epPool.errorResetInterval {
+			ep.errorResetInterval > 0 &&
+			time.Since(ep.errorTs) >= ep.errorResetInterval {
 			epPoolLog.Infof("%s: error#: %d->0)", ep.url, ep.numErrors)
 			ep.numErrors = 0
 		}
@@ -802,41 +1933,378 @@ func (epPool *HttpEndpointPool) GetCurrentHealthy(maxWait time.Duration) *HttpEn
 	return ep
 }
 
+// The number of rotation turns the endpoint should keep the head of the
+// healthy list for: its weight, normalized by the GCD of the weights of the
+// healthy endpoints, such that equal weights amount to a single turn, i.e.
+// the unweighted rotation. The endpoints under health check are not in the
+// healthy list, so their weights are excluded. Must be called w/ the lock
+// held.
+func (epPool *HttpEndpointPool) healthyHeadMaxTurns(ep *HttpEndpoint) int {
+	weightGcd := 0
+	for hEp := epPool.healthy.head; hEp != nil; hEp = hEp.next {
+		a, b := hEp.weight, weightGcd
+		for b != 0 {
+			a, b = b, a%b
+		}
+		weightGcd = a
+	}
+	if weightGcd <= 0 {
+		return 1
+	}
+	return ep.weight / weightGcd
+}
+
+// Negotiate the content encoding w/ the endpoint, if needed, and return the
+// one to be used for sending, or the empty string if the buffer should be sent
+// as provided by the compressor. The negotiation is bound by the deadline of
+// the send that triggered it:
+func (epPool *HttpEndpointPool) GetContentEncoding(ep *HttpEndpoint, deadline time.Time) string {
+	epPool.mu.Lock()
+	negotiateEncoding, contentEncoding := ep.negotiateEncoding, ep.contentEncoding
+	epPool.mu.Unlock()
+	if !negotiateEncoding {
+		return contentEncoding
+	}
+
+	contentEncoding = ""
+	ctx, cancel := context.WithDeadline(epPool.ctx, deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, ep.url, nil)
+	if err == nil {
+		if epPool.authorization != "" {
+			req.Header.Add("Authorization", epPool.authorization)
+		}
+		epPool.setHeaders(req.Header)
+	}
+	var res *http.Response
+	if err == nil {
+		res, err = epPool.client.Do(req)
+		if res != nil && res.Body != nil {
+			res.Body.Close()
+		}
+	}
+	if err != nil {
+		epPoolLog.Warnf("%s: negotiate encoding: %v", ep.url, err)
+	} else if acceptEncoding := res.Header.Values("Accept-Encoding"); len(acceptEncoding) == 0 {
+		epPoolLog.Warnf(
+			"%s: negotiate encoding: %s %q: %s: no Accept-Encoding header",
+			ep.url, req.Method, req.URL, res.Status,
+		)
+	} else {
+		contentEncoding = SelectContentEncoding(acceptEncoding)
+		epPoolLog.Infof(
+			"%s: negotiate encoding: Accept-Encoding: %q, selected: %q",
+			ep.url, acceptEncoding, contentEncoding,
+		)
+	}
+
+	epPool.mu.Lock()
+	ep.negotiateEncoding = false
+	ep.contentEncoding = contentEncoding
+	epPool.mu.Unlock()
+	return contentEncoding
+}
+
+// Select the most preferred supported encoding from Accept-Encoding header
+// values. Identity is acceptable unless explicitly excluded via q=0, in which
+// case the empty string is returned:
+func SelectContentEncoding(acceptEncoding []string) string {
+	accepted := map[string]bool{
+		HTTP_CONTENT_ENCODING_IDENTITY: true,
+	}
+	for _, value := range acceptEncoding {
+		for _, coding := range strings.Split(value, ",") {
+			params := strings.Split(coding, ";")
+			coding = strings.ToLower(strings.TrimSpace(params[0]))
+			if coding == "" {
+				continue
+			}
+			ok := true
+			for _, param := range params[1:] {
+				param = strings.ReplaceAll(param, " ", "")
+				if q, found := strings.CutPrefix(param, "q="); found {
+					if qVal, err := strconv.ParseFloat(q, 64); err == nil && qVal <= 0 {
+						ok = false
+					}
+				}
+			}
+			accepted[coding] = ok
+		}
+	}
+	for _, contentEncoding := range HttpEndpointPoolContentEncodingPreference {
+		if accepted[contentEncoding] {
+			return contentEncoding
+		}
+	}
+	return ""
+}
+
+// Re-encode a buffer, as needed:
+func (epPool *HttpEndpointPool) EncodeBuffer(b []byte, srcEncoding string, contentEncoding string) ([]byte, error) {
+	if srcEncoding == "" {
+		srcEncoding = HTTP_CONTENT_ENCODING_IDENTITY
+	}
+	if contentEncoding == "" || contentEncoding == srcEncoding {
+		return b, nil
+	}
+
+	switch srcEncoding {
+	case HTTP_CONTENT_ENCODING_IDENTITY:
+	case HTTP_CONTENT_ENCODING_GZIP:
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("EncodeBuffer: gzip.NewReader: %v", err)
+		}
+		b, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("EncodeBuffer: gzip read: %v", err)
+		}
+	case HTTP_CONTENT_ENCODING_SNAPPY:
+		var err error
+		b, err = io.ReadAll(snappy.NewReader(bytes.NewReader(b)))
+		if err != nil {
+			return nil, fmt.Errorf("EncodeBuffer: snappy read: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("EncodeBuffer: %q: unsupported source encoding", srcEncoding)
+	}
+
+	switch contentEncoding {
+	case HTTP_CONTENT_ENCODING_IDENTITY:
+		return b, nil
+	case HTTP_CONTENT_ENCODING_GZIP:
+		buf := &bytes.Buffer{}
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(b); err != nil {
+			return nil, fmt.Errorf("EncodeBuffer: gzip write: %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("EncodeBuffer: gzip close: %v", err)
+		}
+		return buf.Bytes(), nil
+	case HTTP_CONTENT_ENCODING_ZSTD:
+		if epPool.zstdEncoder == nil {
+			return nil, fmt.Errorf("EncodeBuffer: %q: no encoder", contentEncoding)
+		}
+		return epPool.zstdEncoder.EncodeAll(b, nil), nil
+	}
+	return nil, fmt.Errorf("EncodeBuffer: %q: unsupported encoding", contentEncoding)
+}
+
+// Account for bytes about to be in flight through a credit reader, waiting as
+// needed for the total to fall below the ceiling. A buffer is always admitted
+// if there is nothing else in flight, to guarantee progress. N.B. The caller
+// should hold the lock.
+func (epPool *HttpEndpointPool) acquireInflight(n int) {
+	stats := epPool.stats
+	for epPool.inflightMaxBytes > 0 && !epPool.shutdown && stats.InflightBytes > 0 &&
+		stats.InflightBytes+uint64(n) > uint64(epPool.inflightMaxBytes) {
+		epPool.inflightCond.Wait()
+	}
+	stats.InflightBytes += uint64(n)
+}
+
+func (epPool *HttpEndpointPool) releaseInflight(n int) {
+	epPool.mu.Lock()
+	epPool.stats.InflightBytes -= uint64(n)
+	epPool.inflightCond.Broadcast()
+	epPool.mu.Unlock()
+}
+
+// Acquire a send slot, waiting at most until deadline. The wait time is added
+// to the stats. Return false if no slot could be acquired, due to timeout or
+// pool shutdown.
+func (epPool *HttpEndpointPool) acquireSendSlot(deadline time.Time) bool {
+	startTs := time.Now()
+	acquired := false
+	select {
+	case epPool.sendSem <- struct{}{}:
+		acquired = true
+	default:
+		timer := time.NewTimer(time.Until(deadline))
+		select {
+		case epPool.sendSem <- struct{}{}:
+			acquired = true
+		case <-timer.C:
+		case <-epPool.ctx.Done():
+		}
+		timer.Stop()
+	}
+	waitTime := time.Since(startTs)
+	epPool.mu.Lock()
+	epPool.stats.SendWaitTime += uint64(waitTime.Microseconds())
+	epPool.mu.Unlock()
+	return acquired
+}
+
+func (epPool *HttpEndpointPool) releaseSendSlot() {
+	<-epPool.sendSem
+}
+
+// The action taken when the first send health gate fails and an endpoint is
+// required at startup; it may be replaced for testing:
+var httpEndpointPoolFirstSendGateFatalf = func(format string, args ...any) {
+	epPoolLog.Fatalf(format, args...)
+}
+
+// Claim the first send, return true only for the 1st invocation:
+func (epPool *HttpEndpointPool) claimFirstSend() bool {
+	epPool.mu.Lock()
+	defer epPool.mu.Unlock()
+	if epPool.firstSendClaimed {
+		return false
+	}
+	epPool.firstSendClaimed = true
+	return true
+}
+
 // SendBuffer: the main reason for the pool is to send buffers w/ load balancing
 // and retries. If timeout is < 0 then the pool's sendBufferTimeout is used:
-func (epPool *HttpEndpointPool) SendBuffer(b []byte, timeout time.Duration, gzipped bool) error {
-	var body ReadSeekRewindCloser
+func (epPool *HttpEndpointPool) SendBuffer(b []byte, timeout time.Duration, bufEncoding string) error {
+	if timeout < 0 {
+		timeout = epPool.sendBufferTimeout
+	}
+
+	// First data health gate, distinct from the connectivity probe (health
+	// check), since it confirms that the data is actually accepted:
+	if epPool.firstSendGateTimeout > 0 && epPool.claimFirstSend() {
+		gateStart := time.Now()
+		err := epPool.SendBuffer(b, min(timeout, epPool.firstSendGateTimeout), bufEncoding)
+		if err == nil {
+			epPoolLog.Info("first send health gate passed")
+			return nil
+		}
+		if epPool.requireEndpointAtStartup {
+			httpEndpointPoolFirstSendGateFatalf(
+				"!!! FIRST SEND HEALTH GATE FAILED !!! no data accepted within %s: %v",
+				epPool.firstSendGateTimeout, err,
+			)
+			return err
+		}
+		epPoolLog.Errorf(
+			"!!! FIRST SEND HEALTH GATE FAILED !!! no data accepted within %s: %v",
+			epPool.firstSendGateTimeout, err,
+		)
+		// The gate is informational only, keep sending the buffer for the
+		// rest of the timeout, as a normal send:
+		if timeout -= time.Since(gateStart); timeout <= 0 {
+			return err
+		}
+	}
+
+	var (
+		body         ReadSeekRewindCloser
+		bodyBytes    []byte
+		bodyEncoding string
+	)
 
 	stats, mu := epPool.stats, epPool.mu
 
 	header := http.Header{
 		"Content-Type": {"text/html"},
 	}
-	if gzipped {
-		header.Add("Content-Encoding", "gzip")
-	}
 	if epPool.authorization != "" {
 		header.Add("Authorization", epPool.authorization)
 	}
+	epPool.setHeaders(header)
+	// The remote write buffers are sent as-is, w/ the protocol mandated
+	// method and headers; the latter take precedence over the custom ones:
+	remoteWrite, method := bufEncoding == HTTP_CONTENT_ENCODING_REMOTE_WRITE, http.MethodPut
+	if remoteWrite {
+		method = http.MethodPost
+		header.Set("Content-Type", REMOTE_WRITE_CONTENT_TYPE)
+		header.Set(REMOTE_WRITE_VERSION_HEADER, REMOTE_WRITE_VERSION)
+	}
+	if epPool.batchSeqHeader {
+		// Assigned once per batch, such that the retries can be identified
+		// as such by the receiver:
+		mu.Lock()
+		epPool.batchSeq += 1
+		batchSeq := epPool.batchSeq
+		mu.Unlock()
+		header.Set(HTTP_ENDPOINT_POOL_BATCH_SEQ_HEADER, strconv.FormatUint(batchSeq, 10))
+	}
+
+	deadline := time.Now().Add(timeout)
+
+	if epPool.sendSem != nil {
+		if !epPool.acquireSendSlot(deadline) {
+			return fmt.Errorf("SendBuffer: %w", ErrHttpEndpointPoolNoSendSlot)
+		}
+		defer epPool.releaseSendSlot()
+	}
 
+	inflightBytes := 0
 	mu.Lock()
 	if epPool.credit != nil {
-		body = NewCreditReader(epPool.credit, 128, b)
-	} else {
-		body = NewBytesReadSeekCloser(b)
+		inflightBytes = len(b)
+		epPool.acquireInflight(inflightBytes)
 	}
 	mu.Unlock()
+	if inflightBytes > 0 {
+		defer epPool.releaseInflight(inflightBytes)
+	}
 
-	if timeout < 0 {
-		timeout = epPool.sendBufferTimeout
+	// Track whether the request used a reused connection, for retry on
+	// connection reset:
+	var (
+		connReused bool
+		trace      *httptrace.ClientTrace
+		retryEp    *HttpEndpoint
+	)
+	if epPool.retryOnConnReset {
+		trace = &httptrace.ClientTrace{
+			GotConn: func(info httptrace.GotConnInfo) { connReused = info.Reused },
+		}
 	}
-	deadline := time.Now().Add(timeout)
+	connResetRetried := false
+	// The number of failed attempts, for the retry backoff:
+	numFailures := 0
+	// The last failure, wrapped in the error returned when the attempts are
+	// exhausted:
+	var lastErr error
+	// Repeated identical failures are logged at most once every
+	// healthCheckErrLogInterval, same as the health check errors. N.B. The
+	// failures are tracked by message, since the retries rotate through the
+	// endpoints:
+	var failureLogStates map[string]*httpEndpointPoolFailureLogState
+
 	for attempt := 1; ; attempt++ {
-		maxWait := time.Until(deadline)
-		if maxWait < 0 {
-			maxWait = 0
+		if lastErr != nil {
+			if epPool.maxSendAttempts > 0 && attempt > epPool.maxSendAttempts {
+				return fmt.Errorf(
+					"SendBuffer attempt# %d: %w: %w", attempt-1, ErrHttpEndpointPoolMaxSendAttempts, lastErr,
+				)
+			}
+			if !time.Now().Before(deadline) {
+				return fmt.Errorf(
+					"SendBuffer attempt# %d: %w: %w", attempt-1, ErrHttpEndpointPoolSendDeadline, lastErr,
+				)
+			}
+		}
+		// Once the shutdown has started, there are no health checks to bring
+		// back the failed endpoints, so do not retry:
+		if attempt > 1 {
+			mu.Lock()
+			shutdown := epPool.shutdown
+			mu.Unlock()
+			if shutdown {
+				return fmt.Errorf(
+					"SendBuffer attempt# %d: pool shutdown: %w", attempt, ErrHttpEndpointPoolNoHealthyEP,
+				)
+			}
+		}
+		var ep *HttpEndpoint
+		if retryEp != nil {
+			ep, retryEp = retryEp, nil
+		} else {
+			maxWait := time.Until(deadline)
+			if maxWait < 0 {
+				maxWait = 0
+			}
+			ep = epPool.GetCurrentHealthy(maxWait)
 		}
-		ep := epPool.GetCurrentHealthy(maxWait)
 		if ep == nil {
 			mu.Lock()
 			stats.PoolStats[HTTP_ENDPOINT_POOL_STATS_NO_HEALTHY_EP_ERROR_COUNT] += 1
@@ -845,60 +2313,234 @@ func (epPool *HttpEndpointPool) SendBuffer(b []byte, timeout time.Duration, gzip
 				"SendBuffer attempt# %d: %w", attempt, ErrHttpEndpointPoolNoHealthyEP,
 			)
 		}
-		if attempt > 1 {
+		contentEncoding := HTTP_CONTENT_ENCODING_SNAPPY
+		if !remoteWrite {
+			contentEncoding = epPool.GetContentEncoding(ep, deadline)
+		}
+		if body == nil || contentEncoding != bodyEncoding {
+			encodedBytes := b
+			if !remoteWrite {
+				var err error
+				encodedBytes, err = epPool.EncodeBuffer(b, bufEncoding, contentEncoding)
+				if err != nil {
+					return fmt.Errorf("SendBuffer attempt# %d: %s: %v", attempt, ep.url, err)
+				}
+			}
+			bodyBytes, bodyEncoding = encodedBytes, contentEncoding
+			mu.Lock()
+			if epPool.credit != nil {
+				body = NewCreditReader(epPool.credit, 128, bodyBytes)
+			} else {
+				body = NewBytesReadSeekCloser(bodyBytes)
+			}
+			mu.Unlock()
+		} else if attempt > 1 {
 			body.Rewind()
 		}
 		req := &http.Request{
-			Method: http.MethodPut,
+			Method: method,
 			Header: header.Clone(),
 			URL:    ep.URL,
 			//ContentLength: int64(len(b)),
 			Body: body,
 		}
+		if bodyEncoding == "" && bufEncoding != "" && bufEncoding != HTTP_CONTENT_ENCODING_IDENTITY {
+			req.Header.Add("Content-Encoding", bufEncoding)
+		} else if bodyEncoding != "" && bodyEncoding != HTTP_CONTENT_ENCODING_IDENTITY {
+			req.Header.Add("Content-Encoding", bodyEncoding)
+		}
+		if trace != nil {
+			connReused = false
+			req = req.WithContext(httptrace.WithClientTrace(context.Background(), trace))
+		}
 		res, err := epPool.client.Do(req)
 		sent := err == nil && res != nil
 		success := sent && HttpEndpointPoolSuccessCodes[res.StatusCode]
-		nonRetryable := sent && !HttpEndpointPoolRetryCodes[res.StatusCode]
+		nonRetryable := sent && !epPool.retryCodes[res.StatusCode]
+		var classifierErr error
+		if sent && epPool.ResponseClassifier != nil {
+			var resBody []byte
+			if res.Body != nil {
+				resBody, _ = io.ReadAll(io.LimitReader(res.Body, HTTP_ENDPOINT_POOL_CLASSIFIER_BODY_MAX_SIZE))
+				res.Body.Close()
+			}
+			var retryable bool
+			success, retryable, classifierErr = epPool.ResponseClassifier(res, resBody)
+			nonRetryable = !success && !retryable
+		}
 
 		url := ep.url
-		epStats := stats.EndpointStats[url]
 		mu.Lock()
+		epStats := stats.EndpointStats[url]
+		if epStats == nil {
+			// The endpoint was removed meanwhile, discard the stats:
+			epStats = make(HttpEndpointStats, HTTP_ENDPOINT_STATS_LEN)
+		}
 		epStats[HTTP_ENDPOINT_STATS_SEND_BUFFER_COUNT] += 1
 		if sent {
-			epStats[HTTP_ENDPOINT_STATS_SEND_BUFFER_BYTE_COUNT] += uint64(len(b))
+			epStats[HTTP_ENDPOINT_STATS_SEND_BUFFER_BYTE_COUNT] += uint64(len(bodyBytes))
 		}
-		if !success {
+		if success {
+			epStats[HTTP_ENDPOINT_STATS_LAST_SUCCESS_TS] = uint64(time.Now().UnixMicro())
+		} else {
 			epStats[HTTP_ENDPOINT_STATS_SEND_BUFFER_ERROR_COUNT] += 1
 		}
+		recycleConn := false
+		if sent && epPool.maxRequestsPerConn > 0 {
+			if ep.numRequests++; ep.numRequests >= epPool.maxRequestsPerConn {
+				ep.numRequests = 0
+				stats.ConnRecycleCount += 1
+				recycleConn = true
+			}
+		}
 		mu.Unlock()
+		if recycleConn {
+			// Release the connection into the idle pool before closing the
+			// latter:
+			if res.Body != nil {
+				io.Copy(io.Discard, res.Body)
+				res.Body.Close()
+			}
+			epPool.client.CloseIdleConnections()
+		}
 
 		if success {
 			return nil
 		}
+		if sent && epPool.honorRetryAfter && HttpEndpointPoolRetryAfterCodes[res.StatusCode] {
+			if pause, ok := ParseRetryAfter(res.Header.Get("Retry-After"), time.Now()); ok {
+				if epPool.retryAfterMax > 0 {
+					pause = min(pause, epPool.retryAfterMax)
+				}
+				epPoolLog.Warnf(
+					"SendBuffer attempt# %d: %s %s: %s, Retry-After: %s",
+					attempt, req.Method, ep.url, res.Status, pause,
+				)
+				lastErr = fmt.Errorf("%s %s: %s, Retry-After: %s", req.Method, ep.url, res.Status, pause)
+				epPool.PauseEndpoint(ep, pause)
+				continue
+			}
+		}
 		if nonRetryable {
+			if classifierErr != nil {
+				return fmt.Errorf(
+					"SendBuffer attempt# %d: %s %s: %s: %v", attempt, req.Method, ep.url, res.Status, classifierErr,
+				)
+			}
 			return fmt.Errorf(
 				"SendBuffer attempt# %d: %s %s: %s", attempt, req.Method, ep.url, res.Status,
 			)
 		}
+		// A stale reused connection is not the endpoint's fault, retry once:
+		if err != nil && connReused && !connResetRetried && IsConnResetError(err) {
+			epPoolLog.Warnf(
+				"SendBuffer attempt# %d: %v on reused connection, close idle connections and retry",
+				attempt, err,
+			)
+			epPool.client.CloseIdleConnections()
+			connResetRetried, retryEp, lastErr = true, ep, err
+			continue
+		}
 		// Report the failure:
 		if err != nil {
-			epPoolLog.Warnf("SendBuffer attempt# %d: %v", attempt, err)
+			lastErr = err
+		} else if classifierErr != nil {
+			lastErr = fmt.Errorf("%s %s: %s: %v", req.Method, ep.url, res.Status, classifierErr)
+		} else if res != nil && res.Header.Get("Retry-After") != "" {
+			// Not honored, but useful for troubleshooting:
+			lastErr = fmt.Errorf(
+				"%s %s: %s, Retry-After: %q", req.Method, ep.url, res.Status, res.Header.Get("Retry-After"),
+			)
 		} else if res != nil {
-			epPoolLog.Warnf("SendBuffer attempt# %d: %s %s: %s", attempt, req.Method, ep.url, res.Status)
+			lastErr = fmt.Errorf("%s %s: %s", req.Method, ep.url, res.Status)
 		} else {
-			epPoolLog.Warnf("SendBuffer attempt# %d: %s %s: no response", attempt, req.Method, ep.url)
+			lastErr = fmt.Errorf("%s %s: no response", req.Method, ep.url)
+		}
+		if failureLogStates == nil {
+			failureLogStates = make(map[string]*httpEndpointPoolFailureLogState)
+		}
+		failure := lastErr.Error()
+		failureLogState := failureLogStates[failure]
+		if failureLogState == nil {
+			failureLogState = &httpEndpointPoolFailureLogState{}
+			failureLogStates[failure] = failureLogState
+		}
+		failureLogState.repeatCount += 1
+		if RootLogger.IsEnabledForDebug || failureLogState.repeatCount == 1 ||
+			time.Since(failureLogState.logTs) >= epPool.healthCheckErrLogInterval {
+			repeatCountMsg := ""
+			if failureLogState.repeatCount > 1 {
+				repeatCountMsg = fmt.Sprintf(" (%d times)", failureLogState.repeatCount)
+			}
+			failureLogState.logTs = time.Now()
+			epPoolLog.Warnf("SendBuffer attempt# %d: %s%s", attempt, failure, repeatCountMsg)
 		}
 		// There is something wrong w/ the endpoint:
 		epPool.ReportError(ep)
+		// Back off before the next attempt, to avoid hammering the endpoints
+		// while they are overloaded:
+		numFailures += 1
+		epPool.retryBackoff(ep, numFailures, deadline)
 	}
 }
 
+// The logging state for a repeated SendBuffer failure:
+type httpEndpointPoolFailureLogState struct {
+	repeatCount int
+	logTs       time.Time
+}
+
+// Wait before retrying after the n-th failure, but not past the deadline. The
+// wait is interrupted by the pool shutdown.
+func (epPool *HttpEndpointPool) retryBackoff(ep *HttpEndpoint, n int, deadline time.Time) {
+	if epPool.retryBackoffBase <= 0 {
+		return
+	}
+	maxWait := time.Until(deadline)
+	if maxWait <= 0 {
+		return
+	}
+	backoffMax := maxWait
+	if epPool.retryBackoffMax > 0 {
+		backoffMax = min(backoffMax, epPool.retryBackoffMax)
+	}
+	backoff := epPool.retryBackoffBase
+	for i := 1; i < n && backoff < backoffMax; i++ {
+		backoff *= 2
+	}
+	backoff = min(backoff, backoffMax)
+	backoff += time.Duration(rand.Float64() * HTTP_ENDPOINT_POOL_RETRY_BACKOFF_JITTER_FACTOR * float64(backoff))
+	backoff = min(backoff, maxWait)
+
+	epPool.mu.Lock()
+	if epStats := epPool.stats.EndpointStats[ep.url]; epStats != nil {
+		epStats[HTTP_ENDPOINT_STATS_RETRY_BACKOFF_COUNT] += 1
+	}
+	epPool.mu.Unlock()
+
+	timer := time.NewTimer(backoff)
+	select {
+	case <-timer.C:
+	case <-epPool.ctx.Done():
+	}
+	timer.Stop()
+}
+
+// Whether the error was caused by the peer closing the connection:
+func IsConnResetError(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
 // Needed for testing or clean exit in general:
 func (epPool *HttpEndpointPool) Shutdown() {
 	epPool.mu.Lock()
 	toShutdown := !epPool.shutdown
 	if toShutdown {
 		epPool.shutdown = true
+		// Release the sends waiting for in flight bytes:
+		epPool.inflightCond.Broadcast()
 	}
 	epPool.mu.Unlock()
 
@@ -910,13 +2552,23 @@ func (epPool *HttpEndpointPool) Shutdown() {
 	epPoolLog.Info("initiate pool shutdown")
 	epPoolLog.Info("stop health check goroutines")
 	epPool.ctxCancelFn()
+	// Release the health checks waiting for credit:
+	if credit, ok := epPool.healthCheckCredit.(*Credit); ok {
+		credit.StopReplenish()
+	}
 	epPool.wg.Wait()
 	epPoolLog.Info("all health check goroutines completed")
+	// Stopping the credit makes it unlimited, therefore the in-flight rate
+	// limited sends will complete w/o further throttling, rather than trickle
+	// until send_buffer_timeout:
 	if credit, ok := epPool.credit.(*Credit); ok {
 		epPool.mu.Lock()
 		credit.StopReplenishWait()
 		epPool.credit = nil
 		epPool.mu.Unlock()
 	}
+	if epPool.zstdEncoder != nil {
+		epPool.zstdEncoder.Close()
+	}
 	epPoolLog.Info("pool shutdown complete")
 }
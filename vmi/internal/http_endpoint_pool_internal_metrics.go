@@ -19,6 +19,7 @@ var httpEndpointStatsDeltaMetricsNameMap = map[int]string{
 var httpEndpointPoolStatsDeltaMetricsNameMap = map[int]string{
 	HTTP_ENDPOINT_POOL_STATS_HEALTHY_ROTATE_COUNT:      HTTP_ENDPOINT_POOL_STATS_HEALTHY_ROTATE_DELTA_METRIC,
 	HTTP_ENDPOINT_POOL_STATS_NO_HEALTHY_EP_ERROR_COUNT: HTTP_ENDPOINT_POOL_STATS_NO_HEALTHY_EP_ERROR_DELTA_METRIC,
+	HTTP_ENDPOINT_POOL_STATS_DNS_REFRESH_COUNT:         HTTP_ENDPOINT_POOL_STATS_DNS_REFRESH_DELTA_METRIC,
 }
 
 type httpEndpointPoolStatsIndexMetricMap map[int][]byte
@@ -34,46 +35,168 @@ type HttpEndpointPoolInternalMetrics struct {
 	// Cache for the endpoint metrics, `name{label="val",...}`, indexed by the
 	// URL and the stats index:
 	endpointDeltaMetricsCache map[string]httpEndpointPoolStatsIndexMetricMap
+	// Cache for the endpoint lifetime metrics, indexed by the URL, published
+	// only for the endpoints which were marked unhealthy at least once:
+	unhealthyTotalMetricsCache, downtimeSecondsMetricsCache map[string][]byte
+	// Cache for the endpoint state metrics, indexed by the URL, published only
+	// if the state was recorded:
+	healthyStateMetricsCache, unhealthyStateMetricsCache map[string][]byte
+	// Cache for the endpoint last success age metrics, indexed by the URL,
+	// published only if the endpoint succeeded at least once:
+	lastSuccessAgeMetricsCache map[string][]byte
+	// Cache for the endpoint retry backoff metrics, indexed by the URL,
+	// published only if the backoff is enabled:
+	retryBackoffMetricsCache map[string][]byte
 	// Cache for the pool metrics, `name{label="val",...}`,  indexed by the
 	// stats index:
 	poolDeltaMetricsCache httpEndpointPoolStatsIndexMetricMap
+	// Cache for the in flight bytes metric, published only if there is a
+	// ceiling:
+	inflightBytesMetric []byte
+	// Cache for the send wait metric, published only if there is a limit for
+	// concurrent sends:
+	sendWaitSecondsMetric []byte
+	// Cache for the connection recycle metric, published only if there is a
+	// limit for requests per connection:
+	connRecycleMetric []byte
+	// Cache for the rate limit metrics, published only if there is a rate
+	// limit:
+	rateLimitCreditCurrentMetric, rateLimitThrottleSecondsMetric []byte
+	// Cache for the topology metrics, published only if the pool has
+	// endpoints:
+	endpointsMetric, healthyEndpointsMetric []byte
+	// Stale endpoint cache eviction:
+	endpointCacheAging *metricsCacheAging
 }
 
 func NewHttpEndpointPoolInternalMetrics(internalMetrics *InternalMetrics) *HttpEndpointPoolInternalMetrics {
 	return &HttpEndpointPoolInternalMetrics{
-		internalMetrics:           internalMetrics,
-		endpointDeltaMetricsCache: make(map[string]httpEndpointPoolStatsIndexMetricMap),
+		internalMetrics:             internalMetrics,
+		endpointDeltaMetricsCache:   make(map[string]httpEndpointPoolStatsIndexMetricMap),
+		unhealthyTotalMetricsCache:  make(map[string][]byte),
+		downtimeSecondsMetricsCache: make(map[string][]byte),
+		retryBackoffMetricsCache:    make(map[string][]byte),
+		healthyStateMetricsCache:    make(map[string][]byte),
+		unhealthyStateMetricsCache:  make(map[string][]byte),
+		lastSuccessAgeMetricsCache:  make(map[string][]byte),
+		endpointCacheAging:          newMetricsCacheAging(internalMetrics.staleCacheEvictIntervals),
 	}
 }
 
 func (eppim *HttpEndpointPoolInternalMetrics) updatePoolMetricsCache() {
 	instance, hostname := eppim.internalMetrics.Instance, eppim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := eppim.internalMetrics.InstanceLabelName, eppim.internalMetrics.HostnameLabelName
 	eppim.poolDeltaMetricsCache = make(httpEndpointPoolStatsIndexMetricMap)
 	for index, name := range httpEndpointPoolStatsDeltaMetricsNameMap {
 		eppim.poolDeltaMetricsCache[index] = []byte(fmt.Sprintf(
 			`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 		))
 	}
+	eppim.inflightBytesMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_POOL_INFLIGHT_BYTES_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	eppim.sendWaitSecondsMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_POOL_SEND_WAIT_SECONDS_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	eppim.connRecycleMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_POOL_CONN_RECYCLE_DELTA_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	eppim.rateLimitCreditCurrentMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(RATE_LIMIT_CREDIT_CURRENT_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	eppim.rateLimitThrottleSecondsMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(RATE_LIMIT_THROTTLE_SECONDS_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	eppim.endpointsMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_POOL_ENDPOINTS_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	eppim.healthyEndpointsMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_POOL_HEALTHY_ENDPOINTS_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
 }
 
 func (eppim *HttpEndpointPoolInternalMetrics) updateEPMetricsCache(url string) {
 	instance, hostname := eppim.internalMetrics.Instance, eppim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := eppim.internalMetrics.InstanceLabelName, eppim.internalMetrics.HostnameLabelName
 
 	indexMetricMap := make(httpEndpointPoolStatsIndexMetricMap)
 	for index, name := range httpEndpointStatsDeltaMetricsNameMap {
 		metric := fmt.Sprintf(
 			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 			HTTP_ENDPOINT_URL_LABEL_NAME, url,
 		)
 		indexMetricMap[index] = []byte(metric)
 	}
 	eppim.endpointDeltaMetricsCache[url] = indexMetricMap
+
+	eppim.unhealthyTotalMetricsCache[url] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_STATS_UNHEALTHY_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		HTTP_ENDPOINT_URL_LABEL_NAME, url,
+	))
+	eppim.downtimeSecondsMetricsCache[url] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_STATS_DOWNTIME_SECONDS_TOTAL_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		HTTP_ENDPOINT_URL_LABEL_NAME, url,
+	))
+	eppim.retryBackoffMetricsCache[url] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_STATS_RETRY_BACKOFF_DELTA_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		HTTP_ENDPOINT_URL_LABEL_NAME, url,
+	))
+	eppim.lastSuccessAgeMetricsCache[url] = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(HTTP_ENDPOINT_STATS_LAST_SUCCESS_AGE_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+		HTTP_ENDPOINT_URL_LABEL_NAME, url,
+	))
+	for state, cache := range map[string]map[string][]byte{
+		HTTP_ENDPOINT_STATE_HEALTHY:   eppim.healthyStateMetricsCache,
+		HTTP_ENDPOINT_STATE_UNHEALTHY: eppim.unhealthyStateMetricsCache,
+	} {
+		cache[url] = []byte(fmt.Sprintf(
+			`%s{%s="%s",%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+			RenameMetric(HTTP_ENDPOINT_STATS_STATE_METRIC),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
+			HTTP_ENDPOINT_URL_LABEL_NAME, url,
+			HTTP_ENDPOINT_STATS_STATE_LABEL, state,
+		))
+	}
 	indexMetricMap = make(httpEndpointPoolStatsIndexMetricMap)
 }
 
@@ -90,6 +213,8 @@ func (eppim *HttpEndpointPoolInternalMetrics) generateMetrics(buf *bytes.Buffer,
 	metricsCount, partialByteCount, bufMaxSize := 0, 0, mq.GetTargetSize()
 
 	currStats, prevStats := eppim.stats[eppim.currIndex], eppim.stats[1-eppim.currIndex]
+	// The internal metrics timestamp, for the age metrics:
+	ts := eppim.internalMetrics.LastTs
 	currPoolStats := currStats.PoolStats
 
 	var prevPoolStats HttpPoolStats
@@ -103,16 +228,66 @@ func (eppim *HttpEndpointPoolInternalMetrics) generateMetrics(buf *bytes.Buffer,
 	for index, metric := range indexMetricMap {
 		val := currPoolStats[index]
 		if prevPoolStats != nil {
-			val -= prevPoolStats[index]
+			val = uint64Delta(val, prevPoolStats[index])
 		}
 		buf.Write(metric)
 		buf.WriteString(strconv.FormatUint(val, 10))
 		buf.Write(tsSuffix)
 		metricsCount++
 	}
+	if currStats.InflightMaxBytes > 0 {
+		buf.Write(eppim.inflightBytesMetric)
+		buf.WriteString(strconv.FormatUint(currStats.InflightBytes, 10))
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+	if currStats.MaxConcurrentSends > 0 {
+		buf.Write(eppim.sendWaitSecondsMetric)
+		WriteFloatValue(
+			buf,
+			// N.B. The wait time is in microseconds:
+			float64(currStats.SendWaitTime)/1_000_000.0,
+			HTTP_ENDPOINT_POOL_SEND_WAIT_SECONDS_METRIC_PRECISION,
+		)
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+	if currStats.MaxRequestsPerConn > 0 {
+		val := currStats.ConnRecycleCount
+		if prevStats != nil {
+			val = uint64Delta(val, prevStats.ConnRecycleCount)
+		}
+		buf.Write(eppim.connRecycleMetric)
+		buf.WriteString(strconv.FormatUint(val, 10))
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+	if currStats.RateLimitReplenishValue > 0 {
+		buf.Write(eppim.rateLimitCreditCurrentMetric)
+		buf.WriteString(strconv.FormatUint(currStats.RateLimitCreditCurrent, 10))
+		buf.Write(tsSuffix)
+		buf.Write(eppim.rateLimitThrottleSecondsMetric)
+		WriteFloatValue(
+			buf,
+			// N.B. The throttle time is in microseconds:
+			float64(currStats.RateLimitThrottleTime)/1_000_000.0,
+			RATE_LIMIT_THROTTLE_SECONDS_TOTAL_METRIC_PRECISION,
+		)
+		buf.Write(tsSuffix)
+		metricsCount += 2
+	}
+	if currStats.NumEndpoints > 0 {
+		buf.Write(eppim.endpointsMetric)
+		buf.WriteString(strconv.FormatUint(currStats.NumEndpoints, 10))
+		buf.Write(tsSuffix)
+		buf.Write(eppim.healthyEndpointsMetric)
+		buf.WriteString(strconv.FormatUint(currStats.NumHealthy, 10))
+		buf.Write(tsSuffix)
+		metricsCount += 2
+	}
 	if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 		partialByteCount += n
-		mq.QueueBuf(buf)
+		QueueBufFor(mq, eppim.internalMetrics.Id, buf)
 		buf = nil
 	}
 
@@ -136,21 +311,84 @@ func (eppim *HttpEndpointPoolInternalMetrics) generateMetrics(buf *bytes.Buffer,
 		for index, metric := range indexMetricMap {
 			val := currEPStats[index]
 			if prevEPStats != nil {
-				val -= prevEPStats[index]
+				val = uint64Delta(val, prevEPStats[index])
 			}
 			buf.Write(metric)
 			buf.WriteString(strconv.FormatUint(val, 10))
 			buf.Write(tsSuffix)
 			metricsCount++
 		}
+		if currStats.RetryBackoffBase > 0 {
+			index := HTTP_ENDPOINT_STATS_RETRY_BACKOFF_COUNT
+			val := currEPStats[index]
+			if prevEPStats != nil {
+				val = uint64Delta(val, prevEPStats[index])
+			}
+			buf.Write(eppim.retryBackoffMetricsCache[url])
+			buf.WriteString(strconv.FormatUint(val, 10))
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+		if healthy, ok := currStats.EndpointHealthy[url]; ok {
+			// N.B. Both states are published, such that a transition produces
+			// a 0 for the previous state:
+			healthyVal, unhealthyVal := "1", "0"
+			if !healthy {
+				healthyVal, unhealthyVal = "0", "1"
+			}
+			buf.Write(eppim.healthyStateMetricsCache[url])
+			buf.WriteString(healthyVal)
+			buf.Write(tsSuffix)
+			buf.Write(eppim.unhealthyStateMetricsCache[url])
+			buf.WriteString(unhealthyVal)
+			buf.Write(tsSuffix)
+			metricsCount += 2
+		}
+		if lastSuccessTs := currEPStats[HTTP_ENDPOINT_STATS_LAST_SUCCESS_TS]; lastSuccessTs > 0 {
+			// N.B. The timestamp is in microseconds and the age is relative to
+			// the internal metrics timestamp, capped at 0 for clock skew:
+			age := max(ts.UnixMicro()-int64(lastSuccessTs), 0)
+			buf.Write(eppim.lastSuccessAgeMetricsCache[url])
+			WriteFloatValue(
+				buf,
+				float64(age)/1_000_000.0,
+				HTTP_ENDPOINT_STATS_LAST_SUCCESS_AGE_METRIC_PRECISION,
+			)
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
+		if epLifetimeStats := currStats.EndpointLifetimeStats[url]; epLifetimeStats != nil && epLifetimeStats.UnhealthyCount > 0 {
+			buf.Write(eppim.unhealthyTotalMetricsCache[url])
+			buf.WriteString(strconv.FormatUint(epLifetimeStats.UnhealthyCount, 10))
+			buf.Write(tsSuffix)
+			buf.Write(eppim.downtimeSecondsMetricsCache[url])
+			WriteFloatValue(
+				buf,
+				// N.B. The downtime is in microseconds:
+				float64(epLifetimeStats.Downtime)/1_000_000.0,
+				HTTP_ENDPOINT_STATS_DOWNTIME_SECONDS_TOTAL_METRIC_PRECISION,
+			)
+			buf.Write(tsSuffix)
+			metricsCount += 2
+		}
 
 		if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 			partialByteCount += n
-			mq.QueueBuf(buf)
+			QueueBufFor(mq, eppim.internalMetrics.Id, buf)
 			buf = nil
 		}
 	}
 
+	// Evict the cache for the endpoints no longer in the pool:
+	for _, url := range evictStaleMetricsCache(eppim.endpointCacheAging, eppim.endpointDeltaMetricsCache, currStats.EndpointStats) {
+		delete(eppim.unhealthyTotalMetricsCache, url)
+		delete(eppim.downtimeSecondsMetricsCache, url)
+		delete(eppim.retryBackoffMetricsCache, url)
+		delete(eppim.healthyStateMetricsCache, url)
+		delete(eppim.unhealthyStateMetricsCache, url)
+		delete(eppim.lastSuccessAgeMetricsCache, url)
+	}
+
 	// Flip the stats storage:
 	eppim.currIndex = 1 - eppim.currIndex
 
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"fmt"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
 )
@@ -102,3 +104,379 @@ func TestHttpEndpointPoolInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestHttpEndpointPoolInternalMetricsCacheEviction(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	internalMetrics, err := newTestInternalMetricsTsInit(&InternalMetricsTestCase{
+		Instance: "vmi_test",
+		Hostname: "vmi-test",
+		PromTs:   1746121347582,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	evictIntervals := internalMetrics.staleCacheEvictIntervals
+	if evictIntervals <= 0 {
+		t.Fatalf("staleCacheEvictIntervals: want > 0, got: %d", evictIntervals)
+	}
+	eppim := NewHttpEndpointPoolInternalMetrics(internalMetrics)
+	internalMetrics.httpEndpointPoolMetrics = eppim
+
+	keepUrl, goneUrl := "http://host1", "http://host2"
+	newStats := func(urls ...string) *HttpEndpointPoolStats {
+		stats := NewHttpEndpointPoolStats()
+		for _, url := range urls {
+			stats.EndpointStats[url] = make(HttpEndpointStats, HTTP_ENDPOINT_STATS_LEN)
+		}
+		return stats
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	generate := func(stats *HttpEndpointPoolStats) {
+		eppim.stats[eppim.currIndex] = stats
+		_, _, buf := eppim.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+		if buf != nil {
+			testMetricsQueue.ReturnBuf(buf)
+		}
+	}
+
+	// Both endpoints present:
+	generate(newStats(keepUrl, goneUrl))
+	for _, url := range []string{keepUrl, goneUrl} {
+		if eppim.endpointDeltaMetricsCache[url] == nil {
+			t.Fatalf("%q: missing cache entry", url)
+		}
+	}
+
+	// One endpoint disappears; its cache entry should be retained for
+	// evictIntervals - 1 intervals and evicted at the evictIntervals-th:
+	for i := 1; i <= evictIntervals; i++ {
+		generate(newStats(keepUrl))
+		_, goneFound := eppim.endpointDeltaMetricsCache[goneUrl]
+		if wantFound := i < evictIntervals; goneFound != wantFound {
+			t.Fatalf("interval# %d: %q: cache entry found: want: %v, got: %v", i, goneUrl, wantFound, goneFound)
+		}
+		if eppim.endpointDeltaMetricsCache[keepUrl] == nil {
+			t.Fatalf("interval# %d: %q: missing cache entry", i, keepUrl)
+		}
+	}
+	if len(eppim.endpointCacheAging.absentCount) != 0 {
+		t.Fatalf("absentCount: want: empty, got: %v", eppim.endpointCacheAging.absentCount)
+	}
+
+	// An endpoint reappearing should have its cache rebuilt:
+	generate(newStats(keepUrl, goneUrl))
+	if eppim.endpointDeltaMetricsCache[goneUrl] == nil {
+		t.Fatalf("%q: missing cache entry after reappearance", goneUrl)
+	}
+}
+
+func TestHttpEndpointPoolInternalMetricsState(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	epPool, err := buildTestHttpEndpointPool(&HttpEndpointPoolTestCase{
+		epCfgs: []*HttpEndpointConfig{
+			{URL: "http://host1"},
+			{URL: "http://host2"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epPool.Shutdown()
+
+	internalMetrics, err := newTestInternalMetricsTsInit(&InternalMetricsTestCase{
+		Instance: "vmi_test",
+		Hostname: "vmi-test",
+		PromTs:   1746121347582,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eppim := NewHttpEndpointPoolInternalMetrics(internalMetrics)
+	internalMetrics.httpEndpointPoolMetrics = eppim
+
+	stateMetric := func(url, state string, val int) string {
+		return fmt.Sprintf(
+			`%s{%s="%s",%s="%s",%s="%s",%s="%s"} %d %d`,
+			HTTP_ENDPOINT_STATS_STATE_METRIC,
+			INSTANCE_LABEL_NAME, internalMetrics.Instance,
+			HOSTNAME_LABEL_NAME, internalMetrics.Hostname,
+			HTTP_ENDPOINT_URL_LABEL_NAME, url,
+			HTTP_ENDPOINT_STATS_STATE_LABEL, state,
+			val, 1746121347582,
+		)
+	}
+
+	for step, tc := range []struct {
+		// Mark unhealthy, w/o triggering the health check, or healthy:
+		markUnhealthy, markHealthy []string
+		wantMetrics                []string
+	}{
+		{
+			wantMetrics: []string{
+				stateMetric("http://host1", HTTP_ENDPOINT_STATE_HEALTHY, 1),
+				stateMetric("http://host1", HTTP_ENDPOINT_STATE_UNHEALTHY, 0),
+				stateMetric("http://host2", HTTP_ENDPOINT_STATE_HEALTHY, 1),
+				stateMetric("http://host2", HTTP_ENDPOINT_STATE_UNHEALTHY, 0),
+			},
+		},
+		{
+			markUnhealthy: []string{"http://host2"},
+			wantMetrics: []string{
+				stateMetric("http://host1", HTTP_ENDPOINT_STATE_HEALTHY, 1),
+				stateMetric("http://host1", HTTP_ENDPOINT_STATE_UNHEALTHY, 0),
+				stateMetric("http://host2", HTTP_ENDPOINT_STATE_HEALTHY, 0),
+				stateMetric("http://host2", HTTP_ENDPOINT_STATE_UNHEALTHY, 1),
+			},
+		},
+		{
+			markHealthy: []string{"http://host2"},
+			wantMetrics: []string{
+				stateMetric("http://host1", HTTP_ENDPOINT_STATE_HEALTHY, 1),
+				stateMetric("http://host1", HTTP_ENDPOINT_STATE_UNHEALTHY, 0),
+				stateMetric("http://host2", HTTP_ENDPOINT_STATE_HEALTHY, 1),
+				stateMetric("http://host2", HTTP_ENDPOINT_STATE_UNHEALTHY, 0),
+			},
+		},
+	} {
+		epPool.mu.Lock()
+		for _, url := range tc.markUnhealthy {
+			ep := epPool.endpoints[url]
+			epPool.healthy.Remove(ep)
+			ep.healthy = false
+		}
+		epPool.mu.Unlock()
+		for _, url := range tc.markHealthy {
+			epPool.MoveToHealthy(epPool.endpoints[url])
+		}
+
+		eppim.stats[eppim.currIndex] = epPool.SnapStats(eppim.stats[eppim.currIndex])
+		// N.B. No batch target size, the metrics are returned in a single
+		// buffer:
+		_, _, buf := eppim.generateMetrics(&bytes.Buffer{}, internalMetrics.TsSuffixBuf.Bytes())
+		gotMetrics := make(map[string]bool)
+		for _, metric := range strings.Split(buf.String(), "\n") {
+			if strings.HasPrefix(metric, HTTP_ENDPOINT_STATS_STATE_METRIC+"{") {
+				gotMetrics[metric] = true
+			}
+		}
+		for _, metric := range tc.wantMetrics {
+			if !gotMetrics[metric] {
+				t.Errorf("step# %d: missing metric: %s", step, metric)
+			}
+		}
+		if len(gotMetrics) != len(tc.wantMetrics) {
+			t.Errorf("step# %d: state metrics count: want: %d, got: %d", step, len(tc.wantMetrics), len(gotMetrics))
+		}
+		if t.Failed() {
+			t.FailNow()
+		}
+	}
+}
+
+func TestHttpEndpointPoolInternalMetricsInflightBytes(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	tc := &HttpEndpointPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+		CurrStats: NewHttpEndpointPoolStats(),
+	}
+	tc.CurrStats.InflightBytes = 1234
+	tc.CurrStats.InflightMaxBytes = 65536
+	internalMetrics, err := newTestHttpEndpointPoolInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.httpEndpointPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} 1234 %d`,
+		HTTP_ENDPOINT_POOL_INFLIGHT_BYTES_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestHttpEndpointPoolInternalMetricsSendWait(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	tc := &HttpEndpointPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+		CurrStats: NewHttpEndpointPoolStats(),
+	}
+	tc.CurrStats.SendWaitTime = 1_234_567
+	tc.CurrStats.MaxConcurrentSends = 2
+	internalMetrics, err := newTestHttpEndpointPoolInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.httpEndpointPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} 1.234567 %d`,
+		HTTP_ENDPOINT_POOL_SEND_WAIT_SECONDS_TOTAL_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestHttpEndpointPoolInternalMetricsTopology(t *testing.T) {
+	for _, tc := range []struct {
+		name                     string
+		numEndpoints, numHealthy uint64
+	}{
+		{"all_healthy", 3, 3},
+		{"partial", 3, 1},
+		{"none_healthy", 3, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+			defer tlc.RestoreLog()
+
+			internalMetrics, err := newTestInternalMetricsTsInit(&InternalMetricsTestCase{
+				Instance: "vmi_test",
+				Hostname: "vmi-test",
+				PromTs:   1746121347582,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			eppim := NewHttpEndpointPoolInternalMetrics(internalMetrics)
+			internalMetrics.httpEndpointPoolMetrics = eppim
+
+			stats := NewHttpEndpointPoolStats()
+			stats.NumEndpoints, stats.NumHealthy = tc.numEndpoints, tc.numHealthy
+			eppim.stats[eppim.currIndex] = stats
+			testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+			_, _, buf := eppim.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+			if buf != nil {
+				testMetricsQueue.QueueBuf(buf)
+			}
+
+			wantMetrics := []string{
+				fmt.Sprintf(
+					`%s{%s="vmi_test",%s="vmi-test"} %d 1746121347582`,
+					HTTP_ENDPOINT_POOL_ENDPOINTS_METRIC,
+					INSTANCE_LABEL_NAME, HOSTNAME_LABEL_NAME,
+					tc.numEndpoints,
+				),
+				fmt.Sprintf(
+					`%s{%s="vmi_test",%s="vmi-test"} %d 1746121347582`,
+					HTTP_ENDPOINT_POOL_HEALTHY_ENDPOINTS_METRIC,
+					INSTANCE_LABEL_NAME, HOSTNAME_LABEL_NAME,
+					tc.numHealthy,
+				),
+			}
+			errBuf := testMetricsQueue.GenerateReport(wantMetrics, false, nil)
+			if errBuf.Len() > 0 {
+				t.Fatal(errBuf)
+			}
+		})
+	}
+}
+
+func TestHttpEndpointPoolInternalMetricsRateLimit(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// Heavy rate limiting: 20 bytes every 20 milliseconds, i.e. 1000 bytes/sec:
+	epPoolCfg := DefaultHttpEndpointPoolConfig()
+	epPoolCfg.Endpoints = []*HttpEndpointConfig{{URL: "http://host1"}}
+	epPoolCfg.RateLimitMbps = "0.008:20ms"
+	epPool, err := NewHttpEndpointPool(epPoolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epPool.Shutdown()
+
+	// Consume credit in chunks larger than the replenish value, such that
+	// each request is throttled:
+	numRequests, requestSize := 3, 100
+	for i := 0; i < numRequests; i++ {
+		epPool.credit.GetCredit(requestSize, requestSize)
+	}
+	stats := epPool.SnapStats(nil)
+	if stats.RateLimitReplenishValue != 20 {
+		t.Fatalf("RateLimitReplenishValue: want: %d, got: %d", 20, stats.RateLimitReplenishValue)
+	}
+	// The 1st request uses the initial credit, the others wait for 5
+	// replenishments each, give or take:
+	wantMinThrottleTime := uint64(time.Duration(numRequests-1) * 4 * 20 * time.Millisecond / time.Microsecond)
+	if stats.RateLimitThrottleTime < wantMinThrottleTime {
+		t.Fatalf("RateLimitThrottleTime: want: >= %d, got: %d", wantMinThrottleTime, stats.RateLimitThrottleTime)
+	}
+
+	tc := &HttpEndpointPoolInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+		CurrStats: stats,
+	}
+	internalMetrics, err := newTestHttpEndpointPoolInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := internalMetrics.httpEndpointPoolMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetrics := []string{
+		fmt.Sprintf(
+			`%s{%s="%s",%s="%s"} %d %d`,
+			RATE_LIMIT_CREDIT_CURRENT_METRIC,
+			INSTANCE_LABEL_NAME, tc.Instance,
+			HOSTNAME_LABEL_NAME, tc.Hostname,
+			stats.RateLimitCreditCurrent,
+			tc.PromTs,
+		),
+		fmt.Sprintf(
+			`%s{%s="%s",%s="%s"} %.6f %d`,
+			RATE_LIMIT_THROTTLE_SECONDS_TOTAL_METRIC,
+			INSTANCE_LABEL_NAME, tc.Instance,
+			HOSTNAME_LABEL_NAME, tc.Hostname,
+			float64(stats.RateLimitThrottleTime)/1_000_000.0,
+			tc.PromTs,
+		),
+	}
+	errBuf := testMetricsQueue.GenerateReport(wantMetrics, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
@@ -0,0 +1,73 @@
+// Background HTTP server, shared by the optional runner endpoints.
+
+package vmi_internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+type BackgroundHttpServer struct {
+	addr     string
+	server   *http.Server
+	listener net.Listener
+	log      *logrus.Entry
+	// Wait for the server goroutine at shutdown:
+	wg *sync.WaitGroup
+}
+
+func NewBackgroundHttpServer(addr string, handler http.Handler, log *logrus.Entry) *BackgroundHttpServer {
+	return &BackgroundHttpServer{
+		addr:   addr,
+		server: &http.Server{Addr: addr, Handler: handler},
+		log:    log,
+		wg:     &sync.WaitGroup{},
+	}
+}
+
+// Bind the listen address and serve in the background. The bind is performed
+// synchronously such that address errors are reported to the caller.
+func (bs *BackgroundHttpServer) Start() error {
+	listener, err := net.Listen("tcp", bs.addr)
+	if err != nil {
+		return fmt.Errorf("BackgroundHttpServer.Start: %v", err)
+	}
+	bs.listener = listener
+	bs.wg.Add(1)
+	go func() {
+		defer bs.wg.Done()
+		bs.log.Infof("listening on %s", listener.Addr())
+		if err := bs.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			bs.log.Error(err)
+		}
+	}()
+	return nil
+}
+
+// The actual listen address, useful when the port was 0:
+func (bs *BackgroundHttpServer) Addr() string {
+	if bs.listener == nil {
+		return bs.addr
+	}
+	return bs.listener.Addr().String()
+}
+
+// Stop accepting new connections and wait for the in-flight requests to
+// complete. The max wait is enforced by the runner's shutdown watchdog.
+func (bs *BackgroundHttpServer) Shutdown() {
+	if bs.listener == nil {
+		return
+	}
+	bs.log.Info("shutdown")
+	if err := bs.server.Shutdown(context.Background()); err != nil {
+		bs.log.Warnf("shutdown: %v", err)
+	}
+	bs.wg.Wait()
+	bs.log.Info("stopped")
+}
@@ -4,15 +4,18 @@ package vmi_internal
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"strconv"
+	"strings"
 	"time"
 )
 
 // Generate internal metrics:
 const (
-	INTERNAL_METRICS_CONFIG_INTERVAL_DEFAULT            = 5 * time.Second
-	INTERNAL_METRICS_CONFIG_FULL_METRICS_FACTOR_DEFAULT = 12
+	INTERNAL_METRICS_CONFIG_INTERVAL_DEFAULT                    = 5 * time.Second
+	INTERNAL_METRICS_CONFIG_FULL_METRICS_FACTOR_DEFAULT         = 12
+	INTERNAL_METRICS_CONFIG_STALE_CACHE_EVICT_INTERVALS_DEFAULT = 12
 
 	// This generator id:
 	INTERNAL_METRICS_ID = "internal_metrics"
@@ -28,6 +31,15 @@ var OSInfoLabelKeys = []string{
 	"machine",
 }
 
+// The following BuildSettings keys will be used as labels in build info
+// metrics:
+var BuildSettingsLabelKeys = []string{
+	"vcs.revision",
+	"vcs.time",
+	"GOOS",
+	"GOARCH",
+}
+
 // The following OSRelease keys will be used as labels in OS info metrics:
 var OSReleaseLabelKeys = []string{
 	"id",
@@ -41,15 +53,69 @@ var OSReleaseLabelKeys = []string{
 type InternalMetricsConfig struct {
 	Interval          time.Duration `yaml:"interval"`
 	FullMetricsFactor int           `yaml:"full_metrics_factor"`
+	// The metrics caches are indexed by keys such as task ID, generator ID,
+	// URL, etc. Entries whose keys are absent from the stats for this many
+	// consecutive intervals are evicted. Use 0 to disable eviction:
+	StaleCacheEvictIntervals int `yaml:"stale_cache_evict_intervals"`
 }
 
 func DefaultInternalMetricsConfig() *InternalMetricsConfig {
 	return &InternalMetricsConfig{
-		Interval:          INTERNAL_METRICS_CONFIG_INTERVAL_DEFAULT,
-		FullMetricsFactor: INTERNAL_METRICS_CONFIG_FULL_METRICS_FACTOR_DEFAULT,
+		Interval:                 INTERNAL_METRICS_CONFIG_INTERVAL_DEFAULT,
+		FullMetricsFactor:        INTERNAL_METRICS_CONFIG_FULL_METRICS_FACTOR_DEFAULT,
+		StaleCacheEvictIntervals: INTERNAL_METRICS_CONFIG_STALE_CACHE_EVICT_INTERVALS_DEFAULT,
+	}
+}
+
+// Track the number of consecutive intervals the metrics cache keys were absent
+// from the stats, for eviction purposes:
+type metricsCacheAging struct {
+	// Evict after this many intervals, 0 to disable:
+	evictIntervals int
+	// The number of consecutive intervals a key was absent:
+	absentCount map[string]int
+}
+
+func newMetricsCacheAging(evictIntervals int) *metricsCacheAging {
+	return &metricsCacheAging{
+		evictIntervals: evictIntervals,
+		absentCount:    make(map[string]int),
 	}
 }
 
+// Evict the cache entries whose keys were absent from the current stats for
+// evictIntervals consecutive invocations. Return the list of evicted keys, such
+// that they can be removed from other caches sharing the same keys.
+func evictStaleMetricsCache[C any, S any](aging *metricsCacheAging, cache map[string]C, currStats map[string]S) []string {
+	if aging == nil || aging.evictIntervals <= 0 {
+		return nil
+	}
+	var evicted []string
+	for key := range cache {
+		if _, ok := currStats[key]; ok {
+			delete(aging.absentCount, key)
+			continue
+		}
+		if aging.absentCount[key]++; aging.absentCount[key] >= aging.evictIntervals {
+			delete(cache, key)
+			delete(aging.absentCount, key)
+			evicted = append(evicted, key)
+		}
+	}
+	return evicted
+}
+
+// Reset-safe delta for counters: if the current value is less than the previous
+// one, then the counter was reset (or the snapshots raced) and the current
+// value is the best approximation for the delta. Otherwise the uint64
+// subtraction would wrap around, causing a bogus spike.
+func uint64Delta(curr, prev uint64) uint64 {
+	if curr < prev {
+		return curr
+	}
+	return curr - prev
+}
+
 type internalMetricsGenFunc func(*bytes.Buffer, []byte) (int, int, *bytes.Buffer)
 
 type InternalMetrics struct {
@@ -73,24 +139,31 @@ type InternalMetrics struct {
 	// Generator specific metrics:
 	generatorMetrics *GeneratorInternalMetrics
 
+	// Stale metrics cache eviction, see InternalMetricsConfig:
+	staleCacheEvictIntervals int
+
 	// A cache for the actual generator function list, based on the above:
 	mGenFuncList []internalMetricsGenFunc
 
 	// Cache for additional metrics:
-	vmiUptimeMetric    []byte
-	vmiBuildinfoMetric []byte
-	osInfoMetric       []byte
-	osReleaseMetric    []byte
-	osUptimeMetric     []byte
+	vmiUptimeMetric         []byte
+	vmiActiveMetric         []byte
+	vmiBuildinfoMetric      []byte
+	vmiConfigWarningsMetric []byte
+	osInfoMetric            []byte
+	osReleaseMetric         []byte
+	osUptimeMetric          []byte
 
 	// The following additional fields are needed for testing only. Left to
 	// their default values, the usual objects will be used.
-	version   string
-	gitInfo   string
-	bootTime  *time.Time
-	startTs   *time.Time
-	osInfo    map[string]string
-	osRelease map[string]string
+	version       string
+	gitInfo       string
+	goVersion     string
+	buildSettings map[string]string
+	bootTime      *time.Time
+	startTs       *time.Time
+	osInfo        map[string]string
+	osRelease     map[string]string
 }
 
 // Reference for importer uptime:
@@ -105,7 +178,9 @@ func NewInternalMetrics(internalMetricsCfg *InternalMetricsConfig) (*InternalMet
 			Id:                INTERNAL_METRICS_ID,
 			Interval:          internalMetricsCfg.Interval,
 			FullMetricsFactor: internalMetricsCfg.FullMetricsFactor,
+			CycleNum:          GetInitialCycleNum(internalMetricsCfg.FullMetricsFactor),
 		},
+		staleCacheEvictIntervals: internalMetricsCfg.StaleCacheEvictIntervals,
 	}
 	internalMetrics.schedulerMetrics = NewSchedulerInternalMetrics(internalMetrics)
 	if compressorPool != nil {
@@ -118,23 +193,38 @@ func NewInternalMetrics(internalMetricsCfg *InternalMetricsConfig) (*InternalMet
 	internalMetrics.processMetrics = NewProcessInternalMetrics(internalMetrics)
 	internalMetrics.generatorMetrics = NewGeneratorInternalMetrics(internalMetrics)
 	internalMetricsLog.Infof(
-		"id=%s, interval=%s, full_metrics_factor=%d",
+		"id=%s, interval=%s, full_metrics_factor=%d, stale_cache_evict_intervals=%d",
 		internalMetrics.Id, internalMetrics.Interval, internalMetrics.FullMetricsFactor,
+		internalMetrics.staleCacheEvictIntervals,
 	)
 	return internalMetrics, nil
 }
 
 func (internalMetrics *InternalMetrics) initialize() {
 	internalMetrics.GenBaseInit()
-	internalMetrics.CycleNum = GetInitialCycleNum(internalMetrics.FullMetricsFactor)
 
 	instance, hostname := internalMetrics.Instance, internalMetrics.Hostname
+	instanceLabel, hostnameLabel := internalMetrics.InstanceLabelName, internalMetrics.HostnameLabelName
 
 	internalMetrics.vmiUptimeMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s"} `, // N.B. whitespace before value!
-		VMI_UPTIME_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+		RenameMetric(VMI_UPTIME_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+
+	internalMetrics.vmiActiveMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. whitespace before value!
+		RenameMetric(VMI_ACTIVE_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+
+	internalMetrics.vmiConfigWarningsMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. whitespace before value!
+		RenameMetric(VMI_CONFIG_WARNINGS_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	))
 
 	version, gitInfo := Version, GitInfo
@@ -144,14 +234,33 @@ func (internalMetrics *InternalMetrics) initialize() {
 	if internalMetrics.gitInfo != "" {
 		gitInfo = internalMetrics.gitInfo
 	}
-	internalMetrics.vmiBuildinfoMetric = []byte(fmt.Sprintf(
-		`%s{%s="%s",%s="%s",%s="%s",%s="%s"} 1`, // value included
-		VMI_BUILD_INFO_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+	goVersion, buildSettings := GoVersion, BuildSettings
+	if internalMetrics.goVersion != "" {
+		goVersion = internalMetrics.goVersion
+	}
+	if internalMetrics.buildSettings != nil {
+		buildSettings = internalMetrics.buildSettings
+	}
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(
+		buf,
+		`%s{%s="%s",%s="%s",%s="%s",%s="%s",%s="%s"`,
+		RenameMetric(VMI_BUILD_INFO_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 		VMI_VERSION_LABEL_NAME, version,
 		VMI_GIT_INFO_LABEL_NAME, gitInfo,
-	))
+		VMI_GO_VERSION_LABEL_NAME, goVersion,
+	)
+	for _, key := range BuildSettingsLabelKeys {
+		fmt.Fprintf(
+			buf, `,%s%s="%s"`,
+			VMI_BUILD_SETTINGS_LABEL_PREFIX, strings.ReplaceAll(strings.ToLower(key), ".", "_"), buildSettings[key],
+		)
+	}
+	fmt.Fprintf(buf, `} 1`) // N.B. value included
+	internalMetrics.vmiBuildinfoMetric = bytes.Clone(buf.Bytes())
 
 	osInfo, osRelease := OsInfo, OsRelease
 	if internalMetrics.osInfo != nil {
@@ -161,13 +270,13 @@ func (internalMetrics *InternalMetrics) initialize() {
 		osRelease = internalMetrics.osRelease
 	}
 
-	buf := &bytes.Buffer{}
+	buf.Reset()
 	fmt.Fprintf(
 		buf,
 		`%s{%s="%s",%s="%s"`,
-		OS_INFO_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+		RenameMetric(OS_INFO_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	)
 	for _, key := range OSInfoLabelKeys {
 		fmt.Fprintf(buf, `,%s%s="%s"`, OS_INFO_LABEL_PREFIX, key, osInfo[key])
@@ -179,9 +288,9 @@ func (internalMetrics *InternalMetrics) initialize() {
 	fmt.Fprintf(
 		buf,
 		`%s{%s="%s",%s="%s"`,
-		OS_RELEASE_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+		RenameMetric(OS_RELEASE_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	)
 	for _, key := range OSReleaseLabelKeys {
 		fmt.Fprintf(buf, `,%s%s="%s"`, OS_RELEASE_LABEL_PREFIX, key, osRelease[key])
@@ -191,9 +300,9 @@ func (internalMetrics *InternalMetrics) initialize() {
 
 	internalMetrics.osUptimeMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s"} `, // N.B. space before value included
-		OS_UPTIME_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+		RenameMetric(OS_UPTIME_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	))
 
 	if internalMetrics.bootTime == nil {
@@ -225,10 +334,15 @@ func (internalMetrics *InternalMetrics) TaskAction() bool {
 		schedulerMetrics.stats[schedulerMetrics.currIndex] = scheduler.SnapStats(
 			schedulerMetrics.stats[schedulerMetrics.currIndex],
 		)
+		schedulerMetrics.workerStats[schedulerMetrics.currIndex] = scheduler.SnapWorkerStats(
+			schedulerMetrics.workerStats[schedulerMetrics.currIndex],
+		)
 		if compressorPoolMetrics != nil {
 			compressorPoolMetrics.stats[compressorPoolMetrics.currIndex] = compressorPool.SnapStats(
 				compressorPoolMetrics.stats[compressorPoolMetrics.currIndex],
 			)
+			compressorPoolMetrics.SnapCompressionLevel()
+			compressorPoolMetrics.SnapActiveCount()
 		}
 		if httpEndpointPoolMetrics != nil {
 			httpEndpointPoolMetrics.stats[httpEndpointPoolMetrics.currIndex] = httpEndpointPool.SnapStats(
@@ -283,15 +397,26 @@ func (internalMetrics *InternalMetrics) TaskAction() bool {
 	}
 
 	buf.Write(internalMetrics.vmiUptimeMetric)
-	buf.WriteString(strconv.FormatFloat(ts.Sub(*internalMetrics.startTs).Seconds(), 'f', UPTIME_METRIC_PRECISION, 64))
+	WriteFloatValue(buf, ts.Sub(*internalMetrics.startTs).Seconds(), UPTIME_METRIC_PRECISION)
 	buf.Write(tsSuffix)
 	metricsCount++
 
 	buf.Write(internalMetrics.osUptimeMetric)
-	buf.WriteString(strconv.FormatFloat(ts.Sub(*internalMetrics.bootTime).Seconds(), 'f', UPTIME_METRIC_PRECISION, 64))
+	WriteFloatValue(buf, ts.Sub(*internalMetrics.bootTime).Seconds(), UPTIME_METRIC_PRECISION)
 	buf.Write(tsSuffix)
 	metricsCount++
 
+	if active, activeSet := getActiveState(); activeSet {
+		buf.Write(internalMetrics.vmiActiveMetric)
+		if active {
+			buf.WriteByte('1')
+		} else {
+			buf.WriteByte('0')
+		}
+		buf.Write(tsSuffix)
+		metricsCount++
+	}
+
 	if firstPass || internalMetrics.CycleNum == 0 {
 		buf.Write(internalMetrics.vmiBuildinfoMetric)
 		buf.Write(tsSuffix)
@@ -304,6 +429,13 @@ func (internalMetrics *InternalMetrics) TaskAction() bool {
 		buf.Write(internalMetrics.osReleaseMetric)
 		buf.Write(tsSuffix)
 		metricsCount++
+
+		if configWarningsCount >= 0 {
+			buf.Write(internalMetrics.vmiConfigWarningsMetric)
+			buf.WriteString(strconv.Itoa(configWarningsCount))
+			buf.Write(tsSuffix)
+			metricsCount++
+		}
 	}
 
 	// Add this generator's metrics by hand since it is the one that generates
@@ -340,7 +472,7 @@ func (internalMetrics *InternalMetrics) TaskAction() bool {
 	buf.WriteString(strconv.FormatInt(int64(byteCount), 10))
 	buf.Write(tsSuffix)
 
-	metricsQueue.QueueBuf(buf)
+	QueueBufFor(metricsQueue, internalMetrics.Id, buf)
 
 	if internalMetrics.CycleNum++; internalMetrics.CycleNum >= internalMetrics.FullMetricsFactor {
 		internalMetrics.CycleNum = 0
@@ -349,7 +481,14 @@ func (internalMetrics *InternalMetrics) TaskAction() bool {
 	return true
 }
 
-// Define and register the task builder:
+// Mockable for testing:
+var newInternalMetricsFn = NewInternalMetrics
+
+// Define and register the task builder. If the interval is <= 0 then the
+// internal metrics are disabled and none of their structures are created, so
+// there is no snapshotting overhead. The stats maintained by the components
+// (scheduler, compressor and HTTP endpoint pools, generators) are still
+// updated, such that they are available to the embedding applications.
 func InternalMetricsTaskBuilder(vmiConfig *VmiConfig) (*Task, error) {
 	if vmiConfig.InternalMetricsConfig.Interval <= 0 {
 		internalMetricsLog.Infof(
@@ -358,9 +497,44 @@ func InternalMetricsTaskBuilder(vmiConfig *VmiConfig) (*Task, error) {
 		return nil, nil
 	}
 
-	internalMetrics, err := NewInternalMetrics(vmiConfig.InternalMetricsConfig)
+	internalMetrics, err := newInternalMetricsFn(vmiConfig.InternalMetricsConfig)
 	if err != nil {
 		return nil, err
 	}
-	return NewTask(internalMetrics.GetId(), internalMetrics.GetInterval(), internalMetrics.TaskAction), nil
+	if selfMetricsServer != nil {
+		metricsQueue := internalMetrics.MetricsQueue
+		if metricsQueue == nil {
+			metricsQueue = MetricsQueue
+		}
+		internalMetrics.MetricsQueue = selfMetricsServer.WrapQueue(metricsQueue)
+	}
+	task := NewTask(internalMetrics.GetId(), internalMetrics.GetInterval(), internalMetrics.TaskAction)
+	task.SetFullMetricsCycle(internalMetrics.FullMetricsFactor, internalMetrics.CycleNum)
+	task.SetForceFullMetrics(internalMetrics.ForceFullMetrics)
+	return task, nil
+}
+
+// Run the internal metrics task once more at shutdown, after the scheduler was
+// stopped and before the pipeline is drained, such that the stats deltas for
+// the last, partial, interval are not lost. The task may be nil, i.e. internal
+// metrics disabled.
+func RunFinalInternalMetrics(task *Task) {
+	if task == nil {
+		return
+	}
+	internalMetricsLog.Info("generate final internal metrics")
+	task.runAction(context.Background())
+}
+
+// Change the internal metrics interval at runtime, e.g. for higher resolution
+// self metrics during an incident. The internal metrics should have been
+// enabled at startup, they cannot be enabled or disabled at runtime.
+func SetInternalMetricsInterval(interval time.Duration) error {
+	if scheduler == nil {
+		return fmt.Errorf("SetInternalMetricsInterval: scheduler not created")
+	}
+	if err := scheduler.SetTaskInterval(INTERNAL_METRICS_ID, interval); err != nil {
+		return fmt.Errorf("SetInternalMetricsInterval: %v", err)
+	}
+	return nil
 }
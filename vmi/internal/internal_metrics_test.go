@@ -7,6 +7,11 @@ import (
 	"fmt"
 	"maps"
 	"path"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -23,6 +28,8 @@ type InternalMetricsTestCase struct {
 	PrevPromTs          *int64
 	Version             string
 	GitInfo             string
+	GoVersion           string
+	BuildSettings       map[string]string
 	BootTimeMsec        int64
 	StartTimeMsec       int64
 	OsInfo              map[string]string
@@ -52,6 +59,8 @@ func newTestInternalMetrics(tc *InternalMetricsTestCase) (*InternalMetrics, erro
 
 	internalMetrics.version = tc.Version
 	internalMetrics.gitInfo = tc.GitInfo
+	internalMetrics.goVersion = tc.GoVersion
+	internalMetrics.buildSettings = maps.Clone(tc.BuildSettings)
 	bootTime := time.UnixMilli(tc.BootTimeMsec)
 	internalMetrics.bootTime = &bootTime
 	startTs := time.UnixMilli(tc.StartTimeMsec)
@@ -132,3 +141,387 @@ func TestInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestInternalMetricsTaskBuilderDisabled(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	newCount := 0
+	savedNewInternalMetricsFn := newInternalMetricsFn
+	newInternalMetricsFn = func(internalMetricsCfg *InternalMetricsConfig) (*InternalMetrics, error) {
+		newCount++
+		return savedNewInternalMetricsFn(internalMetricsCfg)
+	}
+	defer func() { newInternalMetricsFn = savedNewInternalMetricsFn }()
+
+	for _, tc := range []struct {
+		interval  time.Duration
+		wantTask  bool
+		wantCount int
+	}{
+		{0, false, 0},
+		{-time.Second, false, 0},
+		{time.Second, true, 1},
+	} {
+		t.Run(fmt.Sprintf("interval=%s", tc.interval), func(t *testing.T) {
+			newCount = 0
+			vmiConfig := DefaultVmiConfig()
+			vmiConfig.InternalMetricsConfig.Interval = tc.interval
+			task, err := InternalMetricsTaskBuilder(vmiConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotTask := task != nil; gotTask != tc.wantTask {
+				t.Fatalf("task: want: %v, got: %v", tc.wantTask, gotTask)
+			}
+			if newCount != tc.wantCount {
+				t.Fatalf("NewInternalMetrics count: want: %d, got: %d", tc.wantCount, newCount)
+			}
+		})
+	}
+}
+
+func TestUint64Delta(t *testing.T) {
+	for _, tc := range []struct {
+		curr, prev, want uint64
+	}{
+		{10, 3, 7},
+		{10, 10, 0},
+		{3, 10, 3},
+		{0, 1<<64 - 1, 0},
+		{1<<64 - 1, 0, 1<<64 - 1},
+	} {
+		if got := uint64Delta(tc.curr, tc.prev); got != tc.want {
+			t.Errorf("uint64Delta(%d, %d): want: %d, got: %d", tc.curr, tc.prev, tc.want, got)
+		}
+	}
+}
+
+// Verify that counters going backwards (reset or raced snapshots) result in
+// the current value being published as delta, rather than a wrapped value:
+func TestInternalMetricsCounterReset(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	const currVal, prevVal = 7, 1000
+
+	internalMetrics, err := newTestInternalMetricsTsInit(&InternalMetricsTestCase{
+		Instance: "vmi_test",
+		Hostname: "vmi-test",
+		PromTs:   1746121347582,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fillUint64 := func(n int, val uint64) []uint64 {
+		stats := make([]uint64, n)
+		for i := range stats {
+			stats[i] = val
+		}
+		return stats
+	}
+
+	sim := NewSchedulerInternalMetrics(internalMetrics)
+	sim.stats[sim.currIndex] = SchedulerStats{"task": &TaskStats{Uint64Stats: fillUint64(TASK_STATS_UINT64_LEN, currVal)}}
+	sim.stats[1-sim.currIndex] = SchedulerStats{"task": &TaskStats{Uint64Stats: fillUint64(TASK_STATS_UINT64_LEN, prevVal)}}
+
+	cpim := NewCompressorPoolInternalMetrics(internalMetrics)
+	cpim.stats[cpim.currIndex] = CompressorPoolStats{"0": &CompressorStats{
+		Uint64Stats:  fillUint64(COMPRESSOR_STATS_UINT64_LEN, currVal),
+		Float64Stats: make([]float64, COMPRESSOR_STATS_FLOAT64_LEN),
+	}}
+	cpim.stats[1-cpim.currIndex] = CompressorPoolStats{"0": &CompressorStats{
+		Uint64Stats:  fillUint64(COMPRESSOR_STATS_UINT64_LEN, prevVal),
+		Float64Stats: make([]float64, COMPRESSOR_STATS_FLOAT64_LEN),
+	}}
+
+	eppim := NewHttpEndpointPoolInternalMetrics(internalMetrics)
+	eppim.stats[eppim.currIndex] = &HttpEndpointPoolStats{
+		PoolStats:     fillUint64(HTTP_ENDPOINT_POOL_STATS_LEN, currVal),
+		EndpointStats: map[string]HttpEndpointStats{"http://host1": fillUint64(HTTP_ENDPOINT_STATS_LEN, currVal)},
+	}
+	eppim.stats[1-eppim.currIndex] = &HttpEndpointPoolStats{
+		PoolStats:     fillUint64(HTTP_ENDPOINT_POOL_STATS_LEN, prevVal),
+		EndpointStats: map[string]HttpEndpointStats{"http://host1": fillUint64(HTTP_ENDPOINT_STATS_LEN, prevVal)},
+	}
+
+	genim := NewGeneratorInternalMetrics(internalMetrics)
+	genim.generatorStats[genim.currIndex] = MetricsGeneratorStats{"gen": fillUint64(METRICS_GENERATOR_NUM_STATS, currVal)}
+	genim.generatorStats[1-genim.currIndex] = MetricsGeneratorStats{"gen": fillUint64(METRICS_GENERATOR_NUM_STATS, prevVal)}
+
+	goim := NewGoInternalMetrics(internalMetrics)
+	goim.memStats[goim.currIndex].Mallocs = currVal
+	goim.memStats[goim.currIndex].Frees = currVal
+	goim.memStats[goim.currIndex].NumGC = currVal
+	goim.memStats[1-goim.currIndex].Mallocs = prevVal
+	goim.memStats[1-goim.currIndex].Frees = prevVal
+	goim.memStats[1-goim.currIndex].NumGC = prevVal
+
+	for name, mGenFunc := range map[string]internalMetricsGenFunc{
+		"scheduler":          sim.generateMetrics,
+		"compressor_pool":    cpim.generateMetrics,
+		"http_endpoint_pool": eppim.generateMetrics,
+		"generator":          genim.generateMetrics,
+		"go":                 goim.generateMetrics,
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			_, _, buf = mGenFunc(buf, internalMetrics.TsSuffixBuf.Bytes())
+			deltaCount := 0
+			for _, metric := range strings.Split(buf.String(), "\n") {
+				fields := strings.Fields(metric)
+				if len(fields) < 2 || !strings.Contains(fields[0], "_delta{") {
+					continue
+				}
+				deltaCount++
+				if fields[1] != strconv.Itoa(currVal) {
+					t.Errorf("%s: want: %d, got: %s", fields[0], currVal, fields[1])
+				}
+			}
+			if deltaCount == 0 {
+				t.Fatal("no delta metrics generated")
+			}
+		})
+	}
+}
+
+func TestInternalMetricsCustomLabelNames(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	instance, hostname := "vmi_test", "vmi-test"
+	instanceLabel, hostnameLabel := "instance", "host"
+
+	internalMetrics, err := newTestInternalMetrics(&InternalMetricsTestCase{
+		Instance: instance,
+		Hostname: hostname,
+		PromTs:   1746121347582,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	internalMetrics.InstanceLabelName = instanceLabel
+	internalMetrics.HostnameLabelName = hostnameLabel
+
+	// Generate the top level metrics and some of the sub-generators', which
+	// are using the label names from the internal metrics:
+	if !internalMetrics.TaskAction() {
+		t.Fatal("TaskAction() returned false, expected true")
+	}
+	internalMetrics.goMetrics.SnapStats()
+	buf := &bytes.Buffer{}
+	_, _, buf = internalMetrics.goMetrics.generateMetrics(buf, internalMetrics.TsSuffixBuf.Bytes())
+	internalMetrics.processMetrics.SnapStats()
+	_, _, buf = internalMetrics.processMetrics.generateMetrics(buf, internalMetrics.TsSuffixBuf.Bytes())
+	internalMetrics.MetricsQueue.QueueBuf(buf)
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	wantLabels := []string{
+		fmt.Sprintf(`{%s="%s",%s="%s"`, instanceLabel, instance, hostnameLabel, hostname),
+	}
+	unwantedLabels := []string{
+		INSTANCE_LABEL_NAME + "=",
+		HOSTNAME_LABEL_NAME + "=",
+	}
+	metrics := testMetricsQueue.GetMetrics()
+	if len(metrics) == 0 {
+		t.Fatal("no metrics generated")
+	}
+	for _, metric := range metrics {
+		for _, label := range wantLabels {
+			if !strings.Contains(metric, label) {
+				t.Errorf("%s: missing %s", metric, label)
+			}
+		}
+		for _, label := range unwantedLabels {
+			if strings.Contains(metric, label) {
+				t.Errorf("%s: unexpected %s", metric, label)
+			}
+		}
+	}
+}
+
+func TestInternalMetricsBuildInfoGoVersion(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// No GoVersion or BuildSettings overrides, the runtime values should be
+	// used:
+	internalMetrics, err := newTestInternalMetrics(&InternalMetricsTestCase{
+		Instance: "vmi_test",
+		Hostname: "vmi-test",
+		PromTs:   1746121347582,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !internalMetrics.TaskAction() {
+		t.Fatal("TaskAction() returned false, expected true")
+	}
+
+	wantLabels := []string{
+		fmt.Sprintf(`,%s="%s"`, VMI_GO_VERSION_LABEL_NAME, runtime.Version()),
+		fmt.Sprintf(`,%sgoos="%s"`, VMI_BUILD_SETTINGS_LABEL_PREFIX, runtime.GOOS),
+		fmt.Sprintf(`,%sgoarch="%s"`, VMI_BUILD_SETTINGS_LABEL_PREFIX, runtime.GOARCH),
+	}
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	for _, metric := range testMetricsQueue.GetMetrics() {
+		if !strings.HasPrefix(metric, VMI_BUILD_INFO_METRIC+"{") {
+			continue
+		}
+		for _, label := range wantLabels {
+			if !strings.Contains(metric, label) {
+				t.Errorf("%s: missing %s", metric, label)
+			}
+		}
+		return
+	}
+	t.Fatalf("%s: metric not found", VMI_BUILD_INFO_METRIC)
+}
+
+func TestInternalMetricsConfigWarnings(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedConfigWarningsCount := configWarningsCount
+	defer func() { configWarningsCount = savedConfigWarningsCount }()
+
+	// The health check interval is too small, it will be clamped:
+	vmiConfig, err := LoadConfig("", nil, []byte(`
+vmi_config:
+  http_endpoint_pool_config:
+    health_check_interval: 100ms
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	configWarnings := vmiConfig.Validate()
+	if len(configWarnings) != 1 || !strings.Contains(configWarnings[0], "health_check_interval") {
+		t.Fatalf("Validate: want: 1 health_check_interval warning, got: %q", configWarnings)
+	}
+	configWarningsCount = len(configWarnings)
+
+	instance, hostname := "vmi_test", "vmi-test"
+	internalMetrics, err := newTestInternalMetrics(&InternalMetricsTestCase{
+		Instance: instance,
+		Hostname: hostname,
+		PromTs:   1746121347582,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !internalMetrics.TaskAction() {
+		t.Fatal("TaskAction() returned false, expected true")
+	}
+
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} 1 1746121347582`,
+		VMI_CONFIG_WARNINGS_METRIC,
+		INSTANCE_LABEL_NAME, instance,
+		HOSTNAME_LABEL_NAME, hostname,
+	)
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	for _, metric := range testMetricsQueue.GetMetrics() {
+		if metric == wantMetric {
+			return
+		}
+	}
+	t.Fatalf("%s: metric not found", wantMetric)
+}
+
+// A metrics queue recording the queued buffers, safe for concurrent use:
+type bufRecordMetricsQueue struct {
+	*vmi_testutils.TestMetricsQueue
+	bufs []string
+	mu   *sync.Mutex
+}
+
+func (mq *bufRecordMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	mq.mu.Lock()
+	mq.bufs = append(mq.bufs, buf.String())
+	mq.mu.Unlock()
+	mq.TestMetricsQueue.QueueBuf(buf)
+}
+
+func (mq *bufRecordMetricsQueue) getBufs() []string {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return slices.Clone(mq.bufs)
+}
+
+func TestRunFinalInternalMetrics(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	internalMetrics, err := newTestInternalMetrics(&InternalMetricsTestCase{
+		Instance:      "vmi_test",
+		Hostname:      "vmi-test",
+		PromTs:        1746121347582,
+		StartTimeMsec: 1746121340000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mq := &bufRecordMetricsQueue{
+		TestMetricsQueue: vmi_testutils.NewTestMetricsQueue(0),
+		mu:               &sync.Mutex{},
+	}
+	internalMetrics.MetricsQueue = mq
+	// The timestamp is advanced at every invocation, such that the final
+	// metrics are distinguishable:
+	tsMu := &sync.Mutex{}
+	ts := time.UnixMilli(1746121347582)
+	internalMetrics.TimeNowFunc = func() time.Time {
+		tsMu.Lock()
+		defer tsMu.Unlock()
+		ts = ts.Add(time.Second)
+		return ts
+	}
+	// The interval is long enough for the task to run only once, when added:
+	internalMetrics.Interval = time.Hour
+	task := NewTask(internalMetrics.GetId(), internalMetrics.GetInterval(), internalMetrics.TaskAction)
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	scheduler.AddNewTask(task)
+	timeout := 2 * time.Second
+	for deadline := time.Now().Add(timeout); len(mq.getBufs()) == 0; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			scheduler.Shutdown()
+			t.Fatalf("no internal metrics after %s", timeout)
+		}
+	}
+	scheduler.Shutdown()
+
+	numBufs := len(mq.getBufs())
+	RunFinalInternalMetrics(task)
+	bufs := mq.getBufs()
+	if len(bufs) <= numBufs {
+		t.Fatalf("no final internal metrics batch: buffer count: before: %d, after: %d", numBufs, len(bufs))
+	}
+	tsMu.Lock()
+	wantTsSuffix := fmt.Sprintf(" %d\n", ts.UnixMilli())
+	tsMu.Unlock()
+	wantPrefix := fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `,
+		VMI_UPTIME_METRIC, INSTANCE_LABEL_NAME, "vmi_test", HOSTNAME_LABEL_NAME, "vmi-test",
+	)
+	found := false
+	for _, buf := range bufs[numBufs:] {
+		for _, line := range strings.SplitAfter(buf, "\n") {
+			if strings.HasPrefix(line, wantPrefix) && strings.HasSuffix(line, wantTsSuffix) {
+				found = true
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("final internal metrics: missing %s...%q in:\n%s", wantPrefix, wantTsSuffix, strings.Join(bufs[numBufs:], ""))
+	}
+
+	// Disabled internal metrics:
+	RunFinalInternalMetrics(nil)
+}
@@ -0,0 +1,55 @@
+// Shared registry of interned metric prefixes.
+
+package vmi_internal
+
+// The generators cache the metric prefixes, i.e. `name{label="val",...} `, as
+// []byte. When several generators share the same label sets, each would
+// allocate its own copy of the same prefix. The registry below allows them to
+// share a single copy instead: the prefix is built into a scratch buffer and
+// the latter is interned; the lookup of an existing prefix doesn't allocate.
+//
+// The interned prefixes are never removed, so the registry should be used only
+// for prefixes w/ bounded cardinality, e.g. not for label values derived from
+// short lived entities.
+
+import (
+	"sync"
+)
+
+type MetricPrefixRegistry struct {
+	prefixes map[string][]byte
+	mu       *sync.Mutex
+}
+
+func NewMetricPrefixRegistry() *MetricPrefixRegistry {
+	return &MetricPrefixRegistry{
+		prefixes: make(map[string][]byte),
+		mu:       &sync.Mutex{},
+	}
+}
+
+// Return the shared copy of the prefix, creating it as needed. The argument
+// may be reused by the caller afterwards, whereas the returned value must be
+// treated as read-only.
+func (r *MetricPrefixRegistry) Intern(prefix []byte) []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// N.B. The compiler optimizes the map lookup by string(prefix) such that
+	// no allocation takes place:
+	interned, ok := r.prefixes[string(prefix)]
+	if !ok {
+		interned = make([]byte, len(prefix))
+		copy(interned, prefix)
+		r.prefixes[string(interned)] = interned
+	}
+	return interned
+}
+
+func (r *MetricPrefixRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.prefixes)
+}
+
+// The registry shared by all generators:
+var MetricPrefixes = NewMetricPrefixRegistry()
@@ -0,0 +1,92 @@
+// Tests for metric_prefix_registry.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// Build the prefixes for a set of metrics sharing the same label set, as a
+// generator would:
+func buildTestMetricPrefixes(r *MetricPrefixRegistry, scratch *bytes.Buffer, names []string) [][]byte {
+	prefixes := make([][]byte, len(names))
+	for i, name := range names {
+		scratch.Reset()
+		fmt.Fprintf(
+			scratch,
+			`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+			name,
+			INSTANCE_LABEL_NAME, "vmi_test",
+			HOSTNAME_LABEL_NAME, "vmi-test",
+		)
+		if r != nil {
+			prefixes[i] = r.Intern(scratch.Bytes())
+		} else {
+			prefixes[i] = bytes.Clone(scratch.Bytes())
+		}
+	}
+	return prefixes
+}
+
+var testMetricPrefixNames = []string{"vmi_test_metric_a", "vmi_test_metric_b", "vmi_test_metric_c"}
+
+func TestMetricPrefixRegistry(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	r := NewMetricPrefixRegistry()
+	scratch := &bytes.Buffer{}
+
+	// 2 generators sharing the same label set:
+	gen1Prefixes := buildTestMetricPrefixes(r, scratch, testMetricPrefixNames)
+	gen2Prefixes := buildTestMetricPrefixes(r, scratch, testMetricPrefixNames)
+	if got := r.Len(); got != len(testMetricPrefixNames) {
+		t.Fatalf("Len(): want: %d, got: %d", len(testMetricPrefixNames), got)
+	}
+	for i := range testMetricPrefixNames {
+		if !bytes.Equal(gen1Prefixes[i], gen2Prefixes[i]) {
+			t.Fatalf("prefix# %d: %q != %q", i, gen1Prefixes[i], gen2Prefixes[i])
+		}
+		if &gen1Prefixes[i][0] != &gen2Prefixes[i][0] {
+			t.Fatalf("prefix# %d: %q not shared", i, gen1Prefixes[i])
+		}
+	}
+	// The interned prefix should not be affected by the reuse of the scratch
+	// buffer:
+	scratch.Reset()
+	scratch.WriteString("vmi_test_metric_x")
+	if !bytes.HasPrefix(gen1Prefixes[0], []byte(testMetricPrefixNames[0]+"{")) {
+		t.Fatalf("prefix# 0 altered: %q", gen1Prefixes[0])
+	}
+
+	// Interning an existing prefix should not allocate, unlike the private
+	// copy:
+	prefix := bytes.Clone(gen1Prefixes[0])
+	if allocs := testing.AllocsPerRun(100, func() { r.Intern(prefix) }); allocs != 0 {
+		t.Fatalf("Intern() allocs for existing prefix: want: 0, got: %v", allocs)
+	}
+	if allocs := testing.AllocsPerRun(100, func() { _ = bytes.Clone(prefix) }); allocs == 0 {
+		t.Fatalf("bytes.Clone() allocs: want > 0, got: %v", allocs)
+	}
+}
+
+func BenchmarkMetricPrefixRegistryShared(b *testing.B) {
+	r := NewMetricPrefixRegistry()
+	scratch := &bytes.Buffer{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buildTestMetricPrefixes(r, scratch, testMetricPrefixNames)
+	}
+}
+
+func BenchmarkMetricPrefixRegistryPrivate(b *testing.B) {
+	scratch := &bytes.Buffer{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buildTestMetricPrefixes(nil, scratch, testMetricPrefixNames)
+	}
+}
@@ -0,0 +1,42 @@
+// Config driven metric renaming.
+
+package vmi_internal
+
+// For migrations, e.g. to adopt a different naming convention, the emitted
+// metric names may be remapped via vmi_config.metric_renames w/o recompiling.
+// The renaming is applied when the metric prefixes, `name{label="val",...} `,
+// are built into the caches, therefore it has no runtime cost. The label
+// sets and the values are not affected.
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The old -> new name map, set from vmi_config.metric_renames before the
+// caches are built:
+var MetricRenames map[string]string
+
+// Valid metric name, see https://prometheus.io/docs/concepts/data_model/:
+var metricNameRegexp = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+func IsValidMetricName(name string) bool {
+	return metricNameRegexp.MatchString(name)
+}
+
+// Return the name under which the metric should be emitted:
+func RenameMetric(name string) string {
+	if newName, ok := MetricRenames[name]; ok {
+		return newName
+	}
+	return name
+}
+
+func ValidateMetricRenames(renames map[string]string) error {
+	for oldName, newName := range renames {
+		if !IsValidMetricName(newName) {
+			return fmt.Errorf("metric_renames: %q: invalid target name %q", oldName, newName)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Tests for metric_renames.go
+
+package vmi_internal
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestRenameMetric(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedMetricRenames := MetricRenames
+	defer func() { MetricRenames = savedMetricRenames }()
+
+	oldName, newName := GO_NUM_GOROUTINE_METRIC, "myorg_vmi_goroutines"
+	generate := func(renames map[string]string) []string {
+		MetricRenames = renames
+		internalMetrics, err := newTestGoInternalMetrics(&GoInternalMetricsTestCase{
+			GoVersion:    "go1.0",
+			CurrMemStats: &runtime.MemStats{HeapSys: 1000},
+			NumGoRoutine: 13,
+			InternalMetricsTestCase: InternalMetricsTestCase{
+				Instance: "vmi",
+				Hostname: "host",
+				PromTs:   1746121347000,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, buf := internalMetrics.goMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+
+	wantLines := generate(nil)
+	gotLines := generate(map[string]string{oldName: newName})
+	if len(wantLines) != len(gotLines) {
+		t.Fatalf("line count: want: %d, got: %d", len(wantLines), len(gotLines))
+	}
+	renamed := false
+	for i, wantLine := range wantLines {
+		if strings.HasPrefix(wantLine, oldName+"{") {
+			wantLine, renamed = newName+strings.TrimPrefix(wantLine, oldName), true
+		}
+		if gotLines[i] != wantLine {
+			t.Errorf("line# %d:\n\twant: %q\n\t got: %q", i, wantLine, gotLines[i])
+		}
+	}
+	if !renamed {
+		t.Fatalf("%s not found in:\n%s", oldName, strings.Join(wantLines, "\n"))
+	}
+}
+
+func TestValidateMetricRenames(t *testing.T) {
+	for _, tc := range []struct {
+		renames map[string]string
+		wantErr bool
+	}{
+		{nil, false},
+		{map[string]string{"vmi_uptime_sec": "myorg:vmi_uptime_sec"}, false},
+		{map[string]string{"vmi_uptime_sec": ""}, true},
+		{map[string]string{"vmi_uptime_sec": "0vmi_uptime_sec"}, true},
+		{map[string]string{"vmi_uptime_sec": "vmi-uptime-sec"}, true},
+	} {
+		err := ValidateMetricRenames(tc.renames)
+		if gotErr := err != nil; gotErr != tc.wantErr {
+			t.Errorf("%v: error: want: %v, got: %v", tc.renames, tc.wantErr, err)
+		}
+	}
+}
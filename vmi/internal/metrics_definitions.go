@@ -3,7 +3,9 @@
 package vmi_internal
 
 const (
-	// The following labels are common to all metrics:
+	// The following labels are common to all metrics. These are the default
+	// names, they may be overridden via config (see InstanceLabelName and
+	// HostnameLabelName):
 	INSTANCE_LABEL_NAME = "vmi_inst"
 	HOSTNAME_LABEL_NAME = "hostname"
 
@@ -21,8 +23,39 @@ const (
 	COMPRESSOR_STATS_WRITE_ERROR_DELTA_METRIC   = "vmi_compressor_write_error_delta"
 	COMPRESSOR_STATS_COMPRESSION_FACTOR_METRIC  = "vmi_compressor_compression_factor"
 
+	// The average batch size, relative to batch_target_size, for the batches
+	// flushed during the internal metrics interval:
+	COMPRESSOR_STATS_BATCH_FILL_RATIO_METRIC           = "vmi_compressor_batch_fill_ratio"
+	COMPRESSOR_STATS_BATCH_FILL_RATIO_METRIC_PRECISION = 3
+
+	// The uncompressed byte count the compressor reads up to before flushing
+	// the batch, i.e. batch_target_size * compression factor, published only
+	// after the 1st batch was flushed:
+	COMPRESSOR_STATS_READ_BYTE_LIMIT_METRIC = "vmi_compressor_read_byte_limit"
+
+	// The cumulative CPU time, published only where the OS supports per thread
+	// CPU time:
+	COMPRESSOR_STATS_CPU_SECONDS_TOTAL_METRIC           = "vmi_compressor_cpu_seconds_total"
+	COMPRESSOR_STATS_CPU_SECONDS_TOTAL_METRIC_PRECISION = 6
+
+	// The cumulative wall time spent compressing, i.e. writing into and
+	// closing the compressor, published only after the 1st batch was flushed:
+	COMPRESSOR_STATS_COMPRESS_SECONDS_TOTAL_METRIC           = "vmi_compressor_compress_seconds_total"
+	COMPRESSOR_STATS_COMPRESS_SECONDS_TOTAL_METRIC_PRECISION = 6
+
+	// The cumulative number of restarts following unexpected exits, published
+	// only if there were restarts:
+	COMPRESSOR_STATS_RESTART_TOTAL_METRIC = "vmi_compressor_restart_total"
+
 	COMPRESSOR_ID_LABEL_NAME = "compressor"
 
+	// Pool wide, current compression level, published only if adaptive:
+	COMPRESSOR_POOL_COMPRESSION_LEVEL_METRIC = "vmi_compressor_pool_compression_level"
+
+	// Pool wide, the number of compressors currently running; it drops below
+	// the configured number while compressors are waiting to be restarted:
+	COMPRESSOR_POOL_ACTIVE_COUNT_METRIC = "vmi_compressor_active_count"
+
 	//////////////////////////////////////////////////////
 	// Generator Metrics
 	//////////////////////////////////////////////////////
@@ -38,6 +71,20 @@ const (
 	METRICS_GENERATOR_DTIME_METRIC           = "vmi_metrics_gen_dtime_sec"
 	METRICS_GENERATOR_DTIME_METRIC_PRECISION = 6
 
+	// Timestamp regression count, published only if detected:
+	METRICS_GENERATOR_TS_REGRESSION_DELTA_METRIC = "vmi_metrics_ts_regression_delta"
+
+	// Dropped metrics count, published only if there were drops:
+	METRICS_GENERATOR_DROPPED_DELTA_METRIC = "vmi_metrics_dropped_delta"
+
+	// NaN/Inf values count, published only if there were such values:
+	METRICS_GENERATOR_NONFINITE_DELTA_METRIC = "vmi_metrics_nonfinite_delta"
+
+	// Stale metrics count, i.e. dropped because they exceeded max_metric_age
+	// by the time they were picked up by a compressor, published only if
+	// there were drops:
+	METRICS_GENERATOR_STALE_DROPPED_DELTA_METRIC = "vmi_metrics_stale_dropped_delta"
+
 	METRICS_GENERATOR_ID_LABEL_NAME = "gen_id"
 
 	//////////////////////////////////////////////////////
@@ -55,6 +102,11 @@ const (
 	GO_MEM_FREE_DELTA_METRIC    = "vmi_go_mem_free_delta"
 	GO_MEM_NUM_GC_DELTA_METRIC  = "vmi_go_mem_gc_delta"
 
+	// GC stop-the-world pauses, cumulative and the most recent one:
+	GO_GC_PAUSE_SECONDS_TOTAL_METRIC     = "vmi_go_gc_pause_seconds_total"
+	GO_GC_PAUSE_SECONDS_LAST_METRIC      = "vmi_go_gc_pause_seconds_last"
+	GO_GC_PAUSE_SECONDS_METRIC_PRECISION = 6
+
 	//////////////////////////////////////////////////////
 	// HTTP Endpoint Pool Metrics
 	//////////////////////////////////////////////////////
@@ -67,16 +119,52 @@ const (
 	HTTP_ENDPOINT_STATS_SEND_BUFFER_ERROR_DELTA_METRIC  = "vmi_http_ep_send_buffer_error_delta"
 	HTTP_ENDPOINT_STATS_HEALTH_CHECK_DELTA_METRIC       = "vmi_http_ep_healthcheck_delta"
 	HTTP_ENDPOINT_STATS_HEALTH_CHECK_ERROR_DELTA_METRIC = "vmi_http_ep_healthcheck_error_delta"
+	// Published only if the retry backoff is enabled:
+	HTTP_ENDPOINT_STATS_RETRY_BACKOFF_DELTA_METRIC = "vmi_http_ep_send_buffer_retry_backoff_delta"
+
+	// Lifetime, i.e. cumulative across health check cycles, published only for
+	// the endpoints which were marked unhealthy at least once:
+	HTTP_ENDPOINT_STATS_UNHEALTHY_TOTAL_METRIC                  = "vmi_http_ep_unhealthy_total"
+	HTTP_ENDPOINT_STATS_DOWNTIME_SECONDS_TOTAL_METRIC           = "vmi_http_ep_downtime_seconds_total"
+	HTTP_ENDPOINT_STATS_DOWNTIME_SECONDS_TOTAL_METRIC_PRECISION = 3
+
+	// Current state, 1 for the current state and 0 for the other one, such
+	// that a transition clears the previous state:
+	HTTP_ENDPOINT_STATS_STATE_METRIC = "vmi_http_ep_state"
+
+	// The age of the last successful send, relative to the internal metrics
+	// timestamp, published only for the endpoints which succeeded at least
+	// once:
+	HTTP_ENDPOINT_STATS_LAST_SUCCESS_AGE_METRIC           = "vmi_http_ep_last_success_age_sec"
+	HTTP_ENDPOINT_STATS_LAST_SUCCESS_AGE_METRIC_PRECISION = 3
 
 	// Labels:
 	HTTP_ENDPOINT_STATS_STATE_LABEL = "state"
 	HTTP_ENDPOINT_URL_LABEL_NAME    = "url"
 
+	// State label values:
+	HTTP_ENDPOINT_STATE_HEALTHY   = "healthy"
+	HTTP_ENDPOINT_STATE_UNHEALTHY = "unhealthy"
+
 	// Per pool:
 
 	// Deltas since previous internal metrics interval:
 	HTTP_ENDPOINT_POOL_STATS_HEALTHY_ROTATE_DELTA_METRIC      = "vmi_http_ep_pool_healthy_rotate_delta"
 	HTTP_ENDPOINT_POOL_STATS_NO_HEALTHY_EP_ERROR_DELTA_METRIC = "vmi_http_ep_pool_no_healthy_ep_error_delta"
+	HTTP_ENDPOINT_POOL_STATS_DNS_REFRESH_DELTA_METRIC         = "vmi_http_ep_pool_dns_refresh_delta"
+	HTTP_ENDPOINT_POOL_INFLIGHT_BYTES_METRIC                  = "vmi_http_ep_inflight_bytes"
+	HTTP_ENDPOINT_POOL_SEND_WAIT_SECONDS_TOTAL_METRIC         = "vmi_http_ep_pool_send_wait_seconds_total"
+	HTTP_ENDPOINT_POOL_SEND_WAIT_SECONDS_METRIC_PRECISION     = 6
+	HTTP_ENDPOINT_POOL_CONN_RECYCLE_DELTA_METRIC              = "vmi_http_ep_pool_conn_recycle_delta"
+
+	// Rate limit credit, published only if there is a rate limit:
+	RATE_LIMIT_CREDIT_CURRENT_METRIC                   = "vmi_rate_limit_credit_current"
+	RATE_LIMIT_THROTTLE_SECONDS_TOTAL_METRIC           = "vmi_rate_limit_throttle_seconds_total"
+	RATE_LIMIT_THROTTLE_SECONDS_TOTAL_METRIC_PRECISION = 6
+
+	// Topology, current values:
+	HTTP_ENDPOINT_POOL_ENDPOINTS_METRIC         = "vmi_http_ep_pool_endpoints"
+	HTTP_ENDPOINT_POOL_HEALTHY_ENDPOINTS_METRIC = "vmi_http_ep_pool_healthy_endpoints"
 
 	//////////////////////////////////////////////////////
 	// Importer Metrics
@@ -85,9 +173,19 @@ const (
 	// Importer metric:
 	VMI_UPTIME_METRIC = "vmi_uptime_sec" // heartbeat
 
-	VMI_BUILD_INFO_METRIC   = "vmi_build_info"
-	VMI_VERSION_LABEL_NAME  = "vmi_version"
-	VMI_GIT_INFO_LABEL_NAME = "vmi_git_info"
+	// Whether the importer is active (1) or standby (0), published only if the
+	// flag was set via SetActive:
+	VMI_ACTIVE_METRIC = "vmi_active"
+
+	// The number of configuration warnings found at startup, see
+	// VmiConfig.Validate:
+	VMI_CONFIG_WARNINGS_METRIC = "vmi_config_warnings"
+
+	VMI_BUILD_INFO_METRIC           = "vmi_build_info"
+	VMI_VERSION_LABEL_NAME          = "vmi_version"
+	VMI_GIT_INFO_LABEL_NAME         = "vmi_git_info"
+	VMI_GO_VERSION_LABEL_NAME       = "vmi_go_version"
+	VMI_BUILD_SETTINGS_LABEL_PREFIX = "vmi_build_" // prefix + BuildSettingsLabelKeys, lowercased, "." -> "_"
 
 	// OS metrics:
 	OS_INFO_METRIC          = "vmi_os_info"
@@ -117,6 +215,25 @@ const (
 	TASK_STATS_AVG_RUNTIME_METRIC           = "vmi_task_avg_runtime_sec"
 	TASK_STATS_AVG_RUNTIME_METRIC_PRECISION = 6
 
+	// Task action panics, published only if there were panics:
+	TASK_STATS_PANIC_DELTA_METRIC = "vmi_task_panic_delta"
+
+	// Worker utilization over the internal metrics interval, i.e. the fraction
+	// (0..1) of the wall time workers spent executing tasks and the average
+	// number of busy workers:
+	SCHEDULER_WORKER_UTILIZATION_METRIC           = "vmi_scheduler_worker_utilization"
+	SCHEDULER_BUSY_WORKERS_AVG_METRIC             = "vmi_scheduler_busy_workers_avg"
+	SCHEDULER_WORKER_UTILIZATION_METRIC_PRECISION = 3
+
+	// The number of tasks currently registered and how many of them are pending
+	// in the heap, i.e. excluding those in flight:
+	SCHEDULER_TASK_COUNT_METRIC = "vmi_scheduler_task_count"
+	SCHEDULER_HEAP_LEN_METRIC   = "vmi_scheduler_heap_len"
+
+	// The number of workers still alive, it may drop below the configured
+	// number if tasks panic:
+	SCHEDULER_ACTIVE_WORKERS_METRIC = "vmi_scheduler_active_workers"
+
 	// Re-use generator ID label since they have the same value:
 	TASK_STATS_TASK_ID_LABEL_NAME = METRICS_GENERATOR_ID_LABEL_NAME
 )
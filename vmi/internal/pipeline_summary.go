@@ -0,0 +1,140 @@
+// Periodic one-line summary of the pipeline health.
+
+package vmi_internal
+
+// Rather than digging through the internal metrics, the operators may enable
+// a periodic summary logged at info level, e.g.:
+//
+//	12.3 batches/s, 2/3 endpoints healthy, queue 4/64, CF 8.2
+//
+// assembled from the same stats snapshots used for internal metrics. The rate
+// is computed over the summary interval.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var pipelineSummaryLog = NewCompLogger("pipeline")
+
+type PipelineSummary struct {
+	// How often to log the summary:
+	interval time.Duration
+	// The components, either may be nil:
+	compressorPool   *CompressorPool
+	httpEndpointPool *HttpEndpointPool
+	// Dual storage for snapping compressor pool stats, used as current,
+	// previous, toggled after every summary:
+	compressorPoolStats [2]CompressorPoolStats
+	currIndex           int
+	// Storage for HTTP endpoint pool stats, only the current one is needed:
+	httpEndpointPoolStats *HttpEndpointPoolStats
+	// The timestamp of the previous summary, used for rates:
+	lastTs time.Time
+	// Context and wait group for the summary goroutine:
+	ctx         context.Context
+	ctxCancelFn context.CancelFunc
+	wg          *sync.WaitGroup
+}
+
+func NewPipelineSummary(interval time.Duration, compressorPool *CompressorPool, httpEndpointPool *HttpEndpointPool) *PipelineSummary {
+	ctx, ctxCancelFn := context.WithCancel(context.Background())
+	ps := &PipelineSummary{
+		interval:         interval,
+		compressorPool:   compressorPool,
+		httpEndpointPool: httpEndpointPool,
+		lastTs:           time.Now(),
+		ctx:              ctx,
+		ctxCancelFn:      ctxCancelFn,
+		wg:               &sync.WaitGroup{},
+	}
+	pipelineSummaryLog.Infof("interval=%s", ps.interval)
+	return ps
+}
+
+// Snap the stats and build the summary line for the interval ending at ts:
+func (ps *PipelineSummary) Summary(ts time.Time) string {
+	parts := make([]string, 0, 4)
+
+	var crtStats, prevStats CompressorPoolStats
+	if ps.compressorPool != nil {
+		crtStats = ps.compressorPool.SnapStats(ps.compressorPoolStats[ps.currIndex])
+		ps.compressorPoolStats[ps.currIndex] = crtStats
+		prevStats = ps.compressorPoolStats[1-ps.currIndex]
+
+		sendCount := uint64(0)
+		for compressorId, compressorStats := range crtStats {
+			n := compressorStats.Uint64Stats[COMPRESSOR_STATS_SEND_COUNT]
+			if prevCompressorStats := prevStats[compressorId]; prevCompressorStats != nil {
+				n = uint64Delta(n, prevCompressorStats.Uint64Stats[COMPRESSOR_STATS_SEND_COUNT])
+			}
+			sendCount += n
+		}
+		rate := 0.
+		if dt := ts.Sub(ps.lastTs).Seconds(); dt > 0 {
+			rate = float64(sendCount) / dt
+		}
+		parts = append(parts, fmt.Sprintf("%.1f batches/s", rate))
+	}
+
+	if ps.httpEndpointPool != nil {
+		ps.httpEndpointPoolStats = ps.httpEndpointPool.SnapStats(ps.httpEndpointPoolStats)
+		if stats := ps.httpEndpointPoolStats; stats != nil {
+			parts = append(parts, fmt.Sprintf("%d/%d endpoints healthy", stats.NumHealthy, stats.NumEndpoints))
+		}
+	}
+
+	if ps.compressorPool != nil {
+		depth, capacity := ps.compressorPool.GetQueueDepth()
+		parts = append(parts, fmt.Sprintf("queue %d/%d", depth, capacity))
+
+		// The compression factor is averaged across compressors, excluding
+		// the ones which haven't compressed anything yet:
+		cfSum, cfCount := 0., 0
+		for _, compressorStats := range crtStats {
+			if cf := compressorStats.Float64Stats[COMPRESSOR_STATS_COMPRESSION_FACTOR]; cf > 0 {
+				cfSum += cf
+				cfCount++
+			}
+		}
+		if cfCount > 0 {
+			parts = append(parts, fmt.Sprintf("CF %.1f", cfSum/float64(cfCount)))
+		} else {
+			parts = append(parts, "CF n/a")
+		}
+		ps.currIndex = 1 - ps.currIndex
+	}
+
+	ps.lastTs = ts
+	return strings.Join(parts, ", ")
+}
+
+func (ps *PipelineSummary) loop() {
+	defer ps.wg.Done()
+
+	ticker := time.NewTicker(ps.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ps.ctx.Done():
+			return
+		case ts := <-ticker.C:
+			pipelineSummaryLog.Info(ps.Summary(ts))
+		}
+	}
+}
+
+func (ps *PipelineSummary) Start() {
+	ps.lastTs = time.Now()
+	ps.wg.Add(1)
+	go ps.loop()
+}
+
+func (ps *PipelineSummary) Shutdown() {
+	ps.ctxCancelFn()
+	ps.wg.Wait()
+}
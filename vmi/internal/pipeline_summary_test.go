@@ -0,0 +1,114 @@
+// Tests for pipeline_summary.go
+
+package vmi_internal
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// Collect the logged messages:
+type logMessageCollectorHook struct {
+	messages []string
+	mu       *sync.Mutex
+}
+
+func (hook *logMessageCollectorHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (hook *logMessageCollectorHook) Fire(entry *logrus.Entry) error {
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	hook.messages = append(hook.messages, entry.Message)
+	return nil
+}
+
+var pipelineSummaryRegexp = regexp.MustCompile(
+	`^(\d+\.\d) batches/s, (\d+)/(\d+) endpoints healthy, queue (\d+)/(\d+), CF (n/a|\d+\.\d)$`,
+)
+
+func TestPipelineSummary(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, logrus.InfoLevel)
+	defer tlc.RestoreLog()
+
+	hook := &logMessageCollectorHook{mu: &sync.Mutex{}}
+	logger := pipelineSummaryLog.Logger
+	savedHooks := logger.ReplaceHooks(make(logrus.LevelHooks))
+	logger.AddHook(hook)
+	defer logger.ReplaceHooks(savedHooks)
+
+	epPoolCfg := DefaultHttpEndpointPoolConfig()
+	epPoolCfg.Endpoints = []*HttpEndpointConfig{{URL: "http://host1"}, {URL: "http://host2"}}
+	epPool, err := NewHttpEndpointPool(epPoolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epPool.Shutdown()
+
+	poolCfg := DefaultCompressorPoolConfig()
+	poolCfg.NumCompressors = 1
+	poolCfg.BatchTargetSize = "1k"
+	poolCfg.FlushInterval = 50 * time.Millisecond
+	pool, err := NewCompressorPool(poolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Start(NewSenderMock())
+
+	interval, numSummaries := 100*time.Millisecond, 3
+	ps := NewPipelineSummary(interval, pool, epPool)
+	ps.Start()
+	for i := 0; i < numSummaries; i++ {
+		for j := 0; j < 10; j++ {
+			buf := pool.GetBuf()
+			for k := 0; k < 20; k++ {
+				fmt.Fprintf(buf, "vmi_test_metric{i=\"%d\",j=\"%d\",k=\"%d\"} %d 1746121347582\n", i, j, k, k)
+			}
+			pool.QueueBuf(buf)
+		}
+		time.Sleep(interval)
+	}
+	time.Sleep(interval / 2)
+	ps.Shutdown()
+	pool.Shutdown()
+
+	hook.mu.Lock()
+	defer hook.mu.Unlock()
+	summaries := make([][]string, 0)
+	for _, msg := range hook.messages {
+		if m := pipelineSummaryRegexp.FindStringSubmatch(msg); m != nil {
+			summaries = append(summaries, m)
+		}
+	}
+	if len(summaries) < numSummaries-1 {
+		t.Fatalf("summary count: want >= %d, got: %d, messages: %q", numSummaries-1, len(summaries), hook.messages)
+	}
+	maxRate, maxCF := 0., 0.
+	for _, m := range summaries {
+		rate, _ := strconv.ParseFloat(m[1], 64)
+		maxRate = max(maxRate, rate)
+		if m[2] != "2" || m[3] != "2" {
+			t.Errorf("%q: endpoints healthy: want: 2/2", m[0])
+		}
+		if m[5] != strconv.Itoa(poolCfg.MetricsQueueSize) {
+			t.Errorf("%q: queue capacity: want: %d", m[0], poolCfg.MetricsQueueSize)
+		}
+		if m[6] != "n/a" {
+			cf, _ := strconv.ParseFloat(m[6], 64)
+			maxCF = max(maxCF, cf)
+		}
+	}
+	if maxRate <= 0 {
+		t.Errorf("batches/s: want > 0 for at least one summary, got: %q", hook.messages)
+	}
+	if maxCF <= 1 {
+		t.Errorf("CF: want > 1 for at least one summary, got: %q", hook.messages)
+	}
+}
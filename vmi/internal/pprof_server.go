@@ -0,0 +1,39 @@
+// Profiling HTTP endpoint.
+
+package vmi_internal
+
+// Optionally (pprof_addr) the importer may expose the standard net/http/pprof
+// handlers, under /debug/pprof/, for diagnosing CPU hot spots or memory growth
+// w/o rebuilding. The handlers are registered on a dedicated server, rather
+// than on http.DefaultServeMux, such that they are not exposed inadvertently
+// by the other endpoints. N.B. The profiling data may reveal sensitive details
+// about the importer, the address should be restricted accordingly, e.g.
+// "127.0.0.1:6060".
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+const (
+	PPROF_PATH = "/debug/pprof/"
+)
+
+var pprofLog = NewCompLogger("pprof")
+
+type PprofServer struct {
+	*BackgroundHttpServer
+}
+
+func NewPprofServer(addr string) *PprofServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PPROF_PATH, pprof.Index)
+	mux.HandleFunc(PPROF_PATH+"cmdline", pprof.Cmdline)
+	mux.HandleFunc(PPROF_PATH+"profile", pprof.Profile)
+	mux.HandleFunc(PPROF_PATH+"symbol", pprof.Symbol)
+	mux.HandleFunc(PPROF_PATH+"trace", pprof.Trace)
+	pprofLog.Warnf("pprof_addr=%q, path=%q: profiling data exposed", addr, PPROF_PATH)
+	return &PprofServer{
+		BackgroundHttpServer: NewBackgroundHttpServer(addr, mux, pprofLog),
+	}
+}
@@ -0,0 +1,50 @@
+// Tests for pprof_server.go
+
+package vmi_internal
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestPprofServer(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	ps := NewPprofServer("127.0.0.1:0")
+	if err := ps.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer ps.Shutdown()
+
+	for _, tc := range []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{PPROF_PATH, http.StatusOK, "goroutine"},
+		{PPROF_PATH + "cmdline", http.StatusOK, ""},
+		{PPROF_PATH + "heap?debug=1", http.StatusOK, "heap profile"},
+		{"/metrics", http.StatusNotFound, ""},
+	} {
+		resp, err := http.Get("http://" + ps.Addr() + tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tc.wantStatus {
+			t.Fatalf("%s: status: want: %d, got: %d", tc.path, tc.wantStatus, resp.StatusCode)
+		}
+		if !strings.Contains(string(body), tc.wantBody) {
+			t.Fatalf("%s: body: want: %q in %q", tc.path, tc.wantBody, body)
+		}
+	}
+}
@@ -5,7 +5,6 @@ package vmi_internal
 import (
 	"bytes"
 	"fmt"
-	"strconv"
 	"time"
 )
 
@@ -47,11 +46,12 @@ func (pim *ProcessInternalMetrics) SnapStats() {
 
 func (pim *ProcessInternalMetrics) updateMetricsCache() {
 	instance, hostname := pim.internalMetrics.Instance, pim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := pim.internalMetrics.InstanceLabelName, pim.internalMetrics.HostnameLabelName
 	pim.pcpuMetric = []byte(fmt.Sprintf(
 		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-		VMI_PROC_PCPU_METRIC,
-		INSTANCE_LABEL_NAME, instance,
-		HOSTNAME_LABEL_NAME, hostname,
+		RenameMetric(VMI_PROC_PCPU_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
 	))
 
 }
@@ -75,13 +75,13 @@ func (pim *ProcessInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix [
 		dTime := pim.statsTs[pim.currIndex].Sub(pim.statsTs[1-pim.currIndex]).Seconds()
 		dTimeCpu := pim.cpuTime[pim.currIndex] - pim.cpuTime[1-pim.currIndex]
 		buf.Write(pim.pcpuMetric)
-		buf.WriteString(strconv.FormatFloat(dTimeCpu/dTime*100, 'f', 1, 64))
+		WriteFloatValue(buf, dTimeCpu/dTime*100, 1)
 		buf.Write(tsSuffix)
 		metricsCount++
 
 		if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 			partialByteCount += n
-			mq.QueueBuf(buf)
+			QueueBufFor(mq, pim.internalMetrics.Id, buf)
 			buf = nil
 		}
 	}
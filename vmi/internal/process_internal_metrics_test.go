@@ -106,3 +106,47 @@ func TestProcessInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestProcessInternalMetricsFloatFormat(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedFloatFormat := FloatFormat
+	defer func() { FloatFormat = savedFloatFormat }()
+
+	promTs, prevPromTs := int64(1746121347582), int64(1746121344582)
+	for _, tc := range []struct {
+		format  byte
+		wantVal string
+	}{
+		// 0.25 CPU sec over 3 sec:
+		{'f', "8.3"},
+		{'g', "8.333333333333332"},
+	} {
+		t.Run(string(tc.format), func(t *testing.T) {
+			FloatFormat = tc.format
+			internalMetrics, err := newTestProcessInternalMetrics(&ProcessInternalMetricsTestCase{
+				CurrCpuTime: 0.5,
+				PrevCpuTime: 0.25,
+				InternalMetricsTestCase: InternalMetricsTestCase{
+					Instance:   "vmi_test",
+					Hostname:   "vmi-test",
+					PromTs:     promTs,
+					PrevPromTs: &prevPromTs,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			pim := internalMetrics.processMetrics
+			_, _, buf := pim.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+			if buf == nil {
+				t.Fatal("no metrics generated")
+			}
+			want := fmt.Sprintf("%s%s %d\n", pim.pcpuMetric, tc.wantVal, promTs)
+			if got := buf.String(); want != got {
+				t.Fatalf("metric:\nwant: %q\n got: %q", want, got)
+			}
+		})
+	}
+}
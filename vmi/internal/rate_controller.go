@@ -46,6 +46,17 @@ type Credit struct {
 	maxValue       int
 	replenishValue int
 	replenishInt   time.Duration
+	// The cumulative time spent waiting for credit in GetCredit:
+	waitTime time.Duration
+}
+
+// A consistent snapshot of the credit state, e.g. for internal metrics. The
+// current value is CREDIT_UNLIMITED after the replenishment was stopped:
+type CreditSnapshot struct {
+	Current        int
+	ReplenishValue int
+	Max            int
+	WaitTime       time.Duration
 }
 
 // Credit based reader, limiting the rate of data read from a byte buffer and
@@ -162,8 +173,12 @@ func (c *Credit) GetCredit(desired, minAcceptable int) (got int) {
 	c.cond.L.Lock()
 	defer c.cond.L.Unlock()
 
-	for c.current >= 0 && c.current < minAcceptable {
-		c.cond.Wait()
+	if c.current >= 0 && c.current < minAcceptable {
+		waitStart := time.Now()
+		for c.current >= 0 && c.current < minAcceptable {
+			c.cond.Wait()
+		}
+		c.waitTime += time.Since(waitStart)
 	}
 
 	if c.current < 0 {
@@ -175,6 +190,17 @@ func (c *Credit) GetCredit(desired, minAcceptable int) (got int) {
 	return
 }
 
+func (c *Credit) Snapshot() CreditSnapshot {
+	c.cond.L.Lock()
+	defer c.cond.L.Unlock()
+	return CreditSnapshot{
+		Current:        c.current,
+		ReplenishValue: c.replenishValue,
+		Max:            c.maxValue,
+		WaitTime:       c.waitTime,
+	}
+}
+
 func (c *Credit) String() string {
 	if c == nil {
 		return fmt.Sprintf("%v", nil)
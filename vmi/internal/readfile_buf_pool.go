@@ -36,34 +36,61 @@ type ReadFileBufPool struct {
 	// Max read size, if > 0, unlimited otherwise. If the limit is reached then
 	// return ErrReadFileBufPotentialTruncation.
 	maxReadSize int64
+	// Initial capacity for the new buffers, if > 0. Generators emitting
+	// predictably sized output may benefit from pre-sizing, since it avoids the
+	// repeated growth of the buffers while they are being filled.
+	initialCap int
 	// Thread safe mu:
 	mu *sync.Mutex
 }
 
-func NewReadFileBufPool(maxPoolSize int, maxReadSize int64) *ReadFileBufPool {
+func NewReadFileBufPoolWithCap(maxPoolSize int, maxReadSize int64, initialCap int) *ReadFileBufPool {
 	return &ReadFileBufPool{
 		pool:        make([]*bytes.Buffer, 0),
 		maxPoolSize: maxPoolSize,
 		maxReadSize: maxReadSize,
+		initialCap:  initialCap,
 		mu:          &sync.Mutex{},
 	}
 }
 
+func NewReadFileBufPool(maxPoolSize int, maxReadSize int64) *ReadFileBufPool {
+	return NewReadFileBufPoolWithCap(maxPoolSize, maxReadSize, 0)
+}
+
+func NewBufPoolWithCap(maxPoolSize int, initialCap int) *ReadFileBufPool {
+	return NewReadFileBufPoolWithCap(maxPoolSize, 0, initialCap)
+}
+
 func NewBufPool(maxPoolSize int) *ReadFileBufPool {
 	return NewReadFileBufPool(maxPoolSize, 0)
 }
 
 func (p *ReadFileBufPool) GetBuf() *bytes.Buffer {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+	return p.GetBufSized(p.initialCap)
+}
 
+// Retrieve a buffer w/ at least the hinted capacity, if > 0:
+func (p *ReadFileBufPool) GetBufSized(hint int) *bytes.Buffer {
+	p.mu.Lock()
+	var buf *bytes.Buffer
 	if p.poolSize > 0 {
 		p.poolSize--
-		buf := p.pool[p.poolSize]
-		buf.Reset()
-		return buf
+		buf = p.pool[p.poolSize]
+	}
+	p.mu.Unlock()
+
+	if buf == nil {
+		if hint > 0 {
+			return bytes.NewBuffer(make([]byte, 0, hint))
+		}
+		return &bytes.Buffer{}
+	}
+	buf.Reset()
+	if hint > buf.Cap() {
+		buf.Grow(hint)
 	}
-	return &bytes.Buffer{}
+	return buf
 }
 
 func (p *ReadFileBufPool) ReturnBuf(b *bytes.Buffer) {
@@ -121,3 +148,7 @@ func (p *ReadFileBufPool) MaxPoolSize() int {
 func (p *ReadFileBufPool) MaxReadSize() int64 {
 	return p.maxReadSize
 }
+
+func (p *ReadFileBufPool) InitialCap() int {
+	return p.initialCap
+}
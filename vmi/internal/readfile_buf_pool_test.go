@@ -129,3 +129,67 @@ func TestReadFileBufPoolReadFile(t *testing.T) {
 		)
 	}
 }
+
+func TestBufPoolGetBufSized(t *testing.T) {
+	initialCap, hint := 1000, 5000
+	p := NewBufPoolWithCap(0, initialCap)
+
+	// New buffers:
+	if gotCap := p.GetBuf().Cap(); gotCap < initialCap {
+		t.Fatalf("GetBuf(): cap: want >= %d, got: %d", initialCap, gotCap)
+	}
+	if gotCap := p.GetBufSized(hint).Cap(); gotCap < hint {
+		t.Fatalf("GetBufSized(%d): cap: want >= %d, got: %d", hint, hint, gotCap)
+	}
+
+	// Recycled buffers, smaller than the hint:
+	p.ReturnBuf(&bytes.Buffer{})
+	if gotCap := p.GetBuf().Cap(); gotCap < initialCap {
+		t.Fatalf("GetBuf() recycled: cap: want >= %d, got: %d", initialCap, gotCap)
+	}
+	p.ReturnBuf(bytes.NewBufferString("content"))
+	b := p.GetBufSized(hint)
+	if gotCap := b.Cap(); gotCap < hint {
+		t.Fatalf("GetBufSized(%d) recycled: cap: want >= %d, got: %d", hint, hint, gotCap)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("GetBufSized(%d) recycled: buf.Len(): want: 0, got: %d", hint, b.Len())
+	}
+
+	// The compressor pool buffers are pre-sized based on batch_target_size:
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantCap := compressorPoolBufInitialCap(pool.GetTargetSize())
+	if wantCap < pool.GetTargetSize() {
+		t.Fatalf("compressorPoolBufInitialCap(%d): want >= %d, got: %d", pool.GetTargetSize(), pool.GetTargetSize(), wantCap)
+	}
+	if gotCap := pool.GetBuf().Cap(); gotCap < wantCap {
+		t.Fatalf("compressor pool GetBuf(): cap: want >= %d, got: %d", wantCap, gotCap)
+	}
+}
+
+// Fill a buffer w/ metrics lines up to the size of the default batch target,
+// as a generator would; the buffers are not returned to the pool, i.e. every
+// retrieval is a new buffer:
+func benchmarkBufPoolFill(b *testing.B, initialCap int) {
+	p := NewBufPoolWithCap(0, initialCap)
+	line := []byte(`vmi_bench_metric{vmi_inst="vmi",hostname="host",label="value"} 12345 1746121347582` + "\n")
+	size := 64 * 1024
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := p.GetBuf()
+		for buf.Len() < size {
+			buf.Write(line)
+		}
+	}
+}
+
+func BenchmarkBufPoolFillNoCap(b *testing.B) {
+	benchmarkBufPoolFill(b, 0)
+}
+
+func BenchmarkBufPoolFillWithCap(b *testing.B) {
+	benchmarkBufPoolFill(b, compressorPoolBufInitialCap(64*1024))
+}
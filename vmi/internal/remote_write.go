@@ -0,0 +1,440 @@
+// Prometheus remote write output format.
+
+package vmi_internal
+
+// The generators produce metrics in Prometheus exposition text format. When
+// the output format is remote write (see CompressorPoolConfig.OutputFormat),
+// the metrics are converted by RemoteWriteEncoder, registered as the
+// "remote_write" encoding (see sinks.go), into protobuf WriteRequest messages.
+// The latter are concatenated by the compressor into a batch, which is still a
+// valid WriteRequest since all its fields are repeated, and compressed w/
+// snappy block format, as per
+// https://prometheus.io/docs/specs/remote_write_spec/. The messages are simple
+// enough to be encoded directly, w/o pulling in the prompb dependency:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries   { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label        { string name = 1; string value = 2; }
+//	message Sample       { double value = 1; int64 timestamp = 2; }
+//
+// Each line becomes a time series w/ a single sample. Remote write requires a
+// timestamp, so the samples w/o one are assigned the encoding time. The
+// invalid lines are skipped.
+//
+// The metrics queued into a remote write compressor pool must therefore be
+// encoded first; the runner takes care of it for the primary pipeline, the
+// additional sinks and the stdout metrics queue.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+const (
+	METRICS_ENCODING_REMOTE_WRITE = "remote_write"
+
+	REMOTE_WRITE_CONTENT_TYPE   = "application/x-protobuf"
+	REMOTE_WRITE_VERSION_HEADER = "X-Prometheus-Remote-Write-Version"
+	REMOTE_WRITE_VERSION        = "0.1.0"
+
+	REMOTE_WRITE_METRIC_NAME_LABEL = "__name__"
+)
+
+// Protobuf wire types:
+const (
+	protobufWireVarint  = 0
+	protobufWireFixed64 = 1
+	protobufWireBytes   = 2
+)
+
+var remoteWriteMetricNameLabel = []byte(REMOTE_WRITE_METRIC_NAME_LABEL)
+
+// Mockable for testing:
+var remoteWriteTimeNowFn = time.Now
+
+func protobufAppendTag(dst []byte, fieldNum int, wireType int) []byte {
+	return binary.AppendUvarint(dst, uint64(fieldNum<<3|wireType))
+}
+
+func protobufAppendBytes(dst []byte, fieldNum int, b []byte) []byte {
+	dst = protobufAppendTag(dst, fieldNum, protobufWireBytes)
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// The encoded size of a length delimited field, tag included, for fields
+// numbered < 16:
+func protobufBytesFieldSize(n int) int {
+	return 1 + protobufUvarintSize(uint64(n)) + n
+}
+
+func protobufUvarintSize(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// A parsed exposition line:
+type remoteWriteSample struct {
+	// Label name, value pairs, __name__ included, sorted by name:
+	labels [][2][]byte
+	value  float64
+	ts     int64
+}
+
+// Unquote a label value, handling the escapes from the exposition format:
+func remoteWriteUnquote(dst []byte, quoted []byte) []byte {
+	for i := 0; i < len(quoted); i++ {
+		c := quoted[i]
+		if c == '\\' && i+1 < len(quoted) {
+			i++
+			switch quoted[i] {
+			case 'n':
+				c = '\n'
+			default:
+				c = quoted[i]
+			}
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// Parse an exposition line, `name{label="val",...} value [timestamp]`, into
+// sample, reusing the latter's storage. The label values are unquoted into
+// valBuf, which is returned for reuse. Return false if the line is invalid:
+func parseRemoteWriteSample(line []byte, sample *remoteWriteSample, valBuf []byte, defaultTs int64) ([]byte, bool) {
+	sample.labels = sample.labels[:0]
+	i := bytes.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return valBuf, false
+	}
+	sample.labels = append(sample.labels, [2][]byte{remoteWriteMetricNameLabel, line[:i]})
+	n := len(line)
+	if line[i] == '{' {
+		// N.B. The values are appended to valBuf, so they should be sliced
+		// only after it stopped growing:
+		type valSpan struct{ start, end int }
+		spans := make([]valSpan, 0, 8)
+		valBuf = valBuf[:0]
+		i++
+		for {
+			for i < n && (line[i] == ' ' || line[i] == '\t') {
+				i++
+			}
+			if i < n && line[i] == '}' {
+				i++
+				break
+			}
+			start := i
+			for i < n && line[i] != '=' && line[i] != ' ' && line[i] != '\t' {
+				i++
+			}
+			name := line[start:i]
+			for i < n && (line[i] == ' ' || line[i] == '\t') {
+				i++
+			}
+			if len(name) == 0 || i >= n || line[i] != '=' {
+				return valBuf, false
+			}
+			i++
+			for i < n && (line[i] == ' ' || line[i] == '\t') {
+				i++
+			}
+			if i >= n || line[i] != '"' {
+				return valBuf, false
+			}
+			start = i + 1
+			for i++; i < n && line[i] != '"'; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= n {
+				return valBuf, false
+			}
+			spanStart := len(valBuf)
+			valBuf = remoteWriteUnquote(valBuf, line[start:i])
+			spans = append(spans, valSpan{spanStart, len(valBuf)})
+			sample.labels = append(sample.labels, [2][]byte{name, nil})
+			i++
+			for i < n && (line[i] == ' ' || line[i] == '\t') {
+				i++
+			}
+			if i < n && line[i] == ',' {
+				i++
+			} else if i >= n || line[i] != '}' {
+				return valBuf, false
+			}
+		}
+		for k, span := range spans {
+			sample.labels[k+1][1] = valBuf[span.start:span.end]
+		}
+	}
+
+	fields := bytes.Fields(line[i:])
+	if len(fields) < 1 || len(fields) > 2 {
+		return valBuf, false
+	}
+	var err error
+	if sample.value, err = strconv.ParseFloat(string(fields[0]), 64); err != nil {
+		return valBuf, false
+	}
+	sample.ts = defaultTs
+	if len(fields) == 2 {
+		if sample.ts, err = strconv.ParseInt(string(fields[1]), 10, 64); err != nil {
+			return valBuf, false
+		}
+	}
+	slices.SortFunc(sample.labels, func(a, b [2][]byte) int { return bytes.Compare(a[0], b[0]) })
+	return valBuf, true
+}
+
+// Append the TimeSeries message, as a WriteRequest field, for the sample:
+func appendRemoteWriteTimeSeries(dst []byte, sample *remoteWriteSample) []byte {
+	tsSize := 0
+	for _, label := range sample.labels {
+		tsSize += protobufBytesFieldSize(protobufBytesFieldSize(len(label[0])) + protobufBytesFieldSize(len(label[1])))
+	}
+	sampleSize := 1 + 8 // value
+	if sample.ts != 0 {
+		sampleSize += 1 + protobufUvarintSize(uint64(sample.ts))
+	}
+	tsSize += protobufBytesFieldSize(sampleSize)
+
+	dst = protobufAppendTag(dst, 1, protobufWireBytes)
+	dst = binary.AppendUvarint(dst, uint64(tsSize))
+	for _, label := range sample.labels {
+		dst = protobufAppendTag(dst, 1, protobufWireBytes)
+		dst = binary.AppendUvarint(dst, uint64(protobufBytesFieldSize(len(label[0]))+protobufBytesFieldSize(len(label[1]))))
+		dst = protobufAppendBytes(dst, 1, label[0])
+		dst = protobufAppendBytes(dst, 2, label[1])
+	}
+	dst = protobufAppendTag(dst, 2, protobufWireBytes)
+	dst = binary.AppendUvarint(dst, uint64(sampleSize))
+	dst = protobufAppendTag(dst, 1, protobufWireFixed64)
+	dst = binary.LittleEndian.AppendUint64(dst, math.Float64bits(sample.value))
+	if sample.ts != 0 {
+		dst = protobufAppendTag(dst, 2, protobufWireVarint)
+		dst = binary.AppendUvarint(dst, uint64(sample.ts))
+	}
+	return dst
+}
+
+// Convert the metrics in exposition text format into a WriteRequest, appended
+// to dst, w/ defaultTs, in milliseconds, for the samples w/o timestamp. Return
+// the result and the number of invalid lines:
+func AppendRemoteWriteRequest(dst []byte, text []byte, defaultTs int64) ([]byte, int) {
+	sample, invalidCount := &remoteWriteSample{}, 0
+	var valBuf []byte
+	for len(text) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(text, '\n'); i >= 0 {
+			line, text = text[:i], text[i+1:]
+		} else {
+			line, text = text, nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		var ok bool
+		if valBuf, ok = parseRemoteWriteSample(line, sample, valBuf, defaultTs); !ok {
+			invalidCount++
+			continue
+		}
+		dst = appendRemoteWriteTimeSeries(dst, sample)
+	}
+	return dst, invalidCount
+}
+
+// The encoder, see sinks.go:
+type RemoteWriteEncoder struct{}
+
+func (enc *RemoteWriteEncoder) Encode(dst *bytes.Buffer, src []byte) error {
+	b, invalidCount := AppendRemoteWriteRequest(dst.AvailableBuffer(), src, remoteWriteTimeNowFn().UnixMilli())
+	dst.Write(b)
+	if invalidCount > 0 {
+		sinksLog.Warnf("remote write: %d invalid line(s) skipped", invalidCount)
+	}
+	return nil
+}
+
+// Decode the WriteRequest back into exposition text format, 1 line per sample,
+// for display, see StdoutMetricsQueue:
+func (enc *RemoteWriteEncoder) Decode(dst *bytes.Buffer, src []byte) error {
+	for len(src) > 0 {
+		fieldNum, tsBytes, rest, err := protobufNextBytesField(src)
+		if err != nil {
+			return fmt.Errorf("WriteRequest: %v", err)
+		}
+		src = rest
+		if fieldNum != 1 {
+			continue
+		}
+		if err = decodeRemoteWriteTimeSeries(dst, tsBytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Return the next field, which should be length delimited, and the remainder:
+func protobufNextBytesField(b []byte) (int, []byte, []byte, error) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, nil, fmt.Errorf("invalid tag")
+	}
+	fieldNum, wireType := int(tag>>3), int(tag&7)
+	if wireType != protobufWireBytes {
+		return 0, nil, nil, fmt.Errorf("field# %d: wire type: want: %d, got: %d", fieldNum, protobufWireBytes, wireType)
+	}
+	b = b[n:]
+	size, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < size {
+		return 0, nil, nil, fmt.Errorf("field# %d: invalid length", fieldNum)
+	}
+	return fieldNum, b[n : n+int(size)], b[n+int(size):], nil
+}
+
+// Parse a Sample message:
+func decodeRemoteWriteSample(b []byte) (float64, int64, error) {
+	value, ts := 0., int64(0)
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, 0, fmt.Errorf("Sample: invalid tag")
+		}
+		b = b[n:]
+		switch fieldNum, wireType := int(tag>>3), int(tag&7); {
+		case fieldNum == 1 && wireType == protobufWireFixed64:
+			if len(b) < 8 {
+				return 0, 0, fmt.Errorf("Sample: value: short fixed64")
+			}
+			value, b = math.Float64frombits(binary.LittleEndian.Uint64(b)), b[8:]
+		case fieldNum == 2 && wireType == protobufWireVarint:
+			v, n := binary.Uvarint(b)
+			if n <= 0 {
+				return 0, 0, fmt.Errorf("Sample: timestamp: invalid varint")
+			}
+			ts, b = int64(v), b[n:]
+		default:
+			return 0, 0, fmt.Errorf("Sample: unexpected field# %d, wire type %d", fieldNum, wireType)
+		}
+	}
+	return value, ts, nil
+}
+
+// Append the exposition format line(s) for a TimeSeries message:
+func decodeRemoteWriteTimeSeries(dst *bytes.Buffer, b []byte) error {
+	var name []byte
+	labels := make([][2][]byte, 0, 8)
+	samples := make([][]byte, 0, 1)
+	for len(b) > 0 {
+		fieldNum, val, rest, err := protobufNextBytesField(b)
+		if err != nil {
+			return fmt.Errorf("TimeSeries: %v", err)
+		}
+		b = rest
+		switch fieldNum {
+		case 1:
+			var label [2][]byte
+			for len(val) > 0 {
+				fieldNum, s, rest, err := protobufNextBytesField(val)
+				if err != nil {
+					return fmt.Errorf("Label: %v", err)
+				}
+				val = rest
+				if fieldNum == 1 || fieldNum == 2 {
+					label[fieldNum-1] = s
+				}
+			}
+			if bytes.Equal(label[0], remoteWriteMetricNameLabel) {
+				name = label[1]
+			} else {
+				labels = append(labels, label)
+			}
+		case 2:
+			samples = append(samples, val)
+		}
+	}
+	for _, sample := range samples {
+		value, ts, err := decodeRemoteWriteSample(sample)
+		if err != nil {
+			return err
+		}
+		dst.Write(name)
+		if len(labels) > 0 {
+			dst.WriteByte('{')
+			for k, label := range labels {
+				if k > 0 {
+					dst.WriteByte(',')
+				}
+				dst.Write(label[0])
+				dst.WriteString(`="`)
+				remoteWriteEscapeLabelValue(dst, label[1])
+				dst.WriteByte('"')
+			}
+			dst.WriteByte('}')
+		}
+		dst.WriteByte(' ')
+		dst.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+		dst.WriteByte(' ')
+		dst.WriteString(strconv.FormatInt(ts, 10))
+		dst.WriteByte('\n')
+	}
+	return nil
+}
+
+// The reverse of remoteWriteUnquote:
+func remoteWriteEscapeLabelValue(dst *bytes.Buffer, val []byte) {
+	for _, c := range val {
+		switch c {
+		case '\\', '"':
+			dst.WriteByte('\\')
+		case '\n':
+			dst.WriteString(`\n`)
+			continue
+		}
+		dst.WriteByte(c)
+	}
+}
+
+// The remote write batch writer, used by the compressor in lieu of the codec
+// writer. The WriteRequest messages, see RemoteWriteEncoder, are accumulated
+// until Close, when the batch is snappy compressed into the underlying writer:
+type remoteWriteWriter struct {
+	w     io.Writer
+	proto *bytes.Buffer
+	enc   []byte
+}
+
+func newRemoteWriteWriter(w io.Writer) *remoteWriteWriter {
+	return &remoteWriteWriter{w: w, proto: &bytes.Buffer{}}
+}
+
+func (rww *remoteWriteWriter) Write(p []byte) (int, error) {
+	return rww.proto.Write(p)
+}
+
+func (rww *remoteWriteWriter) Close() error {
+	rww.enc = snappy.Encode(rww.enc[:cap(rww.enc)], rww.proto.Bytes())
+	rww.proto.Reset()
+	_, err := rww.w.Write(rww.enc)
+	return err
+}
+
+func (rww *remoteWriteWriter) Reset(w io.Writer) {
+	rww.w = w
+	rww.proto.Reset()
+}
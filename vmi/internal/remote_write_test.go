@@ -0,0 +1,337 @@
+// Unit tests for remote_write.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/snappy"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// Decode a WriteRequest into exposition format lines, for ease of comparison:
+func decodeTestRemoteWriteRequest(b []byte) ([]string, error) {
+	buf := &bytes.Buffer{}
+	if err := (&RemoteWriteEncoder{}).Decode(buf, b); err != nil {
+		return nil, err
+	}
+	series := strings.Split(buf.String(), "\n")
+	return series[:len(series)-1], nil
+}
+
+func TestAppendRemoteWriteRequest(t *testing.T) {
+	defaultTs := int64(1746121347000)
+	for _, tc := range []struct {
+		name             string
+		text             string
+		wantSeries       []string
+		wantInvalidCount int
+	}{
+		{
+			name: "no_labels",
+			text: "metric 42 1746121347582\n",
+			wantSeries: []string{
+				`metric 42 1746121347582`,
+			},
+		},
+		{
+			name: "default_ts",
+			text: "metric 0.5",
+			wantSeries: []string{
+				`metric 0.5 1746121347000`,
+			},
+		},
+		{
+			name: "labels_sorted",
+			text: `metric{z="1",a="2"} 1 1` + "\n",
+			wantSeries: []string{
+				`metric{a="2",z="1"} 1 1`,
+			},
+		},
+		{
+			name: "escapes",
+			text: `metric{path="C:\\dir",q="say \"hi\"",nl="a\nb"} 1 1` + "\n",
+			wantSeries: []string{
+				`metric{nl="a\nb",path="C:\\dir",q="say \"hi\""} 1 1`,
+			},
+		},
+		{
+			name: "comments_and_blank_lines",
+			text: "# HELP metric\n\nmetric{a=\"1\"} 1 1\n\nmetric{a=\"2\"} 2 2\n",
+			wantSeries: []string{
+				`metric{a="1"} 1 1`,
+				`metric{a="2"} 2 2`,
+			},
+		},
+		{
+			name: "special_values",
+			text: "metric{v=\"nan\"} NaN 1\nmetric{v=\"inf\"} +Inf 1\n",
+			wantSeries: []string{
+				`metric{v="nan"} NaN 1`,
+				`metric{v="inf"} +Inf 1`,
+			},
+		},
+		{
+			name: "invalid",
+			text: strings.Join([]string{
+				`metric{a="1"} 1 1`,
+				`metric{a="1" 1 1`,
+				`metric{a=1} 1 1`,
+				`metric not_a_number 1`,
+				`metric 1 not_a_ts`,
+				`metric 1 1 1`,
+				`{a="1"} 1 1`,
+				`metric`,
+			}, "\n"),
+			wantSeries: []string{
+				`metric{a="1"} 1 1`,
+			},
+			wantInvalidCount: 7,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, invalidCount := AppendRemoteWriteRequest(nil, []byte(tc.text), defaultTs)
+			if tc.wantInvalidCount != invalidCount {
+				t.Errorf("invalid count: want: %d, got: %d", tc.wantInvalidCount, invalidCount)
+			}
+			gotSeries, err := decodeTestRemoteWriteRequest(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tc.wantSeries) != len(gotSeries) {
+				t.Fatalf("len(series): want: %d, got: %d: %q", len(tc.wantSeries), len(gotSeries), gotSeries)
+			}
+			for i, want := range tc.wantSeries {
+				if want != gotSeries[i] {
+					t.Errorf("series# %d:\n\twant: %s\n\t got: %s", i, want, gotSeries[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCompressorPoolRemoteWrite(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedRemoteWriteTimeNowFn := remoteWriteTimeNowFn
+	defer func() { remoteWriteTimeNowFn = savedRemoteWriteTimeNowFn }()
+	remoteWriteTimeNowFn = func() time.Time { return time.UnixMilli(1746121347000) }
+
+	pool, err := makeTestCompressorPool(&CompressorPoolTestCase{
+		NumCompressors: 1,
+		FlushInterval:  time.Duration(0),
+		OutputFormat:   COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSenderMock()
+	pool.Start(sender)
+
+	// The buffers are encoded before being queued, the compressor should
+	// concatenate them into valid WriteRequest batches:
+	encoder, err := NewMetricsEncoder(METRICS_ENCODING_REMOTE_WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSeries := make(map[string]bool)
+	text := &bytes.Buffer{}
+	for i := 0; i < 3; i++ {
+		text.Reset()
+		for j := 0; j < 10; j++ {
+			fmt.Fprintf(text, "vmi_test_metric{buf=\"%d\",line=\"%d\"} %d\n", i, j, j)
+			wantSeries[fmt.Sprintf(`vmi_test_metric{buf="%d",line="%d"} %d 1746121347000`, i, j, j)] = true
+		}
+		buf := pool.GetBuf()
+		if err := encoder.Encode(buf, text.Bytes()); err != nil {
+			t.Fatal(err)
+		}
+		pool.QueueBuf(buf)
+	}
+	pool.Shutdown()
+
+	sender.mu.Lock()
+	defer sender.mu.Unlock()
+	for i, b := range sender.bufs {
+		proto, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Fatalf("buf# %d: snappy.Decode: %v", i, err)
+		}
+		gotSeries, err := decodeTestRemoteWriteRequest(proto)
+		if err != nil {
+			t.Fatalf("buf# %d: %v", i, err)
+		}
+		for _, series := range gotSeries {
+			if !wantSeries[series] {
+				t.Errorf("unexpected series: %s", series)
+			}
+			delete(wantSeries, series)
+		}
+	}
+	for series := range wantSeries {
+		t.Errorf("missing series: %s", series)
+	}
+}
+
+type HttpClientDoerRemoteWriteMock struct {
+	methods []string
+	headers []http.Header
+	bodies  [][]byte
+	mu      *sync.Mutex
+}
+
+func (mock *HttpClientDoerRemoteWriteMock) Do(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+	}
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	mock.methods = append(mock.methods, req.Method)
+	mock.headers = append(mock.headers, req.Header.Clone())
+	mock.bodies = append(mock.bodies, body)
+	return &http.Response{
+		StatusCode: http.StatusNoContent,
+		Status:     "204 No Content",
+		Body:       io.NopCloser(strings.NewReader("")),
+	}, nil
+}
+
+func (mock *HttpClientDoerRemoteWriteMock) CloseIdleConnections() {}
+
+func TestHttpEndpointPoolRemoteWrite(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	epPoolCfg := DefaultHttpEndpointPoolConfig()
+	epPoolCfg.Endpoints = []*HttpEndpointConfig{{URL: "http://host1/api/v1/write"}}
+	// The protocol headers should take precedence over the custom ones:
+	epPoolCfg.Headers = map[string]string{
+		"Content-Type":              "text/plain",
+		REMOTE_WRITE_VERSION_HEADER: "2.0.0",
+		"X-Scope-OrgID":             "org1",
+	}
+	epPool, err := NewHttpEndpointPool(epPoolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer epPool.Shutdown()
+	mock := &HttpClientDoerRemoteWriteMock{mu: &sync.Mutex{}}
+	epPool.client = mock
+
+	proto, _ := AppendRemoteWriteRequest(nil, []byte("metric 1 1\n"), 0)
+	b := snappy.Encode(nil, proto)
+	if err = epPool.SendBuffer(b, time.Second, HTTP_CONTENT_ENCODING_REMOTE_WRITE); err != nil {
+		t.Fatal(err)
+	}
+
+	mock.mu.Lock()
+	defer mock.mu.Unlock()
+	if len(mock.methods) != 1 {
+		t.Fatalf("request count: want: 1, got: %d", len(mock.methods))
+	}
+	if mock.methods[0] != http.MethodPost {
+		t.Errorf("method: want: %q, got: %q", http.MethodPost, mock.methods[0])
+	}
+	for name, wantValue := range map[string]string{
+		"Content-Type":              REMOTE_WRITE_CONTENT_TYPE,
+		"Content-Encoding":          HTTP_CONTENT_ENCODING_SNAPPY,
+		REMOTE_WRITE_VERSION_HEADER: REMOTE_WRITE_VERSION,
+		"X-Scope-OrgID":             "org1",
+	} {
+		if gotValues := mock.headers[0].Values(name); len(gotValues) != 1 || gotValues[0] != wantValue {
+			t.Errorf("%s: want: [%q], got: %q", name, wantValue, gotValues)
+		}
+	}
+	if !bytes.Equal(b, mock.bodies[0]) {
+		t.Errorf("body: want: %d bytes as-is, got: %d bytes", len(b), len(mock.bodies[0]))
+	}
+}
+
+func TestRemoteWriteEncoder(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedRemoteWriteTimeNowFn := remoteWriteTimeNowFn
+	defer func() { remoteWriteTimeNowFn = savedRemoteWriteTimeNowFn }()
+	remoteWriteTimeNowFn = func() time.Time { return time.UnixMilli(1746121347000) }
+
+	encoder, err := NewMetricsEncoder(METRICS_ENCODING_REMOTE_WRITE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoder, ok := encoder.(MetricsDecoder)
+	if !ok {
+		t.Fatalf("%T: not a MetricsDecoder", encoder)
+	}
+
+	// The decoding should reproduce the input, w/ the labels sorted and the
+	// default timestamp filled in; encoded buffers should be concatenable:
+	encoded := &bytes.Buffer{}
+	for _, text := range []string{
+		`metric{z="1",a="2"} 1.5 1746121347582` + "\n",
+		`metric{path="C:\\dir",q="say \"hi\"",nl="a\nb"} -3` + "\n" + "other 1e-09 1\n",
+	} {
+		if err := encoder.Encode(encoded, []byte(text)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoded := &bytes.Buffer{}
+	if err := decoder.Decode(decoded, encoded.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	want := `metric{a="2",z="1"} 1.5 1746121347582` + "\n" +
+		`metric{nl="a\nb",path="C:\\dir",q="say \"hi\""} -3 1746121347000` + "\n" +
+		"other 1e-09 1\n"
+	if got := decoded.String(); want != got {
+		t.Fatalf("decoded:\n\twant: %q\n\t got: %q", want, got)
+	}
+
+	if err := decoder.Decode(decoded, []byte{0x0a, 0x7f}); err == nil {
+		t.Fatal("truncated WriteRequest: want error, got nil")
+	}
+}
+
+func TestReconcileSinkEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		encoding, outputFormat         string
+		wantEncoding, wantOutputFormat string
+		wantErr                        bool
+	}{
+		{"", "", METRICS_ENCODING_PROMETHEUS, "", false},
+		{METRICS_ENCODING_PROMETHEUS, COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION, METRICS_ENCODING_PROMETHEUS, COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION, false},
+		{METRICS_ENCODING_PROMETHEUS, COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE, METRICS_ENCODING_REMOTE_WRITE, COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE, false},
+		{METRICS_ENCODING_REMOTE_WRITE, COMPRESSOR_POOL_OUTPUT_FORMAT_EXPOSITION, METRICS_ENCODING_REMOTE_WRITE, COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE, false},
+		{"other", COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE, "", "", true},
+	} {
+		t.Run(tc.encoding+"+"+tc.outputFormat, func(t *testing.T) {
+			poolCfg := DefaultCompressorPoolConfig()
+			poolCfg.OutputFormat = tc.outputFormat
+			gotEncoding, err := ReconcileSinkEncoding(tc.encoding, poolCfg)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatal("want error, got nil")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.wantEncoding != gotEncoding {
+				t.Errorf("encoding: want: %q, got: %q", tc.wantEncoding, gotEncoding)
+			}
+			if tc.wantOutputFormat != poolCfg.OutputFormat {
+				t.Errorf("output_format: want: %q, got: %q", tc.wantOutputFormat, poolCfg.OutputFormat)
+			}
+		})
+	}
+}
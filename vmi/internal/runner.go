@@ -2,16 +2,22 @@ package vmi_internal
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
+	"hash/fnv"
 	"os"
 	"os/signal"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
 	"github.com/bgp59/logrusx"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 )
 
 // The runner is the main entry point for an instance VMI importer.
@@ -34,11 +40,21 @@ import (
 // arguments. The latter must be parsed by the main function *before* calling
 // the runner.
 //
+// Alternatively, in one-shot mode, each task is run exactly once, with full
+// metrics, the queued metrics are delivered and the runner exits with a status
+// reflecting whether all sends succeeded or not. This is useful for cron-style
+// collection.
+//
 // The runner will also handle the shutdown of the importer. It will wait for
 // all tasks to finish before exiting. The shutdown will be triggered by a
 // signal (SIGINT or SIGTERM) and it will have a grace period. If the tasks do
 // not finish within the grace period, the runner will forcefully terminate the
 // importer.
+//
+// Upon SIGHUP the runner will reload the config file and apply the settings
+// which can be changed at runtime: the internal metrics and the generators'
+// intervals, the HTTP endpoint list and the rate limit. The other changes are
+// logged as ignored, they require a restart.
 
 const (
 	CONFIG_FLAG_NAME = "config"
@@ -54,6 +70,29 @@ type BufferQueue interface {
 	GetTargetSize() int
 }
 
+// Metrics queues which may drop buffers can optionally track the source
+// generator, such that the dropped metrics are attributed to the latter:
+type GenIdBufferQueue interface {
+	QueueBufFor(genId string, b *bytes.Buffer)
+}
+
+// Queue a buffer on behalf of a generator, fallback over the plain QueueBuf if
+// the queue doesn't track the source:
+func QueueBufFor(mq BufferQueue, genId string, b *bytes.Buffer) {
+	if genIdMq, ok := mq.(GenIdBufferQueue); ok {
+		genIdMq.QueueBufFor(genId, b)
+	} else {
+		mq.QueueBuf(b)
+	}
+}
+
+// Account for a dropped buffer, the metrics count is the number of lines:
+func updateDroppedMetrics(genId string, b []byte) {
+	if n := bytes.Count(b, []byte{'\n'}); n > 0 {
+		MetricsGenStats.UpdateDropped(genId, uint64(n))
+	}
+}
+
 // The metrics generator interface which allows it to be scheduled as a Task:
 type MetricsGeneratorTask interface {
 	GetId() string
@@ -61,6 +100,54 @@ type MetricsGeneratorTask interface {
 	TaskActivity() bool
 }
 
+// Optional interface for metrics generators supporting the full metrics cycle
+// (see GeneratorBase), used for the task schedule summary:
+type MetricsGeneratorTaskFullCycle interface {
+	GetFullMetricsFactor() int
+	GetCycleNum() int
+}
+
+// Optional interface for metrics generators which can be forced to generate
+// the full set of metrics at the next invocation, used for one-shot mode:
+type MetricsGeneratorTaskForceFull interface {
+	ForceFullMetrics()
+}
+
+// Optional interface for metrics generators which depend on other generators,
+// identified by their IDs, i.e. they should run only after the latter have
+// run in the same cycle:
+type MetricsGeneratorTaskDependencies interface {
+	GetDependencies() []string
+}
+
+// Optional interface for metrics generators which belong to a concurrency
+// class, e.g. multiple instances of the same generator type contending for a
+// shared resource, such that at most N of them run at the same time:
+type MetricsGeneratorTaskConcurrencyClass interface {
+	GetConcurrencyClass() (class string, maxConcurrency int)
+}
+
+// Optional interface for metrics generators which bound their work via a
+// context, e.g. scraping or exec generators, such that a slow source doesn't
+// overrun the interval. When implemented, it is invoked by the scheduler
+// instead of TaskActivity, w/ a context cancelled upon the timeout or at
+// shutdown (see "Timeouts" in scheduler.go):
+type MetricsGeneratorTaskContext interface {
+	TaskActivityContext(ctx context.Context) bool
+}
+
+// Optional interface for metrics generators w/ a timeout for the context
+// above, use 0 for the interval and < 0 for no timeout:
+type MetricsGeneratorTaskTimeout interface {
+	GetTimeout() time.Duration
+}
+
+// Optional interface for metrics generators w/ a scheduling priority, honored
+// when more generators are ready to run than scheduler workers:
+type MetricsGeneratorTaskPriority interface {
+	GetPriority() int
+}
+
 var (
 	// The hostname, based on OS, config or command line arg.
 	Hostname string
@@ -71,6 +158,11 @@ var (
 	// command line args.
 	Instance string = INSTANCE_DEFAULT
 
+	// The names of the instance and hostname labels, common to all metrics,
+	// based on config:
+	InstanceLabelName string = INSTANCE_LABEL_NAME
+	HostnameLabelName string = HOSTNAME_LABEL_NAME
+
 	// Build info, normally set via init() by the user of this package.
 	Version string
 	GitInfo string
@@ -81,13 +173,18 @@ var (
 	MetricsGenStats  = NewMetricsGeneratorStatsContainer()
 	MetricsQueue     BufferQueue
 	scheduler        *Scheduler
+	// Optional, see VmiConfig.SelfMetricsAddr:
+	selfMetricsServer *SelfMetricsServer
+	// The current intervals of the generator tasks, by ID, used for config
+	// reload:
+	genTaskIntervals = make(map[string]time.Duration)
 	// The task builders are registered by the metrics generators via init()
 	// functions. Each builder takes a configuration as an argument and returns
 	// a list of MetricsGeneratorTask that perform the actual metrics generation.
 	taskBuilders = struct {
-		builders []func(config any) ([]MetricsGeneratorTask, error)
+		builders []*taskBuilder
 		mu       *sync.Mutex
-	}{make([]func(config any) ([]MetricsGeneratorTask, error), 0), &sync.Mutex{}}
+	}{make([]*taskBuilder, 0), &sync.Mutex{}}
 
 	// Metrics generation may take the delta approach whereby a specific metric
 	// is generated only if its value has changed from the previous scan.
@@ -105,12 +202,425 @@ var (
 	}{0, &sync.Mutex{}}
 )
 
+// Build a scheduler task for a metrics generator:
+func NewMetricsGeneratorTask(genTask MetricsGeneratorTask) *Task {
+	task := NewTask(genTask.GetId(), genTask.GetInterval(), genTask.TaskActivity)
+	if fullCycleTask, ok := genTask.(MetricsGeneratorTaskFullCycle); ok {
+		task.SetFullMetricsCycle(fullCycleTask.GetFullMetricsFactor(), fullCycleTask.GetCycleNum())
+	}
+	if forceFullTask, ok := genTask.(MetricsGeneratorTaskForceFull); ok {
+		task.SetForceFullMetrics(forceFullTask.ForceFullMetrics)
+	}
+	if depsTask, ok := genTask.(MetricsGeneratorTaskDependencies); ok {
+		if dependencies := depsTask.GetDependencies(); len(dependencies) > 0 {
+			task.SetDependencies(dependencies...)
+		}
+	}
+	if classTask, ok := genTask.(MetricsGeneratorTaskConcurrencyClass); ok {
+		if class, maxConcurrency := classTask.GetConcurrencyClass(); class != "" {
+			task.SetConcurrencyClass(class, maxConcurrency)
+		}
+	}
+	if priorityTask, ok := genTask.(MetricsGeneratorTaskPriority); ok {
+		task.SetPriority(priorityTask.GetPriority())
+	}
+	if ctxTask, ok := genTask.(MetricsGeneratorTaskContext); ok {
+		timeout := time.Duration(0)
+		if timeoutTask, ok := genTask.(MetricsGeneratorTaskTimeout); ok {
+			timeout = timeoutTask.GetTimeout()
+		}
+		task.SetContextAction(ctxTask.TaskActivityContext, timeout)
+	}
+	return task
+}
+
+// One-shot mode: run each task exactly once, with full metrics, then drain the
+// compressor pools, waiting for the delivery of all the metrics. Return true
+// if all the sends were successful.
+func RunOneShot(taskList []*Task, compressorPools []*CompressorPool) bool {
+	for _, task := range taskList {
+		if task.forceFullMetrics != nil {
+			task.forceFullMetrics()
+		}
+		runnerLog.Infof("one-shot: run task %q", task.id)
+		task.runAction(context.Background())
+	}
+
+	// Flush the generators' own queues, if any, before the compressors:
+	ShutdownGeneratorMetricsQueues()
+	return drainCompressorPools(compressorPools, "one-shot")
+}
+
+// Shutdown the compressor pools and report whether there were no send errors.
+// The compressors flush the pending batches at shutdown and the latter returns
+// after all the sends have completed.
+func drainCompressorPools(compressorPools []*CompressorPool, mode string) bool {
+	success := true
+	for _, pool := range compressorPools {
+		pool.Shutdown()
+		for compressorId, stats := range pool.SnapStats(nil) {
+			if sendErrorCount := stats.Uint64Stats[COMPRESSOR_STATS_SEND_ERROR_COUNT]; sendErrorCount > 0 {
+				runnerLog.Errorf("%s: compressor %s: %d send error(s)", mode, compressorId, sendErrorCount)
+				success = false
+			}
+		}
+	}
+	return success
+}
+
+// The startup splay delay, used to de-sync a fleet of importers deployed
+// simultaneously. It is derived from the instance and hostname, rather than
+// random, such that a given importer always uses the same offset in
+// [0, splay), which spreads the fleet-wide first scrapes evenly, restart
+// after restart.
+func StartupSplayDelay(splay time.Duration, instance, hostname string) time.Duration {
+	if splay <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	h.Write([]byte(instance))
+	h.Write([]byte{0})
+	h.Write([]byte(hostname))
+	return time.Duration(h.Sum64() % uint64(splay))
+}
+
+// Start the scheduler after the startup splay delay, unless a signal is
+// received in the meantime, in which case the latter is returned and the
+// scheduler is not started.
+func StartSchedulerAfterSplay(scheduler *Scheduler, delay time.Duration, sigChan <-chan os.Signal) os.Signal {
+	if delay > 0 {
+		runnerLog.Infof("startup splay: delay the scheduler start by %s", delay)
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case sig := <-sigChan:
+			return sig
+		case <-timer.C:
+		}
+	}
+	scheduler.Start()
+	return nil
+}
+
+// The exit code for the shutdown upon reaching max_process_lifetime, signaling
+// to the supervisor that the restart is planned (EX_TEMPFAIL, see
+// sysexits.h):
+const PLANNED_RESTART_EXIT_CODE = 75
+
+// Block until a shutdown signal is received or the max process lifetime is
+// reached, whichever comes first. The reload requests received in the
+// meantime are applied via reloadFn. Use maxLifetime 0 for no limit. Return
+// the shutdown reason, for logging, and the exit code.
+func WaitForShutdown(
+	sigChan, reloadChan <-chan os.Signal,
+	maxLifetime time.Duration,
+	reloadFn func(),
+) (string, int) {
+	var lifetimeChan <-chan time.Time
+	if maxLifetime > 0 {
+		timer := time.NewTimer(maxLifetime)
+		defer timer.Stop()
+		lifetimeChan = timer.C
+	}
+	for {
+		select {
+		case sig := <-sigChan:
+			return fmt.Sprintf("%s signal received", sig), 0
+		case <-lifetimeChan:
+			return "max_process_lifetime reached, planned restart", PLANNED_RESTART_EXIT_CODE
+		case <-reloadChan:
+			reloadFn()
+		}
+	}
+}
+
+// Mockable for testing:
+var runnerExitFn = logrus.Exit
+
+// Act upon the outcome of WaitForShutdown: force exit, via runnerExitFn, if
+// the graceful shutdown is disabled (shutdownMaxWait 0), otherwise return the
+// exit code for the graceful shutdown path.
+func HandleShutdownReason(reason string, exitCode int, shutdownMaxWait time.Duration) int {
+	if shutdownMaxWait == 0 {
+		if exitCode != 0 {
+			runnerLog.Warnf("%s, force exit w/ code %d", reason, exitCode)
+		} else {
+			runnerLog.Logf(logrus.FatalLevel, "%s, force exit", reason)
+			exitCode = 1
+		}
+		runnerExitFn(exitCode)
+		return exitCode
+	}
+	runnerLog.Warnf("%s, shutting down", reason)
+	return exitCode
+}
+
+// The config settings which can be changed at runtime, see ReloadConfig:
+var reloadableConfigKeys = []string{
+	"internal_metrics_config.interval",
+	"http_endpoint_pool_config.endpoints",
+	"http_endpoint_pool_config.rate_limit_mbps",
+}
+
+// Reload the config file and apply the settings which can be changed at
+// runtime:
+//   - internal_metrics_config.interval
+//   - http_endpoint_pool_config.endpoints, matched by URL, such that the
+//     settings of the existing endpoints are left unchanged
+//   - http_endpoint_pool_config.rate_limit_mbps
+//   - the generators' intervals
+//
+// The generators section is loaded into genConfig, which should be primed w/
+// the defaults, same as for Run; use nil to ignore it. The metrics generation
+// (internal or generators) cannot be enabled or disabled at runtime. The other
+// changed settings are logged as ignored. Each setting is applied
+// independently and the current config is updated to reflect the applied
+// changes.
+func ReloadConfig(configFile string, vmiConfig *VmiConfig, genConfig any) error {
+	newVmiConfig, err := LoadConfig(configFile, genConfig, nil)
+	if err != nil {
+		return fmt.Errorf("ReloadConfig: %v", err)
+	}
+	// The command line args take precedence, same as at startup:
+	applyConfigArgs(newVmiConfig, make(ConfigProvenance))
+	logrusx.ApplySetLoggerArgs(newVmiConfig.LoggerConfig)
+
+	errMsgs := make([]string, 0)
+	if err := reloadInternalMetricsInterval(vmiConfig, newVmiConfig); err != nil {
+		errMsgs = append(errMsgs, err.Error())
+	}
+	if httpEndpointPool != nil {
+		if err := reloadHttpEndpointPool(httpEndpointPool, vmiConfig, newVmiConfig); err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+	if genConfig != nil {
+		if err := reloadGeneratorIntervals(genConfig); err != nil {
+			errMsgs = append(errMsgs, err.Error())
+		}
+	}
+	ignoredKeys, err := changedConfigKeys(vmiConfig, newVmiConfig)
+	if err != nil {
+		errMsgs = append(errMsgs, err.Error())
+	}
+	for _, key := range ignoredKeys {
+		if httpEndpointPool == nil && strings.HasPrefix(key, "http_endpoint_pool_config.") ||
+			!slices.Contains(reloadableConfigKeys, key) {
+			runnerLog.Warnf("reload: %s changed, ignored (restart required)", key)
+		}
+	}
+	if len(errMsgs) > 0 {
+		return fmt.Errorf("ReloadConfig: %s", strings.Join(errMsgs, ", "))
+	}
+	return nil
+}
+
+func reloadInternalMetricsInterval(vmiConfig, newVmiConfig *VmiConfig) error {
+	currInterval := vmiConfig.InternalMetricsConfig.Interval
+	newInterval := newVmiConfig.InternalMetricsConfig.Interval
+	if newInterval == currInterval {
+		runnerLog.Infof("reload: internal_metrics_config.interval=%s unchanged", currInterval)
+		return nil
+	}
+	if currInterval <= 0 || newInterval <= 0 {
+		return fmt.Errorf(
+			"internal_metrics_config.interval: %s -> %s: internal metrics cannot be enabled or disabled at runtime",
+			currInterval, newInterval,
+		)
+	}
+	if err := SetInternalMetricsInterval(newInterval); err != nil {
+		return err
+	}
+	runnerLog.Infof("reload: internal_metrics_config.interval: %s -> %s", currInterval, newInterval)
+	vmiConfig.InternalMetricsConfig.Interval = newInterval
+	return nil
+}
+
+func reloadHttpEndpointPool(epPool *HttpEndpointPool, vmiConfig, newVmiConfig *VmiConfig) error {
+	currPoolCfg, newPoolCfg := vmiConfig.HttpEndpointPoolConfig, newVmiConfig.HttpEndpointPoolConfig
+	errMsgs := make([]string, 0)
+	if reflect.DeepEqual(currPoolCfg.Endpoints, newPoolCfg.Endpoints) {
+		runnerLog.Info("reload: http_endpoint_pool_config.endpoints unchanged")
+	} else if err := epPool.UpdateEndpoints(newPoolCfg.Endpoints); err != nil {
+		errMsgs = append(errMsgs, err.Error())
+	} else {
+		runnerLog.Info("reload: http_endpoint_pool_config.endpoints updated")
+		currPoolCfg.Endpoints = newPoolCfg.Endpoints
+	}
+	if currPoolCfg.RateLimitMbps == newPoolCfg.RateLimitMbps {
+		runnerLog.Infof("reload: http_endpoint_pool_config.rate_limit_mbps=%q unchanged", currPoolCfg.RateLimitMbps)
+	} else if err := epPool.SetRateLimit(newPoolCfg.RateLimitMbps); err != nil {
+		errMsgs = append(errMsgs, err.Error())
+	} else {
+		runnerLog.Infof(
+			"reload: http_endpoint_pool_config.rate_limit_mbps: %q -> %q",
+			currPoolCfg.RateLimitMbps, newPoolCfg.RateLimitMbps,
+		)
+		currPoolCfg.RateLimitMbps = newPoolCfg.RateLimitMbps
+	}
+	if len(errMsgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errMsgs, ", "))
+	}
+	return nil
+}
+
+// Get the generator intervals from the reloaded config and apply the changes.
+// The intervals builders are used, if registered, otherwise the tasks are
+// rebuilt and discarded, they are used only for their intervals.
+func reloadGeneratorIntervals(genConfig any) error {
+	newIntervals := make(map[string]time.Duration)
+	taskBuilders.mu.Lock()
+	for _, tb := range taskBuilders.builders {
+		if tb.intervals != nil {
+			intervals, err := tb.intervals(genConfig)
+			if err != nil {
+				taskBuilders.mu.Unlock()
+				return err
+			}
+			for id, interval := range intervals {
+				newIntervals[id] = interval
+			}
+			continue
+		}
+		genTasks, err := tb.build(genConfig)
+		if err != nil {
+			taskBuilders.mu.Unlock()
+			return err
+		}
+		for _, genTask := range genTasks {
+			newIntervals[genTask.GetId()] = genTask.GetInterval()
+		}
+	}
+	taskBuilders.mu.Unlock()
+
+	errMsgs := make([]string, 0)
+	ids := make([]string, 0, len(genTaskIntervals))
+	for id := range genTaskIntervals {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		currInterval := genTaskIntervals[id]
+		newInterval, ok := newIntervals[id]
+		if !ok || newInterval <= 0 {
+			runnerLog.Warnf("reload: generator %s: cannot be disabled at runtime, ignored (restart required)", id)
+			continue
+		}
+		if newInterval == currInterval {
+			continue
+		}
+		if scheduler == nil {
+			errMsgs = append(errMsgs, fmt.Sprintf("generator %s: scheduler not created", id))
+			continue
+		}
+		if err := scheduler.SetTaskInterval(id, newInterval); err != nil {
+			errMsgs = append(errMsgs, fmt.Sprintf("generator %s: %v", id, err))
+			continue
+		}
+		runnerLog.Infof("reload: generator %s: interval: %s -> %s", id, currInterval, newInterval)
+		genTaskIntervals[id] = newInterval
+	}
+	for id, newInterval := range newIntervals {
+		if _, ok := genTaskIntervals[id]; !ok && newInterval > 0 {
+			runnerLog.Warnf("reload: generator %s: cannot be enabled at runtime, ignored (restart required)", id)
+		}
+	}
+	if len(errMsgs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errMsgs, ", "))
+	}
+	return nil
+}
+
+// Return the dot separated keys of the settings which differ between 2
+// configs, sorted:
+func changedConfigKeys(vmiConfig, newVmiConfig *VmiConfig) ([]string, error) {
+	toMap := func(cfg *VmiConfig) (map[string]any, error) {
+		buf, err := yaml.Marshal(cfg)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]any)
+		return m, yaml.Unmarshal(buf, &m)
+	}
+	currMap, err := toMap(vmiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("changedConfigKeys: %v", err)
+	}
+	newMap, err := toMap(newVmiConfig)
+	if err != nil {
+		return nil, fmt.Errorf("changedConfigKeys: %v", err)
+	}
+	keys := make([]string, 0)
+	var diff func(prefix string, curr, new map[string]any)
+	diff = func(prefix string, curr, new map[string]any) {
+		for key := range curr {
+			if _, ok := new[key]; !ok {
+				new[key] = nil
+			}
+		}
+		for key, newVal := range new {
+			currVal := curr[key]
+			currSubMap, currIsMap := currVal.(map[string]any)
+			newSubMap, newIsMap := newVal.(map[string]any)
+			if currIsMap && newIsMap {
+				diff(prefix+key+".", currSubMap, newSubMap)
+			} else if !reflect.DeepEqual(currVal, newVal) {
+				keys = append(keys, prefix+key)
+			}
+		}
+	}
+	diff("", currMap, newMap)
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// Return a new generators config, of the same type as genConfig and primed w/
+// the defaults, as serialized before loading the config file. Return nil if
+// genConfig is not a pointer, i.e. it cannot be reloaded into.
+func newDefaultGenConfig(genConfig any, defaults []byte) (any, error) {
+	v := reflect.ValueOf(genConfig)
+	if v.Kind() != reflect.Pointer || v.IsNil() {
+		return nil, nil
+	}
+	newGenConfig := reflect.New(v.Type().Elem()).Interface()
+	if err := yaml.Unmarshal(defaults, newGenConfig); err != nil {
+		return nil, fmt.Errorf("newDefaultGenConfig: %v", err)
+	}
+	return newGenConfig, nil
+}
+
+type taskBuilder struct {
+	build func(config any) ([]MetricsGeneratorTask, error)
+	// Optional, return the task intervals, by ID, w/o building the tasks; used
+	// for config reload:
+	intervals func(config any) (map[string]time.Duration, error)
+}
+
 func RegisterTaskBuilder(tb func(config any) ([]MetricsGeneratorTask, error)) {
+	RegisterTaskBuilderWithIntervals(tb, nil)
+}
+
+func RegisterTaskBuilderWithIntervals(
+	tb func(config any) ([]MetricsGeneratorTask, error),
+	ib func(config any) (map[string]time.Duration, error),
+) {
 	taskBuilders.mu.Lock()
-	taskBuilders.builders = append(taskBuilders.builders, tb)
+	taskBuilders.builders = append(taskBuilders.builders, &taskBuilder{tb, ib})
 	taskBuilders.mu.Unlock()
 }
 
+// Remove a task from the scheduler at runtime, e.g. when a config reload drops
+// the metrics generated by it:
+func RemoveTask(id string) error {
+	if scheduler == nil {
+		return fmt.Errorf("RemoveTask: scheduler not created")
+	}
+	if err := scheduler.RemoveTask(id); err != nil {
+		return fmt.Errorf("RemoveTask: %v", err)
+	}
+	return nil
+}
+
 func GetInitialCycleNum(fullMetricsFactor int) int {
 	if fullMetricsFactor <= 1 {
 		return 0
@@ -166,6 +676,53 @@ var (
 		),
 	)
 
+	stdoutMetricsEncodingArg = flag.String(
+		"stdout-metrics-encoding",
+		METRICS_ENCODING_PROMETHEUS,
+		FormatFlagUsage(
+			`The encoding for -use-stdout-metrics-queue, see additional_sinks;
+			the metrics are displayed as they would be sent, decoded for
+			human reading if the encoder supports it`,
+		),
+	)
+
+	oneShotArg = flag.Bool(
+		"one-shot",
+		false,
+		FormatFlagUsage(
+			`Run each metrics generator exactly once, with full metrics, wait for the
+			metrics to be delivered and exit. The exit status is 0 if all the metrics
+			were sent successfully, 1 otherwise`,
+		),
+	)
+
+	captureFileArg = flag.String(
+		"capture-file",
+		"",
+		FormatFlagUsage(
+			`Record the generated metrics into the file, for later replay`,
+		),
+	)
+
+	replayFileArg = flag.String(
+		"replay-file",
+		"",
+		FormatFlagUsage(
+			`Replay the metrics recorded via -capture-file instead of running the
+			metrics generators and exit. The exit status is 0 if all the metrics
+			were sent successfully, 1 otherwise`,
+		),
+	)
+
+	replaySpeedArg = flag.Float64(
+		"replay-speed",
+		1,
+		FormatFlagUsage(
+			`The multiplier of the original timing for -replay-file, e.g. 2 for
+			twice as fast; use 0 to replay as fast as possible`,
+		),
+	)
+
 	httpPoolEndpointsArg = flag.String(
 		"http-pool-endpoints",
 		"",
@@ -173,8 +730,29 @@ var (
 			`Override the "vmi_config.http_endpoint_pool_config.endpoints" config setting`,
 		),
 	)
+
+	dumpConfigArg = flag.Bool(
+		"dump-config",
+		false,
+		FormatFlagUsage(
+			`Print the effective vmi_config, annotated with the source of each
+			setting (default, file, env or cli), and exit`,
+		),
+	)
 )
 
+// Override the config with command line args, recording the provenance:
+func applyConfigArgs(vmiConfig *VmiConfig, provenance ConfigProvenance) {
+	if *instanceArg != "" {
+		vmiConfig.Instance = *instanceArg
+		provenance.Set(VMI_CONFIG_SECTION_NAME+".instance", CONFIG_SOURCE_CLI)
+	}
+	if *httpPoolEndpointsArg != "" {
+		vmiConfig.HttpEndpointPoolConfig.OverrideEndpoints(*httpPoolEndpointsArg)
+		provenance.Set(VMI_CONFIG_SECTION_NAME+".http_endpoint_pool_config.endpoints", CONFIG_SOURCE_CLI)
+	}
+}
+
 func init() {
 	logrusx.EnableLoggerArgs()
 }
@@ -202,21 +780,31 @@ func Run(genConfig any) int {
 	}
 
 	configFile := *configFileArg
-	vmiConfig, err = LoadConfig(configFile, genConfig, nil)
+	// Serialize the generators' defaults, needed for priming the config upon
+	// reload:
+	genConfigDefaults, err := yaml.Marshal(genConfig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error serializing the generators config: %v\n", err)
+		return 1
+	}
+	vmiConfig, configProvenance, err := LoadConfigWithProvenance(configFile, genConfig, nil)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading config file: %v\n", err)
 		return 1
 	}
 
 	// Override the config with command line args:
-	if *instanceArg != "" {
-		vmiConfig.Instance = *instanceArg
-	}
-	if *httpPoolEndpointsArg != "" {
-		vmiConfig.HttpEndpointPoolConfig.OverrideEndpoints(*httpPoolEndpointsArg)
-	}
+	applyConfigArgs(vmiConfig, configProvenance)
 	logrusx.ApplySetLoggerArgs(vmiConfig.LoggerConfig)
 
+	if *dumpConfigArg {
+		if err := DumpConfig(os.Stdout, vmiConfig, configProvenance); err != nil {
+			fmt.Fprintf(os.Stderr, "Error dumping config: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+
 	// Set the logger level and file:
 	err = SetLogger(vmiConfig.LoggerConfig)
 	if err != nil {
@@ -226,6 +814,75 @@ func Run(genConfig any) int {
 
 	// Set the globals:
 	Instance = vmiConfig.Instance
+	for _, labelSpec := range []struct {
+		cfgName, val string
+		global       *string
+	}{
+		{"instance_label", vmiConfig.InstanceLabel, &InstanceLabelName},
+		{"hostname_label", vmiConfig.HostnameLabel, &HostnameLabelName},
+	} {
+		if !IsValidLabelName(labelSpec.val) {
+			runnerLog.Errorf("invalid %s %q", labelSpec.cfgName, labelSpec.val)
+			return 1
+		}
+		*labelSpec.global = labelSpec.val
+	}
+	DetectTsRegression = vmiConfig.DetectTsRegression
+	if vmiConfig.GenMaxLinesPerBuffer < 0 {
+		runnerLog.Errorf("invalid generator_max_lines_per_buffer %d, want: >= 0", vmiConfig.GenMaxLinesPerBuffer)
+		return 1
+	}
+	GeneratorMaxLinesPerBuffer = vmiConfig.GenMaxLinesPerBuffer
+	runnerLog.Infof("generator_max_lines_per_buffer=%d", GeneratorMaxLinesPerBuffer)
+	switch vmiConfig.FloatFormat {
+	case VMI_CONFIG_FLOAT_FORMAT_FIXED, VMI_CONFIG_FLOAT_FORMAT_AUTO:
+		FloatFormat = vmiConfig.FloatFormat[0]
+	default:
+		runnerLog.Errorf(
+			"invalid float_format %q, want: %q or %q",
+			vmiConfig.FloatFormat, VMI_CONFIG_FLOAT_FORMAT_FIXED, VMI_CONFIG_FLOAT_FORMAT_AUTO,
+		)
+		return 1
+	}
+	runnerLog.Infof("float_format=%q", vmiConfig.FloatFormat)
+	DropNonFinite = vmiConfig.DropNonFinite
+	runnerLog.Infof("drop_nonfinite=%v", DropNonFinite)
+	runnerLog.Infof("startup_splay=%s", vmiConfig.StartupSplay)
+	if vmiConfig.MaxMetricAge < 0 {
+		runnerLog.Errorf("invalid max_metric_age %s, want: >= 0", vmiConfig.MaxMetricAge)
+		return 1
+	}
+	MaxMetricAge = vmiConfig.MaxMetricAge
+	runnerLog.Infof("max_metric_age=%s", MaxMetricAge)
+	if vmiConfig.MaxProcessLifetime < 0 {
+		runnerLog.Errorf("invalid max_process_lifetime %s, want: >= 0", vmiConfig.MaxProcessLifetime)
+		return 1
+	}
+	runnerLog.Infof("max_process_lifetime=%s", vmiConfig.MaxProcessLifetime)
+	if err := ValidateMetricRenames(vmiConfig.MetricRenames); err != nil {
+		runnerLog.Error(err)
+		return 1
+	}
+	MetricRenames = vmiConfig.MetricRenames
+	for oldName, newName := range MetricRenames {
+		runnerLog.Infof("metric_renames: %s -> %s", oldName, newName)
+	}
+	// Non-fatal config issues, logged once and published as
+	// vmi_config_warnings:
+	configWarnings := vmiConfig.Validate()
+	for _, warning := range configWarnings {
+		runnerLog.Warnf("config: %s", warning)
+	}
+	configWarningsCount = len(configWarnings)
+	runnerLog.Infof("config_warnings=%d", configWarningsCount)
+	TimestampOffset = vmiConfig.TimestampOffset
+	if TimestampOffset != 0 {
+		runnerLog.Warnf("timestamp_offset=%s, all metrics timestamps will be adjusted", TimestampOffset)
+	}
+	if InstanceLabelName == HostnameLabelName {
+		runnerLog.Errorf("instance_label and hostname_label must be different, both are %q", InstanceLabelName)
+		return 1
+	}
 	if *hostnameArg != "" {
 		Hostname = *hostnameArg
 	} else {
@@ -256,7 +913,27 @@ func Run(genConfig any) int {
 		defer shutdownTimer.Stop()
 	}
 
+	// Profiling, started before all the other components and shut down after
+	// them (LIFO), such that their whole lifetime may be profiled:
+	if vmiConfig.PprofAddr != "" && !*oneShotArg {
+		pprofServer := NewPprofServer(vmiConfig.PprofAddr)
+		if err := pprofServer.Start(); err != nil {
+			runnerLog.Fatal(err)
+		}
+		defer pprofServer.Shutdown()
+	}
+
 	// Set the metrics queue:
+	compressorPools := make([]*CompressorPool, 0)
+	if vmiConfig.CompressorPoolConfig == nil {
+		vmiConfig.CompressorPoolConfig = DefaultCompressorPoolConfig()
+	}
+	// The primary sink uses the native encoding, unless implied otherwise by
+	// the output format:
+	primaryEncoding, err := ReconcileSinkEncoding(METRICS_ENCODING_PROMETHEUS, vmiConfig.CompressorPoolConfig)
+	if err != nil {
+		runnerLog.Fatal(err)
+	}
 	if !*useStdoutMetricsQueueArg {
 		// Real queue w/ compressed metrics sent to import endpoints:
 		httpEndpointPool, err = NewHttpEndpointPool(vmiConfig.HttpEndpointPoolConfig)
@@ -269,63 +946,235 @@ func Run(genConfig any) int {
 			runnerLog.Fatal(err)
 		}
 		MetricsQueue = compressorPool
+		compressorPools = append(compressorPools, compressorPool)
 
 		compressorPool.Start(httpEndpointPool)
 		defer compressorPool.Shutdown()
 		defer httpEndpointPool.Shutdown()
+
+		if vmiConfig.SummaryLogInterval > 0 {
+			pipelineSummary := NewPipelineSummary(vmiConfig.SummaryLogInterval, compressorPool, httpEndpointPool)
+			pipelineSummary.Start()
+			defer pipelineSummary.Shutdown()
+		}
+
+		// Additional sinks, if any, or a primary sink w/ a non-native
+		// encoding; the generators will write into a fan out queue, w/ the
+		// primary sink first:
+		if len(vmiConfig.AdditionalSinks) > 0 || primaryEncoding != METRICS_ENCODING_PROMETHEUS {
+			primaryEncoder, err := NewMetricsEncoder(primaryEncoding)
+			if err != nil {
+				runnerLog.Fatalf("sink %q: %v", "primary", err)
+			}
+			sinks := []*SinkQueue{
+				{
+					Name:    "primary",
+					Encoder: primaryEncoder,
+					Queue:   compressorPool,
+				},
+			}
+			for i, sinkCfg := range vmiConfig.AdditionalSinks {
+				sinkName := sinkCfg.Name
+				if sinkName == "" {
+					sinkName = fmt.Sprintf("sink%d", i+1)
+				}
+				if sinkCfg.CompressorPoolConfig == nil {
+					sinkCfg.CompressorPoolConfig = DefaultCompressorPoolConfig()
+				}
+				sinkEncoding, err := ReconcileSinkEncoding(sinkCfg.Encoding, sinkCfg.CompressorPoolConfig)
+				if err != nil {
+					runnerLog.Fatalf("sink %q: %v", sinkName, err)
+				}
+				encoder, err := NewMetricsEncoder(sinkEncoding)
+				if err != nil {
+					runnerLog.Fatalf("sink %q: %v", sinkName, err)
+				}
+				sinkEndpointPool, err := NewHttpEndpointPool(sinkCfg.HttpEndpointPoolConfig)
+				if err != nil {
+					runnerLog.Fatalf("sink %q: %v", sinkName, err)
+				}
+				sinkCompressorPool, err := NewCompressorPool(sinkCfg.CompressorPoolConfig)
+				if err != nil {
+					runnerLog.Fatalf("sink %q: %v", sinkName, err)
+				}
+				compressorPools = append(compressorPools, sinkCompressorPool)
+				sinkCompressorPool.Start(sinkEndpointPool)
+				defer sinkCompressorPool.Shutdown()
+				defer sinkEndpointPool.Shutdown()
+				sinks = append(sinks, &SinkQueue{
+					Name:    sinkName,
+					Encoder: encoder,
+					Queue:   sinkCompressorPool,
+				})
+			}
+			MetricsQueue = NewFanOutMetricsQueue(sinks, vmiConfig.CompressorPoolConfig.BufferPoolMaxSize)
+		}
 	} else {
-		// Simulated queue w/ metrics displayed to stdout:
-		MetricsQueue, err = NewStdoutMetricsQueue(vmiConfig.CompressorPoolConfig)
+		// Simulated queue w/ metrics displayed to stdout, by default w/ the
+		// primary encoding, i.e. as they would be sent:
+		stdoutMetricsEncoding := *stdoutMetricsEncodingArg
+		if stdoutMetricsEncoding == METRICS_ENCODING_PROMETHEUS {
+			stdoutMetricsEncoding = primaryEncoding
+		}
+		stdoutMetricsQueue, err := NewEncodingStdoutMetricsQueue(vmiConfig.CompressorPoolConfig, stdoutMetricsEncoding)
 		if err != nil {
 			runnerLog.Fatal(err)
 		}
-		defer MetricsQueue.(*StdoutMetricsQueue).Shutdown()
+		MetricsQueue = stdoutMetricsQueue
+		// Ensure that the pending output is flushed on all exit paths: normal
+		// return and panic via defer, fatal errors via logrus exit handler
+		// (os.Exit bypasses deferred functions):
+		logrus.RegisterExitHandler(stdoutMetricsQueue.Shutdown)
+		defer stdoutMetricsQueue.Shutdown()
 	}
 
-	// Scheduler:
-	scheduler, err = NewScheduler(vmiConfig.SchedulerConfig)
-	if err != nil {
-		runnerLog.Fatal(err)
+	// Replay mode, no metrics generators:
+	if *replayFileArg != "" {
+		if !RunReplay(*replayFileArg, *replaySpeedArg, compressorPools) {
+			return 1
+		}
+		return 0
+	}
+
+	// Capture the generated metrics, if so requested:
+	if *captureFileArg != "" {
+		captureMetricsQueue, err := NewCaptureMetricsQueue(MetricsQueue, *captureFileArg)
+		if err != nil {
+			runnerLog.Fatal(err)
+		}
+		MetricsQueue = captureMetricsQueue
+		// The capture should be closed after the generators have stopped,
+		// i.e. after the scheduler shutdown:
+		defer captureMetricsQueue.Close()
+	}
+
+	// Suppress the unchanged samples, if so requested:
+	if suppressUnchangedCfg := vmiConfig.SuppressUnchanged; suppressUnchangedCfg != nil && suppressUnchangedCfg.Enabled {
+		suppressUnchangedMetricsQueue, err := NewSuppressUnchangedMetricsQueue(MetricsQueue, suppressUnchangedCfg)
+		if err != nil {
+			runnerLog.Fatal(err)
+		}
+		MetricsQueue = suppressUnchangedMetricsQueue
 	}
-	scheduler.Start()
-	defer scheduler.Shutdown()
 
 	// Initialize metrics generators:
 	taskList := make([]*Task, 0)
 	taskBuilders.mu.Lock()
 	for _, tb := range taskBuilders.builders {
-		genTasks, err := tb(genConfig)
+		genTasks, err := tb.build(genConfig)
 		if err != nil {
 			runnerLog.Fatal(err)
 		}
 		for _, genTask := range genTasks {
-			taskList = append(taskList, NewTask(genTask.GetId(), genTask.GetInterval(), genTask.TaskActivity))
+			taskList = append(taskList, NewMetricsGeneratorTask(genTask))
+			genTaskIntervals[genTask.GetId()] = genTask.GetInterval()
 		}
 	}
 	taskBuilders.mu.Unlock()
+	// Self-scrape endpoint for internal metrics, started before the scheduler
+	// and shut down after it (LIFO), such that the internal metrics may be
+	// queued until the very end:
+	if vmiConfig.SelfMetricsAddr != "" && !*oneShotArg {
+		selfMetricsServer = NewSelfMetricsServer(vmiConfig.SelfMetricsAddr)
+		if err := selfMetricsServer.Start(); err != nil {
+			runnerLog.Fatal(err)
+		}
+		defer selfMetricsServer.Shutdown()
+	}
+
+	// Liveness and readiness probes, up during the startup splay as well, when
+	// they report not live:
+	var healthProbeServer *HealthProbeServer
+	if vmiConfig.HealthProbeAddr != "" && !*oneShotArg {
+		healthProbeServer = NewHealthProbeServer(vmiConfig.HealthProbeAddr, httpEndpointPool)
+		if err := healthProbeServer.Start(); err != nil {
+			runnerLog.Fatal(err)
+		}
+		defer healthProbeServer.Shutdown()
+	}
+
 	// Initialize internal metrics:
-	task, err := InternalMetricsTaskBuilder(vmiConfig)
+	internalMetricsTask, err := InternalMetricsTaskBuilder(vmiConfig)
 	if err != nil {
 		runnerLog.Fatal(err)
 	}
-	taskList = append(taskList, task)
-
-	// Add all tasks to the scheduler:
-	for _, task := range taskList {
-		scheduler.AddNewTask(task)
+	if internalMetricsTask != nil {
+		taskList = append(taskList, internalMetricsTask)
+	}
+	// Validate the dependencies, if any, and order the tasks accordingly, such
+	// that the one-shot mode runs them in the right order:
+	taskList, err = OrderTasksByDependencies(taskList)
+	if err != nil {
+		runnerLog.Fatal(err)
 	}
 
 	// Log instance and hostname, useful for dashboard variable selection:
 	runnerLog.Infof("Instance: %s, Hostname: %s", Instance, Hostname)
 
-	// Block until a signal is received:
+	// Scheduler; it is created even in one-shot mode, where it is not
+	// started, since its stats are used by internal metrics:
+	scheduler, err = NewScheduler(vmiConfig.SchedulerConfig)
+	if err != nil {
+		runnerLog.Fatal(err)
+	}
+
+	if *oneShotArg {
+		if !RunOneShot(taskList, compressorPools) {
+			return 1
+		}
+		return 0
+	}
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
-	sig := <-sigChan
-	if vmiConfig.ShutdownMaxWait == 0 {
-		runnerLog.Fatalf("%s signal received, force exit", sig)
-	} else {
-		runnerLog.Warnf("%s signal received, shutting down", sig)
+	// Reload upon SIGHUP, N.B. on a separate channel, such that it doesn't
+	// interrupt the startup splay; a reload requested during the latter is
+	// applied afterwards:
+	reloadChan := make(chan os.Signal, 1)
+	signal.Notify(reloadChan, syscall.SIGHUP)
+	defer signal.Stop(reloadChan)
+
+	startupSplayDelay := StartupSplayDelay(vmiConfig.StartupSplay, Instance, Hostname)
+	if sig := StartSchedulerAfterSplay(scheduler, startupSplayDelay, sigChan); sig != nil {
+		runnerLog.Warnf("%s signal received during startup splay, shutting down", sig)
+		return 0
+	}
+	// N.B. Deferred functions run in reverse order, so the generators' own
+	// queues, if any, are flushed after the generators were stopped and the
+	// final internal metrics, for the last interval, were generated:
+	defer ShutdownGeneratorMetricsQueues()
+	defer RunFinalInternalMetrics(internalMetricsTask)
+	defer scheduler.Shutdown()
+	if healthProbeServer != nil {
+		healthProbeServer.SetLive(true)
+	}
+
+	// Add all tasks to the scheduler:
+	for _, task := range taskList {
+		scheduler.AddNewTask(task)
+	}
+	LogTaskSchedule(taskList, time.Now())
+
+	// Block until a shutdown signal is received or the max lifetime, measured
+	// from the process start, is reached:
+	maxLifetime := vmiConfig.MaxProcessLifetime
+	if maxLifetime > 0 {
+		maxLifetime = max(maxLifetime-time.Since(startTs), time.Nanosecond)
+	}
+	reason, exitCode := WaitForShutdown(sigChan, reloadChan, maxLifetime, func() {
+		runnerLog.Infof("SIGHUP signal received, reload %s", configFile)
+		newGenConfig, err := newDefaultGenConfig(genConfig, genConfigDefaults)
+		if err != nil {
+			runnerLog.Error(err)
+		}
+		if err := ReloadConfig(configFile, vmiConfig, newGenConfig); err != nil {
+			runnerLog.Error(err)
+		}
+	})
+	exitCode = HandleShutdownReason(reason, exitCode, vmiConfig.ShutdownMaxWait)
+	if healthProbeServer != nil {
+		// The scheduler is about to be shut down:
+		healthProbeServer.SetLive(false)
 	}
 
 	if shutdownTimer != nil {
@@ -337,5 +1186,8 @@ func Run(genConfig any) int {
 		}()
 	}
 
-	return 0
+	if exitCode != 0 {
+		runnerLog.Infof("exit w/ code %d", exitCode)
+	}
+	return exitCode
 }
@@ -0,0 +1,557 @@
+// Tests for runner.go
+
+package vmi_internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"syscall"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// A generator which publishes the full set of metrics only for full cycles
+// and just one metric otherwise:
+type oneShotTestGenerator struct {
+	GeneratorBase
+	numMetrics int
+}
+
+func (gen *oneShotTestGenerator) TaskActivity() bool {
+	if !gen.Initialized {
+		gen.GenBaseInit()
+		gen.Initialized = true
+	}
+	buf := gen.MetricsQueue.GetBuf()
+	gen.GenBaseMetricsStart(buf, gen.TimeNowFunc())
+	numMetrics := 1
+	if gen.CycleNum == 0 {
+		numMetrics = gen.numMetrics
+	}
+	for i := 0; i < numMetrics; i++ {
+		fmt.Fprintf(buf, `one_shot_test{gen="%s",i="%d"} %d`, gen.Id, i, i)
+		buf.Write(gen.TsSuffixBuf.Bytes())
+	}
+	gen.MetricsQueue.QueueBuf(buf)
+	if gen.CycleNum++; gen.CycleNum >= gen.FullMetricsFactor {
+		gen.CycleNum = 0
+	}
+	return true
+}
+
+type failingSenderMock struct{}
+
+func (sender *failingSenderMock) SendBuffer(b []byte, timeout time.Duration, bufEncoding string) error {
+	return errors.New("send failed")
+}
+
+func testRunOneShot(t *testing.T, sender Sender, wantSuccess bool) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	poolCfg := DefaultCompressorPoolConfig()
+	poolCfg.NumCompressors = 2
+	pool, err := NewCompressorPool(poolCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Start(sender)
+	defer pool.Shutdown()
+
+	numGenerators, numMetrics, fullMetricsFactor := 3, 100, 5
+	taskList := make([]*Task, numGenerators)
+	for i := 0; i < numGenerators; i++ {
+		gen := &oneShotTestGenerator{
+			GeneratorBase: GeneratorBase{
+				Id:                fmt.Sprintf("gen%d", i),
+				Interval:          time.Second,
+				FullMetricsFactor: fullMetricsFactor,
+				// Not a full cycle, unless forced:
+				CycleNum:     1 + i%(fullMetricsFactor-1),
+				Instance:     "vmi_test",
+				Hostname:     "vmi-test",
+				MetricsQueue: pool,
+			},
+			numMetrics: numMetrics,
+		}
+		taskList[i] = NewMetricsGeneratorTask(gen)
+	}
+
+	if gotSuccess := RunOneShot(taskList, []*CompressorPool{pool}); gotSuccess != wantSuccess {
+		t.Fatalf("RunOneShot: want: %v, got: %v", wantSuccess, gotSuccess)
+	}
+
+	senderMock, ok := sender.(*SenderMock)
+	if !ok {
+		return
+	}
+	gotLineMap := senderMock.MapLines()
+	for i := 0; i < numGenerators; i++ {
+		for j := 0; j < numMetrics; j++ {
+			prefix := fmt.Sprintf(`one_shot_test{gen="gen%d",i="%d"} %d `, i, j, j)
+			found := false
+			for line, count := range gotLineMap {
+				if len(line) > len(prefix) && line[:len(prefix)] == prefix {
+					if count != 1 {
+						t.Fatalf("%q: count: want: 1, got: %d", line, count)
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				t.Fatalf("missing metric %q...", prefix)
+			}
+		}
+	}
+	if len(gotLineMap) != numGenerators*numMetrics {
+		t.Fatalf("metrics count: want: %d, got: %d", numGenerators*numMetrics, len(gotLineMap))
+	}
+}
+
+func TestRunOneShot(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		sender      Sender
+		wantSuccess bool
+	}{
+		{"success", NewSenderMock(), true},
+		{"send_error", &failingSenderMock{}, false},
+	} {
+		t.Run(
+			tc.name,
+			func(t *testing.T) { testRunOneShot(t, tc.sender, tc.wantSuccess) },
+		)
+	}
+}
+
+func TestStartupSplayDelay(t *testing.T) {
+	splay := 30 * time.Second
+	delays := make(map[time.Duration]bool)
+	for i := 0; i < 16; i++ {
+		hostname := fmt.Sprintf("vmi-test-%d", i)
+		delay := StartupSplayDelay(splay, "vmi_test", hostname)
+		if delay < 0 || delay >= splay {
+			t.Fatalf("%q: delay: want: [0, %s), got: %s", hostname, splay, delay)
+		}
+		// Deterministic:
+		if again := StartupSplayDelay(splay, "vmi_test", hostname); again != delay {
+			t.Fatalf("%q: delay not deterministic: %s != %s", hostname, delay, again)
+		}
+		delays[delay] = true
+	}
+	// Spread:
+	if len(delays) < 2 {
+		t.Fatalf("delays not spread: %v", delays)
+	}
+	if delay := StartupSplayDelay(0, "vmi_test", "vmi-test-0"); delay != 0 {
+		t.Fatalf("disabled splay: want: 0, got: %s", delay)
+	}
+}
+
+func TestStartSchedulerAfterSplay(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	getState := func(scheduler *Scheduler) SchedulerState {
+		scheduler.mu.Lock()
+		defer scheduler.mu.Unlock()
+		return scheduler.state
+	}
+
+	t.Run("delay", func(t *testing.T) {
+		scheduler, err := NewScheduler(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		delay := 200 * time.Millisecond
+		done := make(chan os.Signal, 1)
+		start := time.Now()
+		go func() { done <- StartSchedulerAfterSplay(scheduler, delay, make(chan os.Signal)) }()
+		time.Sleep(delay / 2)
+		if state := getState(scheduler); state != SchedulerStateCreated {
+			t.Fatalf("state before delay: want: %s, got: %s", SchedulerStateCreated, state)
+		}
+		if sig := <-done; sig != nil {
+			t.Fatalf("signal: want: nil, got: %s", sig)
+		}
+		if elapsed := time.Since(start); elapsed < delay {
+			t.Fatalf("scheduler started after %s, want >= %s", elapsed, delay)
+		}
+		if state := getState(scheduler); state != SchedulerStateRunning {
+			t.Fatalf("state after delay: want: %s, got: %s", SchedulerStateRunning, state)
+		}
+		scheduler.Shutdown()
+	})
+
+	t.Run("signal", func(t *testing.T) {
+		scheduler, err := NewScheduler(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigChan := make(chan os.Signal, 1)
+		sigChan <- syscall.SIGTERM
+		if sig := StartSchedulerAfterSplay(scheduler, time.Hour, sigChan); sig != syscall.SIGTERM {
+			t.Fatalf("signal: want: %s, got: %v", syscall.SIGTERM, sig)
+		}
+		if state := getState(scheduler); state != SchedulerStateCreated {
+			t.Fatalf("state: want: %s, got: %s", SchedulerStateCreated, state)
+		}
+	})
+}
+
+func TestWaitForShutdown(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	for _, tc := range []struct {
+		name        string
+		maxLifetime time.Duration
+		// Send the signal after this delay, 0 for no signal:
+		sigDelay     time.Duration
+		numReloads   int
+		wantExitCode int
+	}{
+		{"lifetime", 100 * time.Millisecond, 0, 0, PLANNED_RESTART_EXIT_CODE},
+		{"lifetime_after_reload", 100 * time.Millisecond, 0, 2, PLANNED_RESTART_EXIT_CODE},
+		{"signal", 0, 50 * time.Millisecond, 0, 0},
+		{"signal_before_lifetime", time.Hour, 50 * time.Millisecond, 1, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sigChan, reloadChan := make(chan os.Signal, 1), make(chan os.Signal, 1)
+			if tc.sigDelay > 0 {
+				timer := time.AfterFunc(tc.sigDelay, func() { sigChan <- syscall.SIGTERM })
+				defer timer.Stop()
+			}
+			numReloads := 0
+			go func() {
+				for i := 0; i < tc.numReloads; i++ {
+					reloadChan <- syscall.SIGHUP
+				}
+			}()
+			start := time.Now()
+			reason, exitCode := WaitForShutdown(sigChan, reloadChan, tc.maxLifetime, func() { numReloads++ })
+			elapsed := time.Since(start)
+			t.Logf("reason: %s, exit code: %d, elapsed: %s", reason, exitCode, elapsed)
+			if exitCode != tc.wantExitCode {
+				t.Fatalf("exit code: want: %d, got: %d", tc.wantExitCode, exitCode)
+			}
+			if exitCode == PLANNED_RESTART_EXIT_CODE && elapsed < tc.maxLifetime {
+				t.Fatalf("shutdown after %s, want >= %s", elapsed, tc.maxLifetime)
+			}
+			if numReloads != tc.numReloads {
+				t.Fatalf("reload count: want: %d, got: %d", tc.numReloads, numReloads)
+			}
+		})
+	}
+}
+
+func TestHandleShutdownReason(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedRunnerExitFn := runnerExitFn
+	defer func() { runnerExitFn = savedRunnerExitFn }()
+
+	for _, tc := range []struct {
+		name            string
+		maxLifetime     time.Duration
+		shutdownMaxWait time.Duration
+		wantExitCode    int
+		// The exit code passed to the exit function, -1 if not invoked:
+		wantForceExitCode int
+	}{
+		{"graceful_planned_restart", 50 * time.Millisecond, 5 * time.Second, PLANNED_RESTART_EXIT_CODE, -1},
+		{"graceful_signal", 0, 5 * time.Second, 0, -1},
+		{"force_planned_restart", 50 * time.Millisecond, 0, PLANNED_RESTART_EXIT_CODE, PLANNED_RESTART_EXIT_CODE},
+		{"force_signal", 0, 0, 1, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			gotForceExitCode := -1
+			runnerExitFn = func(code int) { gotForceExitCode = code }
+
+			sigChan, reloadChan := make(chan os.Signal, 1), make(chan os.Signal, 1)
+			if tc.maxLifetime == 0 {
+				sigChan <- syscall.SIGTERM
+			}
+			reason, exitCode := WaitForShutdown(sigChan, reloadChan, tc.maxLifetime, func() {})
+			exitCode = HandleShutdownReason(reason, exitCode, tc.shutdownMaxWait)
+			if exitCode != tc.wantExitCode {
+				t.Errorf("exit code: want: %d, got: %d", tc.wantExitCode, exitCode)
+			}
+			if gotForceExitCode != tc.wantForceExitCode {
+				t.Errorf("force exit code: want: %d, got: %d", tc.wantForceExitCode, gotForceExitCode)
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	initialInterval, newInterval, runTime := time.Hour, 100*time.Millisecond, 1*time.Second
+
+	savedScheduler := scheduler
+	defer func() { scheduler = savedScheduler }()
+	var err error
+	scheduler, err = NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	// Stand-in for the internal metrics task:
+	invokeCount := make(chan bool, 2*int(runTime/newInterval))
+	scheduler.AddNewTask(NewTask(INTERNAL_METRICS_ID, initialInterval, func() bool {
+		select {
+		case invokeCount <- true:
+		default:
+		}
+		return true
+	}))
+	<-invokeCount
+
+	configFile := path.Join(t.TempDir(), "vmi-config.yaml")
+	writeConfig := func(interval time.Duration) {
+		content := fmt.Sprintf("%s:\n  internal_metrics_config:\n    interval: %s\n", VMI_CONFIG_SECTION_NAME, interval)
+		if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vmiConfig := DefaultVmiConfig()
+	vmiConfig.InternalMetricsConfig.Interval = initialInterval
+
+	// Internal metrics cannot be disabled at runtime:
+	writeConfig(0)
+	if err := ReloadConfig(configFile, vmiConfig, nil); err == nil {
+		t.Fatal("ReloadConfig(interval=0): want error, got nil")
+	}
+	if vmiConfig.InternalMetricsConfig.Interval != initialInterval {
+		t.Fatalf("interval: want: %s, got: %s", initialInterval, vmiConfig.InternalMetricsConfig.Interval)
+	}
+
+	writeConfig(newInterval)
+	if err := ReloadConfig(configFile, vmiConfig, nil); err != nil {
+		t.Fatal(err)
+	}
+	if vmiConfig.InternalMetricsConfig.Interval != newInterval {
+		t.Fatalf("interval: want: %s, got: %s", newInterval, vmiConfig.InternalMetricsConfig.Interval)
+	}
+	time.Sleep(runTime)
+	// Allow for some slack at either end:
+	if wantMinCount := int(runTime/newInterval) - 2; len(invokeCount) < wantMinCount {
+		t.Fatalf("executions after reload: want >= %d, got: %d", wantMinCount, len(invokeCount))
+	}
+}
+
+type reloadTestGenConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+type reloadTestGenerator struct {
+	GeneratorBase
+	invokeCount chan bool
+}
+
+func (gen *reloadTestGenerator) TaskActivity() bool {
+	select {
+	case gen.invokeCount <- true:
+	default:
+	}
+	return true
+}
+
+func TestReloadConfigHotSwap(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	genId, initialInterval, newInterval, runTime := "reload_test", time.Hour, 100*time.Millisecond, 1*time.Second
+
+	savedScheduler, savedHttpEndpointPool, savedGenTaskIntervals := scheduler, httpEndpointPool, genTaskIntervals
+	taskBuilders.mu.Lock()
+	savedBuilders := taskBuilders.builders
+	taskBuilders.builders = []*taskBuilder{
+		{
+			build: func(config any) ([]MetricsGeneratorTask, error) {
+				cfg := config.(*reloadTestGenConfig)
+				return []MetricsGeneratorTask{
+					&reloadTestGenerator{GeneratorBase: GeneratorBase{Id: genId, Interval: cfg.Interval}},
+				}, nil
+			},
+		},
+	}
+	taskBuilders.mu.Unlock()
+	defer func() {
+		scheduler, httpEndpointPool, genTaskIntervals = savedScheduler, savedHttpEndpointPool, savedGenTaskIntervals
+		taskBuilders.mu.Lock()
+		taskBuilders.builders = savedBuilders
+		taskBuilders.mu.Unlock()
+	}()
+
+	var err error
+	scheduler, err = NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	vmiConfig := DefaultVmiConfig()
+	vmiConfig.HttpEndpointPoolConfig.Endpoints = []*HttpEndpointConfig{
+		{URL: "http://host1"},
+		{URL: "http://host2"},
+	}
+	httpEndpointPool, err = NewHttpEndpointPool(vmiConfig.HttpEndpointPoolConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpEndpointPool.Shutdown()
+
+	invokeCount := make(chan bool, 2*int(runTime/newInterval))
+	gen := &reloadTestGenerator{
+		GeneratorBase: GeneratorBase{Id: genId, Interval: initialInterval},
+		invokeCount:   invokeCount,
+	}
+	genTaskIntervals = map[string]time.Duration{genId: initialInterval}
+	scheduler.AddNewTask(NewMetricsGeneratorTask(gen))
+	<-invokeCount
+
+	configFile := path.Join(t.TempDir(), "vmi-config.yaml")
+	content := fmt.Sprintf(`%s:
+  http_endpoint_pool_config:
+    endpoints:
+      - url: http://host2
+      - url: http://host3
+    rate_limit_mbps: "8"
+  scheduler_config:
+    num_workers: 7
+%s:
+  interval: %s
+`,
+		VMI_CONFIG_SECTION_NAME, GENERATORS_SECTION_NAME, newInterval,
+	)
+	if err := os.WriteFile(configFile, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The settings which cannot be changed at runtime should be reported:
+	newVmiConfig, err := LoadConfig(configFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotKeys, err := changedConfigKeys(vmiConfig, newVmiConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(gotKeys, "scheduler_config.num_workers") {
+		t.Fatalf("changedConfigKeys: want: %q in %q", "scheduler_config.num_workers", gotKeys)
+	}
+
+	genConfig := &reloadTestGenConfig{Interval: initialInterval}
+	if err := ReloadConfig(configFile, vmiConfig, genConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoints:
+	wantUrls := []string{"http://host2", "http://host3"}
+	gotUrls := make([]string, 0)
+	httpEndpointPool.mu.Lock()
+	for ep := httpEndpointPool.healthy.head; ep != nil; ep = ep.next {
+		gotUrls = append(gotUrls, ep.url)
+	}
+	credit, _ := httpEndpointPool.credit.(*Credit)
+	httpEndpointPool.mu.Unlock()
+	if !slices.Equal(wantUrls, gotUrls) {
+		t.Fatalf("healthy endpoints: want: %q, got: %q", wantUrls, gotUrls)
+	}
+	if len(vmiConfig.HttpEndpointPoolConfig.Endpoints) != len(wantUrls) {
+		t.Fatalf("config endpoints: want: %d, got: %d", len(wantUrls), len(vmiConfig.HttpEndpointPoolConfig.Endpoints))
+	}
+
+	// Rate limit:
+	if credit == nil {
+		t.Fatal("rate limit: want: credit, got: nil")
+	}
+	if want, got := 1_000_000, credit.Snapshot().ReplenishValue; want != got {
+		t.Fatalf("rate limit replenish value: want: %d, got: %d", want, got)
+	}
+	if want, got := "8", vmiConfig.HttpEndpointPoolConfig.RateLimitMbps; want != got {
+		t.Fatalf("config rate_limit_mbps: want: %q, got: %q", want, got)
+	}
+
+	// Generator interval:
+	if got := genTaskIntervals[genId]; got != newInterval {
+		t.Fatalf("%s interval: want: %s, got: %s", genId, newInterval, got)
+	}
+	time.Sleep(runTime)
+	// Allow for some slack at either end:
+	if wantMinCount := int(runTime/newInterval) - 2; len(invokeCount) < wantMinCount {
+		t.Fatalf("executions after reload: want >= %d, got: %d", wantMinCount, len(invokeCount))
+	}
+
+	// Not changeable at runtime:
+	if vmiConfig.SchedulerConfig.NumWorkers == 7 {
+		t.Fatal("scheduler_config.num_workers: want: unchanged, got: 7")
+	}
+}
+
+func TestReloadGeneratorIntervalsBuilder(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	genId, initialInterval, newInterval := "reload_intervals_test", time.Hour, 2*time.Hour
+
+	savedScheduler, savedGenTaskIntervals := scheduler, genTaskIntervals
+	buildCount := 0
+	taskBuilders.mu.Lock()
+	savedBuilders := taskBuilders.builders
+	taskBuilders.builders = []*taskBuilder{
+		{
+			build: func(config any) ([]MetricsGeneratorTask, error) {
+				buildCount++
+				return nil, nil
+			},
+			intervals: func(config any) (map[string]time.Duration, error) {
+				return map[string]time.Duration{genId: config.(*reloadTestGenConfig).Interval}, nil
+			},
+		},
+	}
+	taskBuilders.mu.Unlock()
+	defer func() {
+		scheduler, genTaskIntervals = savedScheduler, savedGenTaskIntervals
+		taskBuilders.mu.Lock()
+		taskBuilders.builders = savedBuilders
+		taskBuilders.mu.Unlock()
+	}()
+
+	var err error
+	scheduler, err = NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+	scheduler.AddNewTask(NewMetricsGeneratorTask(
+		&reloadTestGenerator{GeneratorBase: GeneratorBase{Id: genId, Interval: initialInterval}},
+	))
+	genTaskIntervals = map[string]time.Duration{genId: initialInterval}
+
+	if err := reloadGeneratorIntervals(&reloadTestGenConfig{Interval: newInterval}); err != nil {
+		t.Fatal(err)
+	}
+	if got := genTaskIntervals[genId]; got != newInterval {
+		t.Fatalf("%s interval: want: %s, got: %s", genId, newInterval, got)
+	}
+	// The intervals builder should be used instead of the task builder:
+	if buildCount != 0 {
+		t.Fatalf("task builder invocations: want: 0, got: %d", buildCount)
+	}
+}
@@ -55,17 +55,122 @@ package vmi_internal
 // The TODO Queue feeds the Worker Pool; the number of workers in the pool
 // controls the level of concurrency of task execution and it allows for short
 // tasks to be executed without having to wait for a long one to complete.
+// The TODO Queue is ordered by task priority and FIFO within the same priority
+// (see Priorities below).
+//
+// A panic in the task action is recovered and counted (see
+// TASK_STATS_PANIC_COUNT), such that a buggy task doesn't take down the whole
+// process. The task is then either re-queued or disabled, based on
+// DisableTaskOnPanic; the worker survives either way. Should a worker exit
+// nonetheless, e.g. the action called runtime.Goexit, the task is dropped and
+// the worker is not replaced; the number of workers still alive is available
+// via SnapWorkerStats, such that the loss is visible.
+//
+//  Dependencies
+//  ============
+//
+// A task may declare that it depends on other tasks, by their IDs, e.g. a
+// summary generator aggregating the data produced by others. When a dependent
+// task is due, the Dispatcher checks whether each of its dependencies completed
+// at least one execution since the previous dispatch of the dependent task. If
+// not, the latter is put back into the Next Task Heap and rechecked after a
+// short delay. Disabled dependencies are ignored. This is a scoped ordering
+// mechanism, rather than a full DAG: there is no data passing, and cycles are
+// rejected upfront (see OrderTasksByDependencies).
+//
+//  Concurrency Classes
+//  ===================
+//
+// A task may belong to a concurrency class, e.g. the instances of the same
+// generator type contending for a shared resource, such as a disk subsystem.
+// At most N tasks of the class are executed at the same time, where N is the
+// class limit. When a task is due and the limit was reached, the Dispatcher
+// puts it back into the Next Task Heap and rechecks it after a short delay,
+// similar to the dependencies, such that the workers are not blocked.
+//
+//  Interval Change
+//  ===============
+//
+// The interval of a task may be changed at runtime via SetTaskInterval. The
+// change is passed to the Dispatcher, which is the sole owner of the heap. If
+// the task is in the heap, it is rescheduled right away based on the new
+// interval, otherwise (i.e. the task is in flight) the change is recorded and
+// applied when the task is re-added by the worker.
+//
+//  Task Removal
+//  ============
+//
+// A task may be removed at runtime via RemoveTask, e.g. when a config reload
+// drops the metrics generated by it. The task is marked as removed and the
+// removal is passed to the Dispatcher; if the task is in the heap, it is
+// removed right away, otherwise (i.e. the task is in flight) it is dropped
+// instead of being re-queued. Either way it will not be executed again.
+//
+//  Priorities
+//  ==========
+//
+// A task may have a priority, default 0, higher value meaning higher priority.
+// When more tasks are ready than workers, i.e. under worker contention, the
+// ready tasks wait in the TODO Queue and the workers pick them in priority
+// order, such that a high priority task is not delayed by a low priority bulk
+// task dispatched before it. The priority also breaks the ties in the Next
+// Task Heap, for tasks scheduled at the same time. When all the tasks have the
+// same priority, the order is FIFO.
+//
+//  Jitter
+//  ======
+//
+// By default the tasks are scheduled at multiples of their interval, therefore
+// all the tasks sharing an interval are executed at the same time, leading to
+// CPU and network spikes. The spikes may be smoothed out by a per task offset,
+// derived from the task ID as a deterministic pseudo-random value in the
+// [0, jitter * interval) range. Since the offset is stable across
+// reschedules, the intervals between executions remain regular.
+//
+//  Wall-Clock Alignment
+//  ====================
+//
+// The multiples of the interval are computed from the zero time, i.e. they are
+// UTC aligned. Optionally (align_to_wallclock) they are computed in the local
+// time zone instead and the new tasks are not executed right away, such that
+// all the executions, the first one included, land on clean local wall-clock
+// boundaries, e.g. at the top of the minute, which makes the timestamps
+// comparable across hosts. This applies to the intervals dividing evenly a
+// minute, an hour or a day, whichever is the smallest one larger than the
+// interval; a warning is logged for the others. The jitter is disabled, since
+// it would shift the executions off the boundaries.
+//
+//  Timeouts
+//  ========
+//
+// A task may have a context aware action, in which case it is invoked w/ a
+// context derived from the scheduler's one, such that it is cancelled at
+// shutdown, and bound by the task timeout, default the interval. The context
+// allows the action, e.g. a scraping or an exec generator, to cancel its own
+// I/O cleanly, such that a slow source doesn't overrun the interval. The
+// timeout is advisory, i.e. the scheduler doesn't interrupt the action, the
+// latter should honor the context.
 
 import (
 	"container/heap"
 	"context"
+	"fmt"
+	"hash/fnv"
+	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const (
-	SCHEDULER_CONFIG_NUM_WORKERS_DEFAULT = -1
-	SCHEDULER_MAX_NUM_WORKERS            = 8
+	SCHEDULER_CONFIG_NUM_WORKERS_DEFAULT           = -1
+	SCHEDULER_CONFIG_MAX_NUM_WORKERS_DEFAULT       = 0 // i.e. SCHEDULER_MAX_NUM_WORKERS
+	SCHEDULER_CONFIG_JITTER_DEFAULT                = 0.
+	SCHEDULER_CONFIG_DISABLE_TASK_ON_PANIC_DEFAULT = false
+	SCHEDULER_CONFIG_ALIGN_TO_WALLCLOCK_DEFAULT    = false
+	// The default ceiling for the number of workers, see MaxNumWorkers:
+	SCHEDULER_MAX_NUM_WORKERS = 8
 )
 
 const (
@@ -75,6 +180,12 @@ const (
 	SCHEDULER_GRANULARITY = 20 * time.Millisecond
 	// The minimum pause between 2 consecutive executions of the same task:
 	SCHEDULER_TASK_MIN_EXECUTION_PAUSE = 2 * SCHEDULER_GRANULARITY
+	// Time format for the task schedule summary:
+	SCHEDULER_TASK_SCHEDULE_TIME_FORMAT = "2006-01-02T15:04:05.000Z07:00"
+	// How often to recheck a task waiting for its dependencies:
+	SCHEDULER_DEPENDENCY_RECHECK_INTERVAL = SCHEDULER_GRANULARITY
+	// How often to recheck a task waiting for a slot in its concurrency class:
+	SCHEDULER_CONCURRENCY_RECHECK_INTERVAL = SCHEDULER_GRANULARITY
 )
 
 const (
@@ -100,6 +211,10 @@ const (
 	// Total runtime of the task, in microseconds.
 	TASK_STATS_TOTAL_RUNTIME
 
+	// How many times the task action panicked; such executions are counted as
+	// executed as well:
+	TASK_STATS_PANIC_COUNT
+
 	// Must be last:
 	TASK_STATS_UINT64_LEN
 )
@@ -118,6 +233,11 @@ type Task struct {
 	interval time.Duration
 	// Action:
 	action func() bool
+	// Optional context aware action, used instead of the action above, and
+	// its timeout, use 0 for the interval and < 0 for no timeout (see
+	// Timeouts):
+	ctxAction func(ctx context.Context) bool
+	timeout   time.Duration
 
 	// Whether it was re-added by a worker or not (i.e. the logical complement
 	// of new task). New tasks are scheduled for execution immediately whereas
@@ -126,21 +246,175 @@ type Task struct {
 	// When last executed, used to protect long running tasks from being
 	// scheduled back to back:
 	lastExecuted time.Time
+
+	// Informational, used for the task schedule summary: the full metrics
+	// factor and the initial cycle# (see "Partial V. Full Metrics" in
+	// README.md), 0 if not applicable:
+	fullMetricsFactor int
+	initialCycleNum   int
+
+	// Optional function forcing the next execution to generate the full set of
+	// metrics, used for one-shot mode:
+	forceFullMetrics func()
+
+	// The IDs of the tasks it depends on and their execution counts as of the
+	// previous dispatch of this task:
+	dependencies    []string
+	depExecutedRefs []uint64
+
+	// The concurrency class, if any, and the max number of tasks of the class
+	// which may execute at the same time:
+	concurrencyClass    string
+	maxClassConcurrency int
+
+	// The offset applied to the multiples of interval, see Jitter:
+	jitterOffset time.Duration
+	// Whether the multiples of interval are local wall-clock aligned, see
+	// Wall-Clock Alignment:
+	alignToWallClock bool
+
+	// The priority, higher value meaning higher priority, see Priorities:
+	priority int
+	// The sequence# assigned when placed into the TODO Queue, used for FIFO
+	// order within the same priority. N.B. Access via the TODO Queue only:
+	todoSeq uint64
+
+	// Whether the task was removed via RemoveTask. N.B. Access w/ the
+	// scheduler lock held:
+	removed bool
+}
+
+// A request to change the interval of a task, see SetTaskInterval:
+type taskIntervalChange struct {
+	id       string
+	interval time.Duration
 }
 
 type SchedulerStats map[string]*TaskStats
 
+// The TODO Queue, see Priorities. The tasks are held in a max heap by priority
+// and the ready channel has a token for each of them, such that the workers
+// may wait for a task and for shutdown at the same time. The channel capacity
+// bounds the queue length, same as for a channel based queue.
+type schedulerTodoQueue struct {
+	tasks []*Task
+	seq   uint64
+	ready chan struct{}
+	mu    *sync.Mutex
+}
+
+func newSchedulerTodoQueue(maxLen int) *schedulerTodoQueue {
+	return &schedulerTodoQueue{
+		tasks: make([]*Task, 0),
+		ready: make(chan struct{}, maxLen),
+		mu:    &sync.Mutex{},
+	}
+}
+
+// heap.Interface, N.B. it should be used w/ the lock held:
+func (q *schedulerTodoQueue) Len() int { return len(q.tasks) }
+
+func (q *schedulerTodoQueue) Less(i, j int) bool {
+	if q.tasks[i].priority != q.tasks[j].priority {
+		return q.tasks[i].priority > q.tasks[j].priority
+	}
+	return q.tasks[i].todoSeq < q.tasks[j].todoSeq
+}
+
+func (q *schedulerTodoQueue) Swap(i, j int) { q.tasks[i], q.tasks[j] = q.tasks[j], q.tasks[i] }
+
+func (q *schedulerTodoQueue) Push(x any) { q.tasks = append(q.tasks, x.(*Task)) }
+
+func (q *schedulerTodoQueue) Pop() any {
+	newLen := len(q.tasks) - 1
+	task := q.tasks[newLen]
+	q.tasks[newLen] = nil
+	q.tasks = q.tasks[:newLen]
+	return task
+}
+
+// Add a task, blocking if the queue is full, until there is room or the
+// context is cancelled. Return false in the latter case.
+func (q *schedulerTodoQueue) Put(ctx context.Context, task *Task) bool {
+	// Reserve the slot first, such that the queue length is bounded:
+	select {
+	case q.ready <- struct{}{}:
+	case <-ctx.Done():
+		return false
+	}
+	q.mu.Lock()
+	task.todoSeq = q.seq
+	q.seq++
+	heap.Push(q, task)
+	q.mu.Unlock()
+	return true
+}
+
+// Wait for a task, return nil if the context was cancelled:
+func (q *schedulerTodoQueue) Get(ctx context.Context) *Task {
+	select {
+	case <-q.ready:
+	case <-ctx.Done():
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return heap.Pop(q).(*Task)
+}
+
+// Worker busy time accounting, used for utilization metrics:
+type SchedulerWorkerStats struct {
+	// The number of workers and how many of them are actually alive:
+	NumWorkers    int
+	ActiveWorkers int
+	// Cumulative time spent by all workers executing tasks, including the
+	// elapsed part of the tasks in progress:
+	BusyTime time.Duration
+	// The number of tasks currently registered and how many of them are
+	// pending in the heap, i.e. excluding those in flight:
+	TaskCount int
+	HeapLen   int
+	// When the stats were snapped:
+	Ts time.Time
+}
+
 type Scheduler struct {
 	// Next Task Heap:
 	tasks []*Task
-	// The task and TDOO queues:
-	taskQ, todoQ chan *Task
-	// The number of workers:
-	numWorkers int
+	// The task and TODO queues:
+	taskQ chan *Task
+	todoQ *schedulerTodoQueue
+	// The interval change and removal queues:
+	intervalQ chan *taskIntervalChange
+	removeQ   chan *Task
+	// The registered tasks, by ID, used for validating the interval change and
+	// removal requests:
+	taskById map[string]*Task
+	// The limit and the number of tasks in flight, by concurrency class:
+	classMaxConcurrency map[string]int
+	classInflight       map[string]int
+	// The number of workers and how many of them are actually alive, the
+	// latter maintained by the worker goroutines themselves:
+	numWorkers    int
+	activeWorkers atomic.Int32
+	// The jitter, as a fraction of the interval, see Jitter:
+	jitter float64
+	// See DisableTaskOnPanic:
+	disableTaskOnPanic bool
+	// See AlignToWallClock:
+	alignToWallClock bool
 	// The state of the scheduler, whether it is running or not:
 	state SchedulerState
 	// Stats:
 	stats SchedulerStats
+	// Per worker busy time accounting: cumulative busy time for completed
+	// tasks and the start time of the task in progress (zero if idle):
+	workerBusyTime  []time.Duration
+	workerBusySince []time.Time
+	// The number of registered tasks and the heap length, the latter mirrored
+	// such that it can be snapped under the lock, since the heap proper is
+	// accessed by the dispatcher only:
+	numTasks, heapLen int
 	// General purpose lock for atomic operations: check task `scheduled` flag,
 	// scheduler's `state`, etc. The lock is shared because the contention is
 	// minimal, it doesn't make sense to use individual lock.
@@ -155,6 +429,18 @@ type SchedulerConfig struct {
 	// The number of workers. If set to -1 it will match the number of
 	// available cores:
 	NumWorkers int `yaml:"num_workers"`
+	// The ceiling for the number of workers, applied to NumWorkers above. If
+	// not set (<= 0) then SCHEDULER_MAX_NUM_WORKERS is used:
+	MaxNumWorkers int `yaml:"max_num_workers"`
+	// The jitter, as a fraction (0..1) of the interval, for spreading the
+	// executions of the tasks sharing the same interval. Use 0 to disable:
+	Jitter float64 `yaml:"jitter"`
+	// Whether a task whose action panicked should be disabled, i.e. not
+	// re-queued, rather than retried at its next interval:
+	DisableTaskOnPanic bool `yaml:"disable_task_on_panic"`
+	// Whether to align the executions to the local wall-clock boundaries, see
+	// Wall-Clock Alignment:
+	AlignToWallClock bool `yaml:"align_to_wallclock"`
 }
 
 type SchedulerState int
@@ -197,35 +483,65 @@ func NewScheduler(schedulerCfg *SchedulerConfig) (*Scheduler, error) {
 		schedulerCfg = DefaultSchedulerConfig()
 	}
 
+	maxNumWorkers := schedulerCfg.MaxNumWorkers
+	if maxNumWorkers <= 0 {
+		maxNumWorkers = SCHEDULER_MAX_NUM_WORKERS
+	}
+	if schedulerCfg.Jitter < 0 || schedulerCfg.Jitter > 1 {
+		return nil, fmt.Errorf("NewScheduler: invalid jitter %v, want: 0..1", schedulerCfg.Jitter)
+	}
+	jitter := schedulerCfg.Jitter
+	if schedulerCfg.AlignToWallClock && jitter > 0 {
+		schedulerLog.Warnf("jitter=%v ignored for align_to_wallclock", jitter)
+		jitter = 0
+	}
 	numWorkers := schedulerCfg.NumWorkers
 	if numWorkers <= 0 {
 		numWorkers = AvailableCPUCount
 	}
-	if numWorkers > SCHEDULER_MAX_NUM_WORKERS {
-		numWorkers = SCHEDULER_MAX_NUM_WORKERS
+	if numWorkers > maxNumWorkers {
+		numWorkers = maxNumWorkers
 	}
 
 	ctx, cancelFn := context.WithCancel(context.Background())
 	scheduler := &Scheduler{
-		tasks:      make([]*Task, 0),
-		taskQ:      make(chan *Task, SCHEDULER_TASK_Q_LEN),
-		todoQ:      make(chan *Task, SCHEDULER_TODO_Q_LEN),
-		numWorkers: numWorkers,
-		stats:      make(SchedulerStats),
-		state:      SchedulerStateCreated,
-		mu:         &sync.Mutex{},
-		ctx:        ctx,
-		cancelFn:   cancelFn,
-		wg:         &sync.WaitGroup{},
+		tasks:               make([]*Task, 0),
+		taskQ:               make(chan *Task, SCHEDULER_TASK_Q_LEN),
+		todoQ:               newSchedulerTodoQueue(SCHEDULER_TODO_Q_LEN),
+		intervalQ:           make(chan *taskIntervalChange, SCHEDULER_TASK_Q_LEN),
+		removeQ:             make(chan *Task, SCHEDULER_TASK_Q_LEN),
+		taskById:            make(map[string]*Task),
+		classMaxConcurrency: make(map[string]int),
+		classInflight:       make(map[string]int),
+		numWorkers:          numWorkers,
+		jitter:              jitter,
+		disableTaskOnPanic:  schedulerCfg.DisableTaskOnPanic,
+		alignToWallClock:    schedulerCfg.AlignToWallClock,
+		stats:               make(SchedulerStats),
+		workerBusyTime:      make([]time.Duration, numWorkers),
+		workerBusySince:     make([]time.Time, numWorkers),
+		state:               SchedulerStateCreated,
+		mu:                  &sync.Mutex{},
+		ctx:                 ctx,
+		cancelFn:            cancelFn,
+		wg:                  &sync.WaitGroup{},
 	}
+	schedulerLog.Infof("max_num_workers=%d", maxNumWorkers)
 	schedulerLog.Infof("num_workers=%d", scheduler.numWorkers)
+	schedulerLog.Infof("jitter=%v", scheduler.jitter)
+	schedulerLog.Infof("disable_task_on_panic=%v", scheduler.disableTaskOnPanic)
+	schedulerLog.Infof("align_to_wallclock=%v", scheduler.alignToWallClock)
 
 	return scheduler, nil
 }
 
 func DefaultSchedulerConfig() *SchedulerConfig {
 	return &SchedulerConfig{
-		NumWorkers: SCHEDULER_CONFIG_NUM_WORKERS_DEFAULT,
+		NumWorkers:         SCHEDULER_CONFIG_NUM_WORKERS_DEFAULT,
+		MaxNumWorkers:      SCHEDULER_CONFIG_MAX_NUM_WORKERS_DEFAULT,
+		Jitter:             SCHEDULER_CONFIG_JITTER_DEFAULT,
+		DisableTaskOnPanic: SCHEDULER_CONFIG_DISABLE_TASK_ON_PANIC_DEFAULT,
+		AlignToWallClock:   SCHEDULER_CONFIG_ALIGN_TO_WALLCLOCK_DEFAULT,
 	}
 }
 
@@ -237,7 +553,11 @@ func (scheduler *Scheduler) Len() int {
 }
 
 func (scheduler *Scheduler) Less(i, j int) bool {
-	return scheduler.tasks[i].nextTs.Before(scheduler.tasks[j].nextTs)
+	taskI, taskJ := scheduler.tasks[i], scheduler.tasks[j]
+	if taskI.nextTs.Equal(taskJ.nextTs) {
+		return taskI.priority > taskJ.priority
+	}
+	return taskI.nextTs.Before(taskJ.nextTs)
 }
 
 func (scheduler *Scheduler) Swap(i, j int) {
@@ -248,6 +568,9 @@ func (scheduler *Scheduler) Swap(i, j int) {
 func (scheduler *Scheduler) Push(x any) {
 	if task, ok := x.(*Task); ok {
 		scheduler.tasks = append(scheduler.tasks, task)
+		scheduler.mu.Lock()
+		scheduler.heapLen = len(scheduler.tasks)
+		scheduler.mu.Unlock()
 	}
 }
 
@@ -255,6 +578,9 @@ func (scheduler *Scheduler) Pop() any {
 	newLen := len(scheduler.tasks) - 1
 	task := scheduler.tasks[newLen]
 	scheduler.tasks = scheduler.tasks[:newLen]
+	scheduler.mu.Lock()
+	scheduler.heapLen = newLen
+	scheduler.mu.Unlock()
 	return task
 }
 
@@ -272,6 +598,49 @@ func CompliantTaskInterval(interval time.Duration) time.Duration {
 	return compliantInterval
 }
 
+// Set the jitter offset of a task based on its ID and interval:
+func (scheduler *Scheduler) setTaskJitterOffset(task *Task) {
+	task.jitterOffset = 0
+	maxOffset := time.Duration(scheduler.jitter * float64(task.interval))
+	if maxOffset <= 0 {
+		return
+	}
+	h := fnv.New64a()
+	h.Write([]byte(task.id))
+	task.jitterOffset = time.Duration(h.Sum64() % uint64(maxOffset))
+}
+
+// Return the nearest future multiple of interval, shifted by the jitter offset
+// or, if wall-clock aligned, by the local time zone offset:
+func (task *Task) alignedNextTs(timeNow time.Time) time.Time {
+	offset := task.jitterOffset
+	if task.alignToWallClock {
+		// Truncate operates on the absolute time, i.e. UTC, shift it such that
+		// the multiples are local:
+		_, zoneOffsetSec := timeNow.Zone()
+		offset = -time.Duration(zoneOffsetSec) * time.Second
+	}
+	return timeNow.Add(-offset).Truncate(task.interval).Add(task.interval + offset)
+}
+
+// Warn about the intervals which cannot be aligned to clean wall-clock
+// boundaries, i.e. they don't divide evenly the smallest of minute, hour or
+// day larger than them:
+func checkWallClockAlignment(id string, interval time.Duration) {
+	for _, boundary := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour} {
+		if interval <= boundary {
+			if boundary%interval != 0 {
+				schedulerLog.Warnf(
+					"task %s: interval=%s doesn't divide %s evenly, the executions will not land on clean wall-clock boundaries",
+					id, interval, boundary,
+				)
+			}
+			return
+		}
+	}
+	schedulerLog.Warnf("task %s: interval=%s longer than a day, it cannot be wall-clock aligned", id, interval)
+}
+
 func (scheduler *Scheduler) AddNewTask(task *Task) {
 	task.addedByWorker = false
 	compliantInterval := CompliantTaskInterval(task.interval)
@@ -281,10 +650,271 @@ func (scheduler *Scheduler) AddNewTask(task *Task) {
 		)
 		task.interval = compliantInterval
 	}
-	schedulerLog.Infof("add task %s: interval=%s", task.id, task.interval)
+	scheduler.setTaskJitterOffset(task)
+	task.alignToWallClock = scheduler.alignToWallClock
+	if task.alignToWallClock {
+		checkWallClockAlignment(task.id, task.interval)
+	}
+	if task.jitterOffset > 0 {
+		schedulerLog.Infof("add task %s: interval=%s, jitter offset=%s", task.id, task.interval, task.jitterOffset)
+	} else {
+		schedulerLog.Infof("add task %s: interval=%s", task.id, task.interval)
+	}
+	scheduler.mu.Lock()
+	scheduler.numTasks += 1
+	scheduler.taskById[task.id] = task
+	if class := task.concurrencyClass; class != "" {
+		// All the tasks of a class should declare the same limit; if not,
+		// the most restrictive one applies:
+		if maxConcurrency, ok := scheduler.classMaxConcurrency[class]; !ok || task.maxClassConcurrency < maxConcurrency {
+			if ok {
+				schedulerLog.Warnf(
+					"task %s: concurrency class %s: max concurrency: %d -> %d",
+					task.id, class, maxConcurrency, task.maxClassConcurrency,
+				)
+			}
+			scheduler.classMaxConcurrency[class] = task.maxClassConcurrency
+		}
+	}
+	scheduler.mu.Unlock()
 	scheduler.taskQ <- task
 }
 
+// Change the interval of a registered task. The new interval is made scheduler
+// compliant and it takes effect at the next scheduling of the task.
+func (scheduler *Scheduler) SetTaskInterval(id string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("task %q: invalid interval %s, want: > 0", id, interval)
+	}
+	scheduler.mu.Lock()
+	registered := scheduler.taskById[id] != nil
+	scheduler.mu.Unlock()
+	if !registered {
+		return fmt.Errorf("task %q: not registered", id)
+	}
+	compliantInterval := CompliantTaskInterval(interval)
+	if compliantInterval != interval {
+		schedulerLog.Warnf(
+			"task %s: interval: %s -> %s", id, interval, compliantInterval,
+		)
+	}
+	if scheduler.alignToWallClock {
+		checkWallClockAlignment(id, compliantInterval)
+	}
+	select {
+	case scheduler.intervalQ <- &taskIntervalChange{id, compliantInterval}:
+	case <-scheduler.ctx.Done():
+		return fmt.Errorf("task %q: scheduler stopped", id)
+	}
+	return nil
+}
+
+// Remove a registered task; it will not be executed again. The task is removed
+// from the heap right away, if pending, or it is dropped instead of being
+// re-queued, if in flight. Its stats are discarded.
+func (scheduler *Scheduler) RemoveTask(id string) error {
+	scheduler.mu.Lock()
+	task := scheduler.taskById[id]
+	if task != nil {
+		task.removed = true
+		scheduler.numTasks -= 1
+		delete(scheduler.taskById, id)
+		delete(scheduler.stats, id)
+	}
+	scheduler.mu.Unlock()
+	if task == nil {
+		return fmt.Errorf("task %q: not registered", id)
+	}
+	schedulerLog.Infof("remove task %s", id)
+	select {
+	case scheduler.removeQ <- task:
+	case <-scheduler.ctx.Done():
+		// The task will not be executed again anyway.
+	}
+	return nil
+}
+
+// Remove a task from the heap, if found there, and return its former index or
+// -1 otherwise. N.B. Call from the dispatcher only.
+func (scheduler *Scheduler) removeFromHeap(task *Task) int {
+	for i, heapTask := range scheduler.tasks {
+		if heapTask == task {
+			heap.Remove(scheduler, i)
+			return i
+		}
+	}
+	return -1
+}
+
+// Apply an interval change to a task, either in the heap or pending. Return
+// true if the task was found in the heap. N.B. Call from the dispatcher only.
+func (scheduler *Scheduler) applyIntervalChange(change *taskIntervalChange, timeNow time.Time) bool {
+	for i, task := range scheduler.tasks {
+		if task.id != change.id {
+			continue
+		}
+		schedulerLog.Infof("task %s: interval=%s -> %s", task.id, task.interval, change.interval)
+		task.interval = change.interval
+		scheduler.setTaskJitterOffset(task)
+		// Reschedule at the nearest future multiple of the new interval, if
+		// sooner than the current scheduling time, observing the minimum pause
+		// since the last execution:
+		nextTs := task.alignedNextTs(timeNow)
+		if minNextTs := task.lastExecuted.Add(SCHEDULER_TASK_MIN_EXECUTION_PAUSE); nextTs.Before(minNextTs) {
+			nextTs = minNextTs
+		}
+		if nextTs.Before(task.nextTs) {
+			task.nextTs = nextTs
+			heap.Fix(scheduler, i)
+		}
+		return true
+	}
+	return false
+}
+
+// Set the informational full metrics cycle parameters for the task:
+func (task *Task) SetFullMetricsCycle(fullMetricsFactor, initialCycleNum int) {
+	task.fullMetricsFactor = fullMetricsFactor
+	task.initialCycleNum = initialCycleNum
+}
+
+// Set the function forcing full metrics for the next execution:
+func (task *Task) SetForceFullMetrics(forceFullMetrics func()) {
+	task.forceFullMetrics = forceFullMetrics
+}
+
+// Set the concurrency class of the task and the max number of tasks of the
+// class which may execute at the same time. N.B. a limit < 1 is adjusted to 1:
+func (task *Task) SetConcurrencyClass(class string, maxConcurrency int) {
+	task.concurrencyClass = class
+	task.maxClassConcurrency = max(maxConcurrency, 1)
+}
+
+// Set the priority of the task, higher value meaning higher priority, see
+// Priorities:
+func (task *Task) SetPriority(priority int) {
+	task.priority = priority
+}
+
+// Set the context aware action of the task and its timeout, use 0 for the
+// interval and < 0 for no timeout, see Timeouts:
+func (task *Task) SetContextAction(ctxAction func(ctx context.Context) bool, timeout time.Duration) {
+	task.ctxAction = ctxAction
+	task.timeout = timeout
+}
+
+// Run the task action, the context aware one, if set, bound by the timeout:
+func (task *Task) runAction(parentCtx context.Context) bool {
+	if task.ctxAction == nil {
+		return task.action()
+	}
+	timeout := task.timeout
+	if timeout == 0 {
+		timeout = task.interval
+	}
+	if timeout <= 0 {
+		return task.ctxAction(parentCtx)
+	}
+	ctx, cancelFn := context.WithTimeout(parentCtx, timeout)
+	defer cancelFn()
+	return task.ctxAction(ctx)
+}
+
+// Set the IDs of the tasks this task depends on:
+func (task *Task) SetDependencies(dependencies ...string) {
+	task.dependencies = dependencies
+	task.depExecutedRefs = make([]uint64, len(dependencies))
+}
+
+// Order the tasks such that each task follows its dependencies, while
+// preserving the original order otherwise. Return an error for unknown
+// dependencies or for dependency cycles.
+func OrderTasksByDependencies(taskList []*Task) ([]*Task, error) {
+	taskById := make(map[string]*Task)
+	for _, task := range taskList {
+		taskById[task.id] = task
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int)
+	ordered := make([]*Task, 0, len(taskList))
+	var visit func(task *Task, path []string) error
+	visit = func(task *Task, path []string) error {
+		switch state[task.id] {
+		case visited:
+			return nil
+		case visiting:
+			return fmt.Errorf("task %q: dependency cycle: %s", task.id, strings.Join(append(path, task.id), " -> "))
+		}
+		state[task.id] = visiting
+		for _, depId := range task.dependencies {
+			dep := taskById[depId]
+			if dep == nil {
+				return fmt.Errorf("task %q: unknown dependency %q", task.id, depId)
+			}
+			if err := visit(dep, append(path, task.id)); err != nil {
+				return err
+			}
+		}
+		state[task.id] = visited
+		ordered = append(ordered, task)
+		return nil
+	}
+	for _, task := range taskList {
+		if err := visit(task, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Return the expected time of the 1st execution for a new task added at
+// timeNow, mirroring the logic of the dispatcher loop:
+func (task *Task) expectedFirstRunTs(timeNow time.Time) time.Time {
+	nextTs := task.alignedNextTs(timeNow)
+	if task.alignToWallClock || nextTs.Sub(timeNow) < SCHEDULER_TASK_MIN_EXECUTION_PAUSE {
+		return nextTs
+	}
+	return timeNow
+}
+
+// Return the expected time of the 1st full metrics cycle, i.e. when the
+// cycle# will be 0, for a new task added at timeNow:
+func (task *Task) expectedFirstFullCycleTs(timeNow time.Time) time.Time {
+	firstRunTs := task.expectedFirstRunTs(timeNow)
+	if task.fullMetricsFactor <= 1 {
+		return firstRunTs
+	}
+	numRuns := (task.fullMetricsFactor - task.initialCycleNum%task.fullMetricsFactor) % task.fullMetricsFactor
+	return firstRunTs.Add(time.Duration(numRuns) * task.interval)
+}
+
+// Build a consolidated view of the schedule for a list of new tasks added at
+// timeNow:
+func FormatTaskSchedule(taskList []*Task, timeNow time.Time) string {
+	entries := make([]string, len(taskList))
+	for i, task := range taskList {
+		entries[i] = fmt.Sprintf(
+			"id=%s, interval=%s, full_metrics_factor=%d, initial_cycle_num=%d, first_run=%s, first_full_cycle=%s",
+			task.id,
+			task.interval,
+			task.fullMetricsFactor,
+			task.initialCycleNum,
+			task.expectedFirstRunTs(timeNow).Format(SCHEDULER_TASK_SCHEDULE_TIME_FORMAT),
+			task.expectedFirstFullCycleTs(timeNow).Format(SCHEDULER_TASK_SCHEDULE_TIME_FORMAT),
+		)
+	}
+	return fmt.Sprintf("task schedule: %d task(s): [%s]", len(taskList), strings.Join(entries, "], ["))
+}
+
+// Log the consolidated schedule for a list of new tasks added at timeNow:
+func LogTaskSchedule(taskList []*Task, timeNow time.Time) {
+	schedulerLog.Info(FormatTaskSchedule(taskList, timeNow))
+}
+
 func (scheduler *Scheduler) dispatcherLoop() {
 	schedulerLog.Info("start dispatcher loop")
 
@@ -307,9 +937,11 @@ func (scheduler *Scheduler) dispatcherLoop() {
 		nextSchedTs time.Time
 	)
 
-	taskQ, todoQ := scheduler.taskQ, scheduler.todoQ
+	taskQ, todoQ, intervalQ, removeQ := scheduler.taskQ, scheduler.todoQ, scheduler.intervalQ, scheduler.removeQ
 	stats, mu := scheduler.stats, scheduler.mu
 	ctx := scheduler.ctx
+	// Interval changes for the tasks in flight, to be applied when re-added:
+	pendingIntervals := make(map[string]time.Duration)
 	for {
 		if !activeTimer && len(scheduler.tasks) > 0 {
 			nextSchedTs = scheduler.tasks[0].nextTs
@@ -320,11 +952,50 @@ func (scheduler *Scheduler) dispatcherLoop() {
 		select {
 		case <-ctx.Done():
 			return
+		case change := <-intervalQ:
+			if scheduler.applyIntervalChange(change, time.Now()) {
+				// The heap may have a new top, rearm the timer:
+				if activeTimer {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					activeTimer = false
+				}
+			} else {
+				pendingIntervals[change.id] = change.interval
+			}
+			task = nil
+		case removedTask := <-removeQ:
+			delete(pendingIntervals, removedTask.id)
+			if scheduler.removeFromHeap(removedTask) == 0 {
+				// The heap has a new top, rearm the timer:
+				if activeTimer {
+					if !timer.Stop() {
+						<-timer.C
+					}
+					activeTimer = false
+				}
+			}
+			task = nil
 		case task = <-taskQ:
+			mu.Lock()
+			removed := task.removed
+			mu.Unlock()
+			if removed {
+				// Removed while in flight, drop it:
+				task = nil
+				break
+			}
+			if interval, ok := pendingIntervals[task.id]; ok {
+				schedulerLog.Infof("task %s: interval=%s -> %s", task.id, task.interval, interval)
+				task.interval = interval
+				scheduler.setTaskJitterOffset(task)
+				delete(pendingIntervals, task.id)
+			}
 			// The desired next scheduling time is the nearest future multiple
-			// of interval:
+			// of interval, shifted by the jitter offset:
 			timeNow := time.Now()
-			nextTs := timeNow.Truncate(task.interval).Add(task.interval)
+			nextTs := task.alignedNextTs(timeNow)
 
 			if task.addedByWorker {
 				// Hack needed when running on MacOS Docker (at the very least).
@@ -346,11 +1017,15 @@ func (scheduler *Scheduler) dispatcherLoop() {
 				}
 
 				mu.Lock()
-				if nextTsTweaked {
-					stats[task.id].Uint64Stats[TASK_STATS_NEXT_TS_HACK_COUNT] += 1
-				}
-				if taskDelayed {
-					stats[task.id].Uint64Stats[TASK_STATS_DELAYED_COUNT] += 1
+				// N.B. the stats are discarded if the task was removed in the
+				// meantime:
+				if taskStats := stats[task.id]; taskStats != nil {
+					if nextTsTweaked {
+						taskStats.Uint64Stats[TASK_STATS_NEXT_TS_HACK_COUNT] += 1
+					}
+					if taskDelayed {
+						taskStats.Uint64Stats[TASK_STATS_DELAYED_COUNT] += 1
+					}
 				}
 				mu.Unlock()
 
@@ -368,10 +1043,12 @@ func (scheduler *Scheduler) dispatcherLoop() {
 
 				// Do not execute right away, wait for scheduling:
 				task = nil
-			} else if nextTs.Sub(timeNow) < SCHEDULER_TASK_MIN_EXECUTION_PAUSE {
-				// New task with a next scheduling time that falls too close
-				// into the near future. Do not schedule right way, rather wait
-				// for the next, regular scheduling:
+			} else if task.alignToWallClock || nextTs.Sub(timeNow) < SCHEDULER_TASK_MIN_EXECUTION_PAUSE {
+				// New task which is either wall-clock aligned, such that even
+				// its first execution should land on a boundary, or has a next
+				// scheduling time that falls too close into the near future.
+				// Do not schedule right way, rather wait for the next, regular
+				// scheduling:
 				task.nextTs = nextTs
 				heap.Push(scheduler, task)
 
@@ -403,22 +1080,124 @@ func (scheduler *Scheduler) dispatcherLoop() {
 			task = heap.Pop(scheduler).(*Task)
 		}
 
+		if task != nil && task.concurrencyClass != "" {
+			mu.Lock()
+			available := scheduler.classSlotAvailable(task)
+			mu.Unlock()
+			if !available {
+				// Recheck later, same as for dependencies below:
+				if RootLogger.IsEnabledForDebug {
+					schedulerLog.Debugf("task %s: waiting for concurrency class %s", task.id, task.concurrencyClass)
+				}
+				task.nextTs = time.Now().Add(SCHEDULER_CONCURRENCY_RECHECK_INTERVAL)
+				heap.Push(scheduler, task)
+				task = nil
+			}
+		}
+
+		if task != nil && len(task.dependencies) > 0 {
+			mu.Lock()
+			ready := scheduler.dependenciesReady(task)
+			mu.Unlock()
+			if !ready {
+				// Recheck later; N.B. the timer is inactive at this point, so
+				// it will be rearmed at the top of the loop:
+				if RootLogger.IsEnabledForDebug {
+					schedulerLog.Debugf("task %s: waiting for dependencies %v", task.id, task.dependencies)
+				}
+				task.nextTs = time.Now().Add(SCHEDULER_DEPENDENCY_RECHECK_INTERVAL)
+				heap.Push(scheduler, task)
+				task = nil
+			}
+		}
+
 		if task != nil {
 			mu.Lock()
+			if task.removed {
+				// Removed after it was popped from the heap, but before the
+				// removal was processed:
+				mu.Unlock()
+				continue
+			}
 			if stats[task.id] == nil {
 				stats[task.id] = NewTaskStats()
 			}
 			stats[task.id].Uint64Stats[TASK_STATS_SCHEDULED_COUNT] += 1
+			if task.concurrencyClass != "" {
+				// N.B. the slot is still available, since only the dispatcher
+				// takes slots:
+				scheduler.classInflight[task.concurrencyClass] += 1
+			}
 			mu.Unlock()
-			todoQ <- task
+			if !todoQ.Put(ctx, task) {
+				return
+			}
 		}
 	}
 }
 
+// Check whether each dependency of the task completed at least one execution
+// since the previous dispatch of the task; disabled or removed dependencies are
+// ignored. If ready, update the reference execution counts. N.B. Call w/ the
+// lock held.
+func (scheduler *Scheduler) dependenciesReady(task *Task) bool {
+	for i, depId := range task.dependencies {
+		depStats := scheduler.stats[depId]
+		if depStats == nil {
+			if scheduler.taskById[depId] == nil {
+				// Removed:
+				continue
+			}
+			return false
+		}
+		if !depStats.Disabled && depStats.Uint64Stats[TASK_STATS_EXECUTED_COUNT] <= task.depExecutedRefs[i] {
+			return false
+		}
+	}
+	for i, depId := range task.dependencies {
+		if depStats := scheduler.stats[depId]; depStats != nil {
+			task.depExecutedRefs[i] = depStats.Uint64Stats[TASK_STATS_EXECUTED_COUNT]
+		}
+	}
+	return true
+}
+
+// Check whether the concurrency class of the task has a slot available. N.B.
+// Call w/ the lock held.
+func (scheduler *Scheduler) classSlotAvailable(task *Task) bool {
+	return scheduler.classInflight[task.concurrencyClass] < scheduler.classMaxConcurrency[task.concurrencyClass]
+}
+
 func (scheduler *Scheduler) workerLoop(workerId int) {
 	schedulerLog.Infof("start worker# %d", workerId)
+	scheduler.activeWorkers.Add(1)
+
+	// The task in progress, if any, needed for cleanup should the worker exit
+	// abnormally:
+	var task *Task
 
 	defer func() {
+		if r := recover(); r != nil {
+			schedulerLog.Errorf("worker# %d: panic: %v\n%s", workerId, r, debug.Stack())
+		}
+		if task != nil {
+			// Abnormal exit while executing the task, e.g. the action called
+			// runtime.Goexit. The task is dropped, as if its action returned
+			// false, unless already removed:
+			schedulerLog.Errorf("worker# %d: task %s: worker exited during execution", workerId, task.id)
+			scheduler.mu.Lock()
+			if !task.removed {
+				scheduler.stats[task.id].Disabled = true
+				scheduler.numTasks -= 1
+				delete(scheduler.taskById, task.id)
+			}
+			if task.concurrencyClass != "" {
+				scheduler.classInflight[task.concurrencyClass] -= 1
+			}
+			scheduler.workerBusySince[workerId] = time.Time{}
+			scheduler.mu.Unlock()
+		}
+		scheduler.activeWorkers.Add(-1)
 		schedulerLog.Infof("worker# %d stopped", workerId)
 		scheduler.wg.Done()
 	}()
@@ -427,35 +1206,87 @@ func (scheduler *Scheduler) workerLoop(workerId int) {
 	stats, mu := scheduler.stats, scheduler.mu
 	ctx := scheduler.ctx
 	for {
-		select {
-		case <-ctx.Done():
+		if task = todoQ.Get(ctx); task == nil {
 			return
-		case task := <-todoQ:
-			startTs := time.Now()
-			reQueue := true
-			if task.action != nil {
-				reQueue = task.action()
+		}
+		startTs := time.Now()
+		mu.Lock()
+		removed := task.removed
+		if removed {
+			// Removed after it was dispatched, do not execute:
+			if task.concurrencyClass != "" {
+				scheduler.classInflight[task.concurrencyClass] -= 1
 			}
-			endTs := time.Now()
-			task.lastExecuted = endTs
-			runtime := endTs.Sub(startTs)
-			mu.Lock()
+		} else {
+			scheduler.workerBusySince[workerId] = startTs
+		}
+		mu.Unlock()
+		if removed {
+			task = nil
+			continue
+		}
+		reQueue, panicked := true, false
+		if task.action != nil || task.ctxAction != nil {
+			reQueue, panicked = scheduler.runTaskAction(workerId, task)
+		}
+		endTs := time.Now()
+		task.lastExecuted = endTs
+		runtime := endTs.Sub(startTs)
+		mu.Lock()
+		if task.concurrencyClass != "" {
+			scheduler.classInflight[task.concurrencyClass] -= 1
+		}
+		if task.removed {
+			// Removed during the execution, the stats were discarded and
+			// the task should not be re-queued:
+			reQueue = false
+		} else {
 			taskStats := stats[task.id]
 			if runtime >= task.interval {
 				taskStats.Uint64Stats[TASK_STATS_OVERRUN_COUNT] += 1
 			}
 			taskStats.Uint64Stats[TASK_STATS_EXECUTED_COUNT] += 1
+			if panicked {
+				taskStats.Uint64Stats[TASK_STATS_PANIC_COUNT] += 1
+			}
 			taskStats.Disabled = !reQueue
-			taskStats.Uint64Stats[TASK_STATS_TOTAL_RUNTIME] += uint64(runtime.Microseconds())
-			mu.Unlock()
-			if reQueue {
-				task.addedByWorker = true
-				taskQ <- task
+			if !reQueue {
+				scheduler.numTasks -= 1
+				delete(scheduler.taskById, task.id)
 			}
+			taskStats.Uint64Stats[TASK_STATS_TOTAL_RUNTIME] += uint64(runtime.Microseconds())
+		}
+		scheduler.workerBusyTime[workerId] += runtime
+		scheduler.workerBusySince[workerId] = time.Time{}
+		mu.Unlock()
+		if reQueue {
+			task.addedByWorker = true
+			taskQ <- task
 		}
+		task = nil
 	}
 }
 
+// Execute the task action, recovering from panics such that a buggy task
+// doesn't take down the whole process. A panic is treated as a failed run, the
+// task is re-queued unless disableTaskOnPanic is set. Return the re-queue flag
+// and whether the action panicked.
+func (scheduler *Scheduler) runTaskAction(workerId int, task *Task) (reQueue bool, panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			schedulerLog.Errorf(
+				"worker# %d: task %s: action panic: %v\n%s",
+				workerId, task.id, r, debug.Stack(),
+			)
+			reQueue, panicked = !scheduler.disableTaskOnPanic, true
+			if !reQueue {
+				schedulerLog.Warnf("worker# %d: task %s: disabled after panic", workerId, task.id)
+			}
+		}
+	}()
+	return task.runAction(scheduler.ctx), false
+}
+
 // Snap current stats.
 func (scheduler *Scheduler) SnapStats(to SchedulerStats) SchedulerStats {
 	if scheduler.stats == nil {
@@ -466,6 +1297,11 @@ func (scheduler *Scheduler) SnapStats(to SchedulerStats) SchedulerStats {
 	}
 	scheduler.mu.Lock()
 	defer scheduler.mu.Unlock()
+	for taskId := range to {
+		if _, ok := scheduler.stats[taskId]; !ok {
+			delete(to, taskId)
+		}
+	}
 	for taskId, taskStats := range scheduler.stats {
 		toTaskStats := to[taskId]
 		if toTaskStats == nil {
@@ -473,7 +1309,32 @@ func (scheduler *Scheduler) SnapStats(to SchedulerStats) SchedulerStats {
 			to[taskId] = toTaskStats
 		}
 		copy(toTaskStats.Uint64Stats, taskStats.Uint64Stats)
+		toTaskStats.Disabled = taskStats.Disabled
+	}
+	return to
+}
+
+// Snap worker busy time stats.
+func (scheduler *Scheduler) SnapWorkerStats(to *SchedulerWorkerStats) *SchedulerWorkerStats {
+	if to == nil {
+		to = &SchedulerWorkerStats{}
+	}
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+	timeNow := time.Now()
+	to.NumWorkers = scheduler.numWorkers
+	to.ActiveWorkers = int(scheduler.activeWorkers.Load())
+	to.BusyTime = 0
+	for workerId, busyTime := range scheduler.workerBusyTime {
+		to.BusyTime += busyTime
+		// Account for the task in progress, if any, such that long running
+		// tasks are reflected in the interval they are running in:
+		if busySince := scheduler.workerBusySince[workerId]; !busySince.IsZero() {
+			to.BusyTime += timeNow.Sub(busySince)
+		}
 	}
+	to.TaskCount, to.HeapLen = scheduler.numTasks, scheduler.heapLen
+	to.Ts = timeNow
 	return to
 }
 
@@ -19,8 +19,18 @@ type SchedulerInternalMetrics struct {
 	stats [2]SchedulerStats
 	// The current index:
 	currIndex int
+	// Same for worker stats:
+	workerStats [2]*SchedulerWorkerStats
 	// Cache the full metrics for each taskId and stats index:
 	uint64DeltaMetricsCache map[string]taskStatsIndexMetricMap
+	// Cache the worker utilization metrics:
+	workerUtilizationMetric, busyWorkersAvgMetric []byte
+	// Cache the task count metrics:
+	taskCountMetric, heapLenMetric []byte
+	// Cache the active workers metric:
+	activeWorkersMetric []byte
+	// Stale cache eviction:
+	cacheAging *metricsCacheAging
 }
 
 // The following stats will be used to generate deltas:
@@ -31,25 +41,28 @@ var taskStatsUint64DeltaMetricsNameMap = map[int]string{
 	TASK_STATS_EXECUTED_COUNT:     TASK_STATS_EXECUTED_DELTA_METRIC,
 	TASK_STATS_NEXT_TS_HACK_COUNT: TASK_STATS_NEXT_TS_HACK_DELTA_METRIC,
 	TASK_STATS_TOTAL_RUNTIME:      TASK_STATS_AVG_RUNTIME_METRIC,
+	TASK_STATS_PANIC_COUNT:        TASK_STATS_PANIC_DELTA_METRIC,
 }
 
 func NewSchedulerInternalMetrics(internalMetrics *InternalMetrics) *SchedulerInternalMetrics {
 	return &SchedulerInternalMetrics{
 		internalMetrics:         internalMetrics,
 		uint64DeltaMetricsCache: make(map[string]taskStatsIndexMetricMap),
+		cacheAging:              newMetricsCacheAging(internalMetrics.staleCacheEvictIntervals),
 	}
 }
 
 func (sim *SchedulerInternalMetrics) updateMetricsCache(taskId string) {
 	instance, hostname := sim.internalMetrics.Instance, sim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := sim.internalMetrics.InstanceLabelName, sim.internalMetrics.HostnameLabelName
 
 	indexMetricMap := make(taskStatsIndexMetricMap)
 	for index, name := range taskStatsUint64DeltaMetricsNameMap {
 		metric := fmt.Sprintf(
 			`%s{%s="%s",%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
-			name,
-			INSTANCE_LABEL_NAME, instance,
-			HOSTNAME_LABEL_NAME, hostname,
+			RenameMetric(name),
+			instanceLabel, instance,
+			hostnameLabel, hostname,
 			TASK_STATS_TASK_ID_LABEL_NAME, taskId,
 		)
 		indexMetricMap[index] = []byte(metric)
@@ -57,6 +70,119 @@ func (sim *SchedulerInternalMetrics) updateMetricsCache(taskId string) {
 	sim.uint64DeltaMetricsCache[taskId] = indexMetricMap
 }
 
+func (sim *SchedulerInternalMetrics) updateWorkerMetricsCache() {
+	instance, hostname := sim.internalMetrics.Instance, sim.internalMetrics.Hostname
+	instanceLabel, hostnameLabel := sim.internalMetrics.InstanceLabelName, sim.internalMetrics.HostnameLabelName
+
+	sim.workerUtilizationMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(SCHEDULER_WORKER_UTILIZATION_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	sim.busyWorkersAvgMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(SCHEDULER_BUSY_WORKERS_AVG_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	sim.taskCountMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(SCHEDULER_TASK_COUNT_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	sim.heapLenMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(SCHEDULER_HEAP_LEN_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+	sim.activeWorkersMetric = []byte(fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} `, // N.B. include the whitespace separating the metric from value
+		RenameMetric(SCHEDULER_ACTIVE_WORKERS_METRIC),
+		instanceLabel, instance,
+		hostnameLabel, hostname,
+	))
+}
+
+// Generate the task count metrics; they are current values, so they are
+// available from the 1st pass, but only if there are registered tasks:
+func (sim *SchedulerInternalMetrics) generateTaskCountMetrics(buf *bytes.Buffer, tsSuffix []byte) (int, *bytes.Buffer) {
+	currStats := sim.workerStats[sim.currIndex]
+	if currStats == nil || currStats.TaskCount <= 0 {
+		return 0, buf
+	}
+	if buf == nil {
+		buf = sim.internalMetrics.MetricsQueue.GetBuf()
+	}
+	if sim.taskCountMetric == nil {
+		sim.updateWorkerMetricsCache()
+	}
+	buf.Write(sim.taskCountMetric)
+	buf.WriteString(strconv.Itoa(currStats.TaskCount))
+	buf.Write(tsSuffix)
+	buf.Write(sim.heapLenMetric)
+	buf.WriteString(strconv.Itoa(currStats.HeapLen))
+	buf.Write(tsSuffix)
+	return 2, buf
+}
+
+// Generate the active workers metric; it is a current value, so it is
+// available from the 1st pass:
+func (sim *SchedulerInternalMetrics) generateActiveWorkersMetric(buf *bytes.Buffer, tsSuffix []byte) (int, *bytes.Buffer) {
+	currStats := sim.workerStats[sim.currIndex]
+	if currStats == nil || currStats.NumWorkers <= 0 {
+		return 0, buf
+	}
+	if buf == nil {
+		buf = sim.internalMetrics.MetricsQueue.GetBuf()
+	}
+	if sim.activeWorkersMetric == nil {
+		sim.updateWorkerMetricsCache()
+	}
+	buf.Write(sim.activeWorkersMetric)
+	buf.WriteString(strconv.Itoa(currStats.ActiveWorkers))
+	buf.Write(tsSuffix)
+	return 1, buf
+}
+
+// Generate the worker utilization metrics; they require 2 snapshots so they
+// are not available for the 1st pass:
+func (sim *SchedulerInternalMetrics) generateWorkerMetrics(buf *bytes.Buffer, tsSuffix []byte) (int, *bytes.Buffer) {
+	currStats, prevStats := sim.workerStats[sim.currIndex], sim.workerStats[1-sim.currIndex]
+	if currStats == nil || prevStats == nil || currStats.NumWorkers <= 0 {
+		return 0, buf
+	}
+	wallTime := currStats.Ts.Sub(prevStats.Ts)
+	if wallTime <= 0 {
+		return 0, buf
+	}
+	busyTime := currStats.BusyTime - prevStats.BusyTime
+	if busyTime < 0 {
+		busyTime = 0
+	}
+	busyWorkersAvg := float64(busyTime) / float64(wallTime)
+	utilization := busyWorkersAvg / float64(currStats.NumWorkers)
+	if utilization > 1 {
+		utilization = 1
+	}
+
+	if buf == nil {
+		buf = sim.internalMetrics.MetricsQueue.GetBuf()
+	}
+	if sim.workerUtilizationMetric == nil {
+		sim.updateWorkerMetricsCache()
+	}
+	buf.Write(sim.workerUtilizationMetric)
+	WriteFloatValue(buf, utilization, SCHEDULER_WORKER_UTILIZATION_METRIC_PRECISION)
+	buf.Write(tsSuffix)
+	buf.Write(sim.busyWorkersAvgMetric)
+	WriteFloatValue(buf, busyWorkersAvg, SCHEDULER_WORKER_UTILIZATION_METRIC_PRECISION)
+	buf.Write(tsSuffix)
+	return 2, buf
+}
+
 func (sim *SchedulerInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix []byte) (int, int, *bytes.Buffer) {
 	mq := sim.internalMetrics.MetricsQueue
 	metricsCount, partialByteCount, bufMaxSize := 0, 0, mq.GetTargetSize()
@@ -82,7 +208,7 @@ func (sim *SchedulerInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix
 		for index, metric := range uint64IndexMetricMap {
 			val := currTaskStats.Uint64Stats[index]
 			if prevTaskStats != nil {
-				val -= prevTaskStats.Uint64Stats[index]
+				val = uint64Delta(val, prevTaskStats.Uint64Stats[index])
 			}
 			if index == TASK_STATS_TOTAL_RUNTIME {
 				runtime, avgRuntimeMetric = val, metric
@@ -93,6 +219,10 @@ func (sim *SchedulerInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix
 			if index == TASK_STATS_EXECUTED_COUNT {
 				executedCount = val
 			}
+			if index == TASK_STATS_PANIC_COUNT && val == 0 {
+				// Published only if there were panics:
+				continue
+			}
 
 			buf.Write(metric)
 			buf.WriteString(strconv.FormatUint(val, 10))
@@ -101,22 +231,33 @@ func (sim *SchedulerInternalMetrics) generateMetrics(buf *bytes.Buffer, tsSuffix
 		}
 		if executedCount > 0 {
 			buf.Write(avgRuntimeMetric)
-			buf.WriteString(strconv.FormatFloat(
+			WriteFloatValue(
+				buf,
 				// N.B. The runtime is in microseconds, so we need to convert it to seconds.
 				float64(runtime)/1_000_000.0/float64(executedCount),
-				'f', TASK_STATS_AVG_RUNTIME_METRIC_PRECISION, 64,
-			))
+				TASK_STATS_AVG_RUNTIME_METRIC_PRECISION,
+			)
 			buf.Write(tsSuffix)
 			metricsCount++
 		}
 
 		if n := buf.Len(); bufMaxSize > 0 && n >= bufMaxSize {
 			partialByteCount += n
-			mq.QueueBuf(buf)
+			QueueBufFor(mq, sim.internalMetrics.Id, buf)
 			buf = nil
 		}
 	}
 
+	workerMetricsCount, buf := sim.generateWorkerMetrics(buf, tsSuffix)
+	metricsCount += workerMetricsCount
+	taskCountMetricsCount, buf := sim.generateTaskCountMetrics(buf, tsSuffix)
+	metricsCount += taskCountMetricsCount
+	activeWorkersMetricsCount, buf := sim.generateActiveWorkersMetric(buf, tsSuffix)
+	metricsCount += activeWorkersMetricsCount
+
+	// Evict the cache for tasks no longer present:
+	evictStaleMetricsCache(sim.cacheAging, sim.uint64DeltaMetricsCache, currStats)
+
 	// Flip the stats storage:
 	sim.currIndex = 1 - sim.currIndex
 
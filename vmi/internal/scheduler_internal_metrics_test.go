@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"path"
 	"testing"
+	"time"
 
 	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
 )
@@ -103,3 +104,112 @@ func TestSchedulerInternalMetrics(t *testing.T) {
 		}
 	}
 }
+
+func TestSchedulerInternalMetricsWorkerUtilization(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	tc := &SchedulerInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+	}
+	internalMetrics, err := newTestSchedulerInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedulerInternalMetrics := internalMetrics.schedulerMetrics
+	prevTs := time.Now()
+	// 4 workers, 3 sec worth of busy time over 2 sec of wall time:
+	schedulerInternalMetrics.workerStats[1-schedulerInternalMetrics.currIndex] = &SchedulerWorkerStats{
+		NumWorkers: 4,
+		BusyTime:   5 * time.Second,
+		Ts:         prevTs,
+	}
+	schedulerInternalMetrics.workerStats[schedulerInternalMetrics.currIndex] = &SchedulerWorkerStats{
+		NumWorkers: 4,
+		BusyTime:   8 * time.Second,
+		Ts:         prevTs.Add(2 * time.Second),
+	}
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := schedulerInternalMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetrics := make([]string, 0)
+	for _, mv := range []struct {
+		name string
+		val  string
+	}{
+		{SCHEDULER_WORKER_UTILIZATION_METRIC, "0.375"},
+		{SCHEDULER_BUSY_WORKERS_AVG_METRIC, "1.500"},
+	} {
+		wantMetrics = append(wantMetrics, fmt.Sprintf(
+			`%s{%s="%s",%s="%s"} %s %d`,
+			mv.name,
+			INSTANCE_LABEL_NAME, tc.Instance,
+			HOSTNAME_LABEL_NAME, tc.Hostname,
+			mv.val, tc.PromTs,
+		))
+	}
+	errBuf := testMetricsQueue.GenerateReport(wantMetrics, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestSchedulerInternalMetricsTaskCount(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	tc := &SchedulerInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+	}
+	internalMetrics, err := newTestSchedulerInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedulerInternalMetrics := internalMetrics.schedulerMetrics
+	// 1st scan, the task counts should be generated regardless:
+	schedulerInternalMetrics.workerStats[schedulerInternalMetrics.currIndex] = &SchedulerWorkerStats{
+		NumWorkers: 4,
+		TaskCount:  7,
+		HeapLen:    5,
+		Ts:         time.Now(),
+	}
+
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := schedulerInternalMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+
+	wantMetrics := make([]string, 0)
+	for _, mv := range []struct {
+		name string
+		val  string
+	}{
+		{SCHEDULER_TASK_COUNT_METRIC, "7"},
+		{SCHEDULER_HEAP_LEN_METRIC, "5"},
+	} {
+		wantMetrics = append(wantMetrics, fmt.Sprintf(
+			`%s{%s="%s",%s="%s"} %s %d`,
+			mv.name,
+			INSTANCE_LABEL_NAME, tc.Instance,
+			HOSTNAME_LABEL_NAME, tc.Hostname,
+			mv.val, tc.PromTs,
+		))
+	}
+	errBuf := testMetricsQueue.GenerateReport(wantMetrics, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
@@ -4,8 +4,13 @@ package vmi_internal
 
 import (
 	"bytes"
+	"context"
 	"fmt"
+	"runtime"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -254,3 +259,1153 @@ func TestSchedulerExecute(t *testing.T) {
 		)
 	}
 }
+
+type TaskScheduleTestCase struct {
+	id                string
+	interval          time.Duration
+	fullMetricsFactor int
+	initialCycleNum   int
+	alignToWallClock  bool
+	timeNow           time.Time
+	wantFirstRunTs    time.Time
+	wantFirstFullTs   time.Time
+}
+
+func TestTaskScheduleExpectedTs(t *testing.T) {
+	t0 := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []*TaskScheduleTestCase{
+		{
+			interval:        time.Second,
+			timeNow:         t0.Add(100 * time.Millisecond),
+			wantFirstRunTs:  t0.Add(100 * time.Millisecond),
+			wantFirstFullTs: t0.Add(100 * time.Millisecond),
+		},
+		{
+			interval:        time.Second,
+			timeNow:         t0.Add(990 * time.Millisecond),
+			wantFirstRunTs:  t0.Add(time.Second),
+			wantFirstFullTs: t0.Add(time.Second),
+		},
+		{
+			interval:          5 * time.Second,
+			fullMetricsFactor: 12,
+			initialCycleNum:   0,
+			timeNow:           t0.Add(time.Second),
+			wantFirstRunTs:    t0.Add(time.Second),
+			wantFirstFullTs:   t0.Add(time.Second),
+		},
+		{
+			interval:          5 * time.Second,
+			fullMetricsFactor: 12,
+			initialCycleNum:   3,
+			timeNow:           t0.Add(time.Second),
+			wantFirstRunTs:    t0.Add(time.Second),
+			wantFirstFullTs:   t0.Add(time.Second + 9*5*time.Second),
+		},
+		// Wall-clock aligned, the 1st execution waits for the boundary even
+		// if there is ample time until then:
+		{
+			interval:         time.Second,
+			alignToWallClock: true,
+			timeNow:          t0.Add(100 * time.Millisecond),
+			wantFirstRunTs:   t0.Add(time.Second),
+			wantFirstFullTs:  t0.Add(time.Second),
+		},
+		{
+			interval:          5 * time.Second,
+			fullMetricsFactor: 12,
+			initialCycleNum:   3,
+			alignToWallClock:  true,
+			timeNow:           t0.Add(time.Second),
+			wantFirstRunTs:    t0.Add(5 * time.Second),
+			wantFirstFullTs:   t0.Add(5*time.Second + 9*5*time.Second),
+		},
+	} {
+		t.Run(
+			"",
+			func(t *testing.T) {
+				task := NewTask("test", tc.interval, nil)
+				task.SetFullMetricsCycle(tc.fullMetricsFactor, tc.initialCycleNum)
+				task.alignToWallClock = tc.alignToWallClock
+				if got := task.expectedFirstRunTs(tc.timeNow); !got.Equal(tc.wantFirstRunTs) {
+					t.Errorf("first run: want: %s, got: %s", tc.wantFirstRunTs, got)
+				}
+				if got := task.expectedFirstFullCycleTs(tc.timeNow); !got.Equal(tc.wantFirstFullTs) {
+					t.Errorf("first full cycle: want: %s, got: %s", tc.wantFirstFullTs, got)
+				}
+			},
+		)
+	}
+}
+
+func TestFormatTaskSchedule(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	taskList := []*Task{
+		NewTask("task1", time.Second, nil),
+		NewTask("task2", 5*time.Second, nil),
+		NewTask("task3", 10*time.Second, nil),
+		NewTask("task4", 5*time.Second, nil),
+	}
+	taskList[1].SetFullMetricsCycle(12, 3)
+	taskList[2].SetFullMetricsCycle(6, 0)
+	taskList[3].SetFullMetricsCycle(12, 3)
+	taskList[3].alignToWallClock = true
+
+	timeNow := time.Date(2025, 1, 1, 0, 0, 1, 0, time.UTC)
+	wantEntries := []string{
+		// Ample time until the next interval boundary, run right away:
+		"id=task1, interval=1s, full_metrics_factor=0, initial_cycle_num=0, " +
+			"first_run=2025-01-01T00:00:01.000Z, first_full_cycle=2025-01-01T00:00:01.000Z",
+		// 9 more runs until the cycle# wraps around to 0:
+		"id=task2, interval=5s, full_metrics_factor=12, initial_cycle_num=3, " +
+			"first_run=2025-01-01T00:00:01.000Z, first_full_cycle=2025-01-01T00:00:46.000Z",
+		"id=task3, interval=10s, full_metrics_factor=6, initial_cycle_num=0, " +
+			"first_run=2025-01-01T00:00:01.000Z, first_full_cycle=2025-01-01T00:00:01.000Z",
+		// Wall-clock aligned, wait for the boundary:
+		"id=task4, interval=5s, full_metrics_factor=12, initial_cycle_num=3, " +
+			"first_run=2025-01-01T00:00:05.000Z, first_full_cycle=2025-01-01T00:00:50.000Z",
+	}
+	want := fmt.Sprintf("task schedule: %d task(s): [%s]", len(taskList), strings.Join(wantEntries, "], ["))
+	if got := FormatTaskSchedule(taskList, timeNow); want != got {
+		t.Fatalf("schedule:\nwant: %s\n got: %s", want, got)
+	}
+}
+
+func TestSchedulerNumWorkers(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	for _, tc := range []struct {
+		numWorkers, maxNumWorkers int
+		wantNumWorkers            int
+	}{
+		{4, 0, 4},
+		{SCHEDULER_MAX_NUM_WORKERS + 4, 0, SCHEDULER_MAX_NUM_WORKERS},
+		{SCHEDULER_MAX_NUM_WORKERS + 4, -1, SCHEDULER_MAX_NUM_WORKERS},
+		{SCHEDULER_MAX_NUM_WORKERS + 4, 4 * SCHEDULER_MAX_NUM_WORKERS, SCHEDULER_MAX_NUM_WORKERS + 4},
+		{5 * SCHEDULER_MAX_NUM_WORKERS, 4 * SCHEDULER_MAX_NUM_WORKERS, 4 * SCHEDULER_MAX_NUM_WORKERS},
+		{4, 2, 2},
+		{-1, 0, min(AvailableCPUCount, SCHEDULER_MAX_NUM_WORKERS)},
+		{-1, 1, 1},
+	} {
+		t.Run(
+			fmt.Sprintf("numWorkers=%d,maxNumWorkers=%d", tc.numWorkers, tc.maxNumWorkers),
+			func(t *testing.T) {
+				scheduler, err := NewScheduler(&SchedulerConfig{
+					NumWorkers:    tc.numWorkers,
+					MaxNumWorkers: tc.maxNumWorkers,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if scheduler.numWorkers != tc.wantNumWorkers {
+					t.Fatalf("numWorkers: want: %d, got: %d", tc.wantNumWorkers, scheduler.numWorkers)
+				}
+			},
+		)
+	}
+}
+
+func TestSchedulerWorkerUtilization(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// Each task keeps a worker busy for half of its interval, so with as many
+	// tasks as workers the expected utilization is ~0.5:
+	numWorkers, interval, execDuration := 2, 200*time.Millisecond, 100*time.Millisecond
+	wantMinUtilization, wantMaxUtilization := 0.35, 0.65
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numWorkers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+	for i := 0; i < numWorkers; i++ {
+		testTask := &TestTask{execDurations: []time.Duration{execDuration}}
+		testTask.task = NewTask(fmt.Sprintf("task%d", i), interval, testTask.taskAction)
+		scheduler.AddNewTask(testTask.task)
+	}
+
+	// Allow the tasks to settle into their schedule:
+	time.Sleep(2 * interval)
+	prevStats := scheduler.SnapWorkerStats(nil)
+	time.Sleep(10 * interval)
+	currStats := scheduler.SnapWorkerStats(nil)
+
+	if currStats.NumWorkers != numWorkers {
+		t.Fatalf("NumWorkers: want: %d, got: %d", numWorkers, currStats.NumWorkers)
+	}
+	busyWorkersAvg := float64(currStats.BusyTime-prevStats.BusyTime) / float64(currStats.Ts.Sub(prevStats.Ts))
+	utilization := busyWorkersAvg / float64(numWorkers)
+	if utilization < wantMinUtilization || wantMaxUtilization < utilization {
+		t.Fatalf(
+			"utilization: want: %.03f..%.03f, got: %.03f",
+			wantMinUtilization, wantMaxUtilization, utilization,
+		)
+	}
+}
+
+func TestSchedulerTaskCount(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// All tasks but one are idle in the heap, due to the long interval, while
+	// the remaining one is kept in flight until released, at which point it
+	// disables itself:
+	numTasks, interval, idleInterval, timeout := 5, 50*time.Millisecond, 24*time.Hour, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	started, release := make(chan bool, 1), make(chan bool)
+	scheduler.AddNewTask(NewTask("blocking", interval, func() bool {
+		started <- true
+		<-release
+		return false
+	}))
+	select {
+	case <-started:
+	case <-time.After(timeout):
+		t.Fatalf("blocking task not started after %s", timeout)
+	}
+	for i := 1; i < numTasks; i++ {
+		scheduler.AddNewTask(NewTask(fmt.Sprintf("task%d", i), idleInterval, func() bool { return true }))
+	}
+
+	waitForCounts := func(wantTaskCount, wantHeapLen int) {
+		var stats *SchedulerWorkerStats
+		for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			stats = scheduler.SnapWorkerStats(stats)
+			if stats.TaskCount == wantTaskCount && stats.HeapLen == wantHeapLen {
+				return
+			}
+		}
+		t.Fatalf(
+			"TaskCount/HeapLen: want: %d/%d, got: %d/%d",
+			wantTaskCount, wantHeapLen, stats.TaskCount, stats.HeapLen,
+		)
+	}
+
+	waitForCounts(numTasks, numTasks-1)
+	close(release)
+	waitForCounts(numTasks-1, numTasks-1)
+}
+
+func TestSchedulerTaskDependencies(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// The dependency and the dependent task are due at the same time; the
+	// former takes a while to complete, so w/o ordering the latter would run
+	// concurrently w/ it:
+	interval, depDuration, runTime := 100*time.Millisecond, 30*time.Millisecond, 1*time.Second
+
+	mu := &sync.Mutex{}
+	depDoneCount, depDoneCounts := 0, make([]int, 0)
+	depTask := NewTask("dep", interval, func() bool {
+		time.Sleep(depDuration)
+		mu.Lock()
+		depDoneCount++
+		mu.Unlock()
+		return true
+	})
+	dependentTask := NewTask("dependent", interval, func() bool {
+		mu.Lock()
+		depDoneCounts = append(depDoneCounts, depDoneCount)
+		mu.Unlock()
+		return true
+	})
+	dependentTask.SetDependencies(depTask.id)
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	// Add the dependent first, to make sure that the ordering is not
+	// incidental:
+	scheduler.AddNewTask(dependentTask)
+	scheduler.AddNewTask(depTask)
+	time.Sleep(runTime)
+	scheduler.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(depDoneCounts) < 2 {
+		t.Fatalf("dependent task executions: want >= 2, got: %d", len(depDoneCounts))
+	}
+	// Every execution of the dependent task should have been preceded by a
+	// new completed execution of the dependency:
+	for i, count := range depDoneCounts {
+		prevCount := 0
+		if i > 0 {
+			prevCount = depDoneCounts[i-1]
+		}
+		if count <= prevCount {
+			t.Fatalf("dependency completed counts at dependent execution: want increasing from 1, got: %v", depDoneCounts)
+		}
+	}
+}
+
+func TestOrderTasksByDependencies(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		deps    map[string][]string
+		ids     []string
+		wantIds []string
+		wantErr bool
+	}{
+		{"no_deps", nil, []string{"a", "b", "c"}, []string{"a", "b", "c"}, false},
+		{"reorder", map[string][]string{"a": {"c"}}, []string{"a", "b", "c"}, []string{"c", "a", "b"}, false},
+		{"chain", map[string][]string{"a": {"b"}, "b": {"c"}}, []string{"a", "b", "c"}, []string{"c", "b", "a"}, false},
+		{"unknown", map[string][]string{"a": {"x"}}, []string{"a", "b"}, nil, true},
+		{"cycle", map[string][]string{"a": {"b"}, "b": {"a"}}, []string{"a", "b"}, nil, true},
+		{"self", map[string][]string{"a": {"a"}}, []string{"a"}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			taskList := make([]*Task, len(tc.ids))
+			for i, id := range tc.ids {
+				taskList[i] = NewTask(id, time.Second, nil)
+				if deps := tc.deps[id]; len(deps) > 0 {
+					taskList[i].SetDependencies(deps...)
+				}
+			}
+			ordered, err := OrderTasksByDependencies(taskList)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("error: want: %v, got: %v", tc.wantErr, err)
+			}
+			if err != nil {
+				return
+			}
+			gotIds := make([]string, len(ordered))
+			for i, task := range ordered {
+				gotIds[i] = task.id
+			}
+			if strings.Join(gotIds, ",") != strings.Join(tc.wantIds, ",") {
+				t.Fatalf("order: want: %v, got: %v", tc.wantIds, gotIds)
+			}
+		})
+	}
+}
+
+func TestSchedulerSetTaskInterval(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	initialInterval, newInterval, runTime, timeout := time.Hour, 100*time.Millisecond, 1*time.Second, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	mu := &sync.Mutex{}
+	invokeTss := make([]time.Time, 0)
+	task := NewTask("task", initialInterval, func() bool {
+		mu.Lock()
+		invokeTss = append(invokeTss, time.Now())
+		mu.Unlock()
+		return true
+	})
+
+	if err := scheduler.SetTaskInterval(task.id, newInterval); err == nil {
+		t.Fatal("SetTaskInterval for unregistered task: want error, got nil")
+	}
+
+	scheduler.AddNewTask(task)
+	if err := scheduler.SetTaskInterval(task.id, 0); err == nil {
+		t.Fatal("SetTaskInterval(0): want error, got nil")
+	}
+
+	// Wait for the 1st execution, after which the task will be idle in the
+	// heap due to the long interval:
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := len(invokeTss)
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task not executed after %s", timeout)
+		}
+	}
+
+	if err := scheduler.SetTaskInterval(task.id, newInterval); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(runTime)
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Allow for some slack at either end:
+	wantMinCount := int(runTime/newInterval) - 2
+	if len(invokeTss)-1 < wantMinCount {
+		t.Fatalf("executions after interval change: want >= %d, got: %d", wantMinCount, len(invokeTss)-1)
+	}
+	for i := 2; i < len(invokeTss); i++ {
+		if d := invokeTss[i].Sub(invokeTss[i-1]); d > 2*newInterval {
+			t.Fatalf("execution# %d: interval: want ~%s, got: %s", i, newInterval, d)
+		}
+	}
+}
+
+func TestSchedulerRemoveTask(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	interval, runTime, timeout := 100*time.Millisecond, 500*time.Millisecond, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	if err := scheduler.RemoveTask("unregistered"); err == nil {
+		t.Fatal("RemoveTask for unregistered task: want error, got nil")
+	}
+
+	// One task will be removed while pending in the heap and the other one
+	// while in flight, blocked until released:
+	mu := &sync.Mutex{}
+	execCounts := make(map[string]int)
+	inflight, release := make(chan bool, 1), make(chan bool)
+	pendingTask := NewTask("pending", interval, func() bool {
+		mu.Lock()
+		execCounts["pending"] += 1
+		mu.Unlock()
+		return true
+	})
+	inflightTask := NewTask("inflight", interval, func() bool {
+		mu.Lock()
+		execCounts["inflight"] += 1
+		mu.Unlock()
+		select {
+		case inflight <- true:
+		default:
+		}
+		<-release
+		return true
+	})
+	scheduler.AddNewTask(pendingTask)
+	scheduler.AddNewTask(inflightTask)
+
+	select {
+	case <-inflight:
+	case <-time.After(timeout):
+		t.Fatalf("task %s not executed after %s", inflightTask.id, timeout)
+	}
+	// Wait for the pending task to execute at least once:
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := execCounts["pending"]
+		mu.Unlock()
+		if n > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task %s not executed after %s", pendingTask.id, timeout)
+		}
+	}
+
+	for _, task := range []*Task{pendingTask, inflightTask} {
+		if err := scheduler.RemoveTask(task.id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := scheduler.RemoveTask(pendingTask.id); err == nil {
+		t.Fatal("RemoveTask for already removed task: want error, got nil")
+	}
+	close(release)
+
+	mu.Lock()
+	wantExecCounts := make(map[string]int)
+	for id, n := range execCounts {
+		wantExecCounts[id] = n
+	}
+	mu.Unlock()
+	time.Sleep(runTime)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for id, n := range wantExecCounts {
+		if execCounts[id] != n {
+			t.Errorf("task %s: executions after removal: want: 0, got: %d", id, execCounts[id]-n)
+		}
+	}
+
+	stats := scheduler.SnapStats(nil)
+	for _, task := range []*Task{pendingTask, inflightTask} {
+		if _, ok := stats[task.id]; ok {
+			t.Errorf("task %s: stats not discarded", task.id)
+		}
+	}
+	workerStats := scheduler.SnapWorkerStats(nil)
+	if workerStats.TaskCount != 0 || workerStats.HeapLen != 0 {
+		t.Errorf(
+			"TaskCount, HeapLen: want: 0, 0, got: %d, %d",
+			workerStats.TaskCount, workerStats.HeapLen,
+		)
+	}
+}
+
+func TestSchedulerConcurrencyClass(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// Multiple instances of the same class, all due at the same time, w/
+	// enough workers to run them all concurrently, but for the class limit:
+	numTasks, maxConcurrency := 4, 1
+	interval, execDuration, runTime := 200*time.Millisecond, 20*time.Millisecond, 1*time.Second
+
+	mu := &sync.Mutex{}
+	inflight, maxInflight, execCounts := 0, 0, make([]int, numTasks)
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numTasks})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	for i := 0; i < numTasks; i++ {
+		i := i
+		// Build the task from a generator, such that the class is picked up
+		// from the latter:
+		gen := &oneShotTestGenerator{
+			GeneratorBase: GeneratorBase{
+				Id:                  fmt.Sprintf("disk%d", i),
+				Interval:            interval,
+				ConcurrencyClass:    "disk",
+				MaxClassConcurrency: maxConcurrency,
+			},
+		}
+		task := NewMetricsGeneratorTask(gen)
+		task.action = func() bool {
+			mu.Lock()
+			inflight++
+			maxInflight = max(maxInflight, inflight)
+			mu.Unlock()
+			time.Sleep(execDuration)
+			mu.Lock()
+			inflight--
+			execCounts[i]++
+			mu.Unlock()
+			return true
+		}
+		scheduler.AddNewTask(task)
+	}
+	time.Sleep(runTime)
+	scheduler.Shutdown()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInflight != maxConcurrency {
+		t.Fatalf("max concurrent executions: want: %d, got: %d", maxConcurrency, maxInflight)
+	}
+	// The delay caused by the class limit should not prevent the tasks from
+	// running at every interval, give or take:
+	wantMinCount := int(runTime/interval) - 1
+	for i, count := range execCounts {
+		if count < wantMinCount {
+			t.Fatalf("task# %d executions: want >= %d, got: %d", i, wantMinCount, count)
+		}
+	}
+}
+
+func TestSchedulerJitter(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	if _, err := NewScheduler(&SchedulerConfig{Jitter: 1.5}); err == nil {
+		t.Fatal("NewScheduler(jitter=1.5): want error, got nil")
+	}
+
+	jitter, interval, numTasks := 0.5, 400*time.Millisecond, 4
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numTasks, Jitter: jitter})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTasks := make([]*TestTask, numTasks)
+	offsets := make(map[time.Duration]bool)
+	maxOffset := time.Duration(jitter * float64(interval))
+	for i := range testTasks {
+		tt := &TestTask{}
+		tt.task = NewTask(fmt.Sprintf("jitter_task_%d", i), interval, tt.taskAction)
+		testTasks[i] = tt
+
+		// The offset should be within range and stable:
+		scheduler.setTaskJitterOffset(tt.task)
+		offset := tt.task.jitterOffset
+		if offset < 0 || offset >= maxOffset {
+			t.Fatalf("task %s: jitter offset: want: 0..%s, got: %s", tt.task.id, maxOffset, offset)
+		}
+		scheduler.setTaskJitterOffset(tt.task)
+		if tt.task.jitterOffset != offset {
+			t.Fatalf("task %s: jitter offset: want: %s (stable), got: %s", tt.task.id, offset, tt.task.jitterOffset)
+		}
+		offsets[offset] = true
+	}
+	if len(offsets) < 2 {
+		t.Fatalf("jitter offsets: want spread, got: %v", offsets)
+	}
+
+	scheduler.Start()
+	for _, tt := range testTasks {
+		scheduler.AddNewTask(tt.task)
+	}
+	time.Sleep(5 * interval)
+	scheduler.Shutdown()
+
+	// Each execution, except the 1st one, which may be immediate, should occur
+	// shortly after a multiple of interval shifted by the task's offset:
+	maxLag := 50 * time.Millisecond
+	for _, tt := range testTasks {
+		task := tt.task
+		if len(tt.invokeTss) < 3 {
+			t.Fatalf("task %s: want >= 3 executions, got: %d", task.id, len(tt.invokeTss))
+		}
+		for k, ts := range tt.invokeTss[1:] {
+			lag := ts.Sub(ts.Add(-task.jitterOffset).Truncate(interval).Add(task.jitterOffset))
+			if lag > maxLag {
+				t.Errorf(
+					"task %s execute# %d: lag from the aligned time: want: <= %s, got: %s (offset: %s)",
+					task.id, k+1, maxLag, lag, task.jitterOffset,
+				)
+			}
+		}
+	}
+}
+
+func TestTaskAlignedNextTsWallClock(t *testing.T) {
+	// A time zone w/ a non-hour offset, such that the local and UTC boundaries
+	// differ:
+	loc := time.FixedZone("UTC+05:30", 5*3600+1800)
+	for _, tc := range []struct {
+		interval time.Duration
+		timeNow  time.Time
+		wantTs   time.Time
+	}{
+		{
+			15 * time.Second,
+			time.Date(2026, 1, 2, 10, 17, 7, 0, loc),
+			time.Date(2026, 1, 2, 10, 17, 15, 0, loc),
+		},
+		{
+			time.Minute,
+			time.Date(2026, 1, 2, 10, 17, 59, 999_000_000, loc),
+			time.Date(2026, 1, 2, 10, 18, 0, 0, loc),
+		},
+		{
+			time.Hour,
+			time.Date(2026, 1, 2, 10, 17, 7, 0, loc),
+			time.Date(2026, 1, 2, 11, 0, 0, 0, loc),
+		},
+		{
+			24 * time.Hour,
+			time.Date(2026, 1, 2, 10, 17, 7, 0, loc),
+			time.Date(2026, 1, 3, 0, 0, 0, 0, loc),
+		},
+	} {
+		task := NewTask("wallclock", tc.interval, nil)
+		task.alignToWallClock = true
+		if gotTs := task.alignedNextTs(tc.timeNow); !gotTs.Equal(tc.wantTs) {
+			t.Errorf(
+				"interval=%s, timeNow=%s: want: %s, got: %s",
+				tc.interval, tc.timeNow, tc.wantTs, gotTs.In(loc),
+			)
+		}
+	}
+}
+
+func TestSchedulerAlignToWallClock(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	interval, numTasks := 400*time.Millisecond, 2
+	// The jitter should be ignored:
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numTasks, Jitter: 0.5, AlignToWallClock: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTasks := make([]*TestTask, numTasks)
+	for i := range testTasks {
+		tt := &TestTask{}
+		tt.task = NewTask(fmt.Sprintf("wallclock_task_%d", i), interval, tt.taskAction)
+		testTasks[i] = tt
+	}
+	scheduler.Start()
+	for _, tt := range testTasks {
+		scheduler.AddNewTask(tt.task)
+	}
+	time.Sleep(3 * interval)
+	scheduler.Shutdown()
+
+	// Every execution, the 1st one included, should occur shortly after a
+	// local wall-clock multiple of interval:
+	maxLag := 50 * time.Millisecond
+	for _, tt := range testTasks {
+		task := tt.task
+		if task.jitterOffset != 0 {
+			t.Fatalf("task %s: jitter offset: want: 0, got: %s", task.id, task.jitterOffset)
+		}
+		if len(tt.invokeTss) < 2 {
+			t.Fatalf("task %s: want >= 2 executions, got: %d", task.id, len(tt.invokeTss))
+		}
+		for k, ts := range tt.invokeTss {
+			_, zoneOffsetSec := ts.Zone()
+			zoneOffset := time.Duration(zoneOffsetSec) * time.Second
+			lag := ts.Sub(ts.Add(zoneOffset).Truncate(interval).Add(-zoneOffset))
+			if lag > maxLag {
+				t.Errorf(
+					"task %s execute# %d: lag from the wall-clock aligned time: want: <= %s, got: %s",
+					task.id, k, maxLag, lag,
+				)
+			}
+		}
+	}
+}
+
+func TestSchedulerActiveWorkers(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	numWorkers, interval, timeout := 3, 50*time.Millisecond, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numWorkers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	waitActiveWorkers := func(want int) *SchedulerWorkerStats {
+		var stats *SchedulerWorkerStats
+		for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+			stats = scheduler.SnapWorkerStats(stats)
+			if stats.ActiveWorkers == want {
+				return stats
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("ActiveWorkers: want: %d, got: %d", want, stats.ActiveWorkers)
+			}
+		}
+	}
+	waitActiveWorkers(numWorkers)
+
+	// Kill a worker via a task exiting the goroutine; N.B. panics are
+	// recovered, they do not kill the worker:
+	scheduler.AddNewTask(NewTask("goexit", interval, func() bool {
+		runtime.Goexit()
+		return true
+	}))
+	stats := waitActiveWorkers(numWorkers - 1)
+	if stats.NumWorkers != numWorkers {
+		t.Fatalf("NumWorkers: want: %d, got: %d", numWorkers, stats.NumWorkers)
+	}
+	// The task should have been dropped:
+	if stats.TaskCount != 0 {
+		t.Fatalf("TaskCount: want: %d, got: %d", 0, stats.TaskCount)
+	}
+
+	// The remaining workers should still execute tasks:
+	executed := make(chan bool, 1)
+	scheduler.AddNewTask(NewTask("ok", interval, func() bool {
+		executed <- true
+		return false
+	}))
+	select {
+	case <-executed:
+	case <-time.After(timeout):
+		t.Fatalf("task not executed after %s", timeout)
+	}
+
+	// The metric should reflect the reduced count:
+	tc := &SchedulerInternalMetricsTestCase{
+		InternalMetricsTestCase: InternalMetricsTestCase{
+			Instance: "vmi_test",
+			Hostname: "vmi-test",
+			PromTs:   1746121347582,
+		},
+	}
+	internalMetrics, err := newTestSchedulerInternalMetrics(tc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedulerInternalMetrics := internalMetrics.schedulerMetrics
+	schedulerInternalMetrics.workerStats[schedulerInternalMetrics.currIndex] = stats
+	testMetricsQueue := internalMetrics.MetricsQueue.(*vmi_testutils.TestMetricsQueue)
+	_, _, buf := schedulerInternalMetrics.generateMetrics(nil, internalMetrics.TsSuffixBuf.Bytes())
+	if buf != nil {
+		testMetricsQueue.QueueBuf(buf)
+	}
+	wantMetric := fmt.Sprintf(
+		`%s{%s="%s",%s="%s"} %d %d`,
+		SCHEDULER_ACTIVE_WORKERS_METRIC,
+		INSTANCE_LABEL_NAME, tc.Instance,
+		HOSTNAME_LABEL_NAME, tc.Hostname,
+		numWorkers-1, tc.PromTs,
+	)
+	errBuf := testMetricsQueue.GenerateReport([]string{wantMetric}, false, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestSchedulerTaskPanic(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	numWorkers, interval, numExecutions, timeout := 1, 50*time.Millisecond, 3, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numWorkers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	// Panic on the 1st invocation only:
+	mu := &sync.Mutex{}
+	invokeCount := 0
+	task := NewTask("panic", interval, func() bool {
+		mu.Lock()
+		invokeCount += 1
+		n := invokeCount
+		mu.Unlock()
+		if n == 1 {
+			panic("injected panic")
+		}
+		return true
+	})
+	scheduler.AddNewTask(task)
+
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := invokeCount
+		mu.Unlock()
+		if n >= numExecutions {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("invocations: want: >= %d, got: %d after %s", numExecutions, n, timeout)
+		}
+	}
+
+	taskStats := scheduler.SnapStats(nil)[task.id]
+	if taskStats == nil {
+		t.Fatalf("task %s: missing stats", task.id)
+	}
+	if got := taskStats.Uint64Stats[TASK_STATS_PANIC_COUNT]; got != 1 {
+		t.Fatalf("TASK_STATS_PANIC_COUNT: want: 1, got: %d", got)
+	}
+	if got := taskStats.Uint64Stats[TASK_STATS_EXECUTED_COUNT]; got < uint64(numExecutions-1) {
+		t.Fatalf("TASK_STATS_EXECUTED_COUNT: want: >= %d, got: %d", numExecutions-1, got)
+	}
+	if got := scheduler.SnapWorkerStats(nil).ActiveWorkers; got != numWorkers {
+		t.Fatalf("ActiveWorkers: want: %d, got: %d", numWorkers, got)
+	}
+}
+
+func TestSchedulerTaskPanicDisable(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	numWorkers, interval, numExecutions, timeout := 1, 50*time.Millisecond, 5, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: numWorkers, DisableTaskOnPanic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	mu := &sync.Mutex{}
+	panicInvokeCount, okInvokeCount := 0, 0
+	panicTask := NewTask("panic", interval, func() bool {
+		mu.Lock()
+		panicInvokeCount += 1
+		mu.Unlock()
+		panic("injected panic")
+	})
+	okTask := NewTask("ok", interval, func() bool {
+		mu.Lock()
+		okInvokeCount += 1
+		mu.Unlock()
+		return true
+	})
+	scheduler.AddNewTask(panicTask)
+	scheduler.AddNewTask(okTask)
+
+	// The other task should continue running on the surviving worker:
+	for deadline := time.Now().Add(timeout); ; time.Sleep(10 * time.Millisecond) {
+		mu.Lock()
+		n := okInvokeCount
+		mu.Unlock()
+		if n >= numExecutions {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s invocations: want: >= %d, got: %d after %s", okTask.id, numExecutions, n, timeout)
+		}
+	}
+
+	mu.Lock()
+	gotPanicInvokeCount := panicInvokeCount
+	mu.Unlock()
+	if gotPanicInvokeCount != 1 {
+		t.Fatalf("%s invocations: want: 1, got: %d", panicTask.id, gotPanicInvokeCount)
+	}
+	taskStats := scheduler.SnapStats(nil)[panicTask.id]
+	if taskStats == nil {
+		t.Fatalf("task %s: missing stats", panicTask.id)
+	}
+	if got := taskStats.Uint64Stats[TASK_STATS_PANIC_COUNT]; got != 1 {
+		t.Fatalf("TASK_STATS_PANIC_COUNT: want: 1, got: %d", got)
+	}
+	if !taskStats.Disabled {
+		t.Fatalf("task %s: Disabled: want: true, got: false", panicTask.id)
+	}
+	if got := scheduler.SnapWorkerStats(nil).ActiveWorkers; got != numWorkers {
+		t.Fatalf("ActiveWorkers: want: %d, got: %d", numWorkers, got)
+	}
+}
+
+func TestSchedulerTaskPriority(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	// A single worker, kept busy by a blocker task while the other tasks
+	// become ready, such that they contend for it. The interval is long
+	// enough for the tasks to be dispatched right away and to run only once
+	// during the test:
+	interval, timeout := time.Hour, 2*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	blockerStarted, releaseBlocker := make(chan struct{}), make(chan struct{})
+	scheduler.AddNewTask(NewTask("blocker", interval, func() bool {
+		close(blockerStarted)
+		<-releaseBlocker
+		return false
+	}))
+	select {
+	case <-blockerStarted:
+	case <-time.After(timeout):
+		t.Fatalf("blocker not started after %s", timeout)
+	}
+
+	mu := &sync.Mutex{}
+	gotOrder := make([]string, 0)
+	done := make(chan struct{})
+	// Lower priority tasks 1st, in the order they should be executed within
+	// the same priority:
+	taskDefs := []struct {
+		id       string
+		priority int
+	}{
+		{"low0", 0},
+		{"low1", 0},
+		{"mid0", 5},
+		{"high0", 10},
+		{"low2", 0},
+		{"high1", 10},
+	}
+	wantOrder := []string{"high0", "high1", "mid0", "low0", "low1", "low2"}
+	for _, taskDef := range taskDefs {
+		// Build the task from a generator, such that the priority is picked up
+		// from the latter:
+		gen := &oneShotTestGenerator{
+			GeneratorBase: GeneratorBase{
+				Id:       taskDef.id,
+				Interval: interval,
+				Priority: taskDef.priority,
+			},
+		}
+		task := NewMetricsGeneratorTask(gen)
+		id := taskDef.id
+		task.action = func() bool {
+			mu.Lock()
+			gotOrder = append(gotOrder, id)
+			if len(gotOrder) == len(taskDefs) {
+				close(done)
+			}
+			mu.Unlock()
+			return false
+		}
+		scheduler.AddNewTask(task)
+	}
+
+	// Wait for all the tasks to be ready, i.e. in the TODO queue:
+	for deadline := time.Now().Add(timeout); len(scheduler.todoQ.ready) < len(taskDefs); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("TODO queue len: want: %d, got: %d after %s", len(taskDefs), len(scheduler.todoQ.ready), timeout)
+		}
+	}
+	close(releaseBlocker)
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		mu.Lock()
+		defer mu.Unlock()
+		t.Fatalf("executed tasks: want: %d, got: %v after %s", len(taskDefs), gotOrder, timeout)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(wantOrder, gotOrder) {
+		t.Fatalf("execution order: want: %v, got: %v", wantOrder, gotOrder)
+	}
+}
+
+// A generator whose action honors the context, i.e. it waits for the latter to
+// be done, up to a max wait:
+type contextTestGenerator struct {
+	GeneratorBase
+	maxWait time.Duration
+	// The outcome of the last invocation:
+	mu          *sync.Mutex
+	ctxErr      error
+	elapsed     time.Duration
+	invokeCount int
+	plainCount  int
+}
+
+func (gen *contextTestGenerator) TaskActivity() bool {
+	gen.mu.Lock()
+	gen.plainCount++
+	gen.mu.Unlock()
+	return true
+}
+
+func (gen *contextTestGenerator) TaskActivityContext(ctx context.Context) bool {
+	start := time.Now()
+	timer := time.NewTimer(gen.maxWait)
+	defer timer.Stop()
+	var ctxErr error
+	select {
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+	case <-timer.C:
+	}
+	gen.mu.Lock()
+	gen.ctxErr, gen.elapsed = ctxErr, time.Since(start)
+	gen.invokeCount++
+	gen.mu.Unlock()
+	return true
+}
+
+func TestTaskRunActionTimeout(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	maxWait := 2 * time.Second
+	for _, tc := range []struct {
+		name        string
+		interval    time.Duration
+		timeout     time.Duration
+		wantErr     error
+		wantElapsed time.Duration
+	}{
+		{"timeout", time.Second, 50 * time.Millisecond, context.DeadlineExceeded, 50 * time.Millisecond},
+		{"interval", 100 * time.Millisecond, 0, context.DeadlineExceeded, 100 * time.Millisecond},
+		{"no_timeout", 100 * time.Millisecond, -1, nil, maxWait},
+	} {
+		t.Run(
+			tc.name,
+			func(t *testing.T) {
+				gen := &contextTestGenerator{
+					GeneratorBase: GeneratorBase{
+						Id:       tc.name,
+						Interval: tc.interval,
+						Timeout:  tc.timeout,
+					},
+					maxWait: maxWait,
+					mu:      &sync.Mutex{},
+				}
+				task := NewMetricsGeneratorTask(gen)
+				if !task.runAction(context.Background()) {
+					t.Fatal("runAction() returned false, expected true")
+				}
+				if gen.plainCount != 0 {
+					t.Fatalf("TaskActivity() invoked %d times, want: 0", gen.plainCount)
+				}
+				if gen.ctxErr != tc.wantErr {
+					t.Fatalf("ctx.Err(): want: %v, got: %v", tc.wantErr, gen.ctxErr)
+				}
+				// Allow for some slack:
+				if gen.elapsed < tc.wantElapsed || gen.elapsed > tc.wantElapsed+500*time.Millisecond {
+					t.Fatalf("elapsed: want: ~%s, got: %s", tc.wantElapsed, gen.elapsed)
+				}
+			},
+		)
+	}
+}
+
+func TestSchedulerTaskContextTimeout(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	interval, timeout, numExecutions, maxRunTime := 200*time.Millisecond, 20*time.Millisecond, 3, 5*time.Second
+
+	scheduler, err := NewScheduler(&SchedulerConfig{NumWorkers: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler.Start()
+	defer scheduler.Shutdown()
+
+	// The action would otherwise overrun the interval:
+	gen := &contextTestGenerator{
+		GeneratorBase: GeneratorBase{
+			Id:       "ctx",
+			Interval: interval,
+			Timeout:  timeout,
+		},
+		maxWait: 10 * interval,
+		mu:      &sync.Mutex{},
+	}
+	task := NewMetricsGeneratorTask(gen)
+	scheduler.AddNewTask(task)
+
+	for deadline := time.Now().Add(maxRunTime); ; time.Sleep(10 * time.Millisecond) {
+		gen.mu.Lock()
+		n := gen.invokeCount
+		gen.mu.Unlock()
+		if n >= numExecutions {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("invocations: want: >= %d, got: %d after %s", numExecutions, n, maxRunTime)
+		}
+	}
+
+	gen.mu.Lock()
+	ctxErr := gen.ctxErr
+	gen.mu.Unlock()
+	if ctxErr != context.DeadlineExceeded {
+		t.Fatalf("ctx.Err(): want: %v, got: %v", context.DeadlineExceeded, ctxErr)
+	}
+	taskStats := scheduler.SnapStats(nil)[task.id]
+	if taskStats == nil {
+		t.Fatalf("task %s: missing stats", task.id)
+	}
+	if got := taskStats.Uint64Stats[TASK_STATS_OVERRUN_COUNT]; got != 0 {
+		t.Fatalf("TASK_STATS_OVERRUN_COUNT: want: 0, got: %d", got)
+	}
+}
@@ -0,0 +1,137 @@
+// Self-scrape HTTP endpoint for internal metrics.
+
+package vmi_internal
+
+// The internal metrics are normally pushed, along w/ the generated metrics, to
+// the import endpoints. Optionally (self_metrics_addr) they may also be
+// exposed by an HTTP server at /metrics, in Prometheus exposition format, to be
+// pulled by a scraper. This is independent of the push endpoints; it is useful
+// for monitoring the importer itself when the push path is degraded.
+//
+// The served content is collected by wrapping the metrics queue used by the
+// internal metrics generator, rather than generating the metrics separately.
+// Since the internal metrics use the delta approach, the latest sample of each
+// series is retained across generation cycles. The samples are served w/o
+// timestamps, such that the scraper uses the scrape time.
+
+import (
+	"bytes"
+	"net/http"
+	"slices"
+	"sync"
+)
+
+const (
+	SELF_METRICS_PATH         = "/metrics"
+	SELF_METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var selfMetricsLog = NewCompLogger("self_metrics")
+
+type SelfMetricsServer struct {
+	*BackgroundHttpServer
+	// The latest sample, w/o timestamp, of each series, indexed by the series
+	// (name and labels):
+	samples map[string][]byte
+	mu      *sync.Mutex
+}
+
+func NewSelfMetricsServer(addr string) *SelfMetricsServer {
+	sms := &SelfMetricsServer{
+		samples: make(map[string][]byte),
+		mu:      &sync.Mutex{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(SELF_METRICS_PATH, sms.handleMetrics)
+	sms.BackgroundHttpServer = NewBackgroundHttpServer(addr, mux, selfMetricsLog)
+	selfMetricsLog.Infof("self_metrics_addr=%q, path=%q", addr, SELF_METRICS_PATH)
+	return sms
+}
+
+// Update the latest samples from a buffer of metrics, in exposition format:
+func (sms *SelfMetricsServer) Update(b []byte) {
+	sms.mu.Lock()
+	defer sms.mu.Unlock()
+	for len(b) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			line, b = b[:i], b[i+1:]
+		} else {
+			line, b = b, nil
+		}
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		// The series ends either w/ the closing brace of the labels or w/ the
+		// name, if there are no labels:
+		seriesEnd := bytes.IndexByte(line, ' ')
+		if seriesEnd < 0 {
+			continue
+		}
+		if i := bytes.IndexByte(line[:seriesEnd], '{'); i >= 0 {
+			if seriesEnd = bytes.LastIndexByte(line, '}'); seriesEnd < 0 {
+				continue
+			}
+			seriesEnd++
+		}
+		fields := bytes.Fields(line[seriesEnd:])
+		if len(fields) == 0 {
+			continue
+		}
+		series := string(line[:seriesEnd])
+		sample := sms.samples[series][:0]
+		sample = append(sample, line[:seriesEnd]...)
+		sample = append(sample, ' ')
+		sample = append(sample, fields[0]...)
+		sample = append(sample, '\n')
+		sms.samples[series] = sample
+	}
+}
+
+// Write the latest samples, sorted by series for a stable output:
+func (sms *SelfMetricsServer) WriteTo(buf *bytes.Buffer) {
+	sms.mu.Lock()
+	defer sms.mu.Unlock()
+	seriesList := make([]string, 0, len(sms.samples))
+	for series := range sms.samples {
+		seriesList = append(seriesList, series)
+	}
+	slices.Sort(seriesList)
+	for _, series := range seriesList {
+		buf.Write(sms.samples[series])
+	}
+}
+
+func (sms *SelfMetricsServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	buf := &bytes.Buffer{}
+	sms.WriteTo(buf)
+	w.Header().Set("Content-Type", SELF_METRICS_CONTENT_TYPE)
+	w.Write(buf.Bytes())
+}
+
+// Wrap a metrics queue such that the queued buffers update the served samples
+// before being passed on:
+func (sms *SelfMetricsServer) WrapQueue(mq BufferQueue) BufferQueue {
+	return &SelfMetricsQueue{BufferQueue: mq, server: sms}
+}
+
+type SelfMetricsQueue struct {
+	BufferQueue
+	server *SelfMetricsServer
+}
+
+func (smq *SelfMetricsQueue) QueueBuf(b *bytes.Buffer) {
+	smq.server.Update(b.Bytes())
+	smq.BufferQueue.QueueBuf(b)
+}
+
+// Satisfy GenIdBufferQueue interface:
+func (smq *SelfMetricsQueue) QueueBufFor(genId string, b *bytes.Buffer) {
+	smq.server.Update(b.Bytes())
+	QueueBufFor(smq.BufferQueue, genId, b)
+}
@@ -0,0 +1,107 @@
+// Tests for self_metrics.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+func TestSelfMetricsServer(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	sms := NewSelfMetricsServer("127.0.0.1:0")
+	if err := sms.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sms.Shutdown()
+
+	testMetricsQueue := vmi_testutils.NewTestMetricsQueue(0)
+	mq := sms.WrapQueue(testMetricsQueue)
+
+	scrape := func() string {
+		resp, err := http.Get("http://" + sms.Addr() + SELF_METRICS_PATH)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status: want: %d, got: %d", http.StatusOK, resp.StatusCode)
+		}
+		if got := resp.Header.Get("Content-Type"); got != SELF_METRICS_CONTENT_TYPE {
+			t.Fatalf("Content-Type: want: %q, got: %q", SELF_METRICS_CONTENT_TYPE, got)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(body)
+	}
+
+	if got := scrape(); got != "" {
+		t.Fatalf("initial scrape: want: \"\", got: %q", got)
+	}
+
+	for i, tc := range []struct {
+		bufs []string
+		want string
+	}{
+		{
+			bufs: []string{
+				"b{l=\"x y\"} 2 1000\nc 3 1000\n",
+				"a{l=\"1\"} 1 1000\n",
+			},
+			want: "a{l=\"1\"} 1\nb{l=\"x y\"} 2\nc 3\n",
+		},
+		// Delta cycle, only some series are updated, the rest are retained:
+		{
+			bufs: []string{
+				"c 4 2000\n",
+			},
+			want: "a{l=\"1\"} 1\nb{l=\"x y\"} 2\nc 4\n",
+		},
+		// New series, value w/o timestamp:
+		{
+			bufs: []string{
+				"a{l=\"2\"} 5\n",
+			},
+			want: "a{l=\"1\"} 1\na{l=\"2\"} 5\nb{l=\"x y\"} 2\nc 4\n",
+		},
+	} {
+		for j, b := range tc.bufs {
+			buf := mq.GetBuf()
+			buf.WriteString(b)
+			if j%2 == 0 {
+				mq.QueueBuf(buf)
+			} else {
+				QueueBufFor(mq, INTERNAL_METRICS_ID, buf)
+			}
+		}
+		if got := scrape(); got != tc.want {
+			t.Fatalf("step# %d: scrape:\nwant:\n%s\ngot:\n%s", i, tc.want, got)
+		}
+	}
+
+	// The buffers should have been passed on unchanged:
+	wantQueued := []string{
+		`b{l="x y"} 2 1000`, `c 3 1000`, `a{l="1"} 1 1000`, `c 4 2000`, `a{l="2"} 5`,
+	}
+	errBuf := testMetricsQueue.GenerateReport(wantQueued, true, nil)
+	if errBuf != nil && errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+
+	resp, err := http.Post("http://"+sms.Addr()+SELF_METRICS_PATH, "text/plain", &bytes.Buffer{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("POST status: want: %d, got: %d", http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
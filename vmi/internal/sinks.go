@@ -0,0 +1,220 @@
+// Multiple output sinks.
+
+package vmi_internal
+
+// The generated metrics may be sent to multiple destinations (sinks)
+// simultaneously, e.g. during a migration from one VictoriaMetrics cluster to
+// another. The primary sink is built from vmi_config.compressor_pool_config and
+// vmi_config.http_endpoint_pool_config, while additional ones may be defined
+// under vmi_config.additional_sinks, each with its own compressor pool, HTTP
+// endpoint pool and encoder.
+//
+// When additional sinks are defined, the generators write into a fan out
+// queue which encodes each buffer into the queue of every sink:
+//
+//                                          +---------+   +------------+
+//                                     +--->| Encoder |-->| Compressor |--> HTTP Endpoint Pool
+//                                     |    +---------+   +------------+
+//  +------------+    +--------------+ |
+//  | Generators |--->| Fan Out Queue|-+          ...
+//  +------------+    +--------------+ |
+//                                     |    +---------+   +------------+
+//                                     +--->| Encoder |-->| Compressor |--> HTTP Endpoint Pool
+//                                          +---------+   +------------+
+//
+// The generators produce metrics in Prometheus exposition text format, which
+// is the input for all encoders.
+//
+// The compressor pools w/ the remote write output format expect the metrics
+// encoded as such, therefore the remote_write encoding and output format imply
+// each other, see ReconcileSinkEncoding.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The native encoding, i.e. Prometheus exposition text format, passed
+	// through as-is:
+	METRICS_ENCODING_PROMETHEUS = "prometheus"
+
+	SINK_CONFIG_ENCODING_DEFAULT = METRICS_ENCODING_PROMETHEUS
+)
+
+// Convert metrics from the native format to the one expected by the sink:
+type MetricsEncoder interface {
+	// Encode the metrics from src, appending the result to dst:
+	Encode(dst *bytes.Buffer, src []byte) error
+}
+
+// Optional interface for the encoders, converting the encoded metrics back into
+// a human readable form, used for displaying them at stdout, see
+// StdoutMetricsQueue:
+type MetricsDecoder interface {
+	// Decode the metrics from src, appending the result to dst:
+	Decode(dst *bytes.Buffer, src []byte) error
+}
+
+// The native encoder:
+type PrometheusTextEncoder struct{}
+
+func (enc *PrometheusTextEncoder) Encode(dst *bytes.Buffer, src []byte) error {
+	_, err := dst.Write(src)
+	return err
+}
+
+// Encoders are registered by name, the latter being used in the sink config:
+var metricsEncoderBuilders = struct {
+	builders map[string]func() MetricsEncoder
+	mu       *sync.Mutex
+}{
+	map[string]func() MetricsEncoder{
+		METRICS_ENCODING_PROMETHEUS:   func() MetricsEncoder { return &PrometheusTextEncoder{} },
+		METRICS_ENCODING_REMOTE_WRITE: func() MetricsEncoder { return &RemoteWriteEncoder{} },
+	},
+	&sync.Mutex{},
+}
+
+func RegisterMetricsEncoder(encoding string, builder func() MetricsEncoder) {
+	metricsEncoderBuilders.mu.Lock()
+	metricsEncoderBuilders.builders[encoding] = builder
+	metricsEncoderBuilders.mu.Unlock()
+}
+
+func NewMetricsEncoder(encoding string) (MetricsEncoder, error) {
+	metricsEncoderBuilders.mu.Lock()
+	defer metricsEncoderBuilders.mu.Unlock()
+	builder := metricsEncoderBuilders.builders[encoding]
+	if builder == nil {
+		encodings := make([]string, 0, len(metricsEncoderBuilders.builders))
+		for encoding := range metricsEncoderBuilders.builders {
+			encodings = append(encodings, encoding)
+		}
+		sort.Strings(encodings)
+		return nil, fmt.Errorf("NewMetricsEncoder: invalid encoding %q, want one of %q", encoding, encodings)
+	}
+	return builder(), nil
+}
+
+// Reconcile the encoding w/ the output format of the compressor pool: the
+// remote write output format implies the remote_write encoding, which replaces
+// the native one, and vice versa. The pool config is updated as needed. Return
+// the resulting encoding or an error if they conflict.
+func ReconcileSinkEncoding(encoding string, poolCfg *CompressorPoolConfig) (string, error) {
+	if encoding == "" {
+		encoding = SINK_CONFIG_ENCODING_DEFAULT
+	}
+	remoteWriteOutput := poolCfg.OutputFormat == COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE
+	switch {
+	case encoding == METRICS_ENCODING_REMOTE_WRITE && !remoteWriteOutput:
+		poolCfg.OutputFormat = COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE
+	case encoding == METRICS_ENCODING_PROMETHEUS && remoteWriteOutput:
+		encoding = METRICS_ENCODING_REMOTE_WRITE
+	case encoding != METRICS_ENCODING_REMOTE_WRITE && remoteWriteOutput:
+		return "", fmt.Errorf(
+			"encoding %q: incompatible w/ output_format %q",
+			encoding, COMPRESSOR_POOL_OUTPUT_FORMAT_REMOTE_WRITE,
+		)
+	}
+	return encoding, nil
+}
+
+type SinkConfig struct {
+	// The name, used for logging:
+	Name string `yaml:"name"`
+	// The encoding, see RegisterMetricsEncoder:
+	Encoding string `yaml:"encoding"`
+	// Specific components configuration:
+	CompressorPoolConfig   *CompressorPoolConfig   `yaml:"compressor_pool_config"`
+	HttpEndpointPoolConfig *HttpEndpointPoolConfig `yaml:"http_endpoint_pool_config"`
+}
+
+func DefaultSinkConfig() *SinkConfig {
+	return &SinkConfig{
+		Encoding:               SINK_CONFIG_ENCODING_DEFAULT,
+		CompressorPoolConfig:   DefaultCompressorPoolConfig(),
+		HttpEndpointPoolConfig: DefaultHttpEndpointPoolConfig(),
+	}
+}
+
+// Sinks are loaded from a list, so they have to be primed w/ default values
+// explicitly:
+func (sinkCfg *SinkConfig) UnmarshalYAML(node *yaml.Node) error {
+	type sinkConfig SinkConfig
+	cfg := (*sinkConfig)(DefaultSinkConfig())
+	if err := node.Decode(cfg); err != nil {
+		return err
+	}
+	*sinkCfg = SinkConfig(*cfg)
+	return nil
+}
+
+// A sink as seen by the fan out queue:
+type SinkQueue struct {
+	Name    string
+	Encoder MetricsEncoder
+	Queue   BufferQueue
+}
+
+type FanOutMetricsQueue struct {
+	// The buffer pool for the generators:
+	bufPool *ReadFileBufPool
+	// The sinks:
+	sinks []*SinkQueue
+	// The target size, the minimum across all sinks:
+	targetSize int
+}
+
+var sinksLog = NewCompLogger("sinks")
+
+func NewFanOutMetricsQueue(sinks []*SinkQueue, bufferPoolMaxSize int) *FanOutMetricsQueue {
+	targetSize := 0
+	for i, sink := range sinks {
+		if sinkTargetSize := sink.Queue.GetTargetSize(); i == 0 || sinkTargetSize < targetSize {
+			targetSize = sinkTargetSize
+		}
+		sinksLog.Infof("sink# %d: name=%q", i, sink.Name)
+	}
+	return &FanOutMetricsQueue{
+		bufPool:    NewBufPool(bufferPoolMaxSize),
+		sinks:      sinks,
+		targetSize: targetSize,
+	}
+}
+
+// Satisfy BufferQueue interface:
+func (fq *FanOutMetricsQueue) GetBuf() *bytes.Buffer {
+	return fq.bufPool.GetBuf()
+}
+
+func (fq *FanOutMetricsQueue) ReturnBuf(buf *bytes.Buffer) {
+	fq.bufPool.ReturnBuf(buf)
+}
+
+func (fq *FanOutMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	fq.QueueBufFor(METRICS_GENERATOR_UNKNOWN_ID, buf)
+}
+
+// Satisfy GenIdBufferQueue interface:
+func (fq *FanOutMetricsQueue) QueueBufFor(genId string, buf *bytes.Buffer) {
+	for _, sink := range fq.sinks {
+		sinkBuf := sink.Queue.GetBuf()
+		if err := sink.Encoder.Encode(sinkBuf, buf.Bytes()); err != nil {
+			sinksLog.Warnf("sink %q: gen_id=%q: %v, buffer discarded", sink.Name, genId, err)
+			updateDroppedMetrics(genId, buf.Bytes())
+			sink.Queue.ReturnBuf(sinkBuf)
+			continue
+		}
+		QueueBufFor(sink.Queue, genId, sinkBuf)
+	}
+	fq.bufPool.ReturnBuf(buf)
+}
+
+func (fq *FanOutMetricsQueue) GetTargetSize() int {
+	return fq.targetSize
+}
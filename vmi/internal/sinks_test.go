@@ -0,0 +1,250 @@
+// Tests for sinks.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+const (
+	TEST_SINKS_ENCODING_PREFIXED = "test_prefixed"
+	TEST_SINKS_ENCODING_PREFIX   = "enc:"
+)
+
+// A test encoder which prefixes every line:
+type testPrefixedEncoder struct{}
+
+func (enc *testPrefixedEncoder) Encode(dst *bytes.Buffer, src []byte) error {
+	for _, line := range bytes.SplitAfter(src, []byte{'\n'}) {
+		if len(line) > 0 {
+			dst.WriteString(TEST_SINKS_ENCODING_PREFIX)
+			dst.Write(line)
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterMetricsEncoder(
+		TEST_SINKS_ENCODING_PREFIXED,
+		func() MetricsEncoder { return &testPrefixedEncoder{} },
+	)
+}
+
+func TestFanOutMetricsQueue(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	encodings := []string{METRICS_ENCODING_PROMETHEUS, TEST_SINKS_ENCODING_PREFIXED}
+	linePrefixes := []string{"", TEST_SINKS_ENCODING_PREFIX}
+
+	sinks := make([]*SinkQueue, len(encodings))
+	pools := make([]*CompressorPool, len(encodings))
+	senders := make([]*SenderMock, len(encodings))
+	for i, encoding := range encodings {
+		encoder, err := NewMetricsEncoder(encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		poolCfg := DefaultCompressorPoolConfig()
+		poolCfg.NumCompressors = 2
+		poolCfg.FlushInterval = 0
+		pools[i], err = NewCompressorPool(poolCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		senders[i] = NewSenderMock()
+		pools[i].Start(senders[i])
+		sinks[i] = &SinkQueue{
+			Name:    fmt.Sprintf("sink%d", i),
+			Encoder: encoder,
+			Queue:   pools[i],
+		}
+	}
+
+	fanOutQueue := NewFanOutMetricsQueue(sinks, 0)
+
+	numQueuedBuffers, numLinesPerBuffer := 16, 100
+	wantLines := make([]string, 0)
+	for bufIndx := 0; bufIndx < numQueuedBuffers; bufIndx++ {
+		buf := fanOutQueue.GetBuf()
+		for lineIndx := 0; lineIndx < numLinesPerBuffer; lineIndx++ {
+			line := fmt.Sprintf("metric{buf=\"%d\",line=\"%d\"} 1 1000", bufIndx, lineIndx)
+			wantLines = append(wantLines, line)
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+		fanOutQueue.QueueBuf(buf)
+	}
+
+	for _, pool := range pools {
+		pool.Shutdown()
+	}
+
+	for i, sender := range senders {
+		gotLineMap := sender.MapLines()
+		errBuf := &bytes.Buffer{}
+		for _, line := range wantLines {
+			line = linePrefixes[i] + line
+			if gotLineMap[line] != 1 {
+				fmt.Fprintf(errBuf, "\n%q count: want: 1, got: %d", line, gotLineMap[line])
+			}
+			delete(gotLineMap, line)
+		}
+		for line := range gotLineMap {
+			fmt.Fprintf(errBuf, "\nunexpected %q", line)
+		}
+		if errBuf.Len() > 0 {
+			t.Fatalf("sink %q (encoding %q):%s", sinks[i].Name, encodings[i], errBuf)
+		}
+	}
+}
+
+func TestNewMetricsEncoderInvalid(t *testing.T) {
+	if _, err := NewMetricsEncoder("no-such-encoding"); err == nil {
+		t.Fatal("want error, got nil")
+	}
+}
+
+func TestLoadConfigAdditionalSinks(t *testing.T) {
+	buf := []byte(`
+vmi_config:
+  additional_sinks:
+    - name: secondary
+      encoding: ` + TEST_SINKS_ENCODING_PREFIXED + `
+      compressor_pool_config:
+        num_compressors: 3
+      http_endpoint_pool_config:
+        endpoints:
+          - url: http://localhost:9999/api/v1/import/prometheus
+    - name: tertiary
+`)
+	vmiConfig, err := LoadConfig("", nil, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vmiConfig.AdditionalSinks) != 2 {
+		t.Fatalf("len(additional_sinks): want: 2, got: %d", len(vmiConfig.AdditionalSinks))
+	}
+
+	sinkCfg := vmiConfig.AdditionalSinks[0]
+	if sinkCfg.Encoding != TEST_SINKS_ENCODING_PREFIXED {
+		t.Fatalf("encoding: want: %q, got: %q", TEST_SINKS_ENCODING_PREFIXED, sinkCfg.Encoding)
+	}
+	if sinkCfg.CompressorPoolConfig.NumCompressors != 3 {
+		t.Fatalf("num_compressors: want: 3, got: %d", sinkCfg.CompressorPoolConfig.NumCompressors)
+	}
+	wantBatchTargetSize := DefaultCompressorPoolConfig().BatchTargetSize
+	if sinkCfg.CompressorPoolConfig.BatchTargetSize != wantBatchTargetSize {
+		t.Fatalf(
+			"batch_target_size: want: %q, got: %q",
+			wantBatchTargetSize, sinkCfg.CompressorPoolConfig.BatchTargetSize,
+		)
+	}
+
+	// Unspecified fields should have default values:
+	sinkCfg = vmiConfig.AdditionalSinks[1]
+	if sinkCfg.Encoding != SINK_CONFIG_ENCODING_DEFAULT {
+		t.Fatalf("encoding: want: %q, got: %q", SINK_CONFIG_ENCODING_DEFAULT, sinkCfg.Encoding)
+	}
+	if sinkCfg.CompressorPoolConfig == nil || sinkCfg.HttpEndpointPoolConfig == nil {
+		t.Fatal("nil compressor_pool_config and/or http_endpoint_pool_config")
+	}
+}
+
+func TestFanOutMetricsQueueRemoteWrite(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	encodings := []string{METRICS_ENCODING_PROMETHEUS, METRICS_ENCODING_REMOTE_WRITE}
+
+	sinks := make([]*SinkQueue, len(encodings))
+	pools := make([]*CompressorPool, len(encodings))
+	senders := make([]*SenderMock, len(encodings))
+	for i, encoding := range encodings {
+		encoder, err := NewMetricsEncoder(encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		poolCfg := DefaultCompressorPoolConfig()
+		poolCfg.NumCompressors = 2
+		poolCfg.FlushInterval = 0
+		if _, err = ReconcileSinkEncoding(encoding, poolCfg); err != nil {
+			t.Fatal(err)
+		}
+		pools[i], err = NewCompressorPool(poolCfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		senders[i] = NewSenderMock()
+		pools[i].Start(senders[i])
+		sinks[i] = &SinkQueue{
+			Name:    encoding,
+			Encoder: encoder,
+			Queue:   pools[i],
+		}
+	}
+
+	fanOutQueue := NewFanOutMetricsQueue(sinks, 0)
+
+	numQueuedBuffers, numLinesPerBuffer := 16, 100
+	wantLines := make([]string, 0)
+	for bufIndx := 0; bufIndx < numQueuedBuffers; bufIndx++ {
+		buf := fanOutQueue.GetBuf()
+		for lineIndx := 0; lineIndx < numLinesPerBuffer; lineIndx++ {
+			line := fmt.Sprintf("metric{buf=\"%d\",line=\"%d\"} %d 1746121347582", bufIndx, lineIndx, lineIndx)
+			wantLines = append(wantLines, line)
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+		fanOutQueue.QueueBuf(buf)
+	}
+
+	for _, pool := range pools {
+		pool.Shutdown()
+	}
+
+	// Prometheus sink: the text lines, as queued:
+	gotLineMap := senders[0].MapLines()
+
+	// Remote write sink: the time series decoded from each snappy compressed
+	// WriteRequest:
+	gotSeriesMap := make(map[string]int)
+	senders[1].mu.Lock()
+	for i, b := range senders[1].bufs {
+		proto, err := snappy.Decode(nil, b)
+		if err != nil {
+			t.Fatalf("buf# %d: snappy.Decode: %v", i, err)
+		}
+		gotSeries, err := decodeTestRemoteWriteRequest(proto)
+		if err != nil {
+			t.Fatalf("buf# %d: %v", i, err)
+		}
+		for _, series := range gotSeries {
+			gotSeriesMap[series] += 1
+		}
+	}
+	senders[1].mu.Unlock()
+
+	for i, gotMap := range []map[string]int{gotLineMap, gotSeriesMap} {
+		errBuf := &bytes.Buffer{}
+		for _, line := range wantLines {
+			if gotMap[line] != 1 {
+				fmt.Fprintf(errBuf, "\n%q count: want: 1, got: %d", line, gotMap[line])
+			}
+			delete(gotMap, line)
+		}
+		for line := range gotMap {
+			fmt.Fprintf(errBuf, "\nunexpected %q", line)
+		}
+		if errBuf.Len() > 0 {
+			t.Fatalf("sink %q:%s", sinks[i].Name, errBuf)
+		}
+	}
+}
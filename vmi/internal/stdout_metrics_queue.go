@@ -2,9 +2,18 @@
 
 package vmi_internal
 
+// The metrics are displayed in Prometheus exposition text format by default.
+// For debugging other encoders, the queue may be built w/ the encoder of
+// interest, in which case the metrics are run through it, such that the output
+// reflects what would actually be sent. If the encoder implements
+// MetricsDecoder, the encoded metrics are decoded back for human reading,
+// otherwise they are displayed as-is.
+
 import (
+	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"sync"
 
@@ -22,13 +31,47 @@ type StdoutMetricsQueue struct {
 	wg *sync.WaitGroup
 	// First time use flag, will print a specific header:
 	firstUse bool
+	// Optional encoder, nil for the native format:
+	encoder MetricsEncoder
+	// Scratch buffers for the encoded and decoded metrics:
+	encodedBuf, decodedBuf *bytes.Buffer
+	// Buffered output, flushed whenever the queue is drained and at shutdown:
+	out *bufio.Writer
+	// Whether the queue was closed or not, protected by the lock. Buffers
+	// queued after shutdown are discarded:
+	closed bool
+	mu     *sync.Mutex
 }
 
 func NewStdoutMetricsQueue(poolCfg *CompressorPoolConfig) (*StdoutMetricsQueue, error) {
+	return newStdoutMetricsQueue(poolCfg, os.Stdout)
+}
+
+// Same as NewStdoutMetricsQueue, w/ the metrics run through the encoder for
+// the given encoding, see RegisterMetricsEncoder:
+func NewEncodingStdoutMetricsQueue(poolCfg *CompressorPoolConfig, encoding string) (*StdoutMetricsQueue, error) {
+	return newEncodingStdoutMetricsQueue(poolCfg, encoding, os.Stdout)
+}
+
+// Allow the output to be overridden for testing:
+func newStdoutMetricsQueue(poolCfg *CompressorPoolConfig, out io.Writer) (*StdoutMetricsQueue, error) {
+	return newEncodingStdoutMetricsQueue(poolCfg, METRICS_ENCODING_PROMETHEUS, out)
+}
+
+func newEncodingStdoutMetricsQueue(poolCfg *CompressorPoolConfig, encoding string, out io.Writer) (*StdoutMetricsQueue, error) {
 	if poolCfg == nil {
 		poolCfg = DefaultCompressorPoolConfig()
 	}
 
+	var encoder MetricsEncoder
+	if encoding != "" && encoding != METRICS_ENCODING_PROMETHEUS {
+		var err error
+		encoder, err = NewMetricsEncoder(encoding)
+		if err != nil {
+			return nil, fmt.Errorf("NewStdoutMetricsQueue: %v", err)
+		}
+	}
+
 	batchTargetSize, err := units.RAMInBytes(poolCfg.BatchTargetSize)
 	if err != nil {
 		return nil, fmt.Errorf(
@@ -43,6 +86,11 @@ func NewStdoutMetricsQueue(poolCfg *CompressorPoolConfig) (*StdoutMetricsQueue,
 		batchTargetSize: int(batchTargetSize),
 		wg:              &sync.WaitGroup{},
 		firstUse:        true,
+		encoder:         encoder,
+		encodedBuf:      &bytes.Buffer{},
+		decodedBuf:      &bytes.Buffer{},
+		out:             bufio.NewWriter(out),
+		mu:              &sync.Mutex{},
 	}
 
 	metricsQueue.wg.Add(1)
@@ -60,6 +108,17 @@ func (mq *StdoutMetricsQueue) ReturnBuf(buf *bytes.Buffer) {
 }
 
 func (mq *StdoutMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	mq.QueueBufFor(METRICS_GENERATOR_UNKNOWN_ID, buf)
+}
+
+func (mq *StdoutMetricsQueue) QueueBufFor(genId string, buf *bytes.Buffer) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	if mq.closed {
+		updateDroppedMetrics(genId, buf.Bytes())
+		mq.bufPool.ReturnBuf(buf)
+		return
+	}
 	mq.queue <- buf
 }
 
@@ -70,24 +129,64 @@ func (mq *StdoutMetricsQueue) GetTargetSize() int {
 func (mq *StdoutMetricsQueue) loop() {
 	defer mq.wg.Done()
 
+	out := mq.out
+	// Whatever was written thus far should be flushed at exit:
+	defer out.Flush()
+
 	for {
 		buf, isOpen := <-mq.queue
 		if !isOpen {
 			return
 		}
 		if mq.firstUse {
-			os.Stdout.WriteString("\n# Metrics will be displayed to stdout\n\n")
+			out.WriteString("\n# Metrics will be displayed to stdout\n\n")
 			mq.firstUse = false
 		}
 		if buf.Len() > 0 {
-			os.Stdout.Write(buf.Bytes())
-			os.Stdout.WriteString("\n")
+			out.Write(mq.display(buf.Bytes()))
+			out.WriteString("\n")
 		}
 		mq.bufPool.ReturnBuf(buf)
+		// Flush when there is nothing else pending:
+		if len(mq.queue) == 0 {
+			out.Flush()
+		}
 	}
 }
 
+// Return the displayable form of the metrics, run through the encoder, if
+// any, and decoded back, if supported. The errors are displayed as comments:
+func (mq *StdoutMetricsQueue) display(metrics []byte) []byte {
+	if mq.encoder == nil {
+		return metrics
+	}
+	encodedBuf := mq.encodedBuf
+	encodedBuf.Reset()
+	if err := mq.encoder.Encode(encodedBuf, metrics); err != nil {
+		return []byte(fmt.Sprintf("# encode error: %v\n", err))
+	}
+	decoder, ok := mq.encoder.(MetricsDecoder)
+	if !ok {
+		return encodedBuf.Bytes()
+	}
+	decodedBuf := mq.decodedBuf
+	decodedBuf.Reset()
+	if err := decoder.Decode(decodedBuf, encodedBuf.Bytes()); err != nil {
+		return []byte(fmt.Sprintf("# decode error: %v\n", err))
+	}
+	return decodedBuf.Bytes()
+}
+
+// Close the queue and wait for all pending buffers to be written out. It is
+// safe to call it multiple times, e.g. from a deferred function and from a
+// fatal exit handler.
 func (mq *StdoutMetricsQueue) Shutdown() {
-	close(mq.queue)
+	mq.mu.Lock()
+	alreadyClosed := mq.closed
+	if !alreadyClosed {
+		mq.closed = true
+		close(mq.queue)
+	}
+	mq.mu.Unlock()
 	mq.wg.Wait()
 }
@@ -0,0 +1,211 @@
+// Tests for stdout_metrics_queue.go
+
+package vmi_internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+type StdoutMetricsQueueTestCase struct {
+	numBufs        int
+	linesPerBuf    int
+	queueSize      int
+	shutdownRepeat int
+}
+
+func testStdoutMetricsQueueShutdownFlush(tc *StdoutMetricsQueueTestCase, t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	poolCfg := DefaultCompressorPoolConfig()
+	poolCfg.MetricsQueueSize = tc.queueSize
+	out := &bytes.Buffer{}
+	mq, err := newStdoutMetricsQueue(poolCfg, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantLines := make([]string, 0)
+	for i := 0; i < tc.numBufs; i++ {
+		buf := mq.GetBuf()
+		for j := 0; j < tc.linesPerBuf; j++ {
+			line := fmt.Sprintf(`metric{buf="%d",line="%d"} %d 1746121347582`, i, j, i*tc.linesPerBuf+j)
+			fmt.Fprintf(buf, "%s\n", line)
+			wantLines = append(wantLines, line)
+		}
+		mq.QueueBuf(buf)
+	}
+	// Shutdown right after queueing:
+	for i := 0; i <= tc.shutdownRepeat; i++ {
+		mq.Shutdown()
+	}
+
+	// Buffers queued after shutdown should be discarded:
+	buf := mq.GetBuf()
+	buf.WriteString("metric_after_shutdown 1\n")
+	mq.QueueBuf(buf)
+
+	gotLines := make(map[string]bool)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			gotLines[line] = true
+		}
+	}
+	for _, line := range wantLines {
+		if !gotLines[line] {
+			t.Errorf("missing line: %q", line)
+		}
+	}
+	if len(gotLines) != len(wantLines) {
+		t.Errorf("line count: want: %d, got: %d", len(wantLines), len(gotLines))
+	}
+}
+
+func TestStdoutMetricsQueueShutdownFlush(t *testing.T) {
+	for _, tc := range []*StdoutMetricsQueueTestCase{
+		{numBufs: 1, linesPerBuf: 1, queueSize: 1},
+		{numBufs: 10, linesPerBuf: 100, queueSize: 64},
+		{numBufs: 100, linesPerBuf: 50, queueSize: 4},
+		{numBufs: 16, linesPerBuf: 10, queueSize: 16, shutdownRepeat: 2},
+	} {
+		t.Run(
+			fmt.Sprintf("numBufs=%d,linesPerBuf=%d,queueSize=%d", tc.numBufs, tc.linesPerBuf, tc.queueSize),
+			func(t *testing.T) { testStdoutMetricsQueueShutdownFlush(tc, t) },
+		)
+	}
+}
+
+const (
+	TEST_STDOUT_ENCODING_BINARY = "test_binary"
+)
+
+// A test binary encoder w/ decoding support, a stand-in for the protobuf
+// based ones; each line is encoded as its length (big endian uint32)
+// followed by its bytes:
+type testBinaryEncoder struct{}
+
+func (enc *testBinaryEncoder) Encode(dst *bytes.Buffer, src []byte) error {
+	for _, line := range bytes.Split(src, []byte{'\n'}) {
+		if len(line) > 0 {
+			binary.Write(dst, binary.BigEndian, uint32(len(line)))
+			dst.Write(line)
+		}
+	}
+	return nil
+}
+
+func (enc *testBinaryEncoder) Decode(dst *bytes.Buffer, src []byte) error {
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return fmt.Errorf("truncated length")
+		}
+		n := int(binary.BigEndian.Uint32(src))
+		src = src[4:]
+		if len(src) < n {
+			return fmt.Errorf("truncated line")
+		}
+		dst.Write(src[:n])
+		dst.WriteByte('\n')
+		src = src[n:]
+	}
+	return nil
+}
+
+func init() {
+	RegisterMetricsEncoder(
+		TEST_STDOUT_ENCODING_BINARY,
+		func() MetricsEncoder { return &testBinaryEncoder{} },
+	)
+}
+
+func TestStdoutMetricsQueueEncoding(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	for _, tc := range []struct {
+		encoding string
+		// The prefix expected for the displayed lines:
+		wantPrefix string
+	}{
+		{METRICS_ENCODING_PROMETHEUS, ""},
+		// Decoded back:
+		{TEST_STDOUT_ENCODING_BINARY, ""},
+		// No decoding support, displayed as encoded:
+		{TEST_SINKS_ENCODING_PREFIXED, TEST_SINKS_ENCODING_PREFIX},
+	} {
+		t.Run(tc.encoding, func(t *testing.T) {
+			out := &bytes.Buffer{}
+			mq, err := newEncodingStdoutMetricsQueue(nil, tc.encoding, out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wantLines := make([]string, 0)
+			buf := mq.GetBuf()
+			for i := 0; i < 10; i++ {
+				line := fmt.Sprintf(`metric{line="%d"} %d 1746121347582`, i, i)
+				fmt.Fprintf(buf, "%s\n", line)
+				wantLines = append(wantLines, tc.wantPrefix+line)
+			}
+			mq.QueueBuf(buf)
+			mq.Shutdown()
+
+			gotLines := make([]string, 0)
+			for _, line := range strings.Split(out.String(), "\n") {
+				if line != "" && !strings.HasPrefix(line, "#") {
+					gotLines = append(gotLines, line)
+				}
+			}
+			if want, got := strings.Join(wantLines, "\n"), strings.Join(gotLines, "\n"); want != got {
+				t.Fatalf("output:\nwant:\n%s\ngot:\n%s", want, got)
+			}
+		})
+	}
+
+	if _, err := newEncodingStdoutMetricsQueue(nil, "no_such_encoding", &bytes.Buffer{}); err == nil {
+		t.Fatal("no error for invalid encoding")
+	}
+}
+
+func TestStdoutMetricsQueueRemoteWrite(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	savedRemoteWriteTimeNowFn := remoteWriteTimeNowFn
+	defer func() { remoteWriteTimeNowFn = savedRemoteWriteTimeNowFn }()
+	remoteWriteTimeNowFn = func() time.Time { return time.UnixMilli(1746121347000) }
+
+	out := &bytes.Buffer{}
+	mq, err := newEncodingStdoutMetricsQueue(nil, METRICS_ENCODING_REMOTE_WRITE, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := mq.GetBuf()
+	buf.WriteString(`metric{inst="a",job="test"} 1.5 1746121347582` + "\n")
+	buf.WriteString(`metric_no_labels 42 1746121347583` + "\n")
+	// No timestamp, the batch time is assigned:
+	buf.WriteString(`metric_no_ts{inst="b"} -3` + "\n")
+	mq.QueueBuf(buf)
+	mq.Shutdown()
+
+	wantLines := []string{
+		`metric{inst="a",job="test"} 1.5 1746121347582`,
+		`metric_no_labels 42 1746121347583`,
+		`metric_no_ts{inst="b"} -3 1746121347000`,
+	}
+	gotLines := make([]string, 0)
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line != "" && !strings.HasPrefix(line, "#") {
+			gotLines = append(gotLines, line)
+		}
+	}
+	if want, got := strings.Join(wantLines, "\n"), strings.Join(gotLines, "\n"); want != got {
+		t.Fatalf("output:\nwant:\n%s\ngot:\n%s", want, got)
+	}
+}
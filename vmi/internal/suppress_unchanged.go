@@ -0,0 +1,205 @@
+// Framework level suppression of unchanged samples.
+
+package vmi_internal
+
+// Some data sources re-report the exact same value every cycle for many
+// series. The generators taking the delta approach already suppress the
+// unchanged values, but the ones which don't re-send everything. The queue
+// below centralizes the delta behavior for all generators: it caches the last
+// sent value for each series, i.e. `name{label="val",...}`, and it suppresses
+// the samples w/ the same value until the full metrics interval has elapsed
+// since the last sent one.
+//
+// The age is based on the timestamp of the sample, rather than on the
+// wallclock, such that the outcome depends only on the content.
+//
+// The cache is bounded; when it is full, the series which are due for a full
+// metrics re-send anyway are evicted and if that doesn't make room, the new
+// series are passed through uncached, i.e. never suppressed. The cache is
+// walked for eviction only when the earliest due time was reached, such that
+// passing through the new series under label churn costs O(1) per line.
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	SUPPRESS_UNCHANGED_CONFIG_ENABLED_DEFAULT               = false
+	SUPPRESS_UNCHANGED_CONFIG_FULL_METRICS_INTERVAL_DEFAULT = 2 * time.Minute
+	SUPPRESS_UNCHANGED_CONFIG_MAX_SERIES_DEFAULT            = 100000
+)
+
+type SuppressUnchangedConfig struct {
+	// Whether the suppression is enabled or not:
+	Enabled bool `yaml:"enabled"`
+	// Unchanged samples are re-sent at least this often:
+	FullMetricsInterval time.Duration `yaml:"full_metrics_interval"`
+	// The max number of series tracked:
+	MaxSeries int `yaml:"max_series"`
+}
+
+func DefaultSuppressUnchangedConfig() *SuppressUnchangedConfig {
+	return &SuppressUnchangedConfig{
+		Enabled:             SUPPRESS_UNCHANGED_CONFIG_ENABLED_DEFAULT,
+		FullMetricsInterval: SUPPRESS_UNCHANGED_CONFIG_FULL_METRICS_INTERVAL_DEFAULT,
+		MaxSeries:           SUPPRESS_UNCHANGED_CONFIG_MAX_SERIES_DEFAULT,
+	}
+}
+
+type suppressUnchangedEntry struct {
+	// The last sent value:
+	value string
+	// The timestamp of the last sent sample, in milliseconds:
+	sentTs int64
+}
+
+type SuppressUnchangedMetricsQueue struct {
+	BufferQueue
+	// The series cache, keyed by `name{label="val",...}`:
+	cache map[string]*suppressUnchangedEntry
+	// Full metrics interval, in milliseconds:
+	fullMetricsIntervalMs int64
+	maxSeries             int
+	// A lower bound for the earliest time, in milliseconds, when an entry is
+	// due for eviction; the cache is not walked before that:
+	nextEvictTs int64
+	mu          *sync.Mutex
+}
+
+func NewSuppressUnchangedMetricsQueue(metricsQueue BufferQueue, cfg *SuppressUnchangedConfig) (*SuppressUnchangedMetricsQueue, error) {
+	if cfg == nil {
+		cfg = DefaultSuppressUnchangedConfig()
+	}
+	if cfg.FullMetricsInterval <= 0 {
+		return nil, fmt.Errorf(
+			"NewSuppressUnchangedMetricsQueue: invalid full_metrics_interval %s, want > 0",
+			cfg.FullMetricsInterval,
+		)
+	}
+	if cfg.MaxSeries <= 0 {
+		return nil, fmt.Errorf(
+			"NewSuppressUnchangedMetricsQueue: invalid max_series %d, want > 0",
+			cfg.MaxSeries,
+		)
+	}
+	runnerLog.Infof("suppress_unchanged.full_metrics_interval=%s", cfg.FullMetricsInterval)
+	runnerLog.Infof("suppress_unchanged.max_series=%d", cfg.MaxSeries)
+	return &SuppressUnchangedMetricsQueue{
+		BufferQueue:           metricsQueue,
+		cache:                 make(map[string]*suppressUnchangedEntry),
+		fullMetricsIntervalMs: cfg.FullMetricsInterval.Milliseconds(),
+		maxSeries:             cfg.MaxSeries,
+		nextEvictTs:           math.MaxInt64,
+		mu:                    &sync.Mutex{},
+	}, nil
+}
+
+// Split a `name{label="val",...} value ts` line into series and value and
+// parse the timestamp. Return ok=false if the line doesn't have a timestamp.
+func splitSuppressUnchangedLine(line []byte) (series, value []byte, ts int64, ok bool) {
+	tsStart := bytes.LastIndexByte(line, ' ')
+	if tsStart <= 0 {
+		return
+	}
+	valueStart := bytes.LastIndexByte(line[:tsStart], ' ')
+	if valueStart <= 0 {
+		return
+	}
+	// Parse the timestamp in place, to avoid the allocation of a string:
+	digits := line[tsStart+1:]
+	if len(digits) == 0 {
+		return
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' {
+			return
+		}
+		ts = ts*10 + int64(c-'0')
+	}
+	return line[:valueStart], line[valueStart+1 : tsStart], ts, true
+}
+
+// Evict the series due for a full metrics re-send as of ts and update the
+// next eviction time. Must be called w/ the lock held.
+func (sq *SuppressUnchangedMetricsQueue) evict(ts int64) {
+	nextEvictTs := int64(math.MaxInt64)
+	for series, entry := range sq.cache {
+		if dueTs := entry.sentTs + sq.fullMetricsIntervalMs; ts >= dueTs {
+			delete(sq.cache, series)
+		} else if dueTs < nextEvictTs {
+			nextEvictTs = dueTs
+		}
+	}
+	sq.nextEvictTs = nextEvictTs
+}
+
+// Whether the sample should be sent or not, updating the cache accordingly:
+func (sq *SuppressUnchangedMetricsQueue) shouldSend(line []byte) bool {
+	series, value, ts, ok := splitSuppressUnchangedLine(line)
+	if !ok {
+		return true
+	}
+	// N.B. The compiler optimizes the map lookup and the comparison by
+	// string([]byte) such that no allocation takes place:
+	entry := sq.cache[string(series)]
+	if entry == nil {
+		if len(sq.cache) >= sq.maxSeries {
+			if ts < sq.nextEvictTs {
+				return true
+			}
+			sq.evict(ts)
+			if len(sq.cache) >= sq.maxSeries {
+				return true
+			}
+		}
+		sq.cache[string(series)] = &suppressUnchangedEntry{string(value), ts}
+		// N.B. The updates of the existing entries can only postpone their
+		// due time, so the bound stays valid w/o adjustment:
+		if dueTs := ts + sq.fullMetricsIntervalMs; dueTs < sq.nextEvictTs {
+			sq.nextEvictTs = dueTs
+		}
+		return true
+	}
+	if string(value) == entry.value && ts-entry.sentTs < sq.fullMetricsIntervalMs {
+		return false
+	}
+	if string(value) != entry.value {
+		entry.value = string(value)
+	}
+	entry.sentTs = ts
+	return true
+}
+
+func (sq *SuppressUnchangedMetricsQueue) QueueBuf(buf *bytes.Buffer) {
+	sq.QueueBufFor(METRICS_GENERATOR_UNKNOWN_ID, buf)
+}
+
+// Satisfy GenIdBufferQueue interface:
+func (sq *SuppressUnchangedMetricsQueue) QueueBufFor(genId string, buf *bytes.Buffer) {
+	// Compact the buffer in place, since the kept lines can only move towards
+	// the start:
+	b := buf.Bytes()
+	n := 0
+	sq.mu.Lock()
+	for start := 0; start < len(b); {
+		end, next := len(b), len(b)
+		if i := bytes.IndexByte(b[start:], '\n'); i >= 0 {
+			end, next = start+i, start+i+1
+		}
+		if sq.shouldSend(b[start:end]) {
+			n += copy(b[n:], b[start:next])
+		}
+		start = next
+	}
+	sq.mu.Unlock()
+	buf.Truncate(n)
+	if n == 0 {
+		sq.BufferQueue.ReturnBuf(buf)
+		return
+	}
+	QueueBufFor(sq.BufferQueue, genId, buf)
+}
@@ -0,0 +1,164 @@
+// Tests for suppress_unchanged.go
+
+package vmi_internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	vmi_testutils "github.com/bgp59/victoriametrics-importer/vmi/testutils"
+)
+
+// A non-delta generator, emitting all its metrics every cycle:
+type suppressUnchangedTestGenerator struct {
+	GeneratorBase
+	cycle int
+}
+
+func (gen *suppressUnchangedTestGenerator) generate(ts time.Time) {
+	buf := gen.MetricsQueue.GetBuf()
+	tsSuffix := fmt.Sprintf(" %d\n", ts.UnixMilli())
+	// Unchanged:
+	buf.WriteString(`vmi_test_const{i="1"} 1` + tsSuffix)
+	buf.WriteString(`vmi_test_const{i="2"} 2` + tsSuffix)
+	// Changed every cycle:
+	buf.WriteString(fmt.Sprintf(`vmi_test_counter{i="1"} %d`, gen.cycle) + tsSuffix)
+	// Changed every 3rd cycle:
+	buf.WriteString(fmt.Sprintf(`vmi_test_gauge{i="1"} %d`, gen.cycle/3) + tsSuffix)
+	QueueBufFor(gen.MetricsQueue, gen.Id, buf)
+	gen.cycle++
+}
+
+func TestSuppressUnchangedMetricsQueue(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	interval, numCycles := time.Second, 12
+	cfg := DefaultSuppressUnchangedConfig()
+	cfg.Enabled = true
+	cfg.FullMetricsInterval = 5 * interval
+
+	mq := vmi_testutils.NewTestMetricsQueue(0)
+	sq, err := NewSuppressUnchangedMetricsQueue(mq, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gen := &suppressUnchangedTestGenerator{
+		GeneratorBase: GeneratorBase{Id: "suppress_unchanged_test", MetricsQueue: sq},
+	}
+	ts0 := time.UnixMilli(1746121347000)
+	wantMetrics := make([]string, 0)
+	for cycle := 0; cycle < numCycles; cycle++ {
+		ts := ts0.Add(time.Duration(cycle) * interval)
+		gen.generate(ts)
+		tsSuffix := fmt.Sprintf(" %d", ts.UnixMilli())
+		// The unchanged series are sent at full metrics interval only:
+		if cycle%5 == 0 {
+			wantMetrics = append(
+				wantMetrics,
+				`vmi_test_const{i="1"} 1`+tsSuffix,
+				`vmi_test_const{i="2"} 2`+tsSuffix,
+			)
+		}
+		wantMetrics = append(wantMetrics, fmt.Sprintf(`vmi_test_counter{i="1"} %d`, cycle)+tsSuffix)
+		// The value changes more often than the full metrics interval:
+		if cycle%3 == 0 {
+			wantMetrics = append(wantMetrics, fmt.Sprintf(`vmi_test_gauge{i="1"} %d`, cycle/3)+tsSuffix)
+		}
+	}
+
+	errBuf := mq.GenerateReport(wantMetrics, true, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestSuppressUnchangedMetricsQueueMaxSeries(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	cfg := DefaultSuppressUnchangedConfig()
+	cfg.Enabled = true
+	cfg.FullMetricsInterval = time.Minute
+	cfg.MaxSeries = 1
+
+	mq := vmi_testutils.NewTestMetricsQueue(0)
+	sq, err := NewSuppressUnchangedMetricsQueue(mq, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts0 := time.UnixMilli(1746121347000)
+	wantMetrics := make([]string, 0)
+	for cycle := 0; cycle < 3; cycle++ {
+		ts := ts0.Add(time.Duration(cycle) * time.Second).UnixMilli()
+		buf := sq.GetBuf()
+		fmt.Fprintf(buf, "vmi_test_a 1 %d\nvmi_test_b 1 %d\n", ts, ts)
+		sq.QueueBuf(buf)
+		// The 1st series is cached and suppressed, the 2nd one exceeds the
+		// cache size and it is always sent:
+		if cycle == 0 {
+			wantMetrics = append(wantMetrics, fmt.Sprintf("vmi_test_a 1 %d", ts))
+		}
+		wantMetrics = append(wantMetrics, fmt.Sprintf("vmi_test_b 1 %d", ts))
+	}
+	errBuf := mq.GenerateReport(wantMetrics, true, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
+
+func TestSuppressUnchangedMetricsQueueEvict(t *testing.T) {
+	tlc := vmi_testutils.NewTestCollectableLogger(t, RootLogger, nil)
+	defer tlc.RestoreLog()
+
+	cfg := DefaultSuppressUnchangedConfig()
+	cfg.Enabled = true
+	cfg.FullMetricsInterval = time.Minute
+	cfg.MaxSeries = 2
+
+	mq := vmi_testutils.NewTestMetricsQueue(0)
+	sq, err := NewSuppressUnchangedMetricsQueue(mq, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts0 := int64(1746121347000)
+	intervalMs := cfg.FullMetricsInterval.Milliseconds()
+	wantMetrics := make([]string, 0)
+	for i, tc := range []struct {
+		lines           []string
+		ts              int64
+		wantSent        []bool
+		wantCacheSize   int
+		wantNextEvictTs int64
+	}{
+		// Fill the cache:
+		{[]string{"vmi_test_a 1", "vmi_test_b 1"}, ts0, []bool{true, true}, 2, ts0 + intervalMs},
+		// New series w/ the cache full and nothing due, passed through
+		// uncached w/o walking the cache:
+		{[]string{"vmi_test_c 1", "vmi_test_d 1", "vmi_test_a 1"}, ts0 + 1000, []bool{true, true, false}, 2, ts0 + intervalMs},
+		// Once due, the old series are evicted and the new one is cached:
+		{[]string{"vmi_test_c 1"}, ts0 + intervalMs, []bool{true}, 1, ts0 + 2*intervalMs},
+		{[]string{"vmi_test_c 1"}, ts0 + intervalMs + 1000, []bool{false}, 1, ts0 + 2*intervalMs},
+	} {
+		buf := sq.GetBuf()
+		for j, line := range tc.lines {
+			line = fmt.Sprintf("%s %d", line, tc.ts)
+			fmt.Fprintf(buf, "%s\n", line)
+			if tc.wantSent[j] {
+				wantMetrics = append(wantMetrics, line)
+			}
+		}
+		sq.QueueBuf(buf)
+		if got := len(sq.cache); got != tc.wantCacheSize {
+			t.Fatalf("step# %d: cache size: want: %d, got: %d", i, tc.wantCacheSize, got)
+		}
+		if got := sq.nextEvictTs; got != tc.wantNextEvictTs {
+			t.Fatalf("step# %d: nextEvictTs: want: %d, got: %d", i, tc.wantNextEvictTs, got)
+		}
+	}
+	errBuf := mq.GenerateReport(wantMetrics, true, nil)
+	if errBuf.Len() > 0 {
+		t.Fatal(errBuf)
+	}
+}
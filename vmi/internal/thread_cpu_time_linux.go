@@ -0,0 +1,25 @@
+// CPU time of the current OS thread
+
+//go:build linux
+
+package vmi_internal
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// Whether the CPU time can be attributed to an OS thread:
+const THREAD_CPU_TIME_SUPPORTED = true
+
+// Return the CPU time, in seconds, of the calling OS thread. The caller should
+// be locked to the thread, see runtime.LockOSThread, for the result to be
+// meaningful.
+func GetThreadCpuTime() (float64, error) {
+	rusage := &unix.Rusage{}
+	err := unix.Getrusage(unix.RUSAGE_THREAD, rusage)
+	if err != nil {
+		return 0, err
+	}
+	return (float64(rusage.Utime.Sec+rusage.Stime.Sec) +
+		float64(rusage.Utime.Usec+rusage.Stime.Usec)/1e6), nil
+}
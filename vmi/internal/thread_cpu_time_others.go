@@ -0,0 +1,12 @@
+// CPU time of the current OS thread
+
+//go:build !linux
+
+package vmi_internal
+
+// Whether the CPU time can be attributed to an OS thread:
+const THREAD_CPU_TIME_SUPPORTED = false
+
+func GetThreadCpuTime() (float64, error) {
+	return -1, nil
+}
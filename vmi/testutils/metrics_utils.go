@@ -46,6 +46,15 @@ func (mq *TestMetricsQueue) GetTargetSize() int {
 	return mq.batchTargetSize
 }
 
+// Return the list of collected metrics, in no particular order:
+func (mq *TestMetricsQueue) GetMetrics() []string {
+	metrics := make([]string, 0, len(mq.metrics))
+	for metric := range mq.metrics {
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
 func (mq *TestMetricsQueue) GenerateReport(wantMetrics []string, reportExtra bool, errBuf *bytes.Buffer) *bytes.Buffer {
 	if errBuf == nil {
 		errBuf = &bytes.Buffer{}
@@ -3,7 +3,9 @@
 package vmi
 
 import (
+	"bytes"
 	"flag"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -14,11 +16,20 @@ const (
 	INSTANCE_LABEL_NAME             = vmi_internal.INSTANCE_LABEL_NAME
 	HOSTNAME_LABEL_NAME             = vmi_internal.HOSTNAME_LABEL_NAME
 	METRICS_GENERATOR_ID_LABEL_NAME = vmi_internal.METRICS_GENERATOR_ID_LABEL_NAME
+
+	// The separator between the group ID and the member name in the IDs of
+	// the generator group member tasks:
+	GENERATOR_GROUP_MEMBER_ID_SEP = vmi_internal.GENERATOR_GROUP_MEMBER_ID_SEP
+
+	// The exit code returned by the runner upon reaching max_process_lifetime:
+	PLANNED_RESTART_EXIT_CODE = vmi_internal.PLANNED_RESTART_EXIT_CODE
 )
 
 type BufferQueue = vmi_internal.BufferQueue
 type MetricsGeneratorTask = vmi_internal.MetricsGeneratorTask
 type GeneratorBase = vmi_internal.GeneratorBase
+type GeneratorGroup = vmi_internal.GeneratorGroup
+type GeneratorGroupMember = vmi_internal.GeneratorGroupMember
 
 // The instance should be primed w/ the desired default *before* invoking
 // the runner, typically from an init(). Its value may be modified via
@@ -80,8 +91,8 @@ func NewCompLogger(comp string) *logrus.Entry {
 // (assuming that main.go is at the root dir of the module).
 var AddCallerSrcPathPrefixToLogger = vmi_internal.RootLogger.AddCallerSrcPathPrefix
 
-// Utility functions for loading a password spec and for building a basic auth
-// header.
+// Utility functions for loading a password spec and for building a basic or a
+// bearer auth header. The bearer token follows the password spec format.
 //
 // The password may start with the following prefixes:
 //
@@ -98,6 +109,10 @@ func BuildHtmlBasicAuth(username, password string) (string, error) {
 	return vmi_internal.BuildHtmlBasicAuth(username, password)
 }
 
+func BuildHtmlBearerAuth(token string) (string, error) {
+	return vmi_internal.BuildHtmlBearerAuth(token)
+}
+
 // The MetricsQueue will be initialized by the runner, depending upon config and
 // command line args. It can be either a compressor queue sending data to an
 // HTTP end-point pool (typical case), or, for test purposes it could be a
@@ -107,17 +122,59 @@ func BuildHtmlBasicAuth(username, password string) (string, error) {
 //
 //	MetricsQueue <- GetMetricsQueue()
 //	repeat until no more metrics
-//	- buf <- MetricsQueue.GetBuf()
-//	- fill buf with metrics until it reaches MetricsQueue.GetTargetSize() or
-//	  there are no more metrics
-//	- MetricsQueue.QueueBuf(buf)
+//	- buf <- MetricsQueue.GetBuf(), if nil
+//	- write metric line(s) into buf
+//	- buf <- GeneratorBase.GenBaseEmit(buf, numLines), which queues buf and
+//	  returns nil once it reaches MetricsQueue.GetTargetSize() or
+//	  generator_max_lines_per_buffer (see vmi-config-reference.yaml)
+//	if buf not nil: QueueBufFor(MetricsQueue, genId, buf)
+//
+// A generator may set GeneratorBase.BufTargetSizeHint to have its buffers
+// queued at a different size than MetricsQueue.GetTargetSize(), e.g. a smaller
+// one for a small metrics set which should be queued promptly. See the
+// reference generators (refvmi) for examples.
 func GetMetricsQueue() BufferQueue {
 	return vmi_internal.MetricsQueue
 }
 
+// Queue the buffer on behalf of a generator, such that the metrics dropped on
+// the way to the import endpoints, if any, are attributed to the latter.
+func QueueBufFor(metricsQueue BufferQueue, genId string, buf *bytes.Buffer) {
+	vmi_internal.QueueBufFor(metricsQueue, genId, buf)
+}
+
+// Write a float value into the buffer using the configured format (see
+// float_format in vmi-config-reference.yaml); prec is the number of digits
+// after the decimal point for the fixed format.
+func WriteFloatValue(buf *bytes.Buffer, val float64, prec int) {
+	vmi_internal.WriteFloatValue(buf, val, prec)
+}
+
+// Return the name under which the metric should be emitted, based on
+// metric_renames in vmi-config-reference.yaml. Generators should apply it when
+// building their metric prefixes, such that their metrics may be renamed too.
+func RenameMetric(name string) string {
+	return vmi_internal.RenameMetric(name)
+}
+
+// Whether the name is a valid Prometheus label name.
+func IsValidLabelName(name string) bool {
+	return vmi_internal.IsValidLabelName(name)
+}
+
+// Return the shared copy of a metric prefix, `name{label="val",...} `, such that
+// generators using the same label sets do not each allocate their own. The
+// prefix may be built into a scratch buffer, which can be reused afterwards;
+// the returned value must be treated as read-only. N.B. The interned prefixes
+// are never removed, use for bounded cardinality only.
+func InternMetricPrefix(prefix []byte) []byte {
+	return vmi_internal.MetricPrefixes.Intern(prefix)
+}
+
 // Each metrics generator has a set of standard stats, indexed by the generator
 // ID. The stats are updated by the generator at the end of each run and they
-// are used to create generator specific internal metrics.
+// are used to create generator specific internal metrics. They are maintained
+// even if the internal metrics are disabled.
 func UpdateMetricsGeneratorStats[T interface{ int | int64 | uint64 }](genId string, metricCount, byteCount T) {
 	vmi_internal.MetricsGenStats.Update(genId, uint64(metricCount), uint64(byteCount))
 }
@@ -141,10 +198,62 @@ func GetInitialCycleNum(fullMetricsFactor int) int {
 // error condition. The builders will be registered with runner from `init()'
 // functions inside the generators. The argument is cast as `any' because the
 // actual data structure is opaque and immaterial to the this framework.
+//
+// Upon config reload (SIGHUP) the builder is invoked again w/ the reloaded
+// config, to learn the new task intervals, and the tasks it returns are
+// discarded. Therefore it should be free of side effects, otherwise use
+// RegisterTaskBuilderWithIntervals.
 func RegisterTaskBuilder(tb func(any) ([]MetricsGeneratorTask, error)) {
 	vmi_internal.RegisterTaskBuilder(tb)
 }
 
+// Register a task builder along w/ an intervals builder, which given the same
+// generators config argument, returns the intervals of the tasks, by ID,
+// w/o building them. The latter is used upon config reload instead of the
+// task builder. The IDs should match those of the built tasks and the
+// intervals <= 0 indicate disabled tasks.
+func RegisterTaskBuilderWithIntervals(
+	tb func(any) ([]MetricsGeneratorTask, error),
+	ib func(any) (map[string]time.Duration, error),
+) {
+	vmi_internal.RegisterTaskBuilderWithIntervals(tb, ib)
+}
+
+// Remove a generator task, by its ID, from the scheduler at runtime, e.g. when
+// a config reload drops the metrics generated by it. The task will not be
+// executed again and its stats are discarded.
+func RemoveTask(id string) error {
+	return vmi_internal.RemoveTask(id)
+}
+
+// A generator may have multiple groups of metrics generated at different
+// intervals from the same data source, sharing state (e.g. parsed data). Each
+// member of the group is scheduled as its own task, with its own GeneratorBase,
+// and its activity is invoked with the group lock held. The task builder
+// should return group.Tasks().
+func NewGeneratorGroup(id string) *GeneratorGroup {
+	return vmi_internal.NewGeneratorGroup(id)
+}
+
+// For HA deployments, where only one of the importers should send: when set
+// to false, the metrics are still generated, but they are discarded rather
+// than sent. The flag, initially true, is provided by an external coordinator;
+// it is reported as vmi_active once set.
+func SetActive(active bool) {
+	vmi_internal.SetActive(active)
+}
+
+func IsActive() bool {
+	return vmi_internal.IsActive()
+}
+
+// Change the internal metrics interval at runtime, e.g. for higher resolution
+// self metrics during an incident, w/o a restart. The same is achieved by
+// updating the config file and sending SIGHUP to the importer.
+func SetInternalMetricsInterval(interval time.Duration) error {
+	return vmi_internal.SetInternalMetricsInterval(interval)
+}
+
 // The runner is the entry point for the generator loop. It takes as an argument
 // the generators config primed with default values, it loads the config file
 // thus altering some of the defaults and it invokes the registered task